@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
@@ -279,7 +280,7 @@ func TestModDatePreservation(t *testing.T) {
 }
 
 func TestBaseEncoding(t *testing.T) {
-	cases := []struct{ enc string }{{"b64"}, {"b32"}, {"fec"}}
+	cases := []struct{ enc string }{{"b64"}, {"b32"}, {"armor"}, {"fec"}}
 	for _, tc := range cases {
 		tempDir := t.TempDir()
 		root := filepath.Join(tempDir, "root")
@@ -293,6 +294,8 @@ func TestBaseEncoding(t *testing.T) {
 
 		if tc.enc == "fec" {
 			archivePath = filepath.Join(tempDir, "test.goxaf")
+		} else if tc.enc == "armor" {
+			archivePath = filepath.Join(tempDir, "test.goxa.asc")
 		} else {
 			archivePath = filepath.Join(tempDir, "test.goxa."+tc.enc)
 		}
@@ -356,3 +359,54 @@ func TestFECParityOption(t *testing.T) {
 	extracted := filepath.Join(dest, filepath.Base(root), "file.txt")
 	checkFile(t, extracted, data, 0o644, false)
 }
+
+func TestFECStripedCreate(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(3)).Read(data)
+	if err := os.WriteFile(filepath.Join(root, "file.bin"), data, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	// Striped FEC is written straight to the archive, never to a temp file
+	tmp := filepath.Join(tempDir, "tmp")
+	os.MkdirAll(tmp, 0o755)
+	t.Setenv("TMPDIR", tmp)
+
+	archivePath = filepath.Join(tempDir, "test.goxaf")
+	encode = "fec"
+	fecStripe = 8
+	features = 0
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	defer func() {
+		encode = ""
+		fecStripe = 0
+	}()
+
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("temp files written: %v", entries)
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = readFECStripedHeader(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("striped header: %v", err)
+	}
+
+	os.RemoveAll(root)
+	dest := filepath.Join(tempDir, "out")
+	os.MkdirAll(dest, 0o755)
+	extract([]string{dest}, false, false)
+	checkFile(t, filepath.Join(dest, filepath.Base(root), "file.bin"), data, 0o644, false)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An armored archive is plain text that survives being pasted into mail
+// and tickets. Between the BEGIN and END lines every line holds
+// armorLineBytes of the archive in Base64 followed by '*' and the CRC32 of
+// those bytes, and a footer gives the size and CRC32 of the whole archive.
+const (
+	armorBegin = "-----BEGIN GOXA ARCHIVE-----"
+	armorEnd   = "-----END GOXA ARCHIVE-----"
+	// armorLineBytes keeps lines at 73 characters
+	armorLineBytes = 48
+	// armorMaxLine limits how much text is joined looking for a checksum
+	armorMaxLine = 1024
+)
+
+// armorWriter writes the armored text of everything written to it. Close
+// writes the footer and END line.
+type armorWriter struct {
+	w     *bufio.Writer
+	buf   []byte
+	size  uint64
+	crc   uint32
+	begun bool
+}
+
+func newArmorWriter(w io.Writer) *armorWriter {
+	return &armorWriter{w: bufio.NewWriter(w), buf: make([]byte, 0, armorLineBytes)}
+}
+
+func (a *armorWriter) begin() {
+	if !a.begun {
+		a.begun = true
+		fmt.Fprintf(a.w, "%v\n\n", armorBegin)
+	}
+}
+
+func (a *armorWriter) writeLine() error {
+	_, err := fmt.Fprintf(a.w, "%v*%08X\n", base64.StdEncoding.EncodeToString(a.buf), crc32.ChecksumIEEE(a.buf))
+	a.buf = a.buf[:0]
+	return err
+}
+
+func (a *armorWriter) Write(p []byte) (int, error) {
+	a.begin()
+	n := len(p)
+	a.size += uint64(n)
+	a.crc = crc32.Update(a.crc, crc32.IEEETable, p)
+	for len(p) > 0 {
+		c := copy(a.buf[len(a.buf):cap(a.buf)], p)
+		a.buf = a.buf[:len(a.buf)+c]
+		p = p[c:]
+		if len(a.buf) == armorLineBytes {
+			if err := a.writeLine(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (a *armorWriter) Close() error {
+	a.begin()
+	if len(a.buf) > 0 {
+		if err := a.writeLine(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(a.w, "\nSize: %v\nCRC32: %08X\n%v\n", a.size, a.crc, armorEnd)
+	return a.w.Flush()
+}
+
+// armorReader decodes armored text. Text around the BEGIN and END lines is
+// skipped and whitespace anywhere in a line, including carriage returns,
+// is ignored. Lines broken in two are joined again up to their checksum.
+type armorReader struct {
+	r     *bufio.Reader
+	line  int
+	begun bool
+	done  bool
+	// pending collects a data line broken over several lines,
+	// starting at firstLine
+	pending   string
+	firstLine int
+	out       []byte
+	size      uint64
+	crc       uint32
+	wantSize  string
+	wantCRC   string
+}
+
+func newArmorReader(r io.Reader) *armorReader {
+	return &armorReader{r: bufio.NewReader(r)}
+}
+
+func (a *armorReader) Read(p []byte) (int, error) {
+	for len(a.out) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, a.out)
+	a.out = a.out[n:]
+	return n, nil
+}
+
+// stripSpace removes all whitespace from s.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// next handles one line of input.
+func (a *armorReader) next() error {
+	text, err := a.r.ReadString('\n')
+	if text == "" && err != nil {
+		if err != io.EOF {
+			return err
+		}
+		if !a.begun {
+			return fmt.Errorf("armor: no %v line found", armorBegin)
+		}
+		return fmt.Errorf("armor: %v line missing, the text is cut short", armorEnd)
+	}
+	a.line++
+	s := stripSpace(text)
+	if !a.begun {
+		a.begun = s == stripSpace(armorBegin)
+		return nil
+	}
+	if s == stripSpace(armorEnd) {
+		return a.finish()
+	}
+	if s == "" {
+		return nil
+	}
+	if key, val, ok := strings.Cut(s, ":"); ok {
+		if a.pending != "" {
+			return fmt.Errorf("armor line %v: checksum missing", a.firstLine)
+		}
+		switch strings.ToLower(key) {
+		case "size":
+			a.wantSize = val
+		case "crc32":
+			a.wantCRC = val
+		}
+		return nil
+	}
+	if a.pending == "" {
+		a.firstLine = a.line
+	}
+	a.pending += s
+	star := strings.LastIndexByte(a.pending, '*')
+	if star < 0 || len(a.pending)-star-1 < 8 {
+		if len(a.pending) > armorMaxLine {
+			return fmt.Errorf("armor line %v: checksum missing", a.firstLine)
+		}
+		return nil
+	}
+	payload, sum := a.pending[:star], a.pending[star+1:]
+	a.pending = ""
+	want, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil {
+		return fmt.Errorf("armor line %v: bad checksum %q", a.firstLine, sum)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || crc32.ChecksumIEEE(data) != uint32(want) {
+		return fmt.Errorf("armor line %v is damaged", a.firstLine)
+	}
+	a.out = data
+	a.size += uint64(len(data))
+	a.crc = crc32.Update(a.crc, crc32.IEEETable, data)
+	return nil
+}
+
+// finish checks the footer once the END line is reached.
+func (a *armorReader) finish() error {
+	if a.pending != "" {
+		return fmt.Errorf("armor line %v: checksum missing", a.firstLine)
+	}
+	if a.wantSize == "" || a.wantCRC == "" {
+		return fmt.Errorf("armor: size or CRC32 line missing before %v", armorEnd)
+	}
+	size, err := strconv.ParseUint(a.wantSize, 10, 64)
+	if err != nil || size != a.size {
+		return fmt.Errorf("armor: decoded %v bytes, footer says %v, lines are missing", a.size, a.wantSize)
+	}
+	sum, err := strconv.ParseUint(a.wantCRC, 16, 32)
+	if err != nil || uint32(sum) != a.crc {
+		return fmt.Errorf("armor: CRC32 of the archive does not match, lines are out of order")
+	}
+	a.done = true
+	return nil
+}
+
+// isArmored reports whether buf holds the BEGIN line of armored text.
+func isArmored(buf []byte) bool {
+	for _, line := range strings.Split(string(buf), "\n") {
+		if stripSpace(line) == stripSpace(armorBegin) {
+			return true
+		}
+	}
+	return false
+}
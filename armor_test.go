@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func armorText(t *testing.T, data []byte) string {
+	var buf bytes.Buffer
+	w := newArmorWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.String()
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, armorLineBytes - 1, armorLineBytes, armorLineBytes + 1, 10000} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		text := armorText(t, data)
+		for _, line := range strings.Split(text, "\n") {
+			if len(line) > 76 {
+				t.Fatalf("line of %v characters", len(line))
+			}
+		}
+		got, err := io.ReadAll(newArmorReader(strings.NewReader(text)))
+		if err != nil {
+			t.Fatalf("size %v: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %v: data mismatch", size)
+		}
+	}
+}
+
+func TestArmorDamage(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	text := armorText(t, data)
+	lines := strings.Split(text, "\n")
+
+	// Text around the armor, CRLF line ends, stray whitespace and lines
+	// rewrapped by a mail client are all tolerated
+	var mangled []string
+	for i, line := range lines {
+		switch {
+		case i == 5:
+			mangled = append(mangled, line[:20], "  "+line[20:70], line[70:])
+		case i%3 == 0:
+			mangled = append(mangled, "\t"+line[:len(line)/2]+"  "+line[len(line)/2:]+" ")
+		default:
+			mangled = append(mangled, line)
+		}
+	}
+	pasted := "Hi, the archive is below.\r\n\r\n" + strings.Join(mangled, "\r\n") + "\r\nThanks\r\n"
+	got, err := io.ReadAll(newArmorReader(strings.NewReader(pasted)))
+	if err != nil {
+		t.Fatalf("mangled: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("mangled: data mismatch")
+	}
+	if !isArmored([]byte(pasted)) || isArmored(data) {
+		t.Fatalf("isArmored wrong")
+	}
+
+	cases := []struct {
+		name string
+		edit func([]string) []string
+		want string
+	}{
+		{"changed", func(l []string) []string {
+			b := []byte(l[4])
+			b[10] ^= 1
+			l[4] = string(b)
+			return l
+		}, "armor line 5 is damaged"},
+		{"dropped", func(l []string) []string {
+			return append(l[:4:4], l[5:]...)
+		}, "lines are missing"},
+		{"swapped", func(l []string) []string {
+			l[3], l[4] = l[4], l[3]
+			return l
+		}, "out of order"},
+		{"cut", func(l []string) []string {
+			return l[:10]
+		}, "cut short"},
+		{"no begin", func(l []string) []string {
+			return l[1:]
+		}, "no " + armorBegin},
+	}
+	for _, tc := range cases {
+		l := tc.edit(append([]string(nil), lines...))
+		_, err := io.ReadAll(newArmorReader(strings.NewReader(strings.Join(l, "\n"))))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%v: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+)
+
+// baseCodec is the part of base32.Encoding and base64.Encoding used here.
+type baseCodec interface {
+	Encode(dst, src []byte)
+	Decode(dst, src []byte) (int, error)
+	EncodedLen(n int) int
+}
+
+// baseCodecFor returns the codec for the encoding enc and the size of its
+// groups: every raw bytes of the archive become chars characters.
+func baseCodecFor(enc string) (baseCodec, int64, int64, bool) {
+	switch enc {
+	case "b32":
+		return base32.StdEncoding, 5, 8, true
+	case "b64":
+		return base64.StdEncoding, 3, 4, true
+	}
+	return nil, 0, 0, false
+}
+
+// baseFile presents a Base32 or Base64 encoded file as the archive it
+// holds. Groups of characters map to fixed byte ranges, so any offset can
+// be read or rewritten by decoding or encoding only the groups around it,
+// and no decoded copy is needed.
+type baseFile struct {
+	src   archiveSource
+	out   *os.File
+	codec baseCodec
+	raw   int64
+	chars int64
+	size  int64
+	pos   int64
+}
+
+// newBaseFile returns an empty archive written to f with the encoding enc.
+func newBaseFile(f *os.File, enc string) (*baseFile, error) {
+	codec, raw, chars, ok := baseCodecFor(enc)
+	if !ok {
+		return nil, fmt.Errorf("%v encoding is not seekable", enc)
+	}
+	return &baseFile{src: &fileSource{File: f}, out: f, codec: codec, raw: raw, chars: chars}, nil
+}
+
+// openBaseSource reads the archive encoded with enc in src. It reports
+// false when the text isn't plain groups, such as when it is wrapped into
+// lines, and has to be decoded front to back instead.
+func openBaseSource(src archiveSource, enc string) (*baseFile, bool) {
+	codec, raw, chars, ok := baseCodecFor(enc)
+	if !ok || src.Size()%chars != 0 {
+		return nil, false
+	}
+	b := &baseFile{src: src, codec: codec, raw: raw, chars: chars}
+	if src.Size() == 0 {
+		return b, true
+	}
+	// Padding in the last group tells how much of it is used
+	last := make([]byte, chars)
+	if _, err := src.ReadAt(last, src.Size()-chars); err != nil && err != io.EOF {
+		return nil, false
+	}
+	n, err := codec.Decode(make([]byte, raw), last)
+	if err != nil {
+		return nil, false
+	}
+	b.size = (src.Size()/chars-1)*raw + int64(n)
+	return b, true
+}
+
+// Size returns the decoded size of the archive.
+func (b *baseFile) Size() int64 {
+	return b.size
+}
+
+func (b *baseFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	g0, g1 := off/b.raw, (end+b.raw-1)/b.raw
+	enc := make([]byte, (g1-g0)*b.chars)
+	if n, err := b.src.ReadAt(enc, g0*b.chars); n < len(enc) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	dec := make([]byte, (g1-g0)*b.raw)
+	if _, err := b.codec.Decode(dec, enc); err != nil {
+		return 0, fmt.Errorf("decode at offset %v: %w", off, err)
+	}
+	n := copy(p, dec[off-g0*b.raw:end-g0*b.raw])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *baseFile) WriteAt(p []byte, off int64) (int, error) {
+	if b.out == nil {
+		return 0, errNotSeekable
+	}
+	if off > b.size {
+		return 0, fmt.Errorf("write at %v past the end of the archive", off)
+	}
+	end := off + int64(len(p))
+	g0, g1 := off/b.raw, (end+b.raw-1)/b.raw
+	buf := make([]byte, (g1-g0)*b.raw)
+	// Groups only partly written keep their other bytes
+	if off%b.raw != 0 {
+		if _, err := b.ReadAt(buf[:min(b.raw, b.size-g0*b.raw)], g0*b.raw); err != nil {
+			return 0, err
+		}
+	}
+	if end%b.raw != 0 && end < b.size {
+		tail := (g1 - 1) * b.raw
+		if _, err := b.ReadAt(buf[tail-g0*b.raw:min(g1*b.raw, b.size)-g0*b.raw], tail); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-g0*b.raw:], p)
+	size := max(b.size, end)
+	buf = buf[:min(g1*b.raw, size)-g0*b.raw]
+	enc := make([]byte, b.codec.EncodedLen(len(buf)))
+	b.codec.Encode(enc, buf)
+	if _, err := b.out.WriteAt(enc, g0*b.chars); err != nil {
+		return 0, err
+	}
+	b.size = size
+	return len(p), nil
+}
+
+func (b *baseFile) Read(p []byte) (int, error) {
+	n, err := b.ReadAt(p, b.pos)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *baseFile) Write(p []byte) (int, error) {
+	n, err := b.WriteAt(p, b.pos)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *baseFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %v", offset)
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *baseFile) Sync() error {
+	if b.out == nil {
+		return nil
+	}
+	return b.out.Sync()
+}
+
+func (b *baseFile) Close() error {
+	return b.src.Close()
+}
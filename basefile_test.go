@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBaseFile(t *testing.T) {
+	encodings := map[string]func([]byte) string{
+		"b32": base32.StdEncoding.EncodeToString,
+		"b64": base64.StdEncoding.EncodeToString,
+	}
+	for enc, encodeAll := range encodings {
+		rng := rand.New(rand.NewSource(7))
+		for _, size := range []int{0, 1, 2, 4, 5, 7, 100, 4099} {
+			path := filepath.Join(t.TempDir(), "arc."+enc)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			b, err := newBaseFile(f, enc)
+			if err != nil {
+				t.Fatalf("newBaseFile: %v", err)
+			}
+
+			// Append in uneven pieces, then patch ranges as the header is
+			want := make([]byte, size)
+			rng.Read(want)
+			for off := 0; off < size; {
+				n := min(size-off, 1+rng.Intn(17))
+				if _, err := b.Write(want[off : off+n]); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				off += n
+			}
+			for i := 0; i < 20 && size > 0; i++ {
+				off := rng.Intn(size)
+				patch := make([]byte, 1+rng.Intn(size-off))
+				rng.Read(patch)
+				copy(want[off:], patch)
+				if _, err := b.WriteAt(patch, int64(off)); err != nil {
+					t.Fatalf("patch: %v", err)
+				}
+			}
+			b.Close()
+
+			text, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(text) != encodeAll(want) {
+				t.Fatalf("%v size %v: encoded text differs", enc, size)
+			}
+
+			src, err := openArchiveSource(path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			r, ok := openBaseSource(src, enc)
+			if !ok || r.Size() != int64(size) {
+				t.Fatalf("%v size %v: openBaseSource %v, size %v", enc, size, ok, r.Size())
+			}
+			for i := 0; i < 20 && size > 0; i++ {
+				off := rng.Intn(size)
+				got := make([]byte, 1+rng.Intn(size-off))
+				if _, err := r.ReadAt(got, int64(off)); err != nil {
+					t.Fatalf("ReadAt: %v", err)
+				}
+				if !bytes.Equal(got, want[off:off+len(got)]) {
+					t.Fatalf("%v size %v: data at %v differs", enc, size, off)
+				}
+			}
+			all, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil || !bytes.Equal(all, want) {
+				t.Fatalf("%v size %v: full read differs: %v", enc, size, err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestBaseFileWrapped(t *testing.T) {
+	// Text wrapped into lines by other tools is decoded front to back
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	text := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(text) > 76 {
+		lines = append(lines, text[:76])
+		text = text[76:]
+	}
+	lines = append(lines, text)
+	path := filepath.Join(t.TempDir(), "arc.b64")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	src, err := openArchiveSource(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, ok := openBaseSource(src, "b64"); ok {
+		t.Fatalf("wrapped text opened as plain groups")
+	}
+	src.Close()
+
+	encode = "b64"
+	defer func() { encode = "" }()
+	dec, err := openEncoded(path)
+	if err != nil {
+		t.Fatalf("openEncoded: %v", err)
+	}
+	defer dec.Close()
+	got, err := io.ReadAll(io.NewSectionReader(dec, 0, dec.Size()))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("wrapped decode differs: %v", err)
+	}
+}
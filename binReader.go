@@ -25,39 +25,100 @@ func ReadLPString(r io.Reader) (string, error) {
 	return string(stringData), nil
 }
 
+// archiveSource is random access storage holding an archive, either a
+// local file or a remote URL.
+type archiveSource interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// fileSource adapts an *os.File to archiveSource.
+type fileSource struct {
+	*os.File
+	size int64
+}
+
+func (fs *fileSource) Size() int64 {
+	return fs.size
+}
+
+// openArchiveSource opens path as a local file, a split archive when only
+// its numbered volumes exist or, for http(s) URLs, as a remote archive read
+// with Range requests.
+func openArchiveSource(path string) (archiveSource, error) {
+	if isURL(path) {
+		return newHTTPSource(path)
+	}
+	if hasVolumes(path) {
+		return openVolumeSource(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileSource{File: f, size: info.Size()}, nil
+}
+
 type BinReader struct {
-	file   *os.File
-	reader *bufio.Reader
+	src     archiveSource
+	section *io.SectionReader
+	reader  *bufio.Reader
 }
 
 func NewBinReader(path string) (*BinReader, error) {
-	f, err := os.Open(path)
+	src, err := openArchiveSource(path)
 	if err != nil {
 		return nil, err
 	}
+	return newBinReader(src), nil
+}
+
+// newBinReader reads the archive held by src.
+func newBinReader(src archiveSource) *BinReader {
+	section := io.NewSectionReader(src, 0, src.Size())
 	return &BinReader{
-		file:   f,
-		reader: bufio.NewReaderSize(f, readBuffer),
-	}, nil
+		src:     src,
+		section: section,
+		reader:  bufio.NewReaderSize(section, readBuffer),
+	}
 }
 
 func (br *BinReader) Read(p []byte) (int, error) {
 	return br.reader.Read(p)
 }
 
+// ReadAt reads from the underlying archive, bypassing the buffer.
+func (br *BinReader) ReadAt(p []byte, off int64) (int, error) {
+	return br.src.ReadAt(p, off)
+}
+
+// Size returns the total size of the archive in bytes.
+func (br *BinReader) Size() int64 {
+	return br.src.Size()
+}
+
 func (br *BinReader) Close() error {
-	return br.file.Close()
+	return br.src.Close()
 }
 
 func (br *BinReader) Seek(offset int64, whence int) (int64, error) {
-	// Seek the underlying file
-	pos, err := br.file.Seek(offset, whence)
+	if whence == io.SeekCurrent {
+		// Account for data sitting in the buffer
+		offset -= int64(br.reader.Buffered())
+	}
+	pos, err := br.section.Seek(offset, whence)
 	if err != nil {
 		return 0, err
 	}
 
 	// Reset the buffered reader to discard its buffer
-	br.reader.Reset(br.file)
+	br.reader.Reset(br.section)
 
 	return pos, nil
 }
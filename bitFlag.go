@@ -56,7 +56,7 @@ func flagLetters(flags BitFlags) string {
 	if flags.IsSet(fChecksums) {
 		out += "s"
 	}
-	if flags.IsSet(fBlockChecksums) {
+	if flags.IsSet(fBlockChecksums) || flags.IsSet(fBlockCRC32) {
 		out += "b"
 	}
 	if flags.IsSet(fNoCompress) {
@@ -68,6 +68,9 @@ func flagLetters(flags BitFlags) string {
 	if flags.IsSet(fSpecialFiles) {
 		out += "o"
 	}
+	if flags.IsSet(fRedundant) {
+		out += "r"
+	}
 	return out
 }
 
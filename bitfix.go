@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+)
+
+const (
+	// bitfixMaxBlock is the largest stored block searched for corrections.
+	// Larger blocks allow more corrections that match by chance.
+	bitfixMaxBlock = 1 << 20
+	// bitfixMaxCandidates stops the search once a block is ambiguous
+	bitfixMaxCandidates = 4
+)
+
+// bitfixCandidate is a single-byte correction of a block.
+type bitfixCandidate struct {
+	pos int
+	xor byte
+}
+
+func (c bitfixCandidate) String() string {
+	if bits.OnesCount8(c.xor) == 1 {
+		return fmt.Sprintf("flipped bit %v of byte %v", bits.TrailingZeros8(c.xor), c.pos)
+	}
+	return fmt.Sprintf("replaced byte %v (xor %#02x)", c.pos, c.xor)
+}
+
+// bitfixCandidates returns the single-bit and single-byte changes to data
+// that make its CRC32 equal want, at most limit of them. CRC32 is linear,
+// so the change an error makes to the checksum depends only on its
+// position and value, and every position is tried in one backwards pass.
+func bitfixCandidates(data []byte, want uint32, limit int) []bitfixCandidate {
+	syndrome := crc32.ChecksumIEEE(data) ^ want
+	if syndrome == 0 {
+		return nil
+	}
+	// basis holds the checksum change of each bit of the current byte
+	var basis [8]uint32
+	for b := range basis {
+		basis[b] = crc32.IEEETable[1<<b]
+	}
+	var combo [256]uint32
+	var out []bitfixCandidate
+	for pos := len(data) - 1; pos >= 0; pos-- {
+		for v := 1; v < 256; v++ {
+			low := v & -v
+			combo[v] = combo[v^low] ^ basis[bits.TrailingZeros(uint(low))]
+			if combo[v] == syndrome {
+				out = append(out, bitfixCandidate{pos: pos, xor: byte(v)})
+				if len(out) >= limit {
+					return out
+				}
+			}
+		}
+		for b, r := range basis {
+			basis[b] = crc32.IEEETable[byte(r)] ^ r>>8
+		}
+	}
+	return out
+}
+
+// blockRawSize returns the decoded size of block k of e.
+func blockRawSize(hdr *ArchiveHeader, e *FileEntry, k int) uint64 {
+	if hdr.Flags.IsSet(fNoCompress) {
+		return e.Blocks[k].Size
+	}
+	if hdr.BlockSize == 0 || k == len(e.Blocks)-1 {
+		return e.Size - min(e.Size, uint64(k)*uint64(hdr.BlockSize))
+	}
+	return uint64(hdr.BlockSize)
+}
+
+// blockDecodes reports whether a stored block decodes to raw bytes.
+// Uncompressed blocks always do.
+func blockDecodes(hdr *ArchiveHeader, data []byte, raw uint64) bool {
+	if hdr.Flags.IsSet(fNoCompress) {
+		return true
+	}
+	dec, err := decompressor(bytes.NewReader(data), hdr.CompType)
+	if err != nil {
+		return false
+	}
+	defer dec.Close()
+	if n, err := io.CopyN(io.Discard, dec, int64(raw)); err != nil || uint64(n) != raw {
+		return false
+	}
+	extra, _ := io.CopyN(io.Discard, dec, 1)
+	return extra == 0
+}
+
+// patchedReader reads r with single-byte corrections applied.
+type patchedReader struct {
+	r       io.ReaderAt
+	patches map[int64]byte
+}
+
+func (p patchedReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	for pos, xor := range p.patches {
+		if pos >= off && pos < off+int64(n) {
+			b[pos-off] ^= xor
+		}
+	}
+	return n, err
+}
+
+// fileSumMatches decodes the blocks of e from r and compares them with
+// the stored file checksum. Files without one always match.
+func fileSumMatches(r io.ReaderAt, hdr *ArchiveHeader, e *FileEntry) bool {
+	if hdr.Flags.IsNotSet(fChecksums) {
+		return true
+	}
+	want := make([]byte, hdr.SumLen)
+	if _, err := r.ReadAt(want, int64(e.SumOffset)); err != nil {
+		return false
+	}
+	h := newHasher(hdr.SumType)
+	for k, b := range e.Blocks {
+		var src io.Reader = io.NewSectionReader(r, int64(b.Offset), int64(b.Size))
+		var dec io.ReadCloser
+		if hdr.Flags.IsNotSet(fNoCompress) {
+			var err error
+			if dec, err = decompressor(src, hdr.CompType); err != nil {
+				return false
+			}
+			src = dec
+		}
+		_, err := io.CopyN(h, src, int64(blockRawSize(hdr, e, k)))
+		if dec != nil {
+			dec.Close()
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(padSum(h.Sum(nil), hdr.SumLen), want)
+}
+
+// bitfix checks every block of the archive at archivePath against its
+// stored checksum and corrects blocks damaged by a single flipped bit or
+// byte in place. A correction is only written when exactly one candidate
+// decodes and the file checksum, when stored, matches.
+func bitfix() (*BitfixReport, error) {
+	if isURL(archivePath) || archivePath == "-" || encode != "" || hasVolumes(archivePath) {
+		return nil, fmt.Errorf("bitfix repairs plain goxa archive files in place")
+	}
+	arc, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if hdr.Flags.IsNotSet(fBlockCRC32) {
+		return nil, fmt.Errorf("%v has no block checksums, create it with the b option to use bitfix", archivePath)
+	}
+
+	var total int64
+	for _, e := range hdr.Files {
+		for _, b := range e.Blocks {
+			total += int64(b.Size)
+		}
+	}
+	p, tickDone, finished := progressTicker(&progressData{total: total, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(tickDone)
+		<-finished
+	}()
+
+	report := &BitfixReport{Archive: archivePath}
+	var out *os.File
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+	for i := range hdr.Files {
+		e := &hdr.Files[i]
+		p.file.Store(e.Path)
+		patched := patchedReader{r: arc, patches: map[int64]byte{}}
+		first := len(report.Entries)
+		for k, b := range e.Blocks {
+			report.Blocks++
+			p.current.Add(int64(b.Size))
+			// Only blocks small enough to search are held in memory
+			var data []byte
+			var err error
+			sum := crc32.NewIEEE()
+			if b.Size <= bitfixMaxBlock {
+				data = make([]byte, b.Size)
+				_, err = arc.ReadAt(data, int64(b.Offset))
+				sum.Write(data)
+			} else {
+				_, err = io.CopyN(sum, io.NewSectionReader(arc, int64(b.Offset), int64(b.Size)), int64(b.Size))
+			}
+			if err == nil && sum.Sum32() == b.Sum {
+				continue
+			}
+			report.Damaged++
+			entry := BitfixEntry{Path: e.Path, Block: k, Offset: b.Offset}
+			switch {
+			case err != nil:
+				entry.Status = "unreadable"
+				entry.Fix = err.Error()
+			case b.Size > bitfixMaxBlock:
+				entry.Status = "too large"
+			default:
+				var found []bitfixCandidate
+				for _, c := range bitfixCandidates(data, b.Sum, bitfixMaxCandidates) {
+					data[c.pos] ^= c.xor
+					if blockDecodes(hdr, data, blockRawSize(hdr, e, k)) {
+						found = append(found, c)
+					}
+					data[c.pos] ^= c.xor
+				}
+				switch len(found) {
+				case 0:
+					entry.Status = "unrepairable"
+				case 1:
+					entry.Status = "fixed"
+					entry.Fix = found[0].String()
+					patched.patches[int64(b.Offset)+int64(found[0].pos)] = found[0].xor
+				default:
+					entry.Status = "ambiguous"
+					entry.Fix = fmt.Sprintf("%v possible corrections", len(found))
+				}
+			}
+			report.Entries = append(report.Entries, entry)
+		}
+		if len(patched.patches) == 0 {
+			continue
+		}
+		if !fileSumMatches(patched, hdr, e) {
+			for j := first; j < len(report.Entries); j++ {
+				if report.Entries[j].Status == "fixed" {
+					report.Entries[j].Status = "rejected"
+					report.Entries[j].Fix += ", not written as the file checksum still fails"
+				}
+			}
+			continue
+		}
+		if out == nil {
+			if out, err = os.OpenFile(archivePath, os.O_RDWR, 0); err != nil {
+				return report, err
+			}
+		}
+		for pos, xor := range patched.patches {
+			b := make([]byte, 1)
+			if _, err := arc.ReadAt(b, pos); err != nil {
+				return report, err
+			}
+			b[0] ^= xor
+			if _, err := out.WriteAt(b, pos); err != nil {
+				return report, err
+			}
+			report.Fixed++
+		}
+	}
+	if out != nil && !noFlush {
+		if err := out.Sync(); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// printBitfix shows the damaged blocks and what was done with them.
+func printBitfix(r *BitfixReport, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			doLog(false, "encode report: %v", err)
+		}
+		return
+	}
+	for _, e := range r.Entries {
+		line := fmt.Sprintf("%-12v %v block %v at offset %v", e.Status, e.Path, e.Block, e.Offset)
+		if e.Fix != "" {
+			line += ": " + e.Fix
+		}
+		doLog(false, "%v", line)
+	}
+	doLog(false, "\nChecked %v blocks, %v damaged, %v fixed", r.Blocks, r.Damaged, r.Fixed)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBitfixCandidates(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	data := make([]byte, 3000)
+	rng.Read(data)
+	want := crc32.ChecksumIEEE(data)
+	for _, c := range []bitfixCandidate{{0, 0x01}, {1499, 0x80}, {2999, 0x5a}, {17, 0xff}} {
+		data[c.pos] ^= c.xor
+		found := bitfixCandidates(data, want, bitfixMaxCandidates)
+		data[c.pos] ^= c.xor
+		if len(found) != 1 || found[0] != c {
+			t.Fatalf("error %+v: found %+v", c, found)
+		}
+	}
+	if found := bitfixCandidates(data, want, bitfixMaxCandidates); found != nil {
+		t.Fatalf("intact data: found %+v", found)
+	}
+}
+
+func TestBitfix(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	os.MkdirAll(root, 0o755)
+	contents := map[string][]byte{
+		"a.txt": recoverText(8, 20000),
+		"b.txt": recoverText(9, 9000),
+		"c.txt": recoverText(10, 9000),
+	}
+	for name, data := range contents {
+		os.WriteFile(filepath.Join(root, name), data, 0o644)
+	}
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compType = compZstd
+	blockSize = 4096
+	configureChecksum("blake3")
+	features = fChecksums | fBlockCRC32
+	archivePath = filepath.Join(tempDir, "test.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	blockSize = defaultBlockSize
+
+	_, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	done()
+	data, _ := os.ReadFile(archivePath)
+	a := recoverFile(t, hdr, "a.txt").Blocks[2]
+	data[a.Offset+a.Size/2] ^= 0x10
+	b := recoverFile(t, hdr, "b.txt").Blocks[0]
+	data[b.Offset+20] ^= 0xa5
+	c := recoverFile(t, hdr, "c.txt").Blocks[1]
+	data[c.Offset+10] ^= 0x01
+	data[c.Offset+30] ^= 0x01
+	os.WriteFile(archivePath, data, 0o644)
+
+	report, err := bitfix()
+	if err != nil {
+		t.Fatalf("bitfix failed: %v", err)
+	}
+	if report.Damaged != 3 || report.Fixed != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, e := range report.Entries {
+		want := "fixed"
+		if filepath.Base(e.Path) == "c.txt" {
+			want = "unrepairable"
+		}
+		if e.Status != want {
+			t.Fatalf("%v: status %v, want %v", e.Path, e.Status, want)
+		}
+	}
+
+	dest := filepath.Join(tempDir, "out")
+	os.MkdirAll(dest, 0o755)
+	features = 0
+	extractList = []string{"root/a.txt", "root/b.txt"}
+	defer func() { extractList = nil }()
+	extract([]string{dest}, false, false)
+	checkFile(t, filepath.Join(dest, "root", "a.txt"), contents["a.txt"], 0, false)
+	checkFile(t, filepath.Join(dest, "root", "b.txt"), contents["b.txt"], 0, false)
+}
+
+// checkBlockCRC32 fails unless the archive at path stores a matching
+// CRC32 for every block.
+func checkBlockCRC32(t *testing.T, path string) {
+	t.Helper()
+	arc, hdr, done, err := readArchive(path)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	defer done()
+	if hdr.Flags.IsNotSet(fBlockCRC32) {
+		t.Fatalf("%v has no block CRC32s", path)
+	}
+	for _, e := range hdr.Files {
+		for k, b := range e.Blocks {
+			data := make([]byte, b.Size)
+			if _, err := arc.ReadAt(data, int64(b.Offset)); err != nil {
+				t.Fatalf("read block: %v", err)
+			}
+			if crc32.ChecksumIEEE(data) != b.Sum {
+				t.Fatalf("%v block %v: CRC32 %08x stored, %08x computed", e.Path, k, b.Sum, crc32.ChecksumIEEE(data))
+			}
+		}
+	}
+}
@@ -2,18 +2,37 @@ package main
 
 import (
 	"bufio"
-	"os"
+	"errors"
+	"io"
 )
 
+var errNotSeekable = errors.New("output is not seekable")
+
+// seekFile is the storage behind a BufferedFile, an *os.File or an
+// encoded view of one.
+type seekFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+}
+
+// blockAligner is an output that keeps blocks whole, such as a split
+// archive. alignBlock is called before a block of n bytes and returns the
+// number of padding bytes it wrote first.
+type blockAligner interface {
+	alignBlock(n uint64) (uint64, error)
+}
+
 type BufferedFile struct {
 	doCount  bool
-	file     *os.File
+	file     seekFile
 	writer   *bufio.Writer
 	reader   *bufio.Reader
+	align    blockAligner
 	progress *progressData
 }
 
-func NewBufferedFile(file *os.File, bufSize int, p *progressData) *BufferedFile {
+func NewBufferedFile(file seekFile, bufSize int, p *progressData) *BufferedFile {
 	return &BufferedFile{
 		file:     file,
 		writer:   bufio.NewWriterSize(file, bufSize),
@@ -22,6 +41,17 @@ func NewBufferedFile(file *os.File, bufSize int, p *progressData) *BufferedFile
 	}
 }
 
+// NewBufferedWriter buffers writes to w, which need not be a file. Seeking
+// is not supported.
+func NewBufferedWriter(w io.Writer, bufSize int, p *progressData) *BufferedFile {
+	align, _ := w.(blockAligner)
+	return &BufferedFile{
+		writer:   bufio.NewWriterSize(w, bufSize),
+		align:    align,
+		progress: p,
+	}
+}
+
 func (bf *BufferedFile) Write(p []byte) (int, error) {
 	n, err := bf.writer.Write(p)
 	if bf.doCount {
@@ -41,6 +71,15 @@ func (bf *BufferedFile) WriteString(s string) (int, error) {
 	return bf.writer.WriteString(s)
 }
 
+// alignBlock flushes the buffer and lets the output pad before a block of
+// n bytes.
+func (bf *BufferedFile) alignBlock(n uint64) (uint64, error) {
+	if err := bf.Flush(); err != nil {
+		return 0, err
+	}
+	return bf.align.alignBlock(n)
+}
+
 func (bf *BufferedFile) Flush() error {
 	return bf.writer.Flush()
 }
@@ -49,10 +88,16 @@ func (bf *BufferedFile) Sync() error {
 	if err := bf.Flush(); err != nil {
 		return err
 	}
+	if bf.file == nil {
+		return nil
+	}
 	return bf.file.Sync()
 }
 
 func (bf *BufferedFile) Seek(offset int64, whence int) (int64, error) {
+	if bf.file == nil {
+		return 0, errNotSeekable
+	}
 	if err := bf.Flush(); err != nil {
 		return 0, err
 	}
@@ -65,6 +110,9 @@ func (bf *BufferedFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (bf *BufferedFile) Close() error {
+	if bf.file == nil {
+		return bf.Flush()
+	}
 	if err := bf.Flush(); err != nil {
 		bf.file.Close()
 		return err
@@ -17,7 +17,7 @@ func resetGlobals() {
 	features = fChecksums
 	compression = ""
 	extractList = nil
-	tarUseXz = false
+	tarComp = compGzip
 	protoVersion = protoVersion2
 	blockSize = defaultBlockSize
 	fileRetries = 3
@@ -19,37 +19,51 @@ var (
 	compSpeed                                int   = SpeedFastest
 	checksumType                             uint8 = defaultChecksumType
 	checksumLength                           uint8 = defaultChecksumLen
-	tarUseXz                                 bool
+	tarComp                                  uint8 = compGzip
 	extractList                              []string
 	protoVersion                             uint16 = protoVersion2
 	blockSize                                uint32 = defaultBlockSize
 	threads                                  int    = runtime.NumCPU()
 	fecDataShards                            int    = 10
 	fecParityShards                          int    = 3
-	fileRetries                              int    = 3
-	fileRetryDelay                           int    = 5
-	failOnChange                             bool   = false
-	bombCheck                                bool   = true
-	spaceCheck                               bool   = true
-	noFlush                                  bool   = false
+	fecStripe                                int
+	fecInterleave                            int = 16
+	recoveryVolumes                          int
+	fileRetries                              int  = 3
+	fileRetryDelay                           int  = 5
+	failOnChange                             bool = false
+	bombCheck                                bool = true
+	spaceCheck                               bool = true
+	safeLinks                                bool = true
+	noFlush                                  bool = false
+	volumeSize                               uint64
+	jsonOutput                               bool
+	mergeConflict                            string = "error"
+	// events receives -progress-json events, nil without it
+	events *eventLog
+	// flagsGiven holds the options given on the command line
+	flagsGiven = map[string]bool{}
 )
 
 type FileEntry struct {
-	Offset   uint64
-	Path     string
-	SrcPath  string
-	Linkname string
-	Type     uint8
-	Size     uint64
-	Mode     fs.FileMode
-	ModTime  time.Time
-	Blocks   []Block
-	Changed  bool
+	Offset    uint64
+	SumOffset uint64
+	Path      string
+	SrcPath   string
+	Linkname  string
+	Type      uint8
+	Size      uint64
+	Mode      fs.FileMode
+	ModTime   time.Time
+	Blocks    []Block
+	Changed   bool
 }
 
 type Block struct {
 	Offset uint64
 	Size   uint64
+	// Sum is the CRC32 of the stored block, kept with fBlockCRC32
+	Sum uint32
 }
 
 type ListEntry struct {
@@ -96,3 +110,109 @@ type ArchiveListingOut struct {
 	Dirs           []ListEntryOut `json:"dirs"`
 	Files          []ListEntryOut `json:"files"`
 }
+
+// DiffEntry is one path that differs between an archive and what it is
+// compared with. Status is added, deleted or modified; Changes lists what
+// differs for modified paths.
+type DiffEntry struct {
+	Path    string   `json:"path"`
+	Status  string   `json:"status"`
+	Changes []string `json:"changes,omitempty"`
+}
+
+// DiffReport is the result of the d mode.
+type DiffReport struct {
+	Archive  string      `json:"archive"`
+	Target   string      `json:"target"`
+	Added    int         `json:"added"`
+	Deleted  int         `json:"deleted"`
+	Modified int         `json:"modified"`
+	Entries  []DiffEntry `json:"entries"`
+}
+
+// RecoverEntry is a file or piece of data found by the recover mode.
+type RecoverEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Size   uint64 `json:"size"`
+	Offset uint64 `json:"offset,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// RecoverReport is the result of the recover mode.
+type RecoverReport struct {
+	Archive     string         `json:"archive"`
+	Destination string         `json:"destination"`
+	Header      string         `json:"header"`
+	Trailer     string         `json:"trailer"`
+	Recovered   int            `json:"recovered"`
+	Unverified  int            `json:"unverified"`
+	Damaged     int            `json:"damaged"`
+	Lost        int            `json:"lost"`
+	Fragments   int            `json:"fragments"`
+	Entries     []RecoverEntry `json:"entries"`
+}
+
+// BitfixEntry is a block failing its checksum, found by the bitfix mode.
+type BitfixEntry struct {
+	Path   string `json:"path"`
+	Block  int    `json:"block"`
+	Offset uint64 `json:"offset"`
+	Status string `json:"status"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// BitfixReport is the result of the bitfix mode.
+type BitfixReport struct {
+	Archive string        `json:"archive"`
+	Blocks  int           `json:"blocks"`
+	Damaged int           `json:"damaged"`
+	Fixed   int           `json:"fixed"`
+	Entries []BitfixEntry `json:"entries"`
+}
+
+// FECShard is the health of one shard of a FEC encoded archive.
+type FECShard struct {
+	Index   int  `json:"index"`
+	Parity  bool `json:"parity"`
+	Damaged int  `json:"damaged"`
+}
+
+// FECReport is the result of the fec-verify and fec-repair modes.
+type FECReport struct {
+	Archive       string `json:"archive"`
+	Layout        string `json:"layout"`
+	DataShards    int    `json:"dataShards"`
+	ParityShards  int    `json:"parityShards"`
+	Stripes       int    `json:"stripes"`
+	Damaged       int    `json:"damaged"`
+	Unrecoverable int    `json:"unrecoverable"`
+	// Records counts damaged group headers and end records
+	Records  int        `json:"records"`
+	Note     string     `json:"note,omitempty"`
+	Repaired bool       `json:"repaired"`
+	Shards   []FECShard `json:"shards"`
+}
+
+// ProgressEvent is one line of the -progress-json event stream. Fields
+// that don't apply to an event, or are zero, are left out.
+type ProgressEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Mode       string    `json:"mode,omitempty"`
+	Archive    string    `json:"archive,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Size       uint64    `json:"size,omitempty"`
+	Checksum   string    `json:"checksum,omitempty"`
+	Skipped    bool      `json:"skipped,omitempty"`
+	Current    int64     `json:"current,omitempty"`
+	Total      int64     `json:"total,omitempty"`
+	Written    int64     `json:"written,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Files      int64     `json:"files,omitempty"`
+	Bytes      uint64    `json:"bytes,omitempty"`
+	Warnings   int64     `json:"warnings,omitempty"`
+	Mismatches int64     `json:"mismatches,omitempty"`
+	Elapsed    float64   `json:"elapsed,omitempty"`
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extractFS performs the file system changes of an extraction. Paths are
+// the joined destination paths from entryPath or safeJoin.
+type extractFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	OpenFile(path string, flag int, perm os.FileMode) (*os.File, error)
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, atime, mtime time.Time) error
+	Lchown(path string, uid, gid int) error
+	Symlink(target, path string) error
+	Link(source, path string) error
+	Mknod(path string, mode uint32, dev int) error
+	RemoveAll(path string) error
+	Lsetxattr(path, name string, value []byte) error
+	Close() error
+}
+
+// osFS is the plain extractFS, relying on the path checks alone.
+type osFS struct{}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+func (osFS) Chmod(path string, mode os.FileMode) error         { return os.Chmod(path, mode) }
+func (osFS) Chtimes(path string, atime, mtime time.Time) error { return os.Chtimes(path, atime, mtime) }
+func (osFS) Lchown(path string, uid, gid int) error            { return os.Lchown(path, uid, gid) }
+func (osFS) Symlink(target, path string) error                 { return os.Symlink(target, path) }
+func (osFS) Link(source, path string) error                    { return os.Link(source, path) }
+func (osFS) Mknod(path string, mode uint32, dev int) error     { return mknod(path, mode, dev) }
+func (osFS) RemoveAll(path string) error                       { return os.RemoveAll(path) }
+func (osFS) Lsetxattr(path, name string, value []byte) error   { return lsetxattr(path, name, value) }
+func (osFS) Close() error                                      { return nil }
+
+// extractRoot is used for all writes of the running extraction.
+var extractRoot extractFS = osFS{}
+
+// openExtractRoot confines the following extraction to destination. Where
+// the kernel can enforce it, no write resolves outside destination or
+// through a symlink, whatever happens to the tree meanwhile. Otherwise,
+// and for absolute path archives, the plain file system calls are used.
+func openExtractRoot(destination string, lfeat BitFlags) {
+	extractRoot = osFS{}
+	if lfeat.IsSet(fAbsolutePaths) {
+		return
+	}
+	if err := os.MkdirAll(destination, 0o755); err != nil {
+		return
+	}
+	root, err := openBeneathRoot(filepath.Clean(destination))
+	if err != nil {
+		doLog(true, "kernel path confinement unavailable: %v", err)
+		return
+	}
+	extractRoot = root
+}
+
+// closeExtractRoot releases the root opened by openExtractRoot.
+func closeExtractRoot() {
+	extractRoot.Close()
+	extractRoot = osFS{}
+}
+
+// relBeneath returns path relative to root, or false when it lies outside
+// root, as with absolute path archives.
+func relBeneath(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) || filepath.IsAbs(rel) {
+		return "", false
+	}
+	return rel, true
+}
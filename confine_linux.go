@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const beneathResolve = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS
+
+// beneathFS resolves every path with openat2 relative to an open
+// destination directory, so the kernel refuses to leave it or to follow
+// a symlink. Paths outside the destination use the plain calls.
+type beneathFS struct {
+	dir string
+	fd  int
+}
+
+func openBeneathRoot(dir string) (extractFS, error) {
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Kernels before 5.6, and some sandboxes, lack openat2
+	probe, err := unix.Openat2(fd, ".", &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC, Resolve: beneathResolve})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("openat2: %w", err)
+	}
+	unix.Close(probe)
+	return &beneathFS{dir: dir, fd: fd}, nil
+}
+
+// open resolves rel below the destination.
+func (b *beneathFS) open(rel string, flags uint64, mode uint32) (int, error) {
+	for {
+		fd, err := unix.Openat2(b.fd, rel, &unix.OpenHow{Flags: flags | unix.O_CLOEXEC, Mode: uint64(mode), Resolve: beneathResolve})
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// parent opens the directory holding rel and returns it with the final
+// name. The returned function closes the directory.
+func (b *beneathFS) parent(rel string) (int, string, func(), error) {
+	dir, name := filepath.Split(rel)
+	if dir == "" {
+		return b.fd, name, func() {}, nil
+	}
+	fd, err := b.open(dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, "", nil, err
+	}
+	return fd, name, func() { unix.Close(fd) }, nil
+}
+
+func pathErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+func (b *beneathFS) MkdirAll(path string, perm os.FileMode) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.MkdirAll(path, perm)
+	}
+	fd, err := unix.Dup(b.fd)
+	if err != nil {
+		return pathErr("mkdir", path, err)
+	}
+	defer func() { unix.Close(fd) }()
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		if err := unix.Mkdirat(fd, part, uint32(perm.Perm())); err != nil && err != unix.EEXIST {
+			return pathErr("mkdir", path, err)
+		}
+		next, err := unix.Openat2(fd, part, &unix.OpenHow{Flags: unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC, Resolve: beneathResolve})
+		if err != nil {
+			return pathErr("mkdir", path, err)
+		}
+		unix.Close(fd)
+		fd = next
+	}
+	return nil
+}
+
+func (b *beneathFS) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.OpenFile(path, flag, perm)
+	}
+	fd, err := b.open(rel, uint64(flag), uint32(perm.Perm()))
+	if err != nil {
+		return nil, pathErr("open", path, err)
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+func (b *beneathFS) Chmod(path string, mode os.FileMode) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.Chmod(path, mode)
+	}
+	fd, err := b.open(rel, unix.O_PATH, 0)
+	if err != nil {
+		return pathErr("chmod", path, err)
+	}
+	defer unix.Close(fd)
+	// fchmod doesn't accept O_PATH descriptors, their /proc link does
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unix.S_ISVTX
+	}
+	err = unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), perm)
+	if errors.Is(err, unix.ENOENT) {
+		err = fmt.Errorf("/proc is not available")
+	}
+	return pathErr("chmod", path, err)
+}
+
+func (b *beneathFS) Chtimes(path string, atime, mtime time.Time) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.Chtimes(path, atime, mtime)
+	}
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("chtimes", path, err)
+	}
+	defer done()
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return pathErr("chtimes", path, unix.UtimesNanoAt(dirfd, name, ts, unix.AT_SYMLINK_NOFOLLOW))
+}
+
+func (b *beneathFS) Lchown(path string, uid, gid int) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.Lchown(path, uid, gid)
+	}
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("lchown", path, err)
+	}
+	defer done()
+	return pathErr("lchown", path, unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW))
+}
+
+func (b *beneathFS) Symlink(target, path string) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.Symlink(target, path)
+	}
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("symlink", path, err)
+	}
+	defer done()
+	return pathErr("symlink", path, unix.Symlinkat(target, dirfd, name))
+}
+
+func (b *beneathFS) Link(source, path string) error {
+	srcRel, srcOK := relBeneath(b.dir, source)
+	rel, ok := relBeneath(b.dir, path)
+	if !ok || !srcOK {
+		return os.Link(source, path)
+	}
+	srcfd, srcName, srcDone, err := b.parent(srcRel)
+	if err != nil {
+		return pathErr("link", source, err)
+	}
+	defer srcDone()
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("link", path, err)
+	}
+	defer done()
+	return pathErr("link", path, unix.Linkat(srcfd, srcName, dirfd, name, 0))
+}
+
+func (b *beneathFS) Mknod(path string, mode uint32, dev int) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return mknod(path, mode, dev)
+	}
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("mknod", path, err)
+	}
+	defer done()
+	return pathErr("mknod", path, unix.Mknodat(dirfd, name, mode, dev))
+}
+
+// RemoveAll removes a file, link or directory tree below the destination.
+func (b *beneathFS) RemoveAll(path string) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return os.RemoveAll(path)
+	}
+	dirfd, name, done, err := b.parent(rel)
+	if err != nil {
+		return pathErr("remove", path, err)
+	}
+	defer done()
+	return pathErr("remove", path, removeAt(dirfd, name))
+}
+
+// removeAt removes name from dirfd, descending into directories through
+// their descriptors so no symlink is ever followed.
+func removeAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err != unix.EISDIR {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return err
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, child := range names {
+		if err := removeAt(fd, child); err != nil {
+			return err
+		}
+	}
+	err = unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (b *beneathFS) Lsetxattr(path, name string, value []byte) error {
+	rel, ok := relBeneath(b.dir, path)
+	if !ok {
+		return lsetxattr(path, name, value)
+	}
+	fd, err := b.open(rel, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return pathErr("setxattr", path, err)
+	}
+	defer unix.Close(fd)
+	// fsetxattr doesn't accept O_PATH descriptors, their /proc link does
+	err = unix.Setxattr(fmt.Sprintf("/proc/self/fd/%d", fd), name, value, 0)
+	if errors.Is(err, unix.ENOENT) {
+		err = fmt.Errorf("/proc is not available")
+	}
+	return pathErr("setxattr", path, err)
+}
+
+func (b *beneathFS) Close() error {
+	return unix.Close(b.fd)
+}
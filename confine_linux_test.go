@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBeneathFS(t *testing.T) {
+	tmp := t.TempDir()
+	dest := filepath.Join(tmp, "dest")
+	outside := filepath.Join(tmp, "outside")
+	if err := os.MkdirAll(outside, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	openExtractRoot(dest, 0)
+	defer closeExtractRoot()
+	if _, ok := extractRoot.(*beneathFS); !ok {
+		t.Skip("openat2 not available")
+	}
+
+	file := filepath.Join(dest, "a", "b", "file.txt")
+	if err := extractRoot.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	f, err := extractRoot.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+	if err := extractRoot.Chmod(file, 0o640); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := extractRoot.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != 0o640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected mode %v or time %v", info.Mode(), info.ModTime())
+	}
+	if err := extractRoot.Link(file, filepath.Join(dest, "hard")); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	// A symlink swapped into the tree must never be followed
+	if err := os.Symlink(outside, filepath.Join(dest, "evil")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if f, err := extractRoot.OpenFile(filepath.Join(dest, "evil", "x"), os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+		f.Close()
+		t.Fatalf("open through symlink succeeded")
+	}
+	if err := extractRoot.MkdirAll(filepath.Join(dest, "evil", "sub"), 0o755); err == nil {
+		t.Fatalf("mkdir through symlink succeeded")
+	}
+	if err := extractRoot.Chmod(filepath.Join(dest, "evil"), 0o700); err == nil {
+		t.Fatalf("chmod through symlink succeeded")
+	}
+	if err := extractRoot.Symlink("x", filepath.Join(dest, "evil", "link")); err == nil {
+		t.Fatalf("symlink through symlink succeeded")
+	}
+	// Extended attributes go through the same resolution
+	if unix.Setxattr(outside, "user.goxa-probe", []byte("x"), 0) == nil {
+		unix.Removexattr(outside, "user.goxa-probe")
+		if err := extractRoot.Lsetxattr(file, "user.goxa", []byte("value")); err != nil {
+			t.Fatalf("setxattr: %v", err)
+		}
+		buf := make([]byte, 16)
+		if n, err := unix.Getxattr(file, "user.goxa", buf); err != nil || string(buf[:n]) != "value" {
+			t.Fatalf("xattr not set: %v %q", err, buf[:n])
+		}
+		os.WriteFile(filepath.Join(outside, "target"), nil, 0o644)
+		if err := extractRoot.Lsetxattr(filepath.Join(dest, "evil", "target"), "user.goxa", []byte("x")); err == nil {
+			t.Fatalf("setxattr through symlink succeeded")
+		}
+		if _, err := unix.Getxattr(filepath.Join(outside, "target"), "user.goxa", buf); err == nil {
+			t.Fatalf("xattr set outside the destination")
+		}
+		os.Remove(filepath.Join(outside, "target"))
+	}
+	// RemoveAll clears a whole tree but only unlinks the symlinks in it
+	keep := filepath.Join(outside, "keep")
+	os.WriteFile(keep, []byte("x"), 0o644)
+	tree := filepath.Join(dest, "tree")
+	if err := extractRoot.MkdirAll(filepath.Join(tree, "a", "b"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	os.WriteFile(filepath.Join(tree, "a", "b", "file"), []byte("x"), 0o644)
+	os.WriteFile(filepath.Join(tree, "file"), []byte("x"), 0o644)
+	os.Symlink(outside, filepath.Join(tree, "a", "link"))
+	if err := extractRoot.RemoveAll(tree); err != nil {
+		t.Fatalf("remove tree: %v", err)
+	}
+	if _, err := os.Lstat(tree); !os.IsNotExist(err) {
+		t.Fatalf("tree not removed: %v", err)
+	}
+	if err := extractRoot.RemoveAll(filepath.Join(dest, "evil", "keep")); err == nil {
+		t.Fatalf("remove through symlink succeeded")
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Fatalf("file outside the destination removed: %v", err)
+	}
+	os.Remove(keep)
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("outside directory modified: %v", entries)
+	}
+	if info, _ := os.Stat(outside); info.Mode().Perm() != 0o755 {
+		t.Fatalf("outside directory mode changed to %v", info.Mode())
+	}
+}
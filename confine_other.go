@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openBeneathRoot(dir string) (extractFS, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -9,8 +9,35 @@ const (
 	writeBuffer        = readBuffer
 	defaultArchiveName = "archive.goxa"
 	defaultBlockSize   = 512 * 1024 // 512KiB
+
+	footerMagic = "GXFT"
+	footerLen   = 24
+
+	redundantMagic = "GXRD"
+	redundantLen   = 40
+)
+
+// Modes given as words, mapped to internal command letters
+const (
+	cmdConvert    byte = 'C'
+	cmdRecompress byte = 'R'
+	cmdMerge      byte = 'M'
+	cmdRecover    byte = 'V'
+	cmdFECVerify  byte = 'F'
+	cmdFECRepair  byte = 'E'
+	cmdBitfix     byte = 'B'
 )
 
+var wordModes = map[string]byte{
+	"convert":    cmdConvert,
+	"recompress": cmdRecompress,
+	"merge":      cmdMerge,
+	"recover":    cmdRecover,
+	"fec-verify": cmdFECVerify,
+	"fec-repair": cmdFECRepair,
+	"bitfix":     cmdBitfix,
+}
+
 // Checksum types
 const (
 	sumCRC32 uint8 = iota
@@ -31,12 +58,15 @@ const (
 	fIncludeInvis
 	fSpecialFiles
 	fBlockChecksums
+	fStreamed
+	fRedundant
+	fBlockCRC32
 
 	fTop //Do not use, move or delete
 )
 
 var (
-	flagNames = []string{"None", "Absolute Paths", "Permissions", "Modification Times", "Checksums", "No Compress", "Hidden Files", "Special Files", "Block Checksums", "Unknown"}
+	flagNames = []string{"None", "Absolute Paths", "Permissions", "Modification Times", "Checksums", "No Compress", "Hidden Files", "Special Files", "Block Checksums", "Streamed", "Redundant Index", "Block CRC32s", "Unknown"}
 )
 
 // Entry Types
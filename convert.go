@@ -0,0 +1,705 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/flate"
+)
+
+// zipChanged is the zip entry comment marking files that changed while
+// a goxa archive was written.
+const zipChanged = "goxa: changed during archiving"
+
+// convertSource is an archive being converted.
+type convertSource struct {
+	dirs, files []FileEntry
+	flags       BitFlags
+	// data calls fn for every entry of files in order, passing the
+	// contents of regular files and nil for everything else.
+	data  func(fn func(i int, r io.Reader) error) error
+	close func()
+}
+
+// convertTarget returns the format of the archive name out and, for tar,
+// its compression.
+func convertTarget(out string) (format string, comp uint8, noComp bool, err error) {
+	if isURL(out) {
+		return "", 0, false, fmt.Errorf("archives can not be written to a URL")
+	}
+	lower := strings.ToLower(out)
+	if _, enc := detectEncodingFromExt(out); enc != "" || strings.HasSuffix(lower, ".goxaf") {
+		return "", 0, false, fmt.Errorf("%v: encoded archives can't be converted to", out)
+	}
+	if _, comp, ok := tarCompExt(out); ok {
+		if comp == compBzip2 {
+			return "", 0, false, fmt.Errorf("bzip2 tar archives can only be read")
+		}
+		return "tar", comp, false, nil
+	}
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar", 0, true, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip", 0, false, nil
+	case strings.HasSuffix(lower, ".goxa"):
+		return "goxa", 0, false, nil
+	}
+	return "", 0, false, fmt.Errorf("%v: unknown archive type, use .goxa, .zip or a tar extension", out)
+}
+
+// convert streams the entries of the archive at archivePath, in format,
+// into a new archive out whose type follows from its name. Goxa output
+// uses the -comp, -speed, -block and -sum settings.
+func convert(out, format string) error {
+	outFormat, outComp, outNoComp, err := convertTarget(out)
+	if err != nil {
+		return err
+	}
+	if !doForce {
+		if found, _ := fileExists(out); found {
+			return fmt.Errorf("archive %v already exists", out)
+		}
+	}
+
+	var src *convertSource
+	switch strings.ToLower(format) {
+	case "tar":
+		if archivePath == "-" && outFormat == "goxa" {
+			return fmt.Errorf("converting tar to goxa reads the input twice and can't use stdin")
+		}
+		src, err = tarConvertSource(archivePath, tarComp, features.IsSet(fNoCompress))
+	case "zip":
+		src, err = zipConvertSource(archivePath)
+	default:
+		src, err = goxaConvertSource(archivePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	doLog(false, "Converting %v to %v", archivePath, out)
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// A failed conversion leaves no truncated archive behind
+	failed := true
+	defer func() {
+		if failed {
+			f.Close()
+			os.Remove(out)
+		}
+	}()
+
+	var totalBytes int64
+	for _, e := range src.files {
+		totalBytes += int64(e.Size)
+	}
+	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	switch outFormat {
+	case "tar":
+		err = convertToTar(src, f, outComp, outNoComp, p)
+	case "zip":
+		err = convertToZip(src, f, p)
+	default:
+		err = convertToGoxa(src, f, p)
+	}
+	if err != nil {
+		return err
+	}
+	failed = false
+	if !noFlush {
+		f.Sync()
+	}
+	if st, err := os.Stat(out); err == nil {
+		doLog(false, "\nWrote %v, %v containing %v files.", out, humanize.Bytes(uint64(st.Size())), len(src.files))
+	}
+	return nil
+}
+
+// goxaConvertSource reads a goxa archive, verifying every file checksum.
+func goxaConvertSource(path string) (*convertSource, error) {
+	arc, hdr, done, err := readArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	// Files that couldn't be read while archiving have no data
+	files := make([]FileEntry, 0, len(hdr.Files))
+	for _, e := range hdr.Files {
+		if e.Type == entryFile && e.Offset == 0 && e.Size > 0 {
+			doLog(false, "skipping %v: not stored in the archive", e.Path)
+			events.warn(e.Path, "not stored in the archive, skipped")
+			events.fileSkipped(e.Path)
+			continue
+		}
+		files = append(files, e)
+	}
+	src := &convertSource{
+		dirs:  hdr.Dirs,
+		files: files,
+		flags: hdr.Flags,
+		close: done,
+	}
+	src.data = func(fn func(i int, r io.Reader) error) error {
+		for i := range src.files {
+			item := &src.files[i]
+			if item.Type != entryFile {
+				if err := fn(i, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			r, err := goxaFileReader(arc, hdr, item)
+			if err != nil {
+				return err
+			}
+			if err := fn(i, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return src, nil
+}
+
+// goxaFileReader returns the decoded contents of item. Reading fails at
+// the end when the size or the stored checksum don't match.
+func goxaFileReader(arc *BinReader, hdr *ArchiveHeader, item *FileEntry) (io.Reader, error) {
+	vr := &verifyReader{path: item.Path, size: item.Size}
+	blocks := item.Blocks
+	if len(blocks) == 0 && item.Size > 0 {
+		// Older archives hold one stream per file without a block index
+		off := item.Offset
+		if hdr.Flags.IsSet(fChecksums) && hdr.Flags.IsNotSet(fStreamed) {
+			off += uint64(hdr.SumLen)
+		}
+		blocks = []Block{{Offset: off, Size: uint64(arc.Size()) - off}}
+	}
+	vr.r = &blockReader{arc: arc, blocks: blocks, cType: hdr.CompType, noComp: hdr.Flags.IsSet(fNoCompress)}
+	if hdr.Flags.IsSet(fChecksums) {
+		vr.h = newHasher(hdr.SumType)
+		vr.sumLen = hdr.SumLen
+		if item.Offset == 0 {
+			// Empty files have no blocks to locate their checksum by
+			vr.want = padSum(vr.h.Sum(nil), hdr.SumLen)
+			return vr, nil
+		}
+		vr.want = make([]byte, hdr.SumLen)
+		if _, err := arc.ReadAt(vr.want, int64(item.SumOffset)); err != nil {
+			return nil, fmt.Errorf("unable to read checksum for %v: %w", item.Path, err)
+		}
+	}
+	return vr, nil
+}
+
+// blockReader decodes a file's blocks one after the other.
+type blockReader struct {
+	arc    *BinReader
+	blocks []Block
+	cType  uint8
+	noComp bool
+	cur    io.ReadCloser
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for {
+		if br.cur == nil {
+			if len(br.blocks) == 0 {
+				return 0, io.EOF
+			}
+			b := br.blocks[0]
+			br.blocks = br.blocks[1:]
+			r := io.NewSectionReader(br.arc, int64(b.Offset), int64(b.Size))
+			if br.noComp {
+				br.cur = io.NopCloser(r)
+			} else {
+				dec, err := decompressor(r, br.cType)
+				if err != nil {
+					return 0, err
+				}
+				br.cur = dec
+			}
+		}
+		n, err := br.cur.Read(p)
+		if err == io.EOF {
+			br.cur.Close()
+			br.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// verifyReader passes through exactly size bytes of r and checks them
+// against the checksum want once r is exhausted.
+type verifyReader struct {
+	r      io.Reader
+	path   string
+	size   uint64
+	read   uint64
+	h      hash.Hash
+	want   []byte
+	sumLen uint8
+}
+
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	if left := vr.size - vr.read; uint64(len(p)) > left {
+		p = p[:left]
+	}
+	n := 0
+	var err error
+	if len(p) > 0 {
+		n, err = vr.r.Read(p)
+	} else {
+		err = io.EOF
+	}
+	vr.read += uint64(n)
+	if vr.h != nil {
+		vr.h.Write(p[:n])
+	}
+	if err == io.EOF {
+		return n, vr.finish()
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: %w", vr.path, err)
+	}
+	return n, err
+}
+
+func (vr *verifyReader) finish() error {
+	if vr.read != vr.size {
+		return fmt.Errorf("%v: size mismatch, header says %v bytes, got %v", vr.path, vr.size, vr.read)
+	}
+	if vr.h != nil && !bytes.Equal(padSum(vr.h.Sum(nil), vr.sumLen), vr.want) {
+		if !doForce {
+			return fmt.Errorf("checksum mismatch for %v", vr.path)
+		}
+		doLog(false, "Checksum mismatch for %v (continuing)", vr.path)
+		events.warn(vr.path, "checksum mismatch")
+	}
+	return io.EOF
+}
+
+// tarConvertSource reads a tar archive. Its entries are collected in a
+// first pass, so the contents are read by opening the archive again.
+func tarConvertSource(path string, comp uint8, noComp bool) (*convertSource, error) {
+	r, _, closeSrc, err := openTarFile(path, comp, noComp)
+	if err != nil {
+		return nil, err
+	}
+	src := &convertSource{close: func() {}}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeSrc()
+			return nil, err
+		}
+		entry, isDir, flags := tarEntry(hdr)
+		src.flags |= flags
+		if isDir {
+			src.dirs = append(src.dirs, entry)
+		} else {
+			src.files = append(src.files, entry)
+		}
+	}
+	closeSrc()
+	if noComp {
+		src.flags |= fNoCompress
+	}
+
+	src.data = func(fn func(i int, r io.Reader) error) error {
+		r, _, closeSrc, err := openTarFile(path, comp, noComp)
+		if err != nil {
+			return err
+		}
+		defer closeSrc()
+		tr := tar.NewReader(r)
+		i := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			if i >= len(src.files) {
+				return fmt.Errorf("tar archive changed while converting")
+			}
+			var data io.Reader
+			if src.files[i].Type == entryFile {
+				data = tr
+			}
+			if err := fn(i, data); err != nil {
+				return err
+			}
+			i++
+		}
+		if i != len(src.files) {
+			return fmt.Errorf("tar archive changed while converting")
+		}
+		return nil
+	}
+	return src, nil
+}
+
+// zipConvertSource reads a zip archive.
+func zipConvertSource(path string) (*convertSource, error) {
+	as, err := openArchiveSource(path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(as, as.Size())
+	if err != nil {
+		as.Close()
+		return nil, err
+	}
+	dirs, files, flags := zipEntries(zr)
+	src := &convertSource{dirs: dirs, files: files, flags: flags, close: func() { as.Close() }}
+	var entries []*zip.File
+	for _, f := range zr.File {
+		if !f.Mode().IsDir() {
+			entries = append(entries, f)
+		}
+	}
+	for i, f := range entries {
+		src.files[i].Changed = f.Comment == zipChanged
+		if src.files[i].Type != entrySymlink {
+			if src.files[i].Type != entryFile {
+				src.files[i].Size = 0
+			}
+			continue
+		}
+		src.files[i].Size = 0
+		rc, err := f.Open()
+		if err != nil {
+			as.Close()
+			return nil, err
+		}
+		link, err := io.ReadAll(io.LimitReader(rc, 4096))
+		rc.Close()
+		if err != nil {
+			as.Close()
+			return nil, err
+		}
+		src.files[i].Linkname = string(link)
+	}
+	src.data = func(fn func(i int, r io.Reader) error) error {
+		for i, f := range entries {
+			if src.files[i].Type != entryFile {
+				if err := fn(i, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(i, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return src, nil
+}
+
+// tarHeader builds the tar header for a converted entry, or nil for
+// special files tar can't represent.
+func tarHeader(entry FileEntry, isDir bool) *tar.Header {
+	hdr := &tar.Header{
+		Format:  tar.FormatPAX,
+		Name:    filepath.ToSlash(entry.Path),
+		Mode:    int64(entry.Mode.Perm()),
+		ModTime: entry.ModTime,
+	}
+	if entry.Mode&os.ModeSetuid != 0 {
+		hdr.Mode |= 0o4000
+	}
+	if entry.Mode&os.ModeSetgid != 0 {
+		hdr.Mode |= 0o2000
+	}
+	if entry.Mode&os.ModeSticky != 0 {
+		hdr.Mode |= 0o1000
+	}
+	if entry.Changed {
+		hdr.PAXRecords = map[string]string{paxChanged: "1"}
+	}
+	switch {
+	case isDir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case entry.Type == entryFile:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(entry.Size)
+	case entry.Type == entrySymlink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = filepath.ToSlash(entry.Linkname)
+	case entry.Type == entryHardlink:
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = filepath.ToSlash(entry.Linkname)
+	case entry.Mode&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	case entry.Mode&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+	case entry.Mode&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+	default:
+		return nil
+	}
+	return hdr
+}
+
+func convertToTar(src *convertSource, w io.Writer, comp uint8, noComp bool, p *progressData) error {
+	bw := bufio.NewWriterSize(w, writeBuffer)
+	var out io.Writer = bw
+	var zw io.WriteCloser
+	if !noComp {
+		zw = compressor(bw, comp)
+		out = zw
+	}
+	tw := tar.NewWriter(out)
+	for _, dir := range src.dirs {
+		if err := tw.WriteHeader(tarHeader(dir, true)); err != nil {
+			return err
+		}
+	}
+	err := src.data(func(i int, r io.Reader) error {
+		entry := src.files[i]
+		hdr := tarHeader(entry, false)
+		if hdr == nil {
+			doLog(true, "tar: skipping special file %v", entry.Path)
+			events.fileSkipped(entry.Path)
+			return nil
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if r == nil {
+			return nil
+		}
+		p.file.Store(entry.Path)
+		events.fileBegin(entry.Path, entry.Size)
+		if _, err := io.Copy(tw, progressReader{r: r, p: p}); err != nil {
+			return err
+		}
+		events.fileEnd(entry.Path, entry.Size, "")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func convertToZip(src *convertSource, w io.Writer, p *progressData) error {
+	bw := bufio.NewWriterSize(w, writeBuffer)
+	zw := zip.NewWriter(bw)
+	level := zipLevel()
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+	// zipHeader follows the feature flags, use those of the source
+	oldFeatures := features
+	features = src.flags &^ fNoCompress
+	if strings.ToLower(compression) == "none" {
+		features |= fNoCompress
+	}
+	defer func() { features = oldFeatures }()
+
+	for _, dir := range src.dirs {
+		if _, err := zw.CreateHeader(zipHeader(dir, true)); err != nil {
+			return err
+		}
+	}
+	err := src.data(func(i int, r io.Reader) error {
+		entry := src.files[i]
+		if entry.Type != entryFile && entry.Type != entrySymlink {
+			doLog(true, "zip: skipping special file %v", entry.Path)
+			events.fileSkipped(entry.Path)
+			return nil
+		}
+		hdr := zipHeader(entry, false)
+		if entry.Changed {
+			hdr.Comment = zipChanged
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if entry.Type == entrySymlink {
+			_, err := io.WriteString(fw, entry.Linkname)
+			return err
+		}
+		p.file.Store(entry.Path)
+		events.fileBegin(entry.Path, entry.Size)
+		if _, err := io.Copy(fw, progressReader{r: r, p: p}); err != nil {
+			return err
+		}
+		events.fileEnd(entry.Path, entry.Size, "stored")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// convertToGoxa writes a goxa archive using the current compression and
+// checksum settings. Checksums are always stored.
+func convertToGoxa(src *convertSource, f *os.File, p *progressData) error {
+	oldFeatures := features
+	features = src.flags&^(fNoCompress|fStreamed) | fChecksums | features&(fRedundant|fBlockCRC32)
+	if strings.ToLower(compression) == "none" {
+		features |= fNoCompress
+	}
+	defer func() { features = oldFeatures }()
+	if features.IsSet(fNoCompress) {
+		blockSize = 0
+	} else if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+
+	files := slices.Clone(src.files)
+	for i := range files {
+		files[i].Offset = 0
+		files[i].Blocks = nil
+		files[i].SumOffset = 0
+	}
+	bf := NewBufferedFile(f, writeBuffer, p)
+	header := writeHeader(src.dirs, files, 0, 0, features, compType)
+	if _, err := bf.Write(header); err != nil {
+		return err
+	}
+	cOffset := uint64(len(header))
+	var buf []byte
+	if blockSize > 0 {
+		buf = make([]byte, blockSize)
+	}
+	h := newHasher(checksumType)
+
+	err := src.data(func(i int, r io.Reader) error {
+		if r == nil {
+			return nil
+		}
+		p.file.Store(files[i].Path)
+		events.fileBegin(files[i].Path, files[i].Size)
+		var err error
+		cOffset, err = encodeFile(bf, &files[i], progressReader{r: r, p: p}, h, buf, cOffset)
+		if err != nil {
+			return err
+		}
+		events.fileEnd(files[i].Path, files[i].Size, "stored")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return finishArchive(bf, src.dirs, files, len(header), cOffset)
+}
+
+// encodeFile writes the contents of entry, read from r, at cOffset of bf,
+// preceded by its checksum when checksums are enabled. It returns the
+// offset following the file.
+func encodeFile(bf *BufferedFile, entry *FileEntry, r io.Reader, h hash.Hash, buf []byte, cOffset uint64) (uint64, error) {
+	entry.Offset = cOffset
+	sumOffset := cOffset
+	var data io.Reader = &sizedReader{r: r, n: int64(entry.Size)}
+	if features.IsSet(fChecksums) {
+		if _, err := bf.Write(make([]byte, checksumLength)); err != nil {
+			return 0, err
+		}
+		cOffset += uint64(checksumLength)
+		h.Reset()
+		data = io.TeeReader(data, h)
+	}
+	blocks, next, err := encodeBlocks(bf, data, buf, cOffset)
+	if err != nil {
+		return 0, err
+	}
+	entry.Blocks = blocks
+	if features.IsNotSet(fChecksums) {
+		return next, nil
+	}
+	if _, err := bf.Seek(int64(sumOffset), io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := bf.Write(padSum(h.Sum(nil), checksumLength)); err != nil {
+		return 0, err
+	}
+	_, err = bf.Seek(int64(next), io.SeekStart)
+	return next, err
+}
+
+// finishArchive appends the trailer for files to bf, which ends at
+// cOffset, replaces the headerLen bytes long placeholder header with the
+// final one and closes bf.
+func finishArchive(bf *BufferedFile, dirs, files []FileEntry, headerLen int, cOffset uint64) error {
+	trailer := writeTrailer(files)
+	if _, err := bf.Write(trailer); err != nil {
+		return err
+	}
+	arcSize := cOffset + uint64(len(trailer))
+	if features.IsSet(fRedundant) {
+		arcSize += uint64(headerLen + len(trailer) + redundantLen)
+	}
+	finalHeader := writeHeader(dirs, files, cOffset, arcSize, features, compType)
+	if len(finalHeader) != headerLen {
+		return fmt.Errorf("header size mismatch")
+	}
+	if features.IsSet(fRedundant) {
+		if _, err := bf.Write(redundantCopies(finalHeader, trailer, cOffset+uint64(len(trailer)))); err != nil {
+			return err
+		}
+	}
+	if _, err := bf.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := bf.Write(finalHeader); err != nil {
+		return err
+	}
+	return bf.Close()
+}
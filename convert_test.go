@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConvertRoundTrip(t *testing.T) {
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	specs := setupTestTree(t, root)
+	os.Symlink("rootfile.txt", filepath.Join(root, "link.txt"))
+	modTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	os.Chtimes(filepath.Join(root, "rootfile.txt"), modTime, modTime)
+
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compType = compZstd
+	configureChecksum("blake3")
+	features = fIncludeInvis | fPermissions | fModDates | fChecksums | fSpecialFiles
+	archivePath = filepath.Join(tempDir, "src.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	steps := []struct {
+		out, format string
+		comp        uint8
+		sum         string
+	}{
+		{"a.tar.gz", "goxa", compZstd, "blake3"},
+		{"b.zip", "tar", compZstd, "blake3"},
+		{"c.goxa", "zip", compLZ4, "xxhash"},
+		{"d.goxa", "goxa", compGzip, "crc32"},
+	}
+	tarComp = compGzip
+	for _, st := range steps {
+		compType = st.comp
+		configureChecksum(st.sum)
+		features = 0
+		out := filepath.Join(tempDir, st.out)
+		if err := convert(out, st.format); err != nil {
+			t.Fatalf("convert to %v: %v", st.out, err)
+		}
+		archivePath = out
+	}
+	if err := convert(filepath.Join(tempDir, "d.goxa"), "goxa"); err == nil {
+		t.Fatalf("expected existing output to be refused")
+	}
+
+	os.RemoveAll(root)
+	dest := filepath.Join(tempDir, "out")
+	os.MkdirAll(dest, 0o755)
+	features = fIncludeInvis | fPermissions | fModDates | fSpecialFiles
+	extract([]string{dest}, false, false)
+
+	base := filepath.Join(dest, filepath.Base(root))
+	for _, sp := range specs {
+		checkFile(t, filepath.Join(base, sp.rel), sp.data, sp.perm, true)
+	}
+	info, err := os.Stat(filepath.Join(base, "rootfile.txt"))
+	if err != nil || !info.ModTime().UTC().Truncate(time.Second).Equal(modTime) {
+		t.Fatalf("mod time not carried over")
+	}
+	if target, err := os.Readlink(filepath.Join(base, "link.txt")); err != nil || target != "rootfile.txt" {
+		t.Fatalf("symlink not carried over: %q %v", target, err)
+	}
+}
+
+func TestConvertTarChanged(t *testing.T) {
+	entry := FileEntry{Path: "a/b.txt", Mode: 0o640, Size: 3, Changed: true}
+	back, isDir, _ := tarEntry(tarHeader(entry, false))
+	if isDir || !back.Changed || back.Path != entry.Path || back.Size != entry.Size {
+		t.Fatalf("tar entry mismatch: %+v", back)
+	}
+}
+
+func TestConvertFailureRemovesOutput(t *testing.T) {
+	tempDir, _, data := recompressSetup(t, true)
+	raw, _ := os.ReadFile(archivePath)
+	idx := bytes.Index(raw, data[:64])
+	if idx < 0 {
+		t.Fatalf("file data not found in archive")
+	}
+	raw[idx+10] ^= 0xff
+	os.WriteFile(archivePath, raw, 0o644)
+
+	features = 0
+	out := filepath.Join(tempDir, "out.tar")
+	if err := convert(out, "goxa"); err == nil {
+		t.Fatalf("expected the checksum mismatch to fail the conversion")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("partial output left behind: %v", err)
+	}
+}
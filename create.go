@@ -1,17 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/base32"
 	"encoding/base64"
-	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	brotli "github.com/andybalholm/brotli"
@@ -24,8 +23,8 @@ import (
 	"github.com/ulikunitz/xz"
 )
 
-func compressor(w io.Writer) io.WriteCloser {
-	switch compType {
+func compressor(w io.Writer, cType uint8) io.WriteCloser {
+	switch cType {
 	case compZstd:
 		level := zstd.SpeedFastest
 		switch compSpeed {
@@ -116,11 +115,44 @@ func create(inputPaths []string) error {
 	var bf *BufferedFile
 	var tmpPath string
 	var outFile *os.File
-	if toStdOut && encode == "" {
-		bf = NewBufferedFile(os.Stdout, writeBuffer, &progressData{})
-		outFile = os.Stdout
+	var encW io.WriteCloser
+	var volW *volumeWriter
+	if toStdOut {
+		if encode == "fec" && fecStripe == 0 {
+			log.Fatalf("FEC encoding with stdout needs -fec-stripe")
+		}
+		// Stdout may be a pipe, so write a streamed archive that never seeks
+		features.Set(fStreamed)
+		var dst io.Writer = os.Stdout
+		if encode == "fec" {
+			fw, err := newFECStripeWriter(os.Stdout, fecStripedConfig())
+			if err != nil {
+				log.Fatalf("fec encode: %v", err)
+			}
+			encW = fw
+			dst = encW
+		} else if encode == "b32" {
+			encW = base32.NewEncoder(base32.StdEncoding, os.Stdout)
+			dst = encW
+		} else if encode == "b64" {
+			encW = base64.NewEncoder(base64.StdEncoding, os.Stdout)
+			dst = encW
+		} else if encode == "armor" {
+			encW = newArmorWriter(os.Stdout)
+			dst = encW
+		}
+		bf = NewBufferedWriter(dst, writeBuffer, &progressData{})
+	} else if volumeSize > 0 {
+		// Volumes are written in order, so use the streamed layout
+		features.Set(fStreamed)
+		vw, err := newVolumeWriter(archivePath, volumeSize)
+		if err != nil {
+			log.Fatalf("create: %v", err)
+		}
+		volW = vw
+		bf = NewBufferedWriter(vw, writeBuffer, &progressData{})
 	} else {
-		if encode != "" || toStdOut {
+		if encode == "fec" && fecStripe == 0 {
 			f, err := os.CreateTemp("", "goxa_tmp_*")
 			if err != nil {
 				log.Fatalf("temp create: %v", err)
@@ -143,7 +175,31 @@ func create(inputPaths []string) error {
 			outFile = f
 			defer outFile.Close()
 		}
-		bf = NewBufferedFile(outFile, writeBuffer, &progressData{})
+		switch {
+		case encode == "b32" || encode == "b64":
+			// Encoded in place, so the header can still be rewritten
+			bw, err := newBaseFile(outFile, encode)
+			if err != nil {
+				log.Fatalf("create: %v", err)
+			}
+			bf = NewBufferedFile(bw, writeBuffer, &progressData{})
+		case encode == "armor":
+			// Armored lines carry checksums and can't be rewritten
+			features.Set(fStreamed)
+			encW = newArmorWriter(outFile)
+			bf = NewBufferedWriter(encW, writeBuffer, &progressData{})
+		case encode == "fec" && fecStripe > 0:
+			// Striped FEC is encoded front to back, like on stdout
+			features.Set(fStreamed)
+			fw, err := newFECStripeWriter(outFile, fecStripedConfig())
+			if err != nil {
+				log.Fatalf("fec encode: %v", err)
+			}
+			encW = fw
+			bf = NewBufferedWriter(encW, writeBuffer, &progressData{})
+		default:
+			bf = NewBufferedFile(outFile, writeBuffer, &progressData{})
+		}
 	}
 	doLog(false, "Creating archive: %v, inputs: %v", archivePath, inputPaths)
 
@@ -152,7 +208,7 @@ func create(inputPaths []string) error {
 		return err
 	}
 
-	if spaceCheck {
+	if spaceCheck && outFile != nil {
 		var totalBytes int64
 		for _, f := range files {
 			totalBytes += int64(f.Size)
@@ -167,18 +223,7 @@ func create(inputPaths []string) error {
 				log.Fatalf("create: insufficient disk space: need %v, available %v", humanize.Bytes(need), humanize.Bytes(free))
 			}
 			if free-need < total/100 {
-				msg := fmt.Sprintf("create would leave %v free", humanize.Bytes(free-need))
-				if interactiveMode {
-					fmt.Printf("%s. Continue? [y/N]: ", msg)
-					reader := bufio.NewReader(os.Stdin)
-					resp, _ := reader.ReadString('\n')
-					resp = strings.TrimSpace(strings.ToLower(resp))
-					if resp != "y" && resp != "yes" {
-						log.Fatalf("aborted: %s", msg)
-					}
-				} else {
-					log.Fatalf("%s", msg)
-				}
+				confirmOrAbort(fmt.Sprintf("create would leave %v free", humanize.Bytes(free-need)))
 			}
 		}
 	}
@@ -199,17 +244,59 @@ func create(inputPaths []string) error {
 	if time.Since(start) > time.Second {
 		fmt.Printf("writing offset table took %v\n", time.Since(start))
 	}
-	if err := bf.Flush(); err != nil {
-		log.Fatalf("flush: %v", err)
+	arcSize := trailerOffset + uint64(len(trailer))
+	if features.IsSet(fRedundant) {
+		arcSize += uint64(headerLen + len(trailer) + redundantLen)
 	}
-	info, err := bf.file.Stat()
-	if err != nil {
-		log.Fatalf("create: os.Create: %v", err)
+
+	if features.IsSet(fStreamed) {
+		arcSize += footerLen
+		if features.IsSet(fRedundant) {
+			bf.Write(redundantCopies(header, trailer, trailerOffset+uint64(len(trailer))))
+		}
+		bf.Write(encodeFooter(trailerOffset, arcSize))
+		if err := bf.Close(); err != nil {
+			log.Fatalf("create: write failed: %v", err)
+		}
+		if encW != nil {
+			if err := encW.Close(); err != nil {
+				log.Fatalf("create: encode failed: %v", err)
+			}
+		}
+		if outFile != nil {
+			if !noFlush {
+				if err := outFile.Sync(); err != nil {
+					log.Fatalf("create: sync failed: %v", err)
+				}
+			}
+			if err := outFile.Close(); err != nil {
+				log.Fatalf("create: close failed: %v", err)
+			}
+			if st, err := os.Stat(archivePath); err == nil {
+				arcSize = uint64(st.Size())
+			}
+		}
+		if volW != nil {
+			if err := volW.Close(); err != nil {
+				log.Fatalf("create: %v", err)
+			}
+			doLog(false, "\nWrote %v volumes, %v containing %v files.", len(volW.names), humanize.Bytes(arcSize), len(files))
+			return nil
+		}
+		doLog(false, "\nWrote %v, %v containing %v files.", archivePath, humanize.Bytes(arcSize), len(files))
+		return nil
 	}
-	finalHeader := writeHeader(emptyDirs, files, trailerOffset, uint64(info.Size()), features, compType)
+
+	finalHeader := writeHeader(emptyDirs, files, trailerOffset, arcSize, features, compType)
 	if len(finalHeader) != headerLen {
 		log.Fatalf("header size mismatch")
 	}
+	if features.IsSet(fRedundant) {
+		bf.Write(redundantCopies(finalHeader, trailer, trailerOffset+uint64(len(trailer))))
+	}
+	if err := bf.Flush(); err != nil {
+		log.Fatalf("flush: %v", err)
+	}
 	if _, err := bf.Seek(0, io.SeekStart); err != nil {
 		log.Fatalf("seek start: %v", err)
 	}
@@ -223,146 +310,38 @@ func create(inputPaths []string) error {
 		fmt.Println("flushing to disk")
 	}
 
-	if encode != "" {
+	if encode == "fec" {
 		outFile.Close()
-		if encode == "fec" {
-			if toStdOut {
-				log.Fatalf("FEC encoding not supported with stdout")
-			}
-			doLog(false, "FEC encoding archive")
-			if err := encodeWithFEC(tmpPath, archivePath); err != nil {
-				log.Fatalf("fec encode: %v", err)
-			}
-			os.Remove(tmpPath)
-			if st, err := os.Stat(archivePath); err == nil {
-				info = st
-			}
-		} else {
-			src, err := os.Open(tmpPath)
-			if err != nil {
-				log.Fatalf("temp reopen: %v", err)
-			}
-			defer os.Remove(tmpPath)
-
-			st, err := src.Stat()
-			if err != nil {
-				src.Close()
-				log.Fatalf("stat tmp: %v", err)
-			}
-			info = st
-
-			var dst io.Writer
-			var encW io.WriteCloser
-			if toStdOut {
-				dst = os.Stdout
-			} else {
-				f, err := os.Create(archivePath)
-				if err != nil {
-					log.Fatalf("create output: %v", err)
-				}
-				defer f.Close()
-				dst = f
-			}
-			if encode == "b32" {
-				doLog(false, "Base32 encoding archive")
-				encW = base32.NewEncoder(base32.StdEncoding, dst)
-			} else {
-				doLog(false, "Base64 encoding archive")
-				encW = base64.NewEncoder(base64.StdEncoding, dst)
-			}
-
-			p, done, finished := progressTicker(&progressData{total: info.Size(), speedWindowSize: time.Second * 5})
-			p.file.Store(archivePath)
-
-			if _, err := io.Copy(encW, progressReader{r: src, p: p}); err != nil {
-				close(done)
-				<-finished
-				log.Fatalf("encode copy: %v", err)
-			}
-			encW.Close()
-			if !toStdOut && !noFlush {
-				if f, ok := dst.(*os.File); ok {
-					f.Sync()
-				}
-			}
-			src.Close()
-			close(done)
-			<-finished
-
-			if !toStdOut {
-				if st, err := os.Stat(archivePath); err == nil {
-					info = st
-				}
-			}
+		doLog(false, "FEC encoding archive")
+		if err := encodeWithFEC(tmpPath, archivePath); err != nil {
+			log.Fatalf("fec encode: %v", err)
+		}
+		os.Remove(tmpPath)
+	}
+	if encode != "" {
+		if st, err := os.Stat(archivePath); err == nil {
+			arcSize = uint64(st.Size())
 		}
 	}
 
-	doLog(false, "\nWrote %v, %v containing %v files.", archivePath, humanize.Bytes(uint64(info.Size())), len(files))
+	doLog(false, "\nWrote %v, %v containing %v files.", archivePath, humanize.Bytes(arcSize), len(files))
 	return nil
 }
 
 func writeHeader(emptyDirs, files []FileEntry, trailerOffset, arcSize uint64, flags BitFlags, cType uint8) []byte {
-	var header bytes.Buffer
-
-	binary.Write(&header, binary.LittleEndian, []byte(magic))
-	binary.Write(&header, binary.LittleEndian, uint16(protoVersion))
-	binary.Write(&header, binary.LittleEndian, flags)
-	binary.Write(&header, binary.LittleEndian, cType)
-	binary.Write(&header, binary.LittleEndian, checksumType)
-	binary.Write(&header, binary.LittleEndian, checksumLength)
-	binary.Write(&header, binary.LittleEndian, blockSize)
-	binary.Write(&header, binary.LittleEndian, trailerOffset)
-	binary.Write(&header, binary.LittleEndian, arcSize)
-
-	binary.Write(&header, binary.LittleEndian, uint64(len(emptyDirs)))
-	for _, folder := range emptyDirs {
-		if flags.IsSet(fPermissions) {
-			binary.Write(&header, binary.LittleEndian, uint32(folder.Mode))
-		}
-		if flags.IsSet(fModDates) {
-			binary.Write(&header, binary.LittleEndian, int64(folder.ModTime.Unix()))
-		}
-		if err := WriteLPString(&header, folder.Path); err != nil {
-			log.Fatalf("write string failed: %v", err)
-		}
+	h := &ArchiveHeader{
+		Version:       protoVersion,
+		Flags:         flags,
+		CompType:      cType,
+		SumType:       checksumType,
+		SumLen:        checksumLength,
+		BlockSize:     blockSize,
+		TrailerOffset: trailerOffset,
+		ArcSize:       arcSize,
+		Dirs:          emptyDirs,
+		Files:         files,
 	}
-
-	binary.Write(&header, binary.LittleEndian, uint64(len(files)))
-	for _, file := range files {
-		binary.Write(&header, binary.LittleEndian, uint64(file.Size))
-		if flags.IsSet(fPermissions) {
-			binary.Write(&header, binary.LittleEndian, uint32(file.Mode))
-		}
-		if flags.IsSet(fModDates) {
-			binary.Write(&header, binary.LittleEndian, int64(file.ModTime.Unix()))
-		}
-		if err := WriteLPString(&header, file.Path); err != nil {
-			log.Fatalf("write string failed: %v", err)
-		}
-		header.WriteByte(file.Type)
-		if file.Type == entrySymlink || file.Type == entryHardlink {
-			if err := WriteLPString(&header, file.Linkname); err != nil {
-				log.Fatalf("write string failed: %v", err)
-			}
-		}
-		if protoVersion >= protoVersion2 {
-			if file.Changed {
-				header.WriteByte(1)
-			} else {
-				header.WriteByte(0)
-			}
-		}
-	}
-	// File offsets are tracked in the trailer only
-	h := newHasher(checksumType)
-	h.Write(header.Bytes())
-	sum := h.Sum(nil)
-	if len(sum) < int(checksumLength) {
-		pad := make([]byte, int(checksumLength)-len(sum))
-		sum = append(sum, pad...)
-	}
-	header.Write(sum[:checksumLength])
-	return header.Bytes()
+	return h.Encode()
 }
 
 func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEntry, uint64) {
@@ -388,6 +367,7 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 	}
 
 	newFiles := make([]FileEntry, 0, len(files))
+	streamed := features.IsSet(fStreamed)
 
 	for i := range files {
 		entry := &files[i]
@@ -398,6 +378,8 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 			continue
 		}
 
+		events.fileBegin(entry.Path, entry.Size)
+		stored := len(newFiles)
 		attempt := 0
 		hadChange := false
 	retryLoop:
@@ -409,25 +391,40 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 			if err != nil {
 				if doForce {
 					doLog(false, "\nUnable to open file: %v (continuing)", entry.Path)
-					break retryLoop
+					events.warn(entry.Path, "unable to open file: %v", err)
+					if streamed {
+						f = nil
+					} else {
+						break retryLoop
+					}
+				} else {
+					log.Fatalf("Unable to open file: %v", entry.Path)
 				}
-				log.Fatalf("Unable to open file: %v", entry.Path)
 			}
 
-			statStart, err := f.Stat()
-			if err != nil {
-				f.Close()
-				if doForce {
+			var statStart os.FileInfo
+			if f != nil {
+				statStart, err = f.Stat()
+				if err != nil {
+					f.Close()
+					if !doForce {
+						log.Fatalf("stat failed: %v", err)
+					}
 					doLog(false, "\nStat failed: %v (continuing)", entry.Path)
-					break retryLoop
+					events.warn(entry.Path, "stat failed: %v", err)
+					if !streamed {
+						break retryLoop
+					}
+					f = nil
 				}
-				log.Fatalf("stat failed: %v", err)
 			}
 
 			entry.Offset = cOffset
 
 			var checksumOffset uint64
-			if features.IsSet(fChecksums) {
+			if features.IsSet(fChecksums) && streamed {
+				h.Reset()
+			} else if features.IsSet(fChecksums) {
 				checksumOffset = cOffset
 				zero := make([]byte, checksumLength)
 				if _, err := bf.Write(zero); err != nil {
@@ -438,84 +435,62 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 				h.Reset()
 			}
 
-			br := NewBufferedFile(f, writeBuffer, p)
-			var src io.Reader = br
+			var src io.Reader
+			var br *BufferedFile
+			var sized *sizedReader
+			if f != nil {
+				br = NewBufferedFile(f, writeBuffer, p)
+				src = br
+			} else {
+				src = bytes.NewReader(nil)
+			}
+			if streamed {
+				// The size is already in the header, so store exactly that much
+				sized = &sizedReader{r: src, n: int64(entry.Size)}
+				src = sized
+			}
 			if features.IsSet(fChecksums) {
-				src = io.TeeReader(br, h)
+				src = io.TeeReader(src, h)
 			}
-			var blocks []Block
-
-			if blockSize == 0 {
-				bOff := cOffset
-				var written uint64
-				if features.IsSet(fNoCompress) {
-					if _, err := io.Copy(bf, src); err != nil {
-						f.Close()
-						log.Fatalf("copy failed: %v", err)
-					}
-					written = uint64(statStart.Size())
-				} else {
-					cw := &countingWriter{w: bf}
-					zw := compressor(cw)
-					if _, err := io.Copy(zw, src); err != nil {
-						f.Close()
-						log.Fatalf("compress copy failed: %v", err)
-					}
-					if err := zw.Close(); err != nil {
-						f.Close()
-						log.Fatalf("compress close failed: %v", err)
-					}
-					written = uint64(cw.Count())
-				}
-				cOffset += written
-				blocks = append(blocks, Block{Offset: bOff, Size: written})
-			} else {
-				for {
-					n, err := io.ReadFull(src, buf)
-					if n > 0 {
-						bOff := cOffset
-						if features.IsSet(fNoCompress) {
-							if _, err := bf.Write(buf[:n]); err != nil {
-								f.Close()
-								log.Fatalf("copy failed: %v", err)
-							}
-							cOffset += uint64(n)
-							blocks = append(blocks, Block{Offset: bOff, Size: uint64(n)})
-						} else {
-							cw := &countingWriter{w: bf}
-							zw := compressor(cw)
-							if _, err := zw.Write(buf[:n]); err != nil {
-								f.Close()
-								log.Fatalf("compress copy failed: %v", err)
-							}
-							if err := zw.Close(); err != nil {
-								f.Close()
-								log.Fatalf("compress close failed: %v", err)
-							}
-							cOffset += uint64(cw.Count())
-							blocks = append(blocks, Block{Offset: bOff, Size: uint64(cw.Count())})
-						}
-					}
-					if err == io.EOF {
-						break
-					}
-					if err == io.ErrUnexpectedEOF {
-						break
-					}
-					if err != nil {
-						f.Close()
-						log.Fatalf("read block failed: %v", err)
-					}
+			blocks, next, err := encodeBlocks(bf, src, buf, cOffset)
+			if err != nil {
+				if f != nil {
+					f.Close()
 				}
+				log.Fatalf("%v", err)
 			}
+			cOffset = next
+			if f == nil {
+				entry.Blocks = blocks
+				cOffset = writeStreamedSum(bf, h, cOffset)
+				newFiles = append(newFiles, *entry)
+				break retryLoop
+			}
+			sizeChanged := streamed && sized.changed()
 			br.Close()
 			f.Close()
 
 			statEnd, err := os.Stat(entry.SrcPath)
-			if err == nil && (statEnd.Size() != statStart.Size() || !statEnd.ModTime().Equal(statStart.ModTime())) {
+			changed := err == nil && (statEnd.Size() != statStart.Size() || !statEnd.ModTime().Equal(statStart.ModTime()))
+			if streamed {
+				// Already written data can't be taken back, keep what was read
+				if changed || sizeChanged {
+					if failOnChange {
+						log.Fatalf("File changed during read: %v", entry.Path)
+					}
+					doLog(false, "\nFile changed during read: %v (stored at its original size)", entry.Path)
+					events.warn(entry.Path, "file changed during read, stored at its original size")
+				}
+				entry.Blocks = blocks
+				cOffset = writeStreamedSum(bf, h, cOffset)
+				newFiles = append(newFiles, *entry)
+				break retryLoop
+			}
+			if changed {
 				hadChange = true
 				if fileRetries == 0 || attempt < fileRetries {
 					doLog(false, "\nFile changed during read: %v (retrying)", entry.Path)
+					events.warn(entry.Path, "file changed during read, retrying")
 					if _, err := bf.Seek(int64(startOffset), io.SeekStart); err != nil {
 						log.Fatalf("seek reset failed: %v", err)
 					}
@@ -527,6 +502,7 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 					log.Fatalf("File changed during read: %v", entry.Path)
 				}
 				doLog(false, "\nFile changed during read: %v (skipping)", entry.Path)
+				events.warn(entry.Path, "file changed during read, skipped")
 				if _, err := bf.Seek(int64(startOffset), io.SeekStart); err != nil {
 					log.Fatalf("seek reset failed: %v", err)
 				}
@@ -559,26 +535,157 @@ func writeEntries(headerLen int, bf *BufferedFile, files []FileEntry) ([]FileEnt
 			newFiles = append(newFiles, *entry)
 			break retryLoop
 		}
+		if len(newFiles) == stored {
+			events.fileSkipped(entry.Path)
+		} else if features.IsSet(fChecksums) {
+			events.fileEnd(entry.Path, entry.Size, "stored")
+		} else {
+			events.fileEnd(entry.Path, entry.Size, "")
+		}
 	}
 	return newFiles, cOffset
 }
 
-func writeTrailer(files []FileEntry) []byte {
-	var trailer bytes.Buffer
-	for _, f := range files {
-		binary.Write(&trailer, binary.LittleEndian, uint32(len(f.Blocks)))
-		for _, b := range f.Blocks {
-			binary.Write(&trailer, binary.LittleEndian, b.Offset)
-			binary.Write(&trailer, binary.LittleEndian, b.Size)
+// encodeBlocks writes src to bf as blocks of blockSize bytes, each
+// compressed on its own unless fNoCompress is set, starting at archive
+// offset cOffset. buf must hold blockSize bytes. It returns the blocks and
+// the offset following the last one.
+func encodeBlocks(bf io.Writer, src io.Reader, buf []byte, cOffset uint64) ([]Block, uint64, error) {
+	var blocks []Block
+	sum := crc32.NewIEEE()
+	w := io.MultiWriter(bf, sum)
+	if blockSize == 0 {
+		bOff := cOffset
+		var written uint64
+		if features.IsSet(fNoCompress) {
+			n, err := io.Copy(w, src)
+			if err != nil {
+				return nil, 0, fmt.Errorf("copy failed: %w", err)
+			}
+			written = uint64(n)
+		} else {
+			cw := &countingWriter{w: w}
+			zw := compressor(cw, compType)
+			if _, err := io.Copy(zw, src); err != nil {
+				return nil, 0, fmt.Errorf("compress copy failed: %w", err)
+			}
+			if err := zw.Close(); err != nil {
+				return nil, 0, fmt.Errorf("compress close failed: %w", err)
+			}
+			written = uint64(cw.Count())
 		}
+		cOffset += written
+		return append(blocks, Block{Offset: bOff, Size: written, Sum: sum.Sum32()}), cOffset, nil
 	}
-	h := newHasher(checksumType)
-	h.Write(trailer.Bytes())
-	sum := h.Sum(nil)
-	if len(sum) < int(checksumLength) {
-		pad := make([]byte, int(checksumLength)-len(sum))
-		sum = append(sum, pad...)
+	// Outputs that keep blocks whole need each block's size before it is
+	// written, so compress into memory first
+	var align *BufferedFile
+	var stage bytes.Buffer
+	if b, ok := bf.(*BufferedFile); ok && b.align != nil {
+		align = b
+		w = io.MultiWriter(&stage, sum)
+	}
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			bOff := cOffset
+			sum.Reset()
+			stage.Reset()
+			if features.IsSet(fNoCompress) {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return nil, 0, fmt.Errorf("copy failed: %w", err)
+				}
+				cOffset += uint64(n)
+				blocks = append(blocks, Block{Offset: bOff, Size: uint64(n), Sum: sum.Sum32()})
+			} else {
+				cw := &countingWriter{w: w}
+				zw := compressor(cw, compType)
+				if _, err := zw.Write(buf[:n]); err != nil {
+					return nil, 0, fmt.Errorf("compress copy failed: %w", err)
+				}
+				if err := zw.Close(); err != nil {
+					return nil, 0, fmt.Errorf("compress close failed: %w", err)
+				}
+				cOffset += uint64(cw.Count())
+				blocks = append(blocks, Block{Offset: bOff, Size: uint64(cw.Count()), Sum: sum.Sum32()})
+			}
+			if align != nil {
+				pad, err := align.alignBlock(uint64(stage.Len()))
+				if err != nil {
+					return nil, 0, fmt.Errorf("write failed: %w", err)
+				}
+				cOffset += pad
+				blocks[len(blocks)-1].Offset += pad
+				if _, err := bf.Write(stage.Bytes()); err != nil {
+					return nil, 0, fmt.Errorf("write failed: %w", err)
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, cOffset, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("read block failed: %w", err)
+		}
+	}
+}
+
+// writeStreamedSum appends the file checksum after its data, as streamed
+// archives can't seek back to fill in a reserved slot.
+func writeStreamedSum(bf *BufferedFile, h hash.Hash, cOffset uint64) uint64 {
+	if features.IsNotSet(fChecksums) {
+		return cOffset
+	}
+	if _, err := bf.Write(padSum(h.Sum(nil), checksumLength)); err != nil {
+		log.Fatalf("write checksum: %v", err)
+	}
+	return cOffset + uint64(checksumLength)
+}
+
+// sizedReader returns exactly n bytes from r, padding with zeros when r
+// ends early and dropping anything beyond n.
+type sizedReader struct {
+	r     io.Reader
+	n     int64
+	short bool
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	if sr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > sr.n {
+		p = p[:sr.n]
+	}
+	n, err := 0, error(nil)
+	if !sr.short {
+		n, err = sr.r.Read(p)
+		if err == io.EOF {
+			sr.short = true
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if sr.short && n == 0 {
+		clear(p)
+		n = len(p)
+	}
+	sr.n -= int64(n)
+	return n, nil
+}
+
+// changed reports whether the source didn't hold exactly n bytes.
+func (sr *sizedReader) changed() bool {
+	if sr.short {
+		return true
 	}
-	trailer.Write(sum[:checksumLength])
-	return trailer.Bytes()
+	var b [1]byte
+	n, _ := sr.r.Read(b[:])
+	return n > 0
+}
+
+func writeTrailer(files []FileEntry) []byte {
+	return encodeTrailer(files, features, checksumType, checksumLength)
 }
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// diffModeMask holds the mode bits compared between entries.
+const diffModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// diffSide is one side of a comparison.
+type diffSide struct {
+	name  string
+	dirs  map[string]FileEntry
+	files map[string]FileEntry
+	flags BitFlags
+	// anySum sides compute checksums of any type, others only hold
+	// sumType checksums of sumLen bytes, if hasSums is set.
+	anySum  bool
+	hasSums bool
+	sumType uint8
+	sumLen  uint8
+	// checksum returns the checksum of e's contents, nil when unknown.
+	checksum func(e *FileEntry, sumType, sumLen uint8) ([]byte, error)
+	close    func()
+}
+
+func newDiffSide(name string, flags BitFlags, dirs, files []FileEntry) *diffSide {
+	s := &diffSide{
+		name:  name,
+		dirs:  make(map[string]FileEntry),
+		files: make(map[string]FileEntry),
+		flags: flags,
+		close: func() {},
+	}
+	for _, d := range dirs {
+		if isSelected(d.Path) {
+			s.dirs[filepath.Clean(d.Path)] = d
+		}
+	}
+	for _, f := range files {
+		if isSelected(f.Path) {
+			s.files[filepath.Clean(f.Path)] = f
+		}
+	}
+	// Like goxa archives, only compare directories without entries
+	for _, m := range []map[string]FileEntry{s.dirs, s.files} {
+		for p := range m {
+			for parent := filepath.Dir(p); parent != p && parent != "."; p, parent = parent, filepath.Dir(parent) {
+				delete(s.dirs, parent)
+			}
+		}
+	}
+	return s
+}
+
+// diffArchive compares the archive at archivePath, in format, with the
+// directory dir it would be extracted to.
+func diffArchive(dir, format string) (*DiffReport, error) {
+	arc, err := loadDiffArchive(archivePath, format)
+	if err != nil {
+		return nil, err
+	}
+	defer arc.close()
+	if arc.flags.IsSet(fAbsolutePaths) && dir != "" {
+		return nil, fmt.Errorf("directory specified in conjunction with an absolute path archive")
+	}
+	if dir == "" {
+		dir = "."
+	}
+	target, err := loadDiffDir(dir, arc)
+	if err != nil {
+		return nil, err
+	}
+	if arc.flags.IsSet(fAbsolutePaths) {
+		dir = "/"
+	}
+	return diffSides(arc, target, dir)
+}
+
+// diffArchives compares the archive at archivePath, in format, with the
+// archive other. File contents are compared when both store checksums of
+// the same type, otherwise sizes, times and modes tell changes apart.
+func diffArchives(other, format string) (*DiffReport, error) {
+	a, err := loadDiffArchive(archivePath, format)
+	if err != nil {
+		return nil, err
+	}
+	defer a.close()
+
+	// The format globals describe the first archive, detect the other's
+	oldEncode, oldTarComp, oldFeatures := encode, tarComp, features
+	encode = ""
+	otherFormat, noComp := detectFormatFromExt(other)
+	if f, nc, ok := detectFormatFromHeader(other); ok {
+		otherFormat, noComp = f, nc
+	}
+	if noComp {
+		features.Set(fNoCompress)
+	} else {
+		features.Clear(fNoCompress)
+	}
+	b, err := loadDiffArchive(other, otherFormat)
+	encode, tarComp, features = oldEncode, oldTarComp, oldFeatures
+	if err != nil {
+		return nil, err
+	}
+	defer b.close()
+	return diffSides(a, b, other)
+}
+
+// isRegularFile reports whether path names an existing regular file.
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// loadDiffArchive reads the entries and, where stored, the checksums of
+// an archive.
+func loadDiffArchive(path, format string) (*diffSide, error) {
+	switch strings.ToLower(format) {
+	case "tar":
+		return loadDiffTar(path)
+	case "zip":
+		return loadDiffZip(path)
+	}
+	arc, hdr, done, err := readArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	s := newDiffSide(path, hdr.Flags, hdr.Dirs, hdr.Files)
+	s.close = done
+	if hdr.Flags.IsNotSet(fChecksums) {
+		return s, nil
+	}
+	s.hasSums, s.sumType, s.sumLen = true, hdr.SumType, hdr.SumLen
+	var mu sync.Mutex
+	s.checksum = func(e *FileEntry, _, _ uint8) ([]byte, error) {
+		if e.Offset == 0 {
+			if e.Size > 0 {
+				return nil, nil // not stored
+			}
+			return padSum(newHasher(hdr.SumType).Sum(nil), hdr.SumLen), nil
+		}
+		sum := make([]byte, hdr.SumLen)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := arc.ReadAt(sum, int64(e.SumOffset)); err != nil {
+			return nil, fmt.Errorf("unable to read checksum for %v: %w", e.Path, err)
+		}
+		return sum, nil
+	}
+	return s, nil
+}
+
+func loadDiffTar(path string) (*diffSide, error) {
+	r, _, closeSrc, err := openTarFile(path, tarComp, features.IsSet(fNoCompress))
+	if err != nil {
+		return nil, err
+	}
+	defer closeSrc()
+	var dirs, files []FileEntry
+	var flags BitFlags
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, isDir, f := tarEntry(hdr)
+		flags |= f
+		if isDir {
+			dirs = append(dirs, entry)
+		} else {
+			files = append(files, entry)
+		}
+	}
+	return newDiffSide(path, flags, dirs, files), nil
+}
+
+func loadDiffZip(path string) (*diffSide, error) {
+	src, err := zipConvertSource(path)
+	if err != nil {
+		return nil, err
+	}
+	as, err := openArchiveSource(path)
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	defer as.Close()
+	zr, err := zip.NewReader(as, as.Size())
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	crcs := make(map[string]uint32)
+	for _, f := range zr.File {
+		crcs[filepath.Clean(filepath.FromSlash(f.Name))] = f.CRC32
+	}
+	s := newDiffSide(path, src.flags, src.dirs, src.files)
+	s.close = src.close
+	s.hasSums, s.sumType, s.sumLen = true, sumCRC32, 4
+	s.checksum = func(e *FileEntry, _, _ uint8) ([]byte, error) {
+		crc, ok := crcs[filepath.Clean(e.Path)]
+		if !ok {
+			return nil, nil
+		}
+		return binary.BigEndian.AppendUint32(nil, crc), nil
+	}
+	return s, nil
+}
+
+// diffRoots returns the paths below dir to walk for comparison with arc:
+// the top level entries of a relative archive, or the deepest directory
+// holding every entry of an absolute one.
+func diffRoots(dir string, arc *diffSide) []string {
+	var paths []string
+	for p := range arc.dirs {
+		paths = append(paths, p)
+	}
+	for p := range arc.files {
+		paths = append(paths, p)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	if arc.flags.IsSet(fAbsolutePaths) {
+		common := paths[0]
+		for _, p := range paths[1:] {
+			for common != p && !strings.HasPrefix(p, common+string(os.PathSeparator)) {
+				parent := filepath.Dir(common)
+				if parent == common {
+					break
+				}
+				common = parent
+			}
+		}
+		return []string{common}
+	}
+	seen := make(map[string]bool)
+	var roots []string
+	for _, p := range paths {
+		top := strings.SplitN(p, string(os.PathSeparator), 2)[0]
+		if !seen[top] {
+			seen[top] = true
+			roots = append(roots, filepath.Join(dir, top))
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// loadDiffDir collects the entries below dir the way an archive with the
+// flags of arc would have stored them.
+func loadDiffDir(dir string, arc *diffSide) (*diffSide, error) {
+	var roots []string
+	for _, root := range diffRoots(dir, arc) {
+		if _, err := os.Lstat(root); err == nil {
+			roots = append(roots, root)
+		}
+	}
+	// Tar and zip archives don't record whether hidden files were included
+	flags := arc.flags
+	for _, m := range []map[string]FileEntry{arc.dirs, arc.files} {
+		for p := range m {
+			if strings.Contains(string(os.PathSeparator)+p, string(os.PathSeparator)+".") {
+				flags |= fIncludeInvis
+			}
+		}
+	}
+	oldFeatures := features
+	features = flags
+	dirs, files, err := walkPaths(roots)
+	features = oldFeatures
+	if err != nil {
+		return nil, err
+	}
+	s := newDiffSide(dir, arc.flags|fPermissions|fModDates, dirs, files)
+	s.anySum = true
+	s.checksum = func(e *FileEntry, sumType, sumLen uint8) ([]byte, error) {
+		f, err := os.Open(e.SrcPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := newHasher(sumType)
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		return padSum(h.Sum(nil), sumLen), nil
+	}
+	return s, nil
+}
+
+// diffSides compares the entries of a with those of b. Paths only in b
+// are reported as added, paths only in a as deleted.
+func diffSides(a, b *diffSide, target string) (*DiffReport, error) {
+	report := &DiffReport{Archive: a.name, Target: target, Entries: []DiffEntry{}}
+	paths := make(map[string]struct{})
+	for _, m := range []map[string]FileEntry{a.dirs, a.files, b.dirs, b.files} {
+		for p := range m {
+			paths[p] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	// Content checks read files, run them in parallel and collect below
+	var mu sync.Mutex
+	var firstErr error
+	contentChanged := make(map[string]bool)
+	wg := sizedwaitgroup.New(max(threads, 1))
+
+	for _, p := range sorted {
+		ad, aDir := a.dirs[p]
+		bd, bDir := b.dirs[p]
+		af, aFile := a.files[p]
+		bf, bFile := b.files[p]
+		switch {
+		case !aDir && !aFile:
+			report.Entries = append(report.Entries, DiffEntry{Path: p, Status: "added"})
+			continue
+		case !bDir && !bFile:
+			report.Entries = append(report.Entries, DiffEntry{Path: p, Status: "deleted"})
+			continue
+		}
+		var changes []string
+		switch {
+		case aDir != bDir:
+			changes = append(changes, "type")
+		case aDir:
+			changes = diffMetaChanges(a, b, ad, bd, false)
+		case af.Type != bf.Type:
+			changes = append(changes, "type")
+		default:
+			if af.Type == entryFile && af.Size != bf.Size {
+				changes = append(changes, "size")
+			}
+			if (af.Type == entrySymlink || af.Type == entryHardlink) && af.Linkname != bf.Linkname {
+				changes = append(changes, "link")
+			}
+			changes = append(changes, diffMetaChanges(a, b, af, bf, true)...)
+			if af.Type == entryFile && af.Size == bf.Size {
+				if sumType, sumLen, ok := diffSumType(a, b); ok {
+					wg.Add()
+					go func(p string, af, bf FileEntry) {
+						defer wg.Done()
+						differs, err := diffContent(a, b, &af, &bf, sumType, sumLen)
+						mu.Lock()
+						defer mu.Unlock()
+						if err != nil && firstErr == nil {
+							firstErr = err
+						}
+						if differs {
+							contentChanged[p] = true
+						}
+					}(p, af, bf)
+				}
+			}
+		}
+		report.Entries = append(report.Entries, DiffEntry{Path: p, Status: "modified", Changes: changes})
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	entries := report.Entries[:0]
+	for _, e := range report.Entries {
+		if contentChanged[e.Path] {
+			e.Changes = append(e.Changes, "content")
+		}
+		if e.Status == "modified" && len(e.Changes) == 0 {
+			continue
+		}
+		switch e.Status {
+		case "added":
+			report.Added++
+		case "deleted":
+			report.Deleted++
+		default:
+			report.Modified++
+		}
+		entries = append(entries, e)
+	}
+	report.Entries = slices.Clip(entries)
+	return report, nil
+}
+
+// diffMetaChanges compares the mode and, for files, the modification time
+// where both sides hold them.
+func diffMetaChanges(a, b *diffSide, ae, be FileEntry, withTime bool) []string {
+	var changes []string
+	both := a.flags & b.flags
+	if withTime && both.IsSet(fModDates) && ae.ModTime.Unix() != be.ModTime.Unix() {
+		changes = append(changes, "mtime")
+	}
+	if both.IsSet(fPermissions) && ae.Type != entrySymlink && ae.Mode&diffModeMask != be.Mode&diffModeMask {
+		changes = append(changes, "mode")
+	}
+	return changes
+}
+
+// diffSumType picks the checksum type both sides can provide.
+func diffSumType(a, b *diffSide) (uint8, uint8, bool) {
+	switch {
+	case a.anySum && b.anySum:
+		return sumBlake3, 32, true
+	case a.anySum:
+		return b.sumType, b.sumLen, b.hasSums
+	case b.anySum:
+		return a.sumType, a.sumLen, a.hasSums
+	}
+	return a.sumType, a.sumLen, a.hasSums && b.hasSums && a.sumType == b.sumType && a.sumLen == b.sumLen
+}
+
+// diffContent reports whether the contents of ae and be differ. Unknown
+// checksums count as unchanged.
+func diffContent(a, b *diffSide, ae, be *FileEntry, sumType, sumLen uint8) (bool, error) {
+	as, err := a.checksum(ae, sumType, sumLen)
+	if err != nil || as == nil {
+		return false, err
+	}
+	bs, err := b.checksum(be, sumType, sumLen)
+	if err != nil || bs == nil {
+		return false, err
+	}
+	return string(as) != string(bs), nil
+}
+
+// printDiff prints report as text or, with jsonOut, as JSON.
+func printDiff(report *DiffReport, jsonOut bool) {
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("json encode: %v", err)
+		}
+		return
+	}
+	for _, e := range report.Entries {
+		switch e.Status {
+		case "added":
+			fmt.Printf("A %v\n", e.Path)
+		case "deleted":
+			fmt.Printf("D %v\n", e.Path)
+		default:
+			fmt.Printf("M %v (%v)\n", e.Path, strings.Join(e.Changes, ", "))
+		}
+	}
+	if len(report.Entries) == 0 {
+		fmt.Println("No differences")
+		return
+	}
+	fmt.Printf("%v added, %v deleted, %v modified\n", report.Added, report.Deleted, report.Modified)
+}
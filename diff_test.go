@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func diffStatus(report *DiffReport) map[string]DiffEntry {
+	m := make(map[string]DiffEntry)
+	for _, e := range report.Entries {
+		m[e.Path] = e
+	}
+	return m
+}
+
+func TestDiffArchiveDir(t *testing.T) {
+	for _, ext := range []string{".goxa", ".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			setupTestTree(t, root)
+
+			protoVersion = protoVersion2
+			toStdOut = false
+			doForce = false
+			encode = ""
+			extractList = nil
+			compType = compZstd
+			tarComp = compGzip
+			configureChecksum("blake3")
+			features = fChecksums | fPermissions | fModDates | fIncludeInvis
+			archivePath = filepath.Join(tempDir, "test"+ext)
+			format := "goxa"
+			var err error
+			switch ext {
+			case ".tar.gz":
+				format = "tar"
+				err = createTar([]string{root})
+			case ".zip":
+				format = "zip"
+				err = createZip([]string{root})
+			default:
+				err = create([]string{root})
+			}
+			if err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+
+			report, err := diffArchive(tempDir, format)
+			if err != nil {
+				t.Fatalf("diff failed: %v", err)
+			}
+			if len(report.Entries) != 0 {
+				t.Fatalf("expected no differences, got %+v", report.Entries)
+			}
+
+			// Same size and time, different contents
+			f1 := filepath.Join(root, "dir1", "file1.txt")
+			st, _ := os.Stat(f1)
+			os.WriteFile(f1, []byte("FILE1"), 0o754)
+			os.Chtimes(f1, st.ModTime(), st.ModTime())
+			later := time.Now().Add(time.Hour)
+			os.WriteFile(filepath.Join(root, "dir2", "file2.txt"), []byte("longer file2"), 0o640)
+			os.Chtimes(filepath.Join(root, "dir2", "file2.txt"), later, later)
+			os.Chmod(filepath.Join(root, "rootfile.txt"), 0o600)
+			os.RemoveAll(filepath.Join(root, ".hiddendir"))
+			os.WriteFile(filepath.Join(root, "new.txt"), []byte("new"), 0o644)
+			os.Chtimes(filepath.Join(root, "dir1", ".hidden"), later, later)
+
+			report, err = diffArchive(tempDir, format)
+			if err != nil {
+				t.Fatalf("diff failed: %v", err)
+			}
+			got := diffStatus(report)
+			expect := map[string][]string{
+				"root/dir1/file1.txt": {"content"},
+				"root/dir2/file2.txt": {"size", "mtime"},
+				"root/rootfile.txt":   {"mode"},
+				"root/dir1/.hidden":   {"mtime"},
+			}
+			if ext == ".tar.gz" {
+				// tar archives hold no checksums
+				delete(expect, "root/dir1/file1.txt")
+			}
+			for p, changes := range expect {
+				e, ok := got[filepath.FromSlash(p)]
+				if !ok || e.Status != "modified" || !slices.Equal(e.Changes, changes) {
+					t.Fatalf("%v: got %+v, want %v", p, e, changes)
+				}
+			}
+			if got[filepath.FromSlash("root/.hiddendir/hfile.txt")].Status != "deleted" {
+				t.Fatalf("expected deleted file, got %+v", report.Entries)
+			}
+			if got[filepath.FromSlash("root/new.txt")].Status != "added" {
+				t.Fatalf("expected added file, got %+v", report.Entries)
+			}
+			if report.Added != 1 || report.Deleted != 1 || report.Modified != len(expect) {
+				t.Fatalf("unexpected counts: %+v", report)
+			}
+
+			extractList = []string{filepath.Join("root", "dir2")}
+			report, err = diffArchive(tempDir, format)
+			extractList = nil
+			if err != nil {
+				t.Fatalf("diff failed: %v", err)
+			}
+			if len(report.Entries) != 1 || report.Entries[0].Path != filepath.FromSlash("root/dir2/file2.txt") {
+				t.Fatalf("selection not applied: %+v", report.Entries)
+			}
+		})
+	}
+}
+
+func TestDiffArchives(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	setupTestTree(t, root)
+
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	extractList = nil
+	compType = compZstd
+	configureChecksum("blake3")
+	features = fChecksums | fModDates
+	archivePath = filepath.Join(tempDir, "v1.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// Same size and time, different contents
+	f1 := filepath.Join(root, "dir1", "file1.txt")
+	st, _ := os.Stat(f1)
+	os.WriteFile(f1, []byte("FILE1"), 0o754)
+	os.Chtimes(f1, st.ModTime(), st.ModTime())
+	os.Remove(filepath.Join(root, "rootfile.txt"))
+	os.WriteFile(filepath.Join(root, "dir2", "new.txt"), []byte("new"), 0o644)
+
+	for _, sum := range []string{"blake3", "crc32"} {
+		t.Run(sum, func(t *testing.T) {
+			configureChecksum(sum)
+			features = fChecksums | fModDates
+			archivePath = filepath.Join(tempDir, "v2-"+sum+".goxa")
+			if err := create([]string{root}); err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+			other := archivePath
+			archivePath = filepath.Join(tempDir, "v1.goxa")
+			report, err := diffArchives(other, "goxa")
+			if err != nil {
+				t.Fatalf("diff failed: %v", err)
+			}
+			got := diffStatus(report)
+			if got[filepath.FromSlash("root/rootfile.txt")].Status != "deleted" || got[filepath.FromSlash("root/dir2/new.txt")].Status != "added" {
+				t.Fatalf("unexpected report: %+v", report.Entries)
+			}
+			changed, ok := got[filepath.FromSlash("root/dir1/file1.txt")]
+			if sum == "blake3" && (!ok || !slices.Equal(changed.Changes, []string{"content"})) {
+				t.Fatalf("content change not found: %+v", report.Entries)
+			}
+			if sum == "crc32" && ok {
+				t.Fatalf("checksums of different types compared: %+v", changed)
+			}
+		})
+	}
+}
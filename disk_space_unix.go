@@ -9,7 +9,7 @@ func getDiskSpace(path string) (free uint64, total uint64, err error) {
 	if err = unix.Statfs(path, &stat); err != nil {
 		return
 	}
-	free = stat.Bavail * uint64(stat.Bsize)
-	total = stat.Blocks * uint64(stat.Bsize)
+	free = uint64(stat.Bavail) * uint64(stat.Bsize)
+	total = uint64(stat.Blocks) * uint64(stat.Bsize)
 	return
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventPeriod is how often byte counters are reported
+const eventPeriod = time.Second
+
+// eventLog writes progress events for -progress-json as newline-delimited
+// JSON, so other programs can follow a long job. Its methods do nothing on
+// a nil eventLog.
+type eventLog struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	enc   *json.Encoder
+	start time.Time
+	ended bool
+
+	files, warnings, mismatches atomic.Int64
+	bytes                       atomic.Uint64
+}
+
+// openEvents opens the event stream target, a file descriptor number or a
+// file name. Standard output is refused, as archives, listings and reports
+// are written there. Fatal log messages are sent as error events too.
+func openEvents(target string) (*eventLog, error) {
+	var w io.WriteCloser
+	if fd, err := strconv.Atoi(target); err == nil {
+		if fd < 1 {
+			return nil, fmt.Errorf("invalid file descriptor %v", fd)
+		}
+		if fd == 1 {
+			return nil, fmt.Errorf("events on stdout would mix with other output, use another descriptor such as 3")
+		}
+		w = os.NewFile(uintptr(fd), "fd"+target)
+	} else {
+		f, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	e := &eventLog{w: w, enc: json.NewEncoder(w), start: time.Now()}
+	log.SetOutput(io.MultiWriter(os.Stderr, eventErrors{e}))
+	return e, nil
+}
+
+func (e *eventLog) emit(ev ProgressEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ended {
+		return
+	}
+	ev.Time = time.Now()
+	e.enc.Encode(ev)
+}
+
+// begin reports the start of mode on archive.
+func (e *eventLog) begin(mode, archive string) {
+	e.emit(ProgressEvent{Event: "start", Mode: mode, Archive: archive})
+}
+
+// fileBegin reports that path of size bytes is being stored or extracted.
+func (e *eventLog) fileBegin(path string, size uint64) {
+	e.emit(ProgressEvent{Event: "file_begin", Path: path, Size: size})
+}
+
+// fileEnd reports a finished file and the result of its checksum:
+// stored, verified, mismatch or empty when it has none.
+func (e *eventLog) fileEnd(path string, size uint64, sum string) {
+	if e == nil {
+		return
+	}
+	e.files.Add(1)
+	e.bytes.Add(size)
+	if sum == "mismatch" {
+		e.mismatches.Add(1)
+	}
+	e.emit(ProgressEvent{Event: "file_end", Path: path, Size: size, Checksum: sum})
+}
+
+// fileSkipped reports a file left out of the archive or extraction.
+func (e *eventLog) fileSkipped(path string) {
+	e.emit(ProgressEvent{Event: "file_end", Path: path, Skipped: true})
+}
+
+// warn reports a problem the job continues past.
+func (e *eventLog) warn(path, format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	e.warnings.Add(1)
+	e.emit(ProgressEvent{Event: "warning", Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// counters reports the byte counters of p, at most once per eventPeriod
+// unless final.
+func (e *eventLog) counters(p *progressData, final bool) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	if !final && now.Sub(p.lastEvent) < eventPeriod {
+		return
+	}
+	p.lastEvent = now
+	file, _ := p.file.Load().(string)
+	e.emit(ProgressEvent{Event: "progress", Path: file, Current: p.current.Load(), Total: p.total, Written: p.written.Load()})
+}
+
+// finish reports the summary of the job ending with exit code code and
+// closes the stream.
+func (e *eventLog) finish(code int) {
+	if e == nil {
+		return
+	}
+	status := "ok"
+	if code != 0 {
+		status = "failed"
+	}
+	e.emit(ProgressEvent{
+		Event:      "summary",
+		Status:     status,
+		Files:      e.files.Load(),
+		Bytes:      e.bytes.Load(),
+		Warnings:   e.warnings.Load(),
+		Mismatches: e.mismatches.Load(),
+		Elapsed:    time.Since(e.start).Seconds(),
+	})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.ended {
+		e.ended = true
+		e.w.Close()
+	}
+}
+
+// eventErrors turns fatal log messages into an error event and a failed
+// summary before the program exits.
+type eventErrors struct {
+	e *eventLog
+}
+
+func (w eventErrors) Write(p []byte) (int, error) {
+	msg := string(p)
+	// Drop the date and time the standard logger puts first
+	if stamp := len("2006/01/02 15:04:05 "); log.Flags() == log.LstdFlags && len(msg) > stamp {
+		msg = msg[stamp:]
+	}
+	w.e.emit(ProgressEvent{Event: "error", Message: strings.TrimSpace(msg)})
+	w.e.finish(1)
+	return len(p), nil
+}
+
+// exitWith ends the event stream and exits with code.
+func exitWith(code int) {
+	events.finish(code)
+	os.Exit(code)
+}
+
+// modeName returns the name of the mode cmdLetter for events.
+func modeName(cmdLetter byte) string {
+	for word, letter := range wordModes {
+		if letter == cmdLetter {
+			return word
+		}
+	}
+	switch cmdLetter {
+	case 'c':
+		return "create"
+	case 'x':
+		return "extract"
+	case 'l':
+		return "list"
+	case 'j':
+		return "json-list"
+	case 'd':
+		return "diff"
+	}
+	return string(cmdLetter)
+}
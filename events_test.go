@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readEvents(t *testing.T, path string) []ProgressEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open events: %v", err)
+	}
+	defer f.Close()
+	var out []ProgressEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ev ProgressEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+func TestProgressEvents(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	files := map[string][]byte{"a.txt": []byte("hello"), "b.txt": make([]byte, 100<<10)}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	archivePath = filepath.Join(tempDir, "test.goxa")
+	features = fChecksums
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	defer func() {
+		events = nil
+		log.SetOutput(os.Stderr)
+	}()
+
+	// Standard output carries archives and listings
+	for _, fd := range []string{"0", "1"} {
+		if _, err := openEvents(fd); err == nil {
+			t.Fatalf("descriptor %v accepted", fd)
+		}
+	}
+
+	run := func(mode string, fn func()) []ProgressEvent {
+		path := filepath.Join(tempDir, mode+".ndjson")
+		e, err := openEvents(path)
+		if err != nil {
+			t.Fatalf("openEvents: %v", err)
+		}
+		events = e
+		events.begin(mode, archivePath)
+		fn()
+		events.finish(0)
+		events = nil
+		return readEvents(t, path)
+	}
+
+	check := func(evs []ProgressEvent, sum string, progress bool) {
+		if len(evs) < 2 || evs[0].Event != "start" || evs[len(evs)-1].Event != "summary" {
+			t.Fatalf("stream must run from start to summary: %+v", evs)
+		}
+		ends := map[string]ProgressEvent{}
+		begins, progressSeen := 0, false
+		for _, ev := range evs {
+			switch ev.Event {
+			case "file_begin":
+				begins++
+			case "file_end":
+				ends[filepath.Base(ev.Path)] = ev
+			case "progress":
+				progressSeen = true
+			}
+		}
+		if begins != len(files) || len(ends) != len(files) || progress && !progressSeen {
+			t.Fatalf("got %v begins, %v ends, progress %v", begins, len(ends), progressSeen)
+		}
+		for name, data := range files {
+			if e := ends[name]; e.Size != uint64(len(data)) || e.Checksum != sum {
+				t.Fatalf("%v: file_end %+v", name, e)
+			}
+		}
+		last := evs[len(evs)-1]
+		if last.Status != "ok" || last.Files != int64(len(files)) || last.Bytes != 5+100<<10 {
+			t.Fatalf("summary %+v", last)
+		}
+	}
+
+	check(run("create", func() {
+		if err := create([]string{root}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}), "stored", true)
+	check(run("extract", func() {
+		extract([]string{filepath.Join(tempDir, "out")}, false, false)
+	}), "verified", true)
+
+	// Other formats report their files the same way
+	archivePath = filepath.Join(tempDir, "test.tar")
+	features = 0
+	check(run("create", func() {
+		if err := createTar([]string{root}); err != nil {
+			t.Fatalf("create tar: %v", err)
+		}
+	}), "", false)
+	check(run("extract", func() {
+		if err := extractTar(filepath.Join(tempDir, "tar")); err != nil {
+			t.Fatalf("extract tar: %v", err)
+		}
+	}), "", false)
+	archivePath = filepath.Join(tempDir, "test.zip")
+	check(run("create", func() {
+		if err := createZip([]string{root}); err != nil {
+			t.Fatalf("create zip: %v", err)
+		}
+	}), "stored", true)
+	check(run("extract", func() {
+		if err := extractZip(filepath.Join(tempDir, "zip")); err != nil {
+			t.Fatalf("extract zip: %v", err)
+		}
+	}), "verified", true)
+}
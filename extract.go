@@ -3,17 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	gzip "github.com/klauspost/pgzip"
+	"hash"
 	"io"
-	"io/fs"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -66,6 +67,30 @@ func decompressor(r io.Reader, cType uint8) (io.ReadCloser, error) {
 
 var skippedFiles, checksumCount atomic.Int64
 
+// extractRepair is set while recovery volumes could still rebuild the
+// archive being extracted. Files whose data fails to decode or verify are
+// collected in it instead of failing, and extracted again from the
+// rebuilt copy.
+var extractRepair *repairQueue
+
+type repairQueue struct {
+	mu    sync.Mutex
+	items []*FileEntry
+}
+
+// deferRepair queues item to be extracted again from the rebuilt archive
+// and reports whether it was queued.
+func deferRepair(item *FileEntry) bool {
+	q := extractRepair
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+	return true
+}
+
 func isZipBomb(f *FileEntry) (uint64, float64, bool) {
 	if len(f.Blocks) == 0 {
 		return 0, 0, false
@@ -131,45 +156,42 @@ func entryName(t uint8) string {
 }
 
 func extract(destinations []string, listOnly bool, jsonList bool) {
-
-	var destination string
-	//Clean destination
-	if len(destinations) > 0 {
-		destination = path.Clean(destinations[0]) + "/"
-
-		if destination != "" {
-			os.Mkdir(destination, os.ModePerm)
+	destination := extractDestination(destinations)
+
+	if archivePath == "-" {
+		// FEC in stripes and armored text decode front to back, so they
+		// can be piped in too
+		in := bufio.NewReaderSize(os.Stdin, readBuffer)
+		var r io.Reader = in
+		var fr *fecStripeReader
+		if head, _ := in.Peek(armorMaxLine); isArmored(head) {
+			r = newArmorReader(in)
+		} else if magic, _ := in.Peek(len(fecMagicStriped)); string(magic) == fecMagicStriped {
+			var err error
+			if fr, err = newFECStripeReader(in); err != nil {
+				log.Fatalf("extract: %v", err)
+			}
+			r = fr
+		}
+		extractStream(r, destination, listOnly, jsonList)
+		if fr != nil && fr.damage.String() != "none" {
+			doLog(false, "FEC: rebuilt damaged stripes in %v", fr.damage)
 		}
-	} else { //use pwd if none specified
-		pwd, _ := os.Getwd()
-		pwd = path.Clean(pwd)
-
-		archiveName := path.Base(archivePath)
-		archiveName = stripArchiveExt(archiveName)
-		destination = path.Clean(pwd + "/" + archiveName + "/")
+		return
 	}
 
 	//Create reader
-	arcPath := archivePath
-	cleanup := func() {}
-	if encode != "" {
-		var err error
-		if encode == "fec" {
-			arcPath, cleanup, err = decodeWithFEC(archivePath)
-		} else {
-			arcPath, cleanup, err = decodeIfNeeded(archivePath)
-		}
-		if err != nil {
-			log.Fatalf("extract: decode failed: %v", err)
-		}
-		defer cleanup()
+	arcPath, cleanup, err := useRecovery(archivePath, false)
+	if err != nil {
+		log.Fatalf("extract: recovery volumes: %v", err)
 	}
-	arc, err := NewBinReader(arcPath)
+	defer cleanup()
+	src, err := openEncoded(arcPath)
 	if err != nil {
 		log.Fatalf("extract: Could not open the archive file: %v", err)
 	}
+	arc := newBinReader(src)
 	defer arc.Close()
-	arcFile := arc.file
 	doLog(false, "Opening archive: %v", archivePath)
 	if !listOnly {
 		doLog(false, "Destination: %v", path.Clean(destination))
@@ -188,211 +210,248 @@ func extract(destinations []string, listOnly bool, jsonList bool) {
 	}()
 
 	//Read header
-	readMagic := make([]byte, 4)
-	if err := binary.Read(arc, binary.LittleEndian, &readMagic); err != nil {
-		log.Fatalf("extract: failed to read magic: %v", err)
+	hdr, err := loadHeader(arc)
+	if err != nil {
+		log.Fatalf("extract: %v", err)
 	}
-	if string(readMagic) != magic {
-		log.Fatal("extract: File does not appear to be a goxa archive")
+	useArchiveHeader(hdr)
+	if uint64(arc.Size()) != hdr.ArcSize {
+		log.Fatalf("extract: archive size mismatch")
 	}
 
-	var readVersion uint16
-	if err := binary.Read(arc, binary.LittleEndian, &readVersion); err != nil {
-		log.Fatalf("extract: failed to read version: %v", err)
-	}
-	if readVersion != protoVersion2 {
-		log.Fatalf("extract: Archive is of an unsupported version: %v", readVersion)
+	if listOnly {
+		close(headerDone)
+		listArchive(hdr, jsonList)
+		return
 	}
 
-	var lfeat BitFlags
-	if err := binary.Read(arc, binary.LittleEndian, &lfeat); err != nil {
-		log.Fatalf("extract: failed to read feature flags: %v", err)
+	if !hdr.Verify() {
+		log.Fatalf("extract: header checksum mismatch")
+	}
+	if err := loadTrailer(arc, hdr); err != nil {
+		log.Fatalf("extract: %v", err)
 	}
-	showFeatures(lfeat)
 
-	ctype := compGzip
-	if readVersion >= protoVersion2 {
-		if err := binary.Read(arc, binary.LittleEndian, &ctype); err != nil {
-			log.Fatalf("extract: failed to read compression type: %v", err)
-		}
-		if err := binary.Read(arc, binary.LittleEndian, &checksumType); err != nil {
-			log.Fatalf("extract: failed to read checksum type: %v", err)
-		}
-		if err := binary.Read(arc, binary.LittleEndian, &checksumLength); err != nil {
-			log.Fatalf("extract: failed to read checksum length: %v", err)
+	close(headerDone)
+	lfeat, ctype := hdr.Flags, hdr.CompType
+	fileList := hdr.Files
+	doLog(false, "Read index: %v files.", len(fileList))
+
+	var totalBytes int64
+	selectedFiles := 0
+	for _, entry := range fileList {
+		if !isSelected(entry.Path) {
+			continue
 		}
+		selectedFiles++
+		totalBytes += int64(entry.Size)
 	}
 
-	if useArchiveFlags {
-		features |= lfeat
-	} else {
-		missing := ""
-		missingFlags := BitFlags(0)
-		if lfeat.IsSet(fPermissions) && features.IsNotSet(fPermissions) {
-			missing += "p"
-			missingFlags |= fPermissions
-		}
-		if lfeat.IsSet(fModDates) && features.IsNotSet(fModDates) {
-			missing += "m"
-			missingFlags |= fModDates
-		}
-		if lfeat.IsSet(fSpecialFiles) && features.IsNotSet(fSpecialFiles) {
-			missing += "o"
-			missingFlags |= fSpecialFiles
-		}
-		if lfeat.IsSet(fIncludeInvis) && features.IsNotSet(fIncludeInvis) {
-			missing += "i"
-			missingFlags |= fIncludeInvis
-		}
-		if missing != "" {
-			if interactiveMode {
-				fmt.Printf("Archive uses flags '%s'. Enable which? (letters or 'u'=all) [none]: ", missing)
-				reader := bufio.NewReader(os.Stdin)
-				resp, _ := reader.ReadString('\n')
-				resp = strings.TrimSpace(strings.ToLower(resp))
-				if resp == "u" {
-					features |= missingFlags
-				} else {
-					for _, r := range resp {
-						switch r {
-						case 'p':
-							if missingFlags.IsSet(fPermissions) {
-								features.Set(fPermissions)
-							}
-						case 'm':
-							if missingFlags.IsSet(fModDates) {
-								features.Set(fModDates)
-							}
-						case 'o':
-							if missingFlags.IsSet(fSpecialFiles) {
-								features.Set(fSpecialFiles)
-							}
-						case 'i':
-							if missingFlags.IsSet(fIncludeInvis) {
-								features.Set(fIncludeInvis)
-							}
-						}
-					}
-				}
-			} else {
-				doLog(false, "Archive uses flags '%s'.", missing)
-			}
-		}
+	if spaceCheck {
+		checkFreeSpace(destination, uint64(totalBytes))
 	}
 
-	var blkSize uint32 = blockSize
-	var trailerOffset uint64
-	var arcSize uint64
-	if readVersion >= protoVersion2 {
-		if err := binary.Read(arc, binary.LittleEndian, &blkSize); err != nil {
-			log.Fatalf("extract: failed to read block size: %v", err)
+	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	startLinkGuard(destination)
+	openExtractRoot(destination, lfeat)
+	defer closeExtractRoot()
+	makeEmptyDirs(destination, hdr)
+
+	// The index passed its checks, damaged file data shows up below
+	if arcPath == archivePath && hasRecovery(archivePath) {
+		extractRepair = &repairQueue{}
+		defer func() { extractRepair = nil }()
+	}
+	if lfeat.IsNotSet(fNoCompress) {
+		if threads < 1 {
+			threads = 1
 		}
-		if err := binary.Read(arc, binary.LittleEndian, &trailerOffset); err != nil {
-			log.Fatalf("extract: failed to read trailer offset: %v", err)
+		wg := sizedwaitgroup.New(threads)
+		for f := range fileList {
+			if !isSelected(fileList[f].Path) || isLinkEntry(&fileList[f]) {
+				continue
+			}
+			wg.Add()
+			go func(item *FileEntry) {
+				defer wg.Done()
+				_ = extractFile(arc, destination, lfeat, ctype, item, p)
+			}(&fileList[f])
 		}
-		blockSize = blkSize
-	}
-	if readVersion >= protoVersion2 {
-		if err := binary.Read(arc, binary.LittleEndian, &arcSize); err != nil {
-			log.Fatalf("extract: failed to read archive size: %v", err)
+		wg.Wait()
+	} else {
+		for f := range fileList {
+			if !isSelected(fileList[f].Path) || isLinkEntry(&fileList[f]) {
+				continue
+			}
+			_ = extractFile(arc, destination, lfeat, ctype, &fileList[f], p)
 		}
-		info, _ := arc.file.Stat()
-		if uint64(info.Size()) != arcSize {
-			log.Fatalf("extract: archive size mismatch")
+	}
+	if extractRepair != nil {
+		damaged := extractRepair.items
+		extractRepair = nil
+		if len(damaged) > 0 {
+			repairExtract(damaged, destination, lfeat, ctype, p)
 		}
 	}
 
-	//Empty Directories
-	var numEmptyDirs uint64
-	if err := binary.Read(arc, binary.LittleEndian, &numEmptyDirs); err != nil {
-		log.Fatalf("extract: failed to read empty directory count: %v", err)
+	// Links come last: no file is written through a symlink from the
+	// archive and hardlink targets already exist
+	for f := range fileList {
+		if !isSelected(fileList[f].Path) || !isLinkEntry(&fileList[f]) {
+			continue
+		}
+		_ = extractFile(arc, destination, lfeat, ctype, &fileList[f], p)
 	}
 
-	dirList := make([]FileEntry, numEmptyDirs)
-	for n := uint64(0); n < numEmptyDirs; n++ {
-		var fileMode uint32
-		var modTime int64
-		if lfeat.IsSet(fPermissions) {
-			if err := binary.Read(arc, binary.LittleEndian, &fileMode); err != nil {
-				log.Fatalf("extract: failed to read directory mode: %v", err)
-			}
-		}
-		if lfeat.IsSet(fModDates) {
-			if err := binary.Read(arc, binary.LittleEndian, &modTime); err != nil {
-				log.Fatalf("extract: failed to read directory mod time: %v", err)
-			}
-		}
+	if lfeat.IsSet(fChecksums) && int(checksumCount.Load()) == selectedFiles-int(skippedFiles.Load()) {
+		doLog(false, "All checksums verified.")
+	}
+}
 
-		pathName, err := ReadLPString(arc)
-		if err != nil {
-			log.Fatalf("extract: failed to read directory path: %v", err)
-		}
+// repairExtract rebuilds the archive from its recovery volumes and
+// extracts the damaged files again from the rebuilt copy.
+func repairExtract(damaged []*FileEntry, destination string, lfeat BitFlags, ctype uint8, p *progressData) {
+	doLog(false, "\n%v files failed their checks, rebuilding the archive from its recovery volumes", len(damaged))
+	events.warn("", "%v files failed their checks, rebuilding the archive from its recovery volumes", len(damaged))
+	arcPath, cleanup, err := useRecovery(archivePath, true)
+	if err != nil {
+		log.Fatalf("extract: recovery volumes: %v", err)
+	}
+	defer cleanup()
+	src, err := openEncoded(arcPath)
+	if err != nil {
+		log.Fatalf("extract: Could not open the rebuilt archive: %v", err)
+	}
+	arc := newBinReader(src)
+	defer arc.Close()
+	for _, item := range damaged {
+		_ = extractFile(arc, destination, lfeat, ctype, item, p)
+	}
+}
 
-		newDirEntry := FileEntry{Path: pathName, Mode: os.FileMode(fileMode), ModTime: time.Unix(modTime, 0).UTC()}
-		dirList[n] = newDirEntry
+// extractDestination returns the extraction directory, creating a
+// requested one or deriving it from the archive name.
+func extractDestination(destinations []string) string {
+	//Clean destination
+	if len(destinations) > 0 {
+		destination := path.Clean(destinations[0]) + "/"
+		os.Mkdir(destination, os.ModePerm)
+		return destination
 	}
 
-	//Files
-	var numFiles uint64
-	if err := binary.Read(arc, binary.LittleEndian, &numFiles); err != nil {
-		log.Fatalf("extract: failed to read file count: %v", err)
+	//use pwd if none specified
+	pwd, _ := os.Getwd()
+	pwd = path.Clean(pwd)
+
+	archiveName := path.Base(archivePath)
+	if isURL(archivePath) {
+		archiveName = urlBaseName(archivePath)
+	} else if archivePath == "-" {
+		archiveName = "stdin"
 	}
+	archiveName = stripArchiveExt(archiveName)
+	return path.Clean(pwd + "/" + archiveName + "/")
+}
 
-	fileList := make([]FileEntry, numFiles)
-	for n := uint64(0); n < numFiles; n++ {
-		var fileSize uint64
-		var fileMode uint32
-		var modTime int64
+// useArchiveHeader applies the settings stored in an archive header and
+// asks about any archive flags the user didn't request.
+func useArchiveHeader(hdr *ArchiveHeader) {
+	lfeat := hdr.Flags
+	showFeatures(lfeat)
+	checksumType = hdr.SumType
+	checksumLength = hdr.SumLen
+	blockSize = hdr.BlockSize
 
-		if err := binary.Read(arc, binary.LittleEndian, &fileSize); err != nil {
-			log.Fatalf("extract: failed to read file size: %v", err)
-		}
-		if lfeat&fPermissions != 0 {
-			if err := binary.Read(arc, binary.LittleEndian, &fileMode); err != nil {
-				log.Fatalf("extract: failed to read file mode: %v", err)
+	if useArchiveFlags {
+		features |= lfeat
+		return
+	}
+	missing := ""
+	missingFlags := BitFlags(0)
+	if lfeat.IsSet(fPermissions) && features.IsNotSet(fPermissions) {
+		missing += "p"
+		missingFlags |= fPermissions
+	}
+	if lfeat.IsSet(fModDates) && features.IsNotSet(fModDates) {
+		missing += "m"
+		missingFlags |= fModDates
+	}
+	if lfeat.IsSet(fSpecialFiles) && features.IsNotSet(fSpecialFiles) {
+		missing += "o"
+		missingFlags |= fSpecialFiles
+	}
+	if lfeat.IsSet(fIncludeInvis) && features.IsNotSet(fIncludeInvis) {
+		missing += "i"
+		missingFlags |= fIncludeInvis
+	}
+	if missing == "" {
+		return
+	}
+	if !interactiveMode {
+		doLog(false, "Archive uses flags '%s'.", missing)
+		return
+	}
+	fmt.Printf("Archive uses flags '%s'. Enable which? (letters or 'u'=all) [none]: ", missing)
+	reader := bufio.NewReader(os.Stdin)
+	resp, _ := reader.ReadString('\n')
+	resp = strings.TrimSpace(strings.ToLower(resp))
+	if resp == "u" {
+		features |= missingFlags
+		return
+	}
+	for _, r := range resp {
+		switch r {
+		case 'p':
+			if missingFlags.IsSet(fPermissions) {
+				features.Set(fPermissions)
 			}
-		}
-		if lfeat&fModDates != 0 {
-			if err := binary.Read(arc, binary.LittleEndian, &modTime); err != nil {
-				log.Fatalf("extract: failed to read file mod time: %v", err)
+		case 'm':
+			if missingFlags.IsSet(fModDates) {
+				features.Set(fModDates)
 			}
-		}
-
-		pathName, err := ReadLPString(arc)
-		if err != nil {
-			log.Fatalf("extract: failed to read file path: %v", err)
-		}
-		var ftype uint8
-		if err := binary.Read(arc, binary.LittleEndian, &ftype); err != nil {
-			log.Fatalf("extract: failed to read file type: %v", err)
-		}
-		var linkName string
-		if ftype == entrySymlink || ftype == entryHardlink {
-			linkName, err = ReadLPString(arc)
-			if err != nil {
-				log.Fatalf("extract: failed to read link target: %v", err)
+		case 'o':
+			if missingFlags.IsSet(fSpecialFiles) {
+				features.Set(fSpecialFiles)
 			}
-		}
-		var changedFlag uint8
-		if readVersion >= protoVersion2 {
-			if err := binary.Read(arc, binary.LittleEndian, &changedFlag); err != nil {
-				log.Fatalf("extract: failed to read changed flag: %v", err)
+		case 'i':
+			if missingFlags.IsSet(fIncludeInvis) {
+				features.Set(fIncludeInvis)
 			}
 		}
-
-		newEntry := FileEntry{Path: pathName, Size: fileSize, Mode: fs.FileMode(fileMode), ModTime: time.Unix(modTime, 0).UTC(), Type: ftype, Linkname: linkName, Changed: changedFlag != 0}
-		fileList[n] = newEntry
 	}
+}
 
-	if listOnly && !jsonList {
+// listArchive prints the selected entries of hdr, either as plain text or
+// as a JSON document.
+func listArchive(hdr *ArchiveHeader, jsonList bool) {
+	printListing(ArchiveListingOut{
+		Version:        hdr.Version,
+		Flags:          flagNamesList(hdr.Flags),
+		Compression:    compName(hdr.CompType),
+		Checksum:       checksumName(hdr.SumType),
+		ChecksumLength: hdr.SumLen,
+		BlockSize:      hdr.BlockSize,
+		ArchiveSize:    hdr.ArcSize,
+	}, hdr.Dirs, hdr.Files, jsonList)
+}
+
+// printListing prints the selected entries as plain text or, with
+// jsonList, as out filled with the entries.
+func printListing(out ArchiveListingOut, dirs, files []FileEntry, jsonList bool) {
+	if !jsonList {
 		fileCount := 0
 		byteCount := 0
-		for _, item := range dirList {
+		for _, item := range dirs {
 			if isSelected(item.Path) {
 				fmt.Printf("%v\n", item.Path)
 			}
 		}
-		for _, item := range fileList {
+		for _, item := range files {
 			if !isSelected(item.Path) {
 				continue
 			}
@@ -401,146 +460,58 @@ func extract(destinations []string, listOnly bool, jsonList bool) {
 			fmt.Printf("%v\n", item.Path)
 		}
 		fmt.Printf("%v files, %v\n", fileCount, humanize.Bytes(uint64(byteCount)))
-
 		return
 	}
 
-	if jsonList {
-		out := ArchiveListingOut{
-			Version:        readVersion,
-			Flags:          flagNamesList(lfeat),
-			Compression:    compName(ctype),
-			Checksum:       checksumName(checksumType),
-			ChecksumLength: checksumLength,
-			BlockSize:      blockSize,
-			ArchiveSize:    arcSize,
-		}
-		for _, item := range dirList {
-			if isSelected(item.Path) {
-				out.Dirs = append(out.Dirs, ListEntryOut{
-					Path:    item.Path,
-					Type:    "dir",
-					Mode:    item.Mode,
-					ModTime: item.ModTime.Unix(),
-				})
-			}
-		}
-		for _, item := range fileList {
-			if !isSelected(item.Path) {
-				continue
-			}
-			out.Files = append(out.Files, ListEntryOut{
-				Path:     item.Path,
-				Type:     entryName(item.Type),
-				Size:     item.Size,
-				Mode:     item.Mode,
-				ModTime:  item.ModTime.Unix(),
-				Linkname: item.Linkname,
+	for _, item := range dirs {
+		if isSelected(item.Path) {
+			out.Dirs = append(out.Dirs, ListEntryOut{
+				Path:    item.Path,
+				Type:    "dir",
+				Mode:    item.Mode,
+				ModTime: item.ModTime.Unix(),
 			})
 		}
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		if err := enc.Encode(out); err != nil {
-			log.Fatalf("json encode: %v", err)
-		}
-		return
-	}
-
-	if readVersion >= protoVersion2 {
-		hdrSum := make([]byte, checksumLength)
-		if _, err := io.ReadFull(arc, hdrSum); err != nil {
-			log.Fatalf("extract: failed to read header checksum: %v", err)
-		}
-		var hdrBytes []byte
-		hdrBytes = writeHeader(dirList, fileList, trailerOffset, arcSize, lfeat, ctype)
-		expect := hdrBytes[len(hdrBytes)-int(checksumLength):]
-		if !bytes.Equal(expect, hdrSum) {
-			log.Fatalf("extract: header checksum mismatch")
-		}
-
-		if _, err := arc.Seek(int64(trailerOffset), io.SeekStart); err != nil {
-			log.Fatalf("extract: seek trailer: %v", err)
-		}
-		for i := range fileList {
-			var count uint32
-			if err := binary.Read(arc, binary.LittleEndian, &count); err != nil {
-				log.Fatalf("extract: read block count: %v", err)
-			}
-			blocks := make([]Block, count)
-			for b := uint32(0); b < count; b++ {
-				if err := binary.Read(arc, binary.LittleEndian, &blocks[b].Offset); err != nil {
-					log.Fatalf("extract: read block offset: %v", err)
-				}
-				if err := binary.Read(arc, binary.LittleEndian, &blocks[b].Size); err != nil {
-					log.Fatalf("extract: read block size: %v", err)
-				}
-			}
-			fileList[i].Blocks = blocks
-			if len(blocks) > 0 {
-				off := blocks[0].Offset
-				if lfeat.IsSet(fChecksums) {
-					off -= uint64(checksumLength)
-				}
-				fileList[i].Offset = off
-			}
-		}
-		tSum := make([]byte, checksumLength)
-		if _, err := io.ReadFull(arc, tSum); err != nil {
-			log.Fatalf("extract: read trailer checksum: %v", err)
-		}
-		trailerBytes := writeTrailer(fileList)
-		expectT := trailerBytes[len(trailerBytes)-int(checksumLength):]
-		if !bytes.Equal(expectT, tSum) {
-			log.Fatalf("extract: trailer checksum mismatch")
-		}
 	}
-
-	close(headerDone)
-	doLog(false, "Read index: %v files.", len(fileList))
-
-	var totalBytes int64
-	selectedFiles := 0
-	for _, entry := range fileList {
-		if !isSelected(entry.Path) {
+	for _, item := range files {
+		if !isSelected(item.Path) {
 			continue
 		}
-		selectedFiles++
-		totalBytes += int64(entry.Size)
+		out.Files = append(out.Files, ListEntryOut{
+			Path:     item.Path,
+			Type:     entryName(item.Type),
+			Size:     item.Size,
+			Mode:     item.Mode,
+			ModTime:  item.ModTime.Unix(),
+			Linkname: item.Linkname,
+		})
 	}
-
-	if spaceCheck && !listOnly {
-		free, total, err := getDiskSpace(destination)
-		if err != nil {
-			doLog(false, "warning: free space check failed: %v", err)
-		} else {
-			need := uint64(totalBytes)
-			if need > free {
-				log.Fatalf("extract: insufficient disk space: need %v, available %v", humanize.Bytes(need), humanize.Bytes(free))
-			}
-			if free-need < total/100 {
-				msg := fmt.Sprintf("extract would leave %v free", humanize.Bytes(free-need))
-				if interactiveMode {
-					fmt.Printf("%s. Continue? [y/N]: ", msg)
-					reader := bufio.NewReader(os.Stdin)
-					resp, _ := reader.ReadString('\n')
-					resp = strings.TrimSpace(strings.ToLower(resp))
-					if resp != "y" && resp != "yes" {
-						log.Fatalf("aborted: %s", msg)
-					}
-				} else {
-					log.Fatalf("%s", msg)
-				}
-			}
-		}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatalf("json encode: %v", err)
 	}
+}
 
-	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
-	defer func() {
-		close(done)
-		<-finished
-	}()
+// checkFreeSpace makes sure destination has room for need bytes.
+func checkFreeSpace(destination string, need uint64) {
+	free, total, err := getDiskSpace(destination)
+	if err != nil {
+		doLog(false, "warning: free space check failed: %v", err)
+		return
+	}
+	if need > free {
+		log.Fatalf("extract: insufficient disk space: need %v, available %v", humanize.Bytes(need), humanize.Bytes(free))
+	}
+	if free-need < total/100 {
+		confirmOrAbort(fmt.Sprintf("extract would leave %v free", humanize.Bytes(free-need)))
+	}
+}
 
-	for _, item := range dirList {
+// makeEmptyDirs creates the selected empty directories of hdr.
+func makeEmptyDirs(destination string, hdr *ArchiveHeader) {
+	lfeat := hdr.Flags
+	for _, item := range hdr.Dirs {
 		if !isSelected(item.Path) {
 			continue
 		}
@@ -562,7 +533,7 @@ func extract(destinations []string, listOnly bool, jsonList bool) {
 				log.Fatalf("extract: invalid path %v", item.Path)
 			}
 		}
-		if err := os.MkdirAll(dirPath, perms); err != nil {
+		if err := extractRoot.MkdirAll(dirPath, perms); err != nil {
 			if doForce {
 				doLog(false, "unable to create directory %v: %v", dirPath, err)
 				continue
@@ -570,37 +541,20 @@ func extract(destinations []string, listOnly bool, jsonList bool) {
 			log.Fatalf("extract: unable to create directory %v: %v", dirPath, err)
 		}
 		if lfeat.IsSet(fModDates) {
-			os.Chtimes(dirPath, item.ModTime, item.ModTime)
+			extractRoot.Chtimes(dirPath, item.ModTime, item.ModTime)
 		}
 	}
+}
 
-	if lfeat.IsNotSet(fNoCompress) {
-		if threads < 1 {
-			threads = 1
-		}
-		wg := sizedwaitgroup.New(threads)
-		for f := range fileList {
-			if !isSelected(fileList[f].Path) {
-				continue
-			}
-			wg.Add()
-			go func(item *FileEntry) {
-				defer wg.Done()
-				_ = extractFile(arcFile, destination, lfeat, ctype, item, p)
-			}(&fileList[f])
-		}
-		wg.Wait()
-	} else {
-		for f := range fileList {
-			if !isSelected(fileList[f].Path) {
-				continue
-			}
-			_ = extractFile(arcFile, destination, lfeat, ctype, &fileList[f], p)
-		}
+// checkZipBomb asks before extracting a file with an extreme
+// compression ratio.
+func checkZipBomb(item *FileEntry) {
+	if !bombCheck {
+		return
 	}
-
-	if lfeat.IsSet(fChecksums) && int(checksumCount.Load()) == selectedFiles-int(skippedFiles.Load()) {
-		doLog(false, "All checksums verified.")
+	compSize, ratio, bomb := isZipBomb(item)
+	if bomb {
+		confirmOrAbort(fmt.Sprintf("potential zip bomb: %s expands from %v to %v (x%.0f)", item.Path, humanize.Bytes(compSize), humanize.Bytes(item.Size), ratio))
 	}
 }
 
@@ -609,36 +563,7 @@ func extractFile(arc io.ReaderAt, destination string, lfeat BitFlags, ctype uint
 		return nil
 	}
 	if item.Type == entrySymlink || item.Type == entryHardlink {
-		var err error
-		var finalPath string
-		if lfeat.IsSet(fAbsolutePaths) {
-			finalPath = filepath.Clean(item.Path)
-		} else {
-			finalPath, err = safeJoin(destination, item.Path)
-			if err != nil {
-				if doForce {
-					doLog(false, "invalid path: %v", item.Path)
-					skippedFiles.Add(1)
-					return nil
-				}
-				log.Fatalf("invalid path: %v", item.Path)
-			}
-		}
-		if err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm); err != nil {
-			if doForce {
-				doLog(false, "unable to create directory %v: %v", filepath.Dir(finalPath), err)
-				skippedFiles.Add(1)
-				return nil
-			}
-			log.Fatalf("extract: unable to create directory %v: %v", filepath.Dir(finalPath), err)
-		}
-		if doForce {
-			os.RemoveAll(finalPath)
-		}
-		if item.Type == entrySymlink {
-			return os.Symlink(item.Linkname, finalPath)
-		}
-		return os.Link(item.Linkname, finalPath)
+		return extractLink(destination, lfeat, item)
 	}
 	if item.Offset == 0 {
 		skippedFiles.Add(1)
@@ -646,72 +571,12 @@ func extractFile(arc io.ReaderAt, destination string, lfeat BitFlags, ctype uint
 	}
 	if item.Changed {
 		doLog(false, "warning: %v changed during archiving", item.Path)
+		events.warn(item.Path, "changed during archiving")
 	}
-	if bombCheck {
-		compSize, ratio, bomb := isZipBomb(item)
-		if bomb {
-			msg := fmt.Sprintf("potential zip bomb: %s expands from %v to %v (x%.0f)", item.Path, humanize.Bytes(compSize), humanize.Bytes(item.Size), ratio)
-			if interactiveMode {
-				fmt.Printf("%s. Continue? [y/N]: ", msg)
-				reader := bufio.NewReader(os.Stdin)
-				resp, _ := reader.ReadString('\n')
-				resp = strings.TrimSpace(strings.ToLower(resp))
-				if resp != "y" && resp != "yes" {
-					log.Fatalf("aborted: %s", msg)
-				}
-			} else {
-				log.Fatalf("%s", msg)
-			}
-		}
-	}
-	var err error
-	var finalPath string
-	if lfeat.IsSet(fAbsolutePaths) {
-		finalPath = filepath.Clean(item.Path)
-	} else {
-		finalPath, err = safeJoin(destination, item.Path)
-		if err != nil {
-			if doForce {
-				doLog(false, "invalid path: %v", item.Path)
-				skippedFiles.Add(1)
-				return nil
-			}
-			log.Fatalf("invalid path: %v", item.Path)
-		}
-	}
-
-	//Make directories
-	dir := filepath.Dir(finalPath)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		if doForce {
-			doLog(false, "unable to create directory %v: %v", dir, err)
-			skippedFiles.Add(1)
-			return nil
-		}
-		log.Fatalf("extract: unable to create directory %v: %v", dir, err)
-	}
-
-	//Set file perms, if needed
-	filePerm := os.FileMode(0644)
-	if lfeat.IsSet(fPermissions) {
-		filePerm = os.FileMode(item.Mode)
-	}
+	checkZipBomb(item)
 
-	//Open file
-	var newFile *os.File
-	if doForce {
-		exists, _ := fileExists(finalPath)
-		if exists {
-			os.Chmod(finalPath, 0644)
-		}
-		newFile, err = os.OpenFile(finalPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		if exists {
-			os.Chmod(finalPath, filePerm)
-		}
-	} else {
-		newFile, err = os.OpenFile(finalPath, os.O_CREATE|os.O_WRONLY, filePerm)
-	}
-	if err != nil {
+	newFile, finalPath, err := openExtractFile(destination, lfeat, item)
+	if err != nil || newFile == nil {
 		return err
 	}
 
@@ -726,6 +591,7 @@ func extractFile(arc io.ReaderAt, destination string, lfeat BitFlags, ctype uint
 	off := int64(item.Offset)
 
 	p.file.Store(item.Path)
+	events.fileBegin(item.Path, item.Size)
 
 	//Create buffer and copy
 	bf := NewBufferedFile(newFile, writeBuffer, p)
@@ -734,10 +600,12 @@ func extractFile(arc io.ReaderAt, destination string, lfeat BitFlags, ctype uint
 	//Read checksum
 	expectedChecksum := make([]byte, checksumLength)
 	if lfeat.IsSet(fChecksums) {
-		r := io.NewSectionReader(arc, off, int64(checksumLength))
+		r := io.NewSectionReader(arc, int64(item.SumOffset), int64(checksumLength))
 		if _, err := io.ReadFull(r, expectedChecksum); err != nil {
 			if doForce {
 				doLog(false, "unable to read checksum for %v: %v", item.Path, err)
+				events.warn(item.Path, "unable to read checksum: %v", err)
+				events.fileSkipped(item.Path)
 				skippedFiles.Add(1)
 				closeFile()
 				return nil
@@ -749,117 +617,245 @@ func extractFile(arc io.ReaderAt, destination string, lfeat BitFlags, ctype uint
 	}
 
 	var writer io.Writer = bf
-	var hashSum []byte
-	hasBlocks := len(item.Blocks) > 0
+	var hasher hash.Hash
 	if lfeat.IsSet(fChecksums) {
-		hasher := newHasher(checksumType)
+		hasher = newHasher(checksumType)
 		writer = io.MultiWriter(bf, hasher)
-		if hasBlocks {
-			for _, b := range item.Blocks {
-				r := io.NewSectionReader(arc, int64(b.Offset), int64(b.Size))
-				if lfeat.IsNotSet(fNoCompress) {
-					dec, err := decompressor(r, ctype)
-					if err != nil {
-						log.Fatalf("decompress setup: %v", err)
-					}
-					_, err = io.Copy(writer, progressReader{r: dec, p: p})
-					if err != nil {
-						log.Fatalf("copy block: %v", err)
-					}
-					dec.Close()
-				} else {
-					_, err := io.Copy(writer, progressReader{r: r, p: p})
-					if err != nil {
-						log.Fatalf("copy block: %v", err)
-					}
-				}
-			}
-		} else {
-			r := io.NewSectionReader(arc, off, 1<<63-1)
-			var src io.Reader = r
-			if lfeat.IsNotSet(fNoCompress) {
-				dec, err := decompressor(r, ctype)
-				if err != nil {
-					log.Fatalf("decompress error: Unable to create reader: %v :: %v", item.Path, err)
-				}
-				defer dec.Close()
-				src = dec
-			}
-			src = progressReader{r: src, p: p}
-			_, err = io.CopyN(writer, src, int64(item.Size))
-			if err != nil {
-				if doForce {
-					doLog(false, "Unable to write data: %v :: %v", item.Path, err)
-				} else {
-					log.Fatalf("Unable to write data to file: %v :: %v", item.Path, err)
-				}
-			}
+	}
+	if err := copyFileData(writer, arc, off, lfeat, ctype, item, p); err != nil {
+		if deferRepair(item) {
+			closeFile()
+			extractRoot.RemoveAll(finalPath)
+			return nil
 		}
-		hashSum = hasher.Sum(nil)
-		if len(hashSum) < int(checksumLength) {
-			pad := make([]byte, int(checksumLength)-len(hashSum))
-			hashSum = append(hashSum, pad...)
+		var we dataWriteError
+		if !errors.As(err, &we) {
+			log.Fatalf("%v", err)
 		}
-	} else {
-		if hasBlocks {
-			for _, b := range item.Blocks {
-				r := io.NewSectionReader(arc, int64(b.Offset), int64(b.Size))
-				if lfeat.IsNotSet(fNoCompress) {
-					dec, err := decompressor(r, ctype)
-					if err != nil {
-						log.Fatalf("decompress setup: %v", err)
-					}
-					_, err = io.Copy(writer, progressReader{r: dec, p: p})
-					if err != nil {
-						log.Fatalf("copy block: %v", err)
-					}
-					dec.Close()
-				} else {
-					_, err := io.Copy(writer, progressReader{r: r, p: p})
-					if err != nil {
-						log.Fatalf("copy block: %v", err)
-					}
+		if !doForce {
+			log.Fatalf("Unable to write data to file: %v :: %v", item.Path, we.err)
+		}
+		doLog(false, "Unable to write data: %v :: %v", item.Path, we.err)
+		events.warn(item.Path, "unable to write data: %v", we.err)
+	}
+	var hashSum []byte
+	if hasher != nil {
+		hashSum = padSum(hasher.Sum(nil), checksumLength)
+	}
+	if err := bf.Close(); err != nil {
+		log.Fatalf("extract: close failed: %v", err)
+	}
+	finishExtractFile(finalPath, lfeat, item, hashSum, expectedChecksum)
+	return nil
+}
+
+// dataWriteError is a failure part way through the single stream of a file
+// from before the block index, which forced extraction continues past.
+type dataWriteError struct {
+	err error
+}
+
+func (e dataWriteError) Error() string {
+	return e.err.Error()
+}
+
+// copyFileData writes the decoded contents of item, whose data starts at
+// off, to w.
+func copyFileData(w io.Writer, arc io.ReaderAt, off int64, lfeat BitFlags, ctype uint8, item *FileEntry, p *progressData) error {
+	if len(item.Blocks) > 0 {
+		for _, b := range item.Blocks {
+			r := io.NewSectionReader(arc, int64(b.Offset), int64(b.Size))
+			if lfeat.IsSet(fNoCompress) {
+				if _, err := io.Copy(w, progressReader{r: r, p: p}); err != nil {
+					return fmt.Errorf("copy block: %w", err)
 				}
+				continue
 			}
-		} else {
-			r := io.NewSectionReader(arc, off, 1<<63-1)
-			var src io.Reader = r
-			if lfeat.IsNotSet(fNoCompress) {
-				dec, err := decompressor(r, ctype)
-				if err != nil {
-					log.Fatalf("decompress error: Unable to create reader: %v :: %v", item.Path, err)
-				}
-				defer dec.Close()
-				src = dec
+			dec, err := decompressor(r, ctype)
+			if err != nil {
+				return fmt.Errorf("decompress setup: %w", err)
 			}
-			src = progressReader{r: src, p: p}
-			_, err = io.CopyN(writer, src, int64(item.Size))
+			_, err = io.Copy(w, progressReader{r: dec, p: p})
+			dec.Close()
 			if err != nil {
-				if doForce {
-					doLog(false, "Unable to write data: %v :: %v", item.Path, err)
-				} else {
-					log.Fatalf("Unable to write data to file: %v :: %v", item.Path, err)
-				}
+				return fmt.Errorf("copy block: %w", err)
 			}
 		}
+		return nil
 	}
-	if err := bf.Close(); err != nil {
-		log.Fatalf("extract: close failed: %v", err)
+	var src io.Reader = io.NewSectionReader(arc, off, 1<<63-1)
+	if lfeat.IsNotSet(fNoCompress) {
+		dec, err := decompressor(src, ctype)
+		if err != nil {
+			return fmt.Errorf("decompress error: Unable to create reader: %v :: %w", item.Path, err)
+		}
+		defer dec.Close()
+		src = dec
 	}
-	if lfeat.IsSet(fModDates) {
-		os.Chtimes(finalPath, item.ModTime, item.ModTime)
+	if _, err := io.CopyN(w, progressReader{r: src, p: p}, int64(item.Size)); err != nil {
+		return dataWriteError{err}
 	}
+	return nil
+}
 
-	if lfeat.IsSet(fChecksums) {
-		if bytes.Equal(hashSum, expectedChecksum) {
-			checksumCount.Add(1)
-		} else {
-			if doForce {
-				doLog(false, "Checksum mismatch for %v", item.Path)
-			} else {
-				log.Fatalf("Checksum mismatch for %v", item.Path)
-			}
+// entryPath resolves where item is written below destination. It returns
+// false when the entry should be skipped.
+func entryPath(destination string, lfeat BitFlags, item *FileEntry) (string, bool) {
+	if lfeat.IsSet(fAbsolutePaths) {
+		return filepath.Clean(item.Path), true
+	}
+	finalPath, err := safeJoin(destination, item.Path)
+	if err != nil {
+		if doForce {
+			doLog(false, "invalid path: %v", item.Path)
+			events.warn(item.Path, "invalid path, skipped")
+			skippedFiles.Add(1)
+			return "", false
+		}
+		log.Fatalf("invalid path: %v", item.Path)
+	}
+	return finalPath, true
+}
+
+// makeParentDir creates the directory holding finalPath. It returns false
+// when the entry should be skipped.
+func makeParentDir(finalPath string) bool {
+	dir := filepath.Dir(finalPath)
+	if err := extractRoot.MkdirAll(dir, os.ModePerm); err != nil {
+		if doForce {
+			doLog(false, "unable to create directory %v: %v", dir, err)
+			skippedFiles.Add(1)
+			return false
 		}
+		log.Fatalf("extract: unable to create directory %v: %v", dir, err)
+	}
+	return true
+}
+
+func isLinkEntry(item *FileEntry) bool {
+	return item.Type == entrySymlink || item.Type == entryHardlink
+}
+
+// linkSource resolves the target of a hardlink, which names an earlier
+// entry of the archive.
+func linkSource(destination string, lfeat BitFlags, linkname string) (string, error) {
+	if lfeat.IsSet(fAbsolutePaths) {
+		return filepath.Clean(linkname), nil
+	}
+	return safeJoin(destination, linkname)
+}
+
+// skipUnsafe reports an entry refused by the link checks. Extraction stops
+// unless forced.
+func skipUnsafe(err error) {
+	if doForce {
+		doLog(false, "skipping unsafe entry: %v", err)
+		events.warn("", "skipping unsafe entry: %v", err)
+		skippedFiles.Add(1)
+		return
+	}
+	log.Fatalf("extract: %v", err)
+}
+
+// extractLink recreates a symlink or hardlink entry.
+func extractLink(destination string, lfeat BitFlags, item *FileEntry) error {
+	finalPath, ok := entryPath(destination, lfeat, item)
+	if !ok {
+		return nil
+	}
+	var source string
+	var err error
+	if item.Type == entrySymlink {
+		err = extractGuard.checkSymlink(finalPath, item.Linkname, lfeat.IsSet(fAbsolutePaths))
+	} else if source, err = linkSource(destination, lfeat, item.Linkname); err == nil {
+		err = extractGuard.checkHardlink(finalPath, source)
 	}
+	if err != nil {
+		skipUnsafe(err)
+		return nil
+	}
+	if !makeParentDir(finalPath) {
+		return nil
+	}
+	if doForce {
+		extractRoot.RemoveAll(finalPath)
+	}
+	if item.Type == entryHardlink {
+		return extractRoot.Link(source, finalPath)
+	}
+	if err := extractRoot.Symlink(item.Linkname, finalPath); err != nil {
+		return err
+	}
+	extractGuard.add(finalPath)
 	return nil
 }
+
+// openExtractFile creates the output file for item. A nil file with a nil
+// error means the entry was skipped.
+func openExtractFile(destination string, lfeat BitFlags, item *FileEntry) (*os.File, string, error) {
+	finalPath, ok := entryPath(destination, lfeat, item)
+	if !ok {
+		return nil, "", nil
+	}
+	if err := extractGuard.checkPath(finalPath); err != nil {
+		skipUnsafe(err)
+		return nil, "", nil
+	}
+	if !makeParentDir(finalPath) {
+		return nil, "", nil
+	}
+
+	//Set file perms, if needed
+	filePerm := os.FileMode(0644)
+	if lfeat.IsSet(fPermissions) {
+		filePerm = os.FileMode(item.Mode)
+	}
+
+	//Open file
+	var newFile *os.File
+	var err error
+	if doForce {
+		exists, _ := fileExists(finalPath)
+		if exists {
+			extractRoot.Chmod(finalPath, 0644)
+		}
+		newFile, err = extractRoot.OpenFile(finalPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if exists {
+			extractRoot.Chmod(finalPath, filePerm)
+		}
+	} else {
+		newFile, err = extractRoot.OpenFile(finalPath, os.O_CREATE|os.O_WRONLY, filePerm)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return newFile, finalPath, nil
+}
+
+// finishExtractFile restores the mod time of an extracted file, checks
+// its checksum and reports the file to events.
+func finishExtractFile(finalPath string, lfeat BitFlags, item *FileEntry, hashSum, expectedChecksum []byte) {
+	if lfeat.IsSet(fModDates) {
+		extractRoot.Chtimes(finalPath, item.ModTime, item.ModTime)
+	}
+
+	if lfeat.IsNotSet(fChecksums) {
+		events.fileEnd(item.Path, item.Size, "")
+		return
+	}
+	if bytes.Equal(hashSum, expectedChecksum) {
+		checksumCount.Add(1)
+		events.fileEnd(item.Path, item.Size, "verified")
+		return
+	}
+	if deferRepair(item) {
+		extractRoot.RemoveAll(finalPath)
+		return
+	}
+	events.fileEnd(item.Path, item.Size, "mismatch")
+	if doForce {
+		doLog(false, "Checksum mismatch for %v", item.Path)
+	} else {
+		log.Fatalf("Checksum mismatch for %v", item.Path)
+	}
+}
@@ -33,3 +33,52 @@ func TestExtractFileDirCreationFailure(t *testing.T) {
 		t.Fatalf("directory should not be created")
 	}
 }
+
+func TestExtractRefusesSymlinkEscape(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("../../outside", filepath.Join(root, "esc")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(root, "ok")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	archivePath = filepath.Join(tmp, "links.goxa")
+	features = fSpecialFiles
+	compType = compZstd
+	protoVersion = protoVersion2
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	doForce = true
+	defer func() {
+		doForce = false
+		safeLinks = true
+	}()
+	dest := filepath.Join(tmp, "out")
+	features = fSpecialFiles
+	extract([]string{dest}, false, false)
+	base := filepath.Join(dest, "root")
+	if _, err := os.Lstat(filepath.Join(base, "esc")); err == nil {
+		t.Fatalf("escaping symlink was created")
+	}
+	if link, err := os.Readlink(filepath.Join(base, "ok")); err != nil || link != "file.txt" {
+		t.Fatalf("inside symlink missing: %v %v", link, err)
+	}
+
+	safeLinks = false
+	dest = filepath.Join(tmp, "unsafe")
+	features = fSpecialFiles
+	extract([]string{dest}, false, false)
+	if _, err := os.Lstat(filepath.Join(dest, "root", "esc")); err != nil {
+		t.Fatalf("symlink should be created with -safelinks=false: %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"time"
@@ -10,7 +12,147 @@ import (
 	"github.com/klauspost/reedsolomon"
 )
 
-const fecMagic = "GOXAFEC"
+const (
+	// fecMagic starts the original layout without shard checksums.
+	fecMagic = "GOXAFEC"
+	// fecMagicV2 starts the layout with a checksum for every stripe of
+	// every shard, so damaged shards can be found and rebuilt.
+	fecMagicV2 = "GOXAFE2"
+	// fecStripeSize is how much of each shard one checksum covers.
+	fecStripeSize = 64 * 1024
+)
+
+// fecHeader describes a FEC encoded archive. The shards follow the header
+// one after the other, data shards first.
+type fecHeader struct {
+	version      int
+	dataShards   int
+	parityShards int
+	shardSize    int64
+	dataSize     int64
+	stripeSize   int64
+	// sums holds the CRC32 of each stripe, indexed by shard then stripe
+	sums [][]uint32
+	// sumsDamaged is set when the header failed its own checksum, so
+	// stripes not matching sums are checked against the parity instead
+	sumsDamaged bool
+	// verifier checks the parity of rows when sumsDamaged is set
+	verifier reedsolomon.Encoder
+	// headerLen is where the first shard starts
+	headerLen int64
+}
+
+func (h *fecHeader) totalShards() int {
+	return h.dataShards + h.parityShards
+}
+
+// stripes returns the number of stripes each shard is checked in.
+func (h *fecHeader) stripes() int {
+	if h.stripeSize == 0 {
+		return 0
+	}
+	return int((h.shardSize + h.stripeSize - 1) / h.stripeSize)
+}
+
+// stripeLen returns the length of stripe s, the last one may be short.
+func (h *fecHeader) stripeLen(s int) int64 {
+	return min(h.stripeSize, h.shardSize-int64(s)*h.stripeSize)
+}
+
+// shardOffset returns where stripe s of shard i is stored.
+func (h *fecHeader) shardOffset(i, s int) int64 {
+	return h.headerLen + int64(i)*h.shardSize + int64(s)*h.stripeSize
+}
+
+// encode serializes a version 2 header followed by its own CRC32.
+func (h *fecHeader) encode() []byte {
+	buf := []byte(fecMagicV2)
+	buf = append(buf, uint8(h.dataShards), uint8(h.parityShards))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.shardSize))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.dataSize))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(h.stripeSize))
+	for i := 0; i < h.totalShards(); i++ {
+		for s := 0; s < h.stripes(); s++ {
+			var sum uint32
+			if h.sums != nil {
+				sum = h.sums[i][s]
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, sum)
+		}
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// readFECHeader parses the header of a FEC encoded archive of either
+// layout. A version 2 header failing its checksum is still used when its
+// sizes fit together, with sumsDamaged set, so one flipped bit in the
+// checksum table doesn't make the archive unreadable.
+func readFECHeader(f io.ReaderAt) (*fecHeader, error) {
+	fixed := make([]byte, len(fecMagicV2)+2+8+8+4)
+	if _, err := f.ReadAt(fixed[:len(fecMagic)], 0); err != nil {
+		return nil, err
+	}
+	h := &fecHeader{}
+	switch string(fixed[:len(fecMagic)]) {
+	case fecMagic:
+		var v1 struct {
+			Data, Parity uint8
+			ShardSize    uint32
+			DataSize     uint64
+		}
+		if err := binary.Read(io.NewSectionReader(f, int64(len(fecMagic)), 14), binary.LittleEndian, &v1); err != nil {
+			return nil, err
+		}
+		h.version = 1
+		h.dataShards, h.parityShards = int(v1.Data), int(v1.Parity)
+		h.shardSize, h.dataSize = int64(v1.ShardSize), int64(v1.DataSize)
+		h.headerLen = int64(len(fecMagic)) + 14
+		return h, nil
+	case fecMagicV2:
+	default:
+		return nil, fmt.Errorf("invalid FEC file")
+	}
+
+	if _, err := f.ReadAt(fixed, 0); err != nil {
+		return nil, err
+	}
+	pos := len(fecMagicV2)
+	h.version = 2
+	h.dataShards, h.parityShards = int(fixed[pos]), int(fixed[pos+1])
+	h.shardSize = int64(binary.LittleEndian.Uint64(fixed[pos+2:]))
+	h.dataSize = int64(binary.LittleEndian.Uint64(fixed[pos+10:]))
+	h.stripeSize = int64(binary.LittleEndian.Uint32(fixed[pos+18:]))
+	if h.dataShards == 0 || h.stripeSize == 0 || h.shardSize < 0 || h.dataSize > h.shardSize*int64(h.dataShards) {
+		return nil, fmt.Errorf("invalid FEC header")
+	}
+	tableLen := int64(h.totalShards()) * int64(h.stripes()) * 4
+	if tableLen > 1<<30 {
+		return nil, fmt.Errorf("invalid FEC header")
+	}
+	buf := make([]byte, int64(len(fixed))+tableLen+4)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("read FEC header: %w", err)
+	}
+	end := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.LittleEndian.Uint32(buf[end:]) {
+		// Both writers size the shards to just hold the data
+		if h.shardSize != (h.dataSize+int64(h.dataShards)-1)/int64(h.dataShards) {
+			return nil, fmt.Errorf("FEC header checksum mismatch")
+		}
+		h.sumsDamaged = true
+	}
+	h.sums = make([][]uint32, h.totalShards())
+	pos = len(fixed)
+	for i := range h.sums {
+		h.sums[i] = make([]uint32, h.stripes())
+		for s := range h.sums[i] {
+			h.sums[i][s] = binary.LittleEndian.Uint32(buf[pos:])
+			pos += 4
+		}
+	}
+	h.headerLen = int64(len(buf))
+	return h, nil
+}
 
 type fileOffsetWriter struct {
 	f   *os.File
@@ -37,12 +179,40 @@ func encodeWithFEC(inPath, outPath string) error {
 		return err
 	}
 
+	if fecStripe > 0 {
+		out, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		p, done, finished := progressTicker(&progressData{total: info.Size(), speedWindowSize: time.Second * 5})
+		p.file.Store(inPath)
+		bw := bufio.NewWriterSize(out, writeBuffer)
+		err = encodeFECStriped(in, bw, p)
+		close(done)
+		<-finished
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == nil && !noFlush {
+			err = out.Sync()
+		}
+		return err
+	}
+
 	enc, err := reedsolomon.NewStream(fecDataShards, fecParityShards)
 	if err != nil {
 		return err
 	}
 
-	shardSize := uint32((info.Size() + int64(fecDataShards) - 1) / int64(fecDataShards))
+	h := &fecHeader{
+		version:      2,
+		dataShards:   fecDataShards,
+		parityShards: fecParityShards,
+		shardSize:    (info.Size() + int64(fecDataShards) - 1) / int64(fecDataShards),
+		dataSize:     info.Size(),
+		stripeSize:   fecStripeSize,
+	}
 
 	out, err := os.Create(outPath)
 	if err != nil {
@@ -50,33 +220,19 @@ func encodeWithFEC(inPath, outPath string) error {
 	}
 	defer out.Close()
 
-	if _, err := out.Write([]byte(fecMagic)); err != nil {
-		return err
-	}
-	if err := binary.Write(out, binary.LittleEndian, uint8(fecDataShards)); err != nil {
-		return err
-	}
-	if err := binary.Write(out, binary.LittleEndian, uint8(fecParityShards)); err != nil {
-		return err
-	}
-	if err := binary.Write(out, binary.LittleEndian, shardSize); err != nil {
-		return err
-	}
-	if err := binary.Write(out, binary.LittleEndian, uint64(info.Size())); err != nil {
-		return err
-	}
-
-	headerLen, err := out.Seek(0, io.SeekCurrent)
-	if err != nil {
+	// The checksums are filled in once the shards are written
+	header := h.encode()
+	if _, err := out.Write(header); err != nil {
 		return err
 	}
+	h.headerLen = int64(len(header))
 
 	p, done, finished := progressTicker(&progressData{total: info.Size(), speedWindowSize: time.Second * 5})
 	p.file.Store(inPath)
 
 	dataW := make([]io.Writer, fecDataShards)
 	for i := range dataW {
-		sw := &fileOffsetWriter{f: out, off: headerLen + int64(i)*int64(shardSize)}
+		sw := &fileOffsetWriter{f: out, off: h.shardOffset(i, 0)}
 		dataW[i] = progressWriter{w: sw, p: p}
 	}
 
@@ -88,11 +244,11 @@ func encodeWithFEC(inPath, outPath string) error {
 
 	dataR := make([]io.Reader, fecDataShards)
 	for i := range dataR {
-		dataR[i] = io.NewSectionReader(out, headerLen+int64(i)*int64(shardSize), int64(shardSize))
+		dataR[i] = io.NewSectionReader(out, h.shardOffset(i, 0), h.shardSize)
 	}
 	parityW := make([]io.Writer, fecParityShards)
 	for i := range parityW {
-		sw := &fileOffsetWriter{f: out, off: headerLen + int64(fecDataShards+i)*int64(shardSize)}
+		sw := &fileOffsetWriter{f: out, off: h.shardOffset(fecDataShards+i, 0)}
 		parityW[i] = progressWriter{w: sw, p: p}
 	}
 
@@ -101,9 +257,15 @@ func encodeWithFEC(inPath, outPath string) error {
 		<-finished
 		return err
 	}
-
 	close(done)
 	<-finished
+
+	if err := fecChecksums(out, h); err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(h.encode(), 0); err != nil {
+		return err
+	}
 	if !noFlush {
 		if err := out.Sync(); err != nil {
 			return err
@@ -112,87 +274,239 @@ func encodeWithFEC(inPath, outPath string) error {
 	return nil
 }
 
-func decodeWithFEC(name string) (string, func(), error) {
-	doLog(false, "FEC decoding archive")
-	f, err := os.Open(name)
-	if err != nil {
-		return "", nil, err
+// fecChecksums computes the stripe checksums of the shards stored in f.
+func fecChecksums(f io.ReaderAt, h *fecHeader) error {
+	h.sums = make([][]uint32, h.totalShards())
+	buf := make([]byte, h.stripeSize)
+	for i := range h.sums {
+		h.sums[i] = make([]uint32, h.stripes())
+		for s := range h.sums[i] {
+			b := buf[:h.stripeLen(s)]
+			if _, err := f.ReadAt(b, h.shardOffset(i, s)); err != nil {
+				return fmt.Errorf("read shard %v: %w", i, err)
+			}
+			h.sums[i][s] = crc32.ChecksumIEEE(b)
+		}
 	}
-	defer f.Close()
+	return nil
+}
 
-	hdr := make([]byte, len(fecMagic))
-	if _, err := io.ReadFull(f, hdr); err != nil {
-		return "", nil, err
+// readRow reads stripe s of every shard into bufs and points shards at
+// them. Stripes failing their checksum are marked in damaged and left
+// empty for Reconstruct, which rebuilds them into their capacity. When
+// the checksums themselves may be damaged, a row whose parity holds is
+// taken as it is. It returns the number of damaged stripes.
+func (h *fecHeader) readRow(f io.ReaderAt, s int, bufs, shards [][]byte, damaged []bool) int {
+	n := h.stripeLen(s)
+	bad := 0
+	readable := true
+	for i := range shards {
+		shards[i] = bufs[i][:n]
+		_, err := f.ReadAt(shards[i], h.shardOffset(i, s))
+		readable = readable && err == nil
+		damaged[i] = err != nil || crc32.ChecksumIEEE(shards[i]) != h.sums[i][s]
+		if damaged[i] {
+			bad++
+		}
 	}
-	if string(hdr) != fecMagic {
-		return "", nil, fmt.Errorf("invalid FEC file")
+	if bad > 0 && h.sumsDamaged && readable && h.parityHolds(shards) {
+		clear(damaged)
+		return 0
 	}
-	var dataShards, parityShards uint8
-	var shardSize uint32
-	var dataSize uint64
-	if err := binary.Read(f, binary.LittleEndian, &dataShards); err != nil {
-		return "", nil, err
+	for i := range shards {
+		if damaged[i] {
+			shards[i] = shards[i][:0]
+		}
 	}
-	if err := binary.Read(f, binary.LittleEndian, &parityShards); err != nil {
-		return "", nil, err
+	return bad
+}
+
+// parityHolds reports whether the parity of a row of shards matches its
+// data.
+func (h *fecHeader) parityHolds(shards [][]byte) bool {
+	if h.verifier == nil {
+		enc, err := reedsolomon.New(h.dataShards, h.parityShards)
+		if err != nil {
+			return false
+		}
+		h.verifier = enc
 	}
-	if err := binary.Read(f, binary.LittleEndian, &shardSize); err != nil {
-		return "", nil, err
+	ok, err := h.verifier.Verify(shards)
+	return err == nil && ok
+}
+
+// fecDamage counts the stripes rebuilt in each shard.
+type fecDamage []int
+
+// String describes which shards were rebuilt.
+func (d fecDamage) String() string {
+	out := ""
+	for i, n := range d {
+		if n == 0 {
+			continue
+		}
+		if out != "" {
+			out += ", "
+		}
+		if n == 1 {
+			out += fmt.Sprintf("shard %v (1 stripe)", i)
+		} else {
+			out += fmt.Sprintf("shard %v (%v stripes)", i, n)
+		}
 	}
-	if err := binary.Read(f, binary.LittleEndian, &dataSize); err != nil {
-		return "", nil, err
+	if out == "" {
+		return "none"
 	}
+	return out
+}
 
-	headerLen, err := f.Seek(0, io.SeekCurrent)
+// fecScan checks every stripe of every shard in f against its checksum
+// and rebuilds the damaged ones from the others. fn receives each row of
+// stripes once all its shards are intact. A row with more damaged shards
+// than there are parity shards is an error.
+func fecScan(f io.ReaderAt, h *fecHeader, p *progressData, fn func(s int, shards [][]byte) error) (fecDamage, error) {
+	enc, err := reedsolomon.New(h.dataShards, h.parityShards)
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+	damage := make(fecDamage, h.totalShards())
+	bufs := make([][]byte, h.totalShards())
+	for i := range bufs {
+		bufs[i] = make([]byte, h.stripeSize)
+	}
+	shards := make([][]byte, h.totalShards())
+	damaged := make([]bool, h.totalShards())
+	for s := 0; s < h.stripes(); s++ {
+		n := h.stripeLen(s)
+		bad := h.readRow(f, s, bufs, shards, damaged)
+		if bad > h.parityShards {
+			return damage, fmt.Errorf("stripe %v has %v damaged shards, only %v can be rebuilt", s, bad, h.parityShards)
+		}
+		if bad > 0 {
+			if err := enc.Reconstruct(shards); err != nil {
+				return damage, fmt.Errorf("rebuild stripe %v: %w", s, err)
+			}
+			for i := range shards {
+				if damaged[i] {
+					damage[i]++
+				}
+			}
+		}
+		if err := fn(s, shards); err != nil {
+			return damage, err
+		}
+		if p != nil {
+			p.current.Add(n * int64(h.dataShards))
+		}
 	}
+	return damage, nil
+}
 
-	enc, err := reedsolomon.NewStream(int(dataShards), int(parityShards))
+func decodeWithFEC(name string) (string, func(), error) {
+	doLog(false, "FEC decoding archive")
+	src, err := openArchiveSource(name)
 	if err != nil {
 		return "", nil, err
 	}
+	defer src.Close()
 
-	total := int(dataShards) + int(parityShards)
-	shards := make([]io.Reader, total)
-	for i := 0; i < total; i++ {
-		shards[i] = io.NewSectionReader(f, headerLen+int64(i)*int64(shardSize), int64(shardSize))
-	}
-
-	ok, err := enc.Verify(shards)
-	if err != nil {
-		return "", nil, err
-	}
-	if !ok {
-		// Not much we can do here without knowing bad shards
+	var h *fecHeader
+	striped := isFECStriped(src)
+	if !striped {
+		h, err = readFECHeader(src)
+		if err != nil {
+			return "", nil, err
+		}
+		if h.sumsDamaged {
+			doLog(false, "FEC: header checksum mismatch, checking stripes against the parity")
+		}
 	}
 
 	tmp, err := os.CreateTemp("", "goxa_fec_dec_*")
 	if err != nil {
 		return "", nil, err
 	}
-
-	p, done, finished := progressTicker(&progressData{total: int64(dataSize), speedWindowSize: time.Second * 5})
-	p.file.Store(name)
-
-	// recreate readers since Verify consumed them
-	dataR := make([]io.Reader, int(dataShards))
-	for i := 0; i < int(dataShards); i++ {
-		dataR[i] = io.NewSectionReader(f, headerLen+int64(i)*int64(shardSize), int64(shardSize))
+	fail := func(err error) (string, func(), error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", nil, err
 	}
 
-	if err := enc.Join(progressWriter{w: tmp, p: p}, dataR, int64(dataSize)); err != nil {
+	if striped {
+		p, done, finished := progressTicker(&progressData{total: src.Size(), speedWindowSize: time.Second * 5})
+		p.file.Store(name)
+		bw := bufio.NewWriterSize(tmp, writeBuffer)
+		err = decodeFECStriped(io.NewSectionReader(src, 0, src.Size()), bw, p)
 		close(done)
 		<-finished
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if !noFlush {
+			tmp.Sync()
+		}
 		tmp.Close()
-		os.Remove(tmp.Name())
-		return "", nil, err
+		return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+	}
+
+	p, done, finished := progressTicker(&progressData{total: h.dataSize, speedWindowSize: time.Second * 5})
+	p.file.Store(name)
+	if h.version == 1 {
+		err = decodeFECv1(src, h, tmp, p)
+	} else {
+		var damage fecDamage
+		damage, err = fecScan(src, h, p, func(s int, shards [][]byte) error {
+			for i, shard := range shards[:h.dataShards] {
+				off := int64(i)*h.shardSize + int64(s)*h.stripeSize
+				if off >= h.dataSize {
+					break
+				}
+				if _, err := tmp.WriteAt(shard[:min(int64(len(shard)), h.dataSize-off)], off); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil && damage.String() != "none" {
+			doLog(false, "FEC: rebuilt damaged stripes in %v", damage)
+		}
+	}
+	close(done)
+	<-finished
+	if err != nil {
+		return fail(err)
 	}
 	if !noFlush {
 		tmp.Sync()
 	}
 	tmp.Close()
-	close(done)
-	<-finished
 	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
 }
+
+// decodeFECv1 joins the data shards of the original layout. Without
+// shard checksums damage can be detected but not located.
+func decodeFECv1(f io.ReaderAt, h *fecHeader, out io.Writer, p *progressData) error {
+	enc, err := reedsolomon.NewStream(h.dataShards, h.parityShards)
+	if err != nil {
+		return err
+	}
+	shards := make([]io.Reader, h.totalShards())
+	for i := range shards {
+		shards[i] = io.NewSectionReader(f, h.shardOffset(i, 0), h.shardSize)
+	}
+	ok, err := enc.Verify(shards)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		doLog(false, "FEC: parity mismatch, this older layout has no shard checksums to locate the damage")
+	}
+	dataR := make([]io.Reader, h.dataShards)
+	for i := range dataR {
+		dataR[i] = io.NewSectionReader(f, h.shardOffset(i, 0), h.shardSize)
+	}
+	return enc.Join(progressWriter{w: out, p: p}, dataR, h.dataSize)
+}
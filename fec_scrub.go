@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// fecVerify checks every shard of the FEC encoded archive name against
+// its checksums without decoding it.
+func fecVerify(name string) (*FECReport, error) {
+	src, err := openArchiveSource(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	p, done, finished := progressTicker(&progressData{total: src.Size(), speedWindowSize: time.Second * 5})
+	p.file.Store(name)
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	var report *FECReport
+	if isFECStriped(src) {
+		report, err = verifyFECStriped(io.NewSectionReader(src, 0, src.Size()), p)
+	} else {
+		var h *fecHeader
+		if h, err = readFECHeader(src); err != nil {
+			return nil, err
+		}
+		report, err = verifyFECShards(src, h, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Archive = name
+	return report, nil
+}
+
+// newFECReport returns a report with an entry for every shard.
+func newFECReport(layout string, dataShards, parityShards int, damage fecDamage) *FECReport {
+	r := &FECReport{Layout: layout, DataShards: dataShards, ParityShards: parityShards}
+	for i := 0; i < dataShards+parityShards; i++ {
+		s := FECShard{Index: i, Parity: i >= dataShards}
+		if damage != nil {
+			s.Damaged = damage[i]
+		}
+		r.Shards = append(r.Shards, s)
+	}
+	return r
+}
+
+// verifyFECShards checks the layout holding each shard in one piece.
+func verifyFECShards(f io.ReaderAt, h *fecHeader, p *progressData) (*FECReport, error) {
+	if h.version == 1 {
+		report := newFECReport("original", h.dataShards, h.parityShards, nil)
+		report.Stripes = 1
+		enc, err := reedsolomon.NewStream(h.dataShards, h.parityShards)
+		if err != nil {
+			return nil, err
+		}
+		shards := make([]io.Reader, h.totalShards())
+		for i := range shards {
+			shards[i] = progressReader{r: io.NewSectionReader(f, h.shardOffset(i, 0), h.shardSize), p: p}
+		}
+		ok, err := enc.Verify(shards)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			report.Damaged, report.Unrecoverable = 1, 1
+			report.Note = "parity mismatch, this older layout has no shard checksums to locate the damage"
+		}
+		return report, nil
+	}
+
+	damage := make(fecDamage, h.totalShards())
+	report := newFECReport("shards", h.dataShards, h.parityShards, damage)
+	report.Stripes = h.stripes()
+	bufs := make([][]byte, h.totalShards())
+	for i := range bufs {
+		bufs[i] = make([]byte, h.stripeSize)
+	}
+	shards := make([][]byte, h.totalShards())
+	damaged := make([]bool, h.totalShards())
+	for s := 0; s < h.stripes(); s++ {
+		bad := h.readRow(f, s, bufs, shards, damaged)
+		for i := range damaged {
+			if damaged[i] {
+				damage[i]++
+			}
+		}
+		if bad > 0 {
+			report.Damaged++
+		}
+		if bad > h.parityShards {
+			report.Unrecoverable++
+		}
+		p.current.Add(h.stripeLen(s) * int64(h.totalShards()))
+	}
+	for i := range report.Shards {
+		report.Shards[i].Damaged = damage[i]
+	}
+	if h.sumsDamaged {
+		// The header is rewritten by a repair
+		report.Records++
+		report.Note = "header checksum mismatch, stripes were checked against the parity"
+	}
+	return report, nil
+}
+
+// verifyFECStriped checks the striped layout read front to back.
+func verifyFECStriped(r io.Reader, p *progressData) (*FECReport, error) {
+	fr, err := newFECStripeReader(progressReader{r: r, p: p})
+	if err != nil {
+		return nil, err
+	}
+	report := newFECReport("striped", fr.s.dataShards, fr.s.parityShards, nil)
+	for !fr.done {
+		group, stripes, end, err := fr.readGroup()
+		if err != nil {
+			return nil, err
+		}
+		if stripes > 0 {
+			dataLen, ok, err := fr.groupData(group, stripes)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				report.Records++
+			}
+			for k := 0; k < stripes; k++ {
+				bad := fr.checkStripe(group, stripes, k)
+				if bad > 0 {
+					report.Damaged++
+				}
+				if bad > fr.s.parityShards {
+					report.Unrecoverable++
+				}
+			}
+			report.Stripes += stripes
+			fr.group++
+			fr.size += uint64(dataLen)
+		}
+		if end != nil && !fr.checkEnd(end) {
+			report.Records++
+		}
+	}
+	for i := range report.Shards {
+		report.Shards[i].Damaged = fr.damage[i]
+	}
+	return report, nil
+}
+
+// fecRepair rewrites the FEC encoded archive at archivePath with every
+// damaged shard rebuilt and the parity computed afresh, keeping its
+// layout and shard counts. Archives in the original layout are written in
+// the layout with shard checksums. Without out the archive is replaced,
+// and only when damage was found unless forced.
+func fecRepair(out string) (*FECReport, error) {
+	inPlace := out == ""
+	if inPlace {
+		if isURL(archivePath) || archivePath == "-" || hasVolumes(archivePath) {
+			return nil, fmt.Errorf("only local FEC files can be repaired in place, name an output file")
+		}
+		out = archivePath
+	} else if !doForce {
+		if found, _ := fileExists(out); found {
+			return nil, fmt.Errorf("file %v already exists", out)
+		}
+	}
+
+	report, err := fecVerify(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if report.Unrecoverable > 0 {
+		return report, fmt.Errorf("%v stripes have more damaged shards than can be rebuilt", report.Unrecoverable)
+	}
+	if inPlace && report.Damaged+report.Records == 0 && !doForce {
+		doLog(false, "No damage found, %v left as is", archivePath)
+		return report, nil
+	}
+
+	var f *os.File
+	if inPlace {
+		f, err = os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+		if err == nil {
+			if st, serr := os.Stat(out); serr == nil {
+				f.Chmod(st.Mode().Perm())
+			}
+		}
+	} else {
+		f, err = os.Create(out)
+	}
+	if err != nil {
+		return report, err
+	}
+	tmpName := f.Name()
+	defer func() {
+		f.Close()
+		if inPlace {
+			os.Remove(tmpName)
+		}
+	}()
+
+	doLog(false, "Repairing %v", archivePath)
+	if report.Layout == "striped" {
+		err = repairFECStriped(f)
+	} else {
+		err = repairFECShards(report, tmpName)
+	}
+	if err != nil {
+		return report, err
+	}
+	if inPlace {
+		f.Close()
+		if err := os.Rename(tmpName, out); err != nil {
+			return report, err
+		}
+	}
+	report.Repaired = true
+	doLog(false, "Wrote %v", out)
+	return report, nil
+}
+
+// repairFECStriped streams the striped archive through the decoder and
+// encodes it again with the same layout into f.
+func repairFECStriped(f *os.File) error {
+	src, err := openArchiveSource(archivePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	p, done, finished := progressTicker(&progressData{total: src.Size(), speedWindowSize: time.Second * 5})
+	p.file.Store(archivePath)
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	fr, err := newFECStripeReader(progressReader{r: io.NewSectionReader(src, 0, src.Size()), p: p})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, writeBuffer)
+	fw, err := newFECStripeWriter(bw, fr.s)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, fr); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if !noFlush {
+		return f.Sync()
+	}
+	return nil
+}
+
+// repairFECShards decodes the archive and encodes it again into outPath
+// with the shard counts of report.
+func repairFECShards(report *FECReport, outPath string) error {
+	arcPath, cleanup, err := decodeWithFEC(archivePath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	oldData, oldParity, oldStripe := fecDataShards, fecParityShards, fecStripe
+	defer func() { fecDataShards, fecParityShards, fecStripe = oldData, oldParity, oldStripe }()
+	fecDataShards, fecParityShards, fecStripe = report.DataShards, report.ParityShards, 0
+	return encodeWithFEC(arcPath, outPath)
+}
+
+// printFECReport shows the health of every shard.
+func printFECReport(r *FECReport, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			doLog(false, "encode report: %v", err)
+		}
+		return
+	}
+	doLog(false, "%v: %v layout, %v data and %v parity shards, %v stripes", r.Archive, r.Layout, r.DataShards, r.ParityShards, r.Stripes)
+	for _, s := range r.Shards {
+		kind := "data"
+		if s.Parity {
+			kind = "parity"
+		}
+		state := "ok"
+		if s.Damaged > 0 {
+			state = fmt.Sprintf("%v damaged stripes", s.Damaged)
+		}
+		doLog(false, "  shard %2v %-6v %v", s.Index, kind, state)
+	}
+	if r.Note != "" {
+		doLog(false, "%v", r.Note)
+	}
+	switch {
+	case r.Repaired:
+		doLog(false, "%v of %v stripes and %v records damaged, rebuilt with fresh parity", r.Damaged, r.Stripes, r.Records)
+	case r.Unrecoverable > 0:
+		doLog(false, "%v of %v stripes damaged, %v beyond repair", r.Damaged, r.Stripes, r.Unrecoverable)
+	case r.Damaged+r.Records > 0:
+		doLog(false, "%v of %v stripes and %v records damaged, all repairable", r.Damaged, r.Stripes, r.Records)
+	default:
+		doLog(false, "All shards intact")
+	}
+}
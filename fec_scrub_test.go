@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFECVerifyRepair(t *testing.T) {
+	data := make([]byte, 200000+31)
+	rand.New(rand.NewSource(3)).Read(data)
+	fecDataShards, fecParityShards, fecInterleave = 4, 2, 4
+	defer func() {
+		fecDataShards, fecParityShards = 10, 3
+		fecStripe, fecInterleave = 0, 16
+		archivePath = defaultArchiveName
+		doForce = false
+	}()
+
+	for _, stripe := range []int{0, 8} {
+		t.Run(map[int]string{0: "shards", 8: "striped"}[stripe], func(t *testing.T) {
+			tempDir := t.TempDir()
+			in := filepath.Join(tempDir, "in.goxa")
+			os.WriteFile(in, data, 0o644)
+			fecStripe = stripe
+			archivePath = filepath.Join(tempDir, "a.goxaf")
+			if err := encodeWithFEC(in, archivePath); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			fecStripe = 0
+			clean, _ := os.ReadFile(archivePath)
+
+			report, err := fecVerify(archivePath)
+			if err != nil || report.Damaged+report.Records != 0 {
+				t.Fatalf("clean archive: %+v, %v", report, err)
+			}
+			doForce = false
+			if _, err := fecRepair(""); err != nil {
+				t.Fatalf("repair clean archive: %v", err)
+			}
+			if got, _ := os.ReadFile(archivePath); !bytes.Equal(got, clean) {
+				t.Fatalf("clean archive rewritten")
+			}
+
+			d := bytes.Clone(clean)
+			for i := 1000; i < 1100; i++ {
+				d[len(d)/2+i] ^= 0xff
+			}
+			os.WriteFile(archivePath, d, 0o644)
+			report, err = fecVerify(archivePath)
+			if err != nil || report.Damaged == 0 || report.Unrecoverable != 0 {
+				t.Fatalf("damage not found: %+v, %v", report, err)
+			}
+
+			if _, err := fecRepair(""); err != nil {
+				t.Fatalf("repair: %v", err)
+			}
+			if got, _ := os.ReadFile(archivePath); !bytes.Equal(got, clean) {
+				t.Fatalf("repaired archive differs from the original encoding")
+			}
+		})
+	}
+}
+
+func TestFECRepairUnrecoverable(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "in.goxa")
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(4)).Read(data)
+	os.WriteFile(in, data, 0o644)
+	fecDataShards, fecParityShards = 4, 1
+	defer func() {
+		fecDataShards, fecParityShards = 10, 3
+		archivePath = defaultArchiveName
+	}()
+	archivePath = filepath.Join(tempDir, "a.goxaf")
+	if err := encodeWithFEC(in, archivePath); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	f, _ := os.Open(archivePath)
+	h, _ := readFECHeader(f)
+	f.Close()
+	d, _ := os.ReadFile(archivePath)
+	d[h.shardOffset(0, 0)] ^= 0xff
+	d[h.shardOffset(2, 0)] ^= 0xff
+	os.WriteFile(archivePath, d, 0o644)
+
+	report, err := fecRepair(filepath.Join(tempDir, "out.goxaf"))
+	if err == nil || report == nil || report.Unrecoverable != 1 {
+		t.Fatalf("expected an unrecoverable stripe, got %+v, %v", report, err)
+	}
+	if report.Shards[0].Damaged != 1 || report.Shards[2].Damaged != 1 || report.Shards[1].Damaged != 0 {
+		t.Fatalf("wrong shards reported: %+v", report.Shards)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "out.goxaf")); err == nil {
+		t.Fatalf("output written for an unrecoverable archive")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// fecMagicStriped starts the striped layout, written and read front to
+	// back in groups of interleaved stripes.
+	fecMagicStriped  = "GOXAFES"
+	fecStripedHdrLen = len(fecMagicStriped) + 1 + 1 + 4 + 2 + 4
+	fecGroupMagic    = "GXFG"
+	fecGroupHdrLen   = 4 + 8 + 8 + 4
+	fecEndMagic      = "GXFE"
+	fecEndLen        = 4 + 8 + 8 + 4
+	// fecMaxGroup bounds the stored size of a group, which the reader
+	// holds in memory whole.
+	fecMaxGroup = 1 << 30
+)
+
+// fecStriped describes the striped FEC layout. Each stripe of input is
+// split into dataShards pieces of pieceSize bytes and parityShards parity
+// pieces are added. depth stripes form a group, stored shard by shard so
+// a burst of damage hits few pieces of any one stripe.
+type fecStriped struct {
+	dataShards   int
+	parityShards int
+	pieceSize    int
+	depth        int
+}
+
+func (s *fecStriped) totalShards() int {
+	return s.dataShards + s.parityShards
+}
+
+// stripeData returns the archive bytes held by one stripe.
+func (s *fecStriped) stripeData() int {
+	return s.pieceSize * s.dataShards
+}
+
+// groupLen returns the stored size of a group of stripes stripes.
+func (s *fecStriped) groupLen(stripes int) int {
+	return fecGroupHdrLen + stripes*s.totalShards()*(s.pieceSize+4)
+}
+
+// pieceOffset returns where piece i of stripe k starts within a group of
+// stripes stripes.
+func (s *fecStriped) pieceOffset(stripes, k, i int) int {
+	return fecGroupHdrLen + (i*stripes+k)*(s.pieceSize+4)
+}
+
+func (s *fecStriped) encodeHeader() []byte {
+	buf := []byte(fecMagicStriped)
+	buf = append(buf, uint8(s.dataShards), uint8(s.parityShards))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.pieceSize))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(s.depth))
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// readFECStripedHeader reads the header of the striped layout from r.
+func readFECStripedHeader(r io.Reader) (*fecStriped, error) {
+	buf := make([]byte, fecStripedHdrLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read FEC header: %w", err)
+	}
+	if string(buf[:len(fecMagicStriped)]) != fecMagicStriped {
+		return nil, fmt.Errorf("invalid FEC file")
+	}
+	end := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.LittleEndian.Uint32(buf[end:]) {
+		return nil, fmt.Errorf("FEC header checksum mismatch")
+	}
+	pos := len(fecMagicStriped)
+	s := &fecStriped{
+		dataShards:   int(buf[pos]),
+		parityShards: int(buf[pos+1]),
+		pieceSize:    int(binary.LittleEndian.Uint32(buf[pos+2:])),
+		depth:        int(binary.LittleEndian.Uint16(buf[pos+6:])),
+	}
+	if s.dataShards == 0 || s.pieceSize == 0 || s.depth == 0 || s.groupLen(s.depth) > fecMaxGroup {
+		return nil, fmt.Errorf("invalid FEC header")
+	}
+	return s, nil
+}
+
+// fecStripeWriter encodes everything written to it in the striped layout.
+// Only one group is held in memory.
+type fecStripeWriter struct {
+	w      io.Writer
+	s      *fecStriped
+	enc    reedsolomon.Encoder
+	buf    []byte
+	n      int
+	parity [][]byte
+	out    []byte
+	groups uint64
+	size   uint64
+}
+
+// fecStripedConfig returns the striped layout set by the FEC options.
+func fecStripedConfig() *fecStriped {
+	return &fecStriped{
+		dataShards:   fecDataShards,
+		parityShards: fecParityShards,
+		pieceSize:    (fecStripe*1024 + fecDataShards - 1) / fecDataShards,
+		depth:        fecInterleave,
+	}
+}
+
+// newFECStripeWriter writes the header of the striped layout s to w.
+func newFECStripeWriter(w io.Writer, s *fecStriped) (*fecStripeWriter, error) {
+	if s.groupLen(s.depth) > fecMaxGroup {
+		return nil, fmt.Errorf("FEC group of %d stripes is larger than %d bytes", s.depth, fecMaxGroup)
+	}
+	enc, err := reedsolomon.New(s.dataShards, s.parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(s.encodeHeader()); err != nil {
+		return nil, err
+	}
+	fw := &fecStripeWriter{
+		w:      w,
+		s:      s,
+		enc:    enc,
+		buf:    make([]byte, s.stripeData()*s.depth),
+		parity: make([][]byte, s.depth*s.parityShards),
+		out:    make([]byte, 0, s.groupLen(s.depth)),
+	}
+	for i := range fw.parity {
+		fw.parity[i] = make([]byte, s.pieceSize)
+	}
+	return fw, nil
+}
+
+func (fw *fecStripeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(fw.buf[fw.n:], p)
+		fw.n += n
+		p = p[n:]
+		written += n
+		if fw.n == len(fw.buf) {
+			if err := fw.flushGroup(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flushGroup encodes and writes the buffered stripes.
+func (fw *fecStripeWriter) flushGroup() error {
+	s := fw.s
+	stripes := (fw.n + s.stripeData() - 1) / s.stripeData()
+	clear(fw.buf[fw.n : stripes*s.stripeData()])
+
+	pieces := make([][][]byte, stripes)
+	for k := range pieces {
+		stripe := fw.buf[k*s.stripeData() : (k+1)*s.stripeData()]
+		pieces[k] = make([][]byte, s.totalShards())
+		for i := 0; i < s.dataShards; i++ {
+			pieces[k][i] = stripe[i*s.pieceSize : (i+1)*s.pieceSize]
+		}
+		copy(pieces[k][s.dataShards:], fw.parity[k*s.parityShards:(k+1)*s.parityShards])
+		if err := fw.enc.Encode(pieces[k]); err != nil {
+			return err
+		}
+	}
+
+	out := append(fw.out[:0], fecGroupMagic...)
+	out = binary.LittleEndian.AppendUint64(out, fw.groups)
+	out = binary.LittleEndian.AppendUint64(out, uint64(fw.n))
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+	for i := 0; i < s.totalShards(); i++ {
+		for k := 0; k < stripes; k++ {
+			out = append(out, pieces[k][i]...)
+			out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(pieces[k][i]))
+		}
+	}
+	fw.out = out
+	fw.groups++
+	fw.size += uint64(fw.n)
+	fw.n = 0
+	_, err := fw.w.Write(out)
+	return err
+}
+
+// Close writes the last group and the end record. The underlying writer
+// is left open.
+func (fw *fecStripeWriter) Close() error {
+	if fw.n > 0 {
+		if err := fw.flushGroup(); err != nil {
+			return err
+		}
+	}
+	end := []byte(fecEndMagic)
+	end = binary.LittleEndian.AppendUint64(end, fw.size)
+	end = binary.LittleEndian.AppendUint64(end, fw.groups)
+	end = binary.LittleEndian.AppendUint32(end, crc32.ChecksumIEEE(end))
+	_, err := fw.w.Write(end)
+	return err
+}
+
+// fecStripeReader decodes the striped layout read front to back,
+// rebuilding pieces that fail their checksum. Only one group is held in
+// memory.
+type fecStripeReader struct {
+	r      *bufio.Reader
+	s      *fecStriped
+	enc    reedsolomon.Encoder
+	buf    []byte
+	out    []byte
+	pieces [][]byte
+	group  uint64
+	size   uint64
+	done   bool
+	// damage counts the rebuilt pieces per shard
+	damage fecDamage
+}
+
+// newFECStripeReader reads the striped layout header from r.
+func newFECStripeReader(r io.Reader) (*fecStripeReader, error) {
+	br := bufio.NewReaderSize(r, readBuffer)
+	s, err := readFECStripedHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := reedsolomon.New(s.dataShards, s.parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &fecStripeReader{
+		r:      br,
+		s:      s,
+		enc:    enc,
+		buf:    make([]byte, s.groupLen(s.depth)),
+		pieces: make([][]byte, s.totalShards()),
+		damage: make(fecDamage, s.totalShards()),
+	}, nil
+}
+
+func (fr *fecStripeReader) Read(p []byte) (int, error) {
+	for len(fr.out) == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		if err := fr.nextGroup(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, fr.out)
+	fr.out = fr.out[n:]
+	return n, nil
+}
+
+// nextGroup reads and decodes the next group.
+func (fr *fecStripeReader) nextGroup() error {
+	group, stripes, end, err := fr.readGroup()
+	if err != nil {
+		return err
+	}
+	if stripes > 0 {
+		if err := fr.decodeGroup(group, stripes); err != nil {
+			return err
+		}
+	}
+	if end != nil && !fr.checkEnd(end) {
+		doLog(false, "FEC: end record damaged or wrong, the archive size can't be confirmed")
+	}
+	return nil
+}
+
+// readGroup reads the next group and, after the last one, the end record.
+// Groups are found by their size alone, so a damaged group header doesn't
+// lose the group. Only the last group may hold fewer stripes.
+func (fr *fecStripeReader) readGroup() (group []byte, stripes int, end []byte, err error) {
+	s := fr.s
+	n, err := io.ReadFull(fr.r, fr.buf)
+	switch {
+	case err == nil:
+		if peek, _ := fr.r.Peek(fecEndLen + 1); len(peek) == fecEndLen {
+			end = bytes.Clone(peek)
+			fr.r.Discard(fecEndLen)
+		}
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		if n < fecEndLen {
+			return nil, 0, nil, fmt.Errorf("FEC data truncated")
+		}
+		end = bytes.Clone(fr.buf[n-fecEndLen : n])
+		n -= fecEndLen
+	default:
+		return nil, 0, nil, err
+	}
+	fr.done = end != nil
+	if n == 0 {
+		return nil, 0, end, nil
+	}
+	pieceLen := s.totalShards() * (s.pieceSize + 4)
+	stripes = (n - fecGroupHdrLen) / pieceLen
+	if n < fecGroupHdrLen || stripes == 0 || fecGroupHdrLen+stripes*pieceLen != n {
+		return nil, 0, nil, fmt.Errorf("FEC group %v truncated", fr.group)
+	}
+	return fr.buf[:n], stripes, end, nil
+}
+
+// groupData returns how many archive bytes a group of stripes stripes
+// holds and whether its header is intact. With a damaged header the
+// stripes are assumed to be full.
+func (fr *fecStripeReader) groupData(group []byte, stripes int) (int, bool, error) {
+	dataLen := stripes * fr.s.stripeData()
+	hdr := group[:fecGroupHdrLen]
+	if string(hdr[:4]) != fecGroupMagic || crc32.ChecksumIEEE(hdr[:fecGroupHdrLen-4]) != binary.LittleEndian.Uint32(hdr[fecGroupHdrLen-4:]) {
+		return dataLen, false, nil
+	}
+	if idx := binary.LittleEndian.Uint64(hdr[4:]); idx != fr.group {
+		return 0, false, fmt.Errorf("FEC group %v found where %v was expected", idx, fr.group)
+	}
+	return min(dataLen, int(binary.LittleEndian.Uint64(hdr[12:]))), true, nil
+}
+
+// checkStripe points fr.pieces at the pieces of stripe k, leaving those
+// failing their checksum nil, and counts them in fr.damage. It returns
+// the number of damaged pieces.
+func (fr *fecStripeReader) checkStripe(group []byte, stripes, k int) int {
+	s := fr.s
+	bad := 0
+	for i := range fr.pieces {
+		off := s.pieceOffset(stripes, k, i)
+		fr.pieces[i] = group[off : off+s.pieceSize]
+		if crc32.ChecksumIEEE(fr.pieces[i]) != binary.LittleEndian.Uint32(group[off+s.pieceSize:]) {
+			fr.pieces[i] = nil
+			fr.damage[i]++
+			bad++
+		}
+	}
+	return bad
+}
+
+// decodeGroup decodes the stripes of one group into fr.out.
+func (fr *fecStripeReader) decodeGroup(group []byte, stripes int) error {
+	s := fr.s
+	dataLen, ok, err := fr.groupData(group, stripes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		doLog(false, "FEC: header of group %v damaged, assuming %v stripes", fr.group, stripes)
+	}
+
+	out := fr.out[:0]
+	for k := 0; k < stripes; k++ {
+		bad := fr.checkStripe(group, stripes, k)
+		if bad > s.parityShards {
+			return fmt.Errorf("stripe %v of FEC group %v has %v damaged pieces, only %v can be rebuilt", k, fr.group, bad, s.parityShards)
+		}
+		if bad > 0 {
+			if err := fr.enc.ReconstructData(fr.pieces); err != nil {
+				return fmt.Errorf("rebuild stripe %v of FEC group %v: %w", k, fr.group, err)
+			}
+		}
+		for _, piece := range fr.pieces[:s.dataShards] {
+			out = append(out, piece...)
+		}
+	}
+	fr.out = out[:dataLen]
+	fr.group++
+	fr.size += uint64(dataLen)
+	return nil
+}
+
+// checkEnd reports whether the end record is intact and matches what was
+// decoded.
+func (fr *fecStripeReader) checkEnd(end []byte) bool {
+	if string(end[:4]) != fecEndMagic || crc32.ChecksumIEEE(end[:fecEndLen-4]) != binary.LittleEndian.Uint32(end[fecEndLen-4:]) {
+		return false
+	}
+	return binary.LittleEndian.Uint64(end[4:]) == fr.size && binary.LittleEndian.Uint64(end[12:]) == fr.group
+}
+
+// encodeFECStriped writes in to out in the striped layout.
+func encodeFECStriped(in io.Reader, out io.Writer, p *progressData) error {
+	fw, err := newFECStripeWriter(out, fecStripedConfig())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, progressReader{r: in, p: p}); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+// decodeFECStriped decodes the striped layout in src to out.
+func decodeFECStriped(src io.Reader, out io.Writer, p *progressData) error {
+	fr, err := newFECStripeReader(progressReader{r: src, p: p})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, fr); err != nil {
+		return err
+	}
+	if fr.damage.String() != "none" {
+		doLog(false, "FEC: rebuilt damaged stripes in %v", fr.damage)
+	}
+	return nil
+}
+
+// isFECStriped reports whether r starts with the striped layout.
+func isFECStriped(r io.ReaderAt) bool {
+	buf := make([]byte, len(fecMagicStriped))
+	_, err := r.ReadAt(buf, 0)
+	return err == nil && string(buf) == fecMagicStriped
+}
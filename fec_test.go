@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFECRepair(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "in.goxa")
+	data := make([]byte, 1<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	os.WriteFile(in, data, 0o644)
+
+	fecDataShards, fecParityShards = 4, 2
+	defer func() { fecDataShards, fecParityShards = 10, 3 }()
+	out := filepath.Join(tempDir, "out.goxaf")
+	if err := encodeWithFEC(in, out); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	f, _ := os.Open(out)
+	h, err := readFECHeader(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	enc, _ := os.ReadFile(out)
+
+	damage := func(shard, stripe int) []byte {
+		d := bytes.Clone(enc)
+		off := h.shardOffset(shard, stripe)
+		for i := off + 10; i < off+100; i++ {
+			d[i] ^= 0xff
+		}
+		return d
+	}
+
+	// Two damaged shards per stripe can be rebuilt with two parity shards
+	d := damage(1, 0)
+	copy(d[h.shardOffset(5, 0):], damage(5, 0)[h.shardOffset(5, 0):h.shardOffset(5, 1)])
+	copy(d[h.shardOffset(3, 2):], damage(3, 2)[h.shardOffset(3, 2):h.shardOffset(3, 3)])
+	os.WriteFile(out, d, 0o644)
+	name, cleanup, err := decodeWithFEC(out)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got, _ := os.ReadFile(name)
+	cleanup()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("repaired data differs")
+	}
+
+	copy(d[h.shardOffset(2, 0):], damage(2, 0)[h.shardOffset(2, 0):h.shardOffset(2, 1)])
+	os.WriteFile(out, d, 0o644)
+	if _, _, err := decodeWithFEC(out); err == nil {
+		t.Fatalf("expected an error with three damaged shards in one stripe")
+	}
+
+	// A flipped bit in the checksum table falls back to the parity
+	d = damage(1, 0)
+	table := len(fecMagicV2) + 2 + 8 + 8 + 4
+	d[table+4*(2*h.stripes()+1)] ^= 0x01
+	os.WriteFile(out, d, 0o644)
+	name, cleanup, err = decodeWithFEC(out)
+	if err != nil {
+		t.Fatalf("decode with damaged table: %v", err)
+	}
+	got, _ = os.ReadFile(name)
+	cleanup()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data differs with damaged table")
+	}
+	report, err := fecVerify(out)
+	if err != nil || report.Damaged != 1 || report.Records != 1 {
+		t.Fatalf("unexpected report with damaged table: %+v, %v", report, err)
+	}
+}
+
+func TestFECStriped(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "in.goxa")
+	data := make([]byte, 300000+77)
+	rand.New(rand.NewSource(2)).Read(data)
+	os.WriteFile(in, data, 0o644)
+
+	fecDataShards, fecParityShards = 4, 2
+	fecStripe, fecInterleave = 4, 8
+	defer func() {
+		fecDataShards, fecParityShards = 10, 3
+		fecStripe, fecInterleave = 0, 16
+	}()
+	out := filepath.Join(tempDir, "out.goxaf")
+	if err := encodeWithFEC(in, out); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	enc, _ := os.ReadFile(out)
+	s, err := readFECStripedHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	group := func(g int) int { return fecStripedHdrLen + g*s.groupLen(s.depth) }
+
+	// A burst as long as two shards of a group hits two pieces of every
+	// stripe, which two parity shards can rebuild
+	d := bytes.Clone(enc)
+	burst := group(2) + s.pieceOffset(s.depth, 0, 1)
+	for i := burst; i < burst+2*s.depth*(s.pieceSize+4); i++ {
+		d[i] = 0
+	}
+	// Scattered damage, including a group header
+	d[group(3)+5] ^= 0xff
+	d[group(5)+s.pieceOffset(s.depth, 3, 0)+7] ^= 0xff
+	d[len(d)-100] ^= 0xff
+	os.WriteFile(out, d, 0o644)
+
+	name, cleanup, err := decodeWithFEC(out)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got, _ := os.ReadFile(name)
+	cleanup()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("repaired data differs")
+	}
+
+	// The same damage read from a stream
+	fr, err := newFECStripeReader(bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("stream reader: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(fr); err != nil {
+		t.Fatalf("stream decode: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("stream decoded data differs")
+	}
+	if fr.damage[1] != s.depth || fr.damage[2] != s.depth {
+		t.Fatalf("unexpected damage: %v", fr.damage)
+	}
+
+	// A third damaged shard in a stripe is too much
+	for i := burst; i < burst+3*s.depth*(s.pieceSize+4); i++ {
+		d[i] = 0
+	}
+	os.WriteFile(out, d, 0o644)
+	if _, _, err := decodeWithFEC(out); err == nil {
+		t.Fatalf("expected an error with three damaged shards in one stripe")
+	}
+	// Groups the reader would refuse are never written
+	fecStripe, fecInterleave = 1<<20, 1<<16-1
+	if _, err := newFECStripeWriter(io.Discard, fecStripedConfig()); err == nil {
+		t.Fatalf("expected an error for an oversized group")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	stdgzip "compress/gzip"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/s2"
+)
+
+// frameReader is the input needed to find where a compressed block ends.
+type frameReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// errFrameUnsupported is returned for compression types whose block
+// boundaries can't be found without the trailer.
+var errFrameUnsupported = fmt.Errorf("block boundaries of this compression type can't be found without the trailer")
+
+// readFrame reads one compressed block holding rawSize uncompressed bytes
+// from r and returns its compressed bytes. It relies only on the framing
+// of each compression format so archives can be read front to back without
+// the block index in the trailer.
+func readFrame(r frameReader, cType uint8, rawSize uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	rec := &recordReader{r: r, buf: &buf}
+	var err error
+	switch cType {
+	case compZstd:
+		err = skipZstdFrame(rec)
+	case compLZ4:
+		err = skipLZ4Frame(rec)
+	case compS2, compSnappy:
+		err = skipSnappyFrame(rec, cType, rawSize)
+	case compXZ:
+		err = skipXZStream(rec)
+	case compGzip:
+		err = skipGzipMember(rec)
+	default:
+		err = errFrameUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// recordReader copies everything read through it into buf.
+type recordReader struct {
+	r   frameReader
+	buf *bytes.Buffer
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf.Write(p[:n])
+	return n, err
+}
+
+func (rr *recordReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.buf.WriteByte(b)
+	}
+	return b, err
+}
+
+func skipN(r io.Reader, n int64) error {
+	_, err := io.CopyN(io.Discard, r, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipZstdFrame walks the block headers of a single zstd frame.
+func skipZstdFrame(r frameReader) error {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(hdr[:4]) != 0xFD2FB528 {
+		return fmt.Errorf("zstd: bad frame magic")
+	}
+	desc := hdr[4]
+	fcsFlag := desc >> 6
+	single := desc&0x20 != 0
+	hasSum := desc&0x04 != 0
+	skip := int64(0)
+	if !single {
+		skip++ // window descriptor
+	}
+	skip += []int64{0, 1, 2, 4}[desc&0x03]
+	switch fcsFlag {
+	case 0:
+		if single {
+			skip++
+		}
+	case 1:
+		skip += 2
+	case 2:
+		skip += 4
+	case 3:
+		skip += 8
+	}
+	if err := skipN(r, skip); err != nil {
+		return err
+	}
+	for {
+		var bh [3]byte
+		if _, err := io.ReadFull(r, bh[:]); err != nil {
+			return err
+		}
+		v := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+		last := v&1 != 0
+		size := int64(v >> 3)
+		switch (v >> 1) & 3 {
+		case 1: // RLE
+			size = 1
+		case 3:
+			return fmt.Errorf("zstd: reserved block type")
+		}
+		if err := skipN(r, size); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if hasSum {
+		return skipN(r, 4)
+	}
+	return nil
+}
+
+// skipLZ4Frame walks the blocks of a single LZ4 frame.
+func skipLZ4Frame(r frameReader) error {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(hdr[:4]) != 0x184D2204 {
+		return fmt.Errorf("lz4: bad frame magic")
+	}
+	flg := hdr[4]
+	blockSum := flg&0x10 != 0
+	contentSize := flg&0x08 != 0
+	contentSum := flg&0x04 != 0
+	dictID := flg&0x01 != 0
+	skip := int64(1) // header checksum
+	if contentSize {
+		skip += 8
+	}
+	if dictID {
+		skip += 4
+	}
+	if err := skipN(r, skip); err != nil {
+		return err
+	}
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+		n := int64(size & 0x7FFFFFFF)
+		if blockSum {
+			n += 4
+		}
+		if err := skipN(r, n); err != nil {
+			return err
+		}
+	}
+	if contentSum {
+		return skipN(r, 4)
+	}
+	return nil
+}
+
+// skipSnappyFrame walks snappy/S2 framed chunks until rawSize bytes of
+// data have been seen. The framing has no end marker.
+func skipSnappyFrame(r frameReader, cType uint8, rawSize uint64) error {
+	var seen uint64
+	for seen < rawSize {
+		var ch [4]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			return err
+		}
+		length := int(ch[1]) | int(ch[2])<<8 | int(ch[3])<<16
+		switch {
+		case ch[0] == 0x00:
+			if length < 4 {
+				return fmt.Errorf("snappy: short chunk")
+			}
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return err
+			}
+			var n int
+			var err error
+			if cType == compS2 {
+				n, err = s2.DecodedLen(chunk[4:])
+			} else {
+				n, err = snappy.DecodedLen(chunk[4:])
+			}
+			if err != nil {
+				return err
+			}
+			seen += uint64(n)
+		case ch[0] == 0x01:
+			if length < 4 {
+				return fmt.Errorf("snappy: short chunk")
+			}
+			if err := skipN(r, int64(length)); err != nil {
+				return err
+			}
+			seen += uint64(length - 4)
+		case ch[0] >= 0x02 && ch[0] <= 0x7f:
+			return fmt.Errorf("snappy: unsupported chunk type %#x", ch[0])
+		default:
+			// stream identifier, padding and skippable chunks
+			if err := skipN(r, int64(length)); err != nil {
+				return err
+			}
+		}
+	}
+	if seen != rawSize {
+		return fmt.Errorf("snappy: block holds %v bytes, expected %v", seen, rawSize)
+	}
+	return nil
+}
+
+// skipGzipMember decodes a single gzip member. Given an io.ByteReader the
+// standard library reader consumes exactly the member and nothing more.
+func skipGzipMember(r frameReader) error {
+	gr, err := stdgzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	gr.Multistream(false)
+	if _, err := io.Copy(io.Discard, gr); err != nil {
+		return err
+	}
+	return gr.Close()
+}
+
+// skipXZStream walks a single xz stream holding LZMA2 blocks.
+func skipXZStream(r frameReader) error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:6], []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}) {
+		return fmt.Errorf("xz: bad stream magic")
+	}
+	checkLen := int64(0)
+	if ct := hdr[7] & 0x0f; ct > 0 {
+		checkLen = 4 << ((ct - 1) / 3)
+	}
+
+	for {
+		first, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if first == 0x00 {
+			break // index indicator
+		}
+		hlen := (int64(first) + 1) * 4
+		bh := make([]byte, hlen-1)
+		if _, err := io.ReadFull(r, bh); err != nil {
+			return err
+		}
+		compSize, err := xzBlockCompressedSize(bh)
+		if err != nil {
+			return err
+		}
+		if compSize < 0 {
+			if compSize, err = skipLZMA2(r); err != nil {
+				return err
+			}
+		} else if err := skipN(r, compSize); err != nil {
+			return err
+		}
+		pad := (4 - (hlen+compSize)%4) % 4
+		if err := skipN(r, pad+checkLen); err != nil {
+			return err
+		}
+	}
+
+	// Index: record count, records, padding, CRC32
+	idxLen := int64(1)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	idxLen += int64(uvarintLen(count))
+	for i := uint64(0); i < count*2; i++ {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		idxLen += int64(uvarintLen(v))
+	}
+	pad := (4 - idxLen%4) % 4
+	// padding, index CRC32 and the stream footer
+	return skipN(r, pad+4+12)
+}
+
+// xzBlockCompressedSize returns the compressed size stored in an xz block
+// header or -1 when absent. Only a lone LZMA2 filter is supported.
+func xzBlockCompressedSize(bh []byte) (int64, error) {
+	br := bytes.NewReader(bh)
+	flags, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	compSize := int64(-1)
+	if flags&0x40 != 0 {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, err
+		}
+		compSize = int64(v)
+	}
+	if flags&0x80 != 0 {
+		if _, err := binary.ReadUvarint(br); err != nil {
+			return 0, err
+		}
+	}
+	id, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, err
+	}
+	if flags&0x03 != 0 || id != 0x21 {
+		return 0, fmt.Errorf("xz: only LZMA2 blocks are supported")
+	}
+	return compSize, nil
+}
+
+// skipLZMA2 walks LZMA2 chunk headers up to the end marker and returns the
+// number of bytes consumed.
+func skipLZMA2(r frameReader) (int64, error) {
+	var total int64
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		total++
+		switch {
+		case c == 0x00:
+			return total, nil
+		case c == 0x01 || c == 0x02:
+			var sz [2]byte
+			if _, err := io.ReadFull(r, sz[:]); err != nil {
+				return 0, err
+			}
+			n := int64(binary.BigEndian.Uint16(sz[:])) + 1
+			if err := skipN(r, n); err != nil {
+				return 0, err
+			}
+			total += 2 + n
+		case c >= 0x80:
+			var sz [4]byte
+			if _, err := io.ReadFull(r, sz[:]); err != nil {
+				return 0, err
+			}
+			n := int64(binary.BigEndian.Uint16(sz[2:])) + 1
+			total += 4
+			if c >= 0xc0 {
+				n++ // properties byte
+			}
+			if err := skipN(r, n); err != nil {
+				return 0, err
+			}
+			total += n
+		default:
+			return 0, fmt.Errorf("xz: invalid LZMA2 control byte %#x", c)
+		}
+	}
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+// ArchiveHeader holds the parsed header of a goxa archive. Blocks and
+// offsets of Files are only filled in once the trailer has been read.
+type ArchiveHeader struct {
+	Version       uint16
+	Flags         BitFlags
+	CompType      uint8
+	SumType       uint8
+	SumLen        uint8
+	BlockSize     uint32
+	TrailerOffset uint64
+	ArcSize       uint64
+	Dirs          []FileEntry
+	Files         []FileEntry
+	Sum           []byte
+}
+
+// readHeader parses an archive header from r, leaving r positioned at
+// the start of the file data. The header checksum is read but not
+// verified, see ArchiveHeader.Verify.
+func readHeader(r io.Reader) (*ArchiveHeader, error) {
+	h := &ArchiveHeader{}
+
+	readMagic := make([]byte, 4)
+	if _, err := io.ReadFull(r, readMagic); err != nil {
+		return nil, fmt.Errorf("failed to read magic: %w", err)
+	}
+	if string(readMagic) != magic {
+		return nil, fmt.Errorf("File does not appear to be a goxa archive")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.Version); err != nil {
+		return nil, fmt.Errorf("failed to read version: %w", err)
+	}
+	if h.Version != protoVersion2 {
+		return nil, fmt.Errorf("Archive is of an unsupported version: %v", h.Version)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.Flags); err != nil {
+		return nil, fmt.Errorf("failed to read feature flags: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.CompType); err != nil {
+		return nil, fmt.Errorf("failed to read compression type: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.SumType); err != nil {
+		return nil, fmt.Errorf("failed to read checksum type: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.SumLen); err != nil {
+		return nil, fmt.Errorf("failed to read checksum length: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.BlockSize); err != nil {
+		return nil, fmt.Errorf("failed to read block size: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.TrailerOffset); err != nil {
+		return nil, fmt.Errorf("failed to read trailer offset: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.ArcSize); err != nil {
+		return nil, fmt.Errorf("failed to read archive size: %w", err)
+	}
+
+	//Empty Directories
+	var numEmptyDirs uint64
+	if err := binary.Read(r, binary.LittleEndian, &numEmptyDirs); err != nil {
+		return nil, fmt.Errorf("failed to read empty directory count: %w", err)
+	}
+	for n := uint64(0); n < numEmptyDirs; n++ {
+		var fileMode uint32
+		var modTime int64
+		if h.Flags.IsSet(fPermissions) {
+			if err := binary.Read(r, binary.LittleEndian, &fileMode); err != nil {
+				return nil, fmt.Errorf("failed to read directory mode: %w", err)
+			}
+		}
+		if h.Flags.IsSet(fModDates) {
+			if err := binary.Read(r, binary.LittleEndian, &modTime); err != nil {
+				return nil, fmt.Errorf("failed to read directory mod time: %w", err)
+			}
+		}
+		pathName, err := ReadLPString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory path: %w", err)
+		}
+		h.Dirs = append(h.Dirs, FileEntry{Path: pathName, Mode: fs.FileMode(fileMode), ModTime: time.Unix(modTime, 0).UTC()})
+	}
+
+	//Files
+	var numFiles uint64
+	if err := binary.Read(r, binary.LittleEndian, &numFiles); err != nil {
+		return nil, fmt.Errorf("failed to read file count: %w", err)
+	}
+	for n := uint64(0); n < numFiles; n++ {
+		var fileSize uint64
+		var fileMode uint32
+		var modTime int64
+
+		if err := binary.Read(r, binary.LittleEndian, &fileSize); err != nil {
+			return nil, fmt.Errorf("failed to read file size: %w", err)
+		}
+		if h.Flags.IsSet(fPermissions) {
+			if err := binary.Read(r, binary.LittleEndian, &fileMode); err != nil {
+				return nil, fmt.Errorf("failed to read file mode: %w", err)
+			}
+		}
+		if h.Flags.IsSet(fModDates) {
+			if err := binary.Read(r, binary.LittleEndian, &modTime); err != nil {
+				return nil, fmt.Errorf("failed to read file mod time: %w", err)
+			}
+		}
+		pathName, err := ReadLPString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file path: %w", err)
+		}
+		var ftype uint8
+		if err := binary.Read(r, binary.LittleEndian, &ftype); err != nil {
+			return nil, fmt.Errorf("failed to read file type: %w", err)
+		}
+		var linkName string
+		if ftype == entrySymlink || ftype == entryHardlink {
+			linkName, err = ReadLPString(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read link target: %w", err)
+			}
+		}
+		var changedFlag uint8
+		if err := binary.Read(r, binary.LittleEndian, &changedFlag); err != nil {
+			return nil, fmt.Errorf("failed to read changed flag: %w", err)
+		}
+		h.Files = append(h.Files, FileEntry{Path: pathName, Size: fileSize, Mode: fs.FileMode(fileMode), ModTime: time.Unix(modTime, 0).UTC(), Type: ftype, Linkname: linkName, Changed: changedFlag != 0})
+	}
+
+	h.Sum = make([]byte, h.SumLen)
+	if _, err := io.ReadFull(r, h.Sum); err != nil {
+		return nil, fmt.Errorf("failed to read header checksum: %w", err)
+	}
+	return h, nil
+}
+
+// Encode serializes the header including its checksum.
+func (h *ArchiveHeader) Encode() []byte {
+	var header bytes.Buffer
+
+	binary.Write(&header, binary.LittleEndian, []byte(magic))
+	binary.Write(&header, binary.LittleEndian, h.Version)
+	binary.Write(&header, binary.LittleEndian, h.Flags)
+	binary.Write(&header, binary.LittleEndian, h.CompType)
+	binary.Write(&header, binary.LittleEndian, h.SumType)
+	binary.Write(&header, binary.LittleEndian, h.SumLen)
+	binary.Write(&header, binary.LittleEndian, h.BlockSize)
+	if h.Flags.IsSet(fStreamed) {
+		// Unknown while streaming, the footer holds the real values
+		binary.Write(&header, binary.LittleEndian, uint64(0))
+		binary.Write(&header, binary.LittleEndian, uint64(0))
+	} else {
+		binary.Write(&header, binary.LittleEndian, h.TrailerOffset)
+		binary.Write(&header, binary.LittleEndian, h.ArcSize)
+	}
+
+	binary.Write(&header, binary.LittleEndian, uint64(len(h.Dirs)))
+	for _, folder := range h.Dirs {
+		if h.Flags.IsSet(fPermissions) {
+			binary.Write(&header, binary.LittleEndian, uint32(folder.Mode))
+		}
+		if h.Flags.IsSet(fModDates) {
+			binary.Write(&header, binary.LittleEndian, int64(folder.ModTime.Unix()))
+		}
+		if err := WriteLPString(&header, folder.Path); err != nil {
+			log.Fatalf("write string failed: %v", err)
+		}
+	}
+
+	binary.Write(&header, binary.LittleEndian, uint64(len(h.Files)))
+	for _, file := range h.Files {
+		binary.Write(&header, binary.LittleEndian, uint64(file.Size))
+		if h.Flags.IsSet(fPermissions) {
+			binary.Write(&header, binary.LittleEndian, uint32(file.Mode))
+		}
+		if h.Flags.IsSet(fModDates) {
+			binary.Write(&header, binary.LittleEndian, int64(file.ModTime.Unix()))
+		}
+		if err := WriteLPString(&header, file.Path); err != nil {
+			log.Fatalf("write string failed: %v", err)
+		}
+		header.WriteByte(file.Type)
+		if file.Type == entrySymlink || file.Type == entryHardlink {
+			if err := WriteLPString(&header, file.Linkname); err != nil {
+				log.Fatalf("write string failed: %v", err)
+			}
+		}
+		if h.Version >= protoVersion2 {
+			if file.Changed {
+				header.WriteByte(1)
+			} else {
+				header.WriteByte(0)
+			}
+		}
+	}
+	// File offsets are tracked in the trailer only
+	header.Write(sumBytes(h.SumType, h.SumLen, header.Bytes()))
+	return header.Bytes()
+}
+
+// Verify reports whether the stored header checksum matches its contents.
+func (h *ArchiveHeader) Verify() bool {
+	enc := h.Encode()
+	return bytes.Equal(enc[len(enc)-int(h.SumLen):], h.Sum)
+}
+
+// readTrailer reads the block index that starts at the current position
+// of r into h.Files and verifies the trailer checksum.
+func readTrailer(r io.Reader, h *ArchiveHeader) error {
+	for i := range h.Files {
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return fmt.Errorf("read block count: %w", err)
+		}
+		blocks := make([]Block, 0, min(count, 1024))
+		for b := uint32(0); b < count; b++ {
+			var blk Block
+			if err := binary.Read(r, binary.LittleEndian, &blk.Offset); err != nil {
+				return fmt.Errorf("read block offset: %w", err)
+			}
+			if err := binary.Read(r, binary.LittleEndian, &blk.Size); err != nil {
+				return fmt.Errorf("read block size: %w", err)
+			}
+			if h.Flags.IsSet(fBlockCRC32) {
+				if err := binary.Read(r, binary.LittleEndian, &blk.Sum); err != nil {
+					return fmt.Errorf("read block checksum: %w", err)
+				}
+			}
+			blocks = append(blocks, blk)
+		}
+		h.Files[i].Blocks = blocks
+		if len(blocks) > 0 {
+			off := blocks[0].Offset
+			if h.Flags.IsSet(fStreamed) {
+				// Streamed archives store the checksum after the data
+				last := blocks[len(blocks)-1]
+				h.Files[i].SumOffset = last.Offset + last.Size
+			} else if h.Flags.IsSet(fChecksums) {
+				off -= uint64(h.SumLen)
+				h.Files[i].SumOffset = off
+			}
+			h.Files[i].Offset = off
+		}
+	}
+	tSum := make([]byte, h.SumLen)
+	if _, err := io.ReadFull(r, tSum); err != nil {
+		return fmt.Errorf("read trailer checksum: %w", err)
+	}
+	trailerBytes := encodeTrailer(h.Files, h.Flags, h.SumType, h.SumLen)
+	if !bytes.Equal(trailerBytes[len(trailerBytes)-int(h.SumLen):], tSum) {
+		return fmt.Errorf("trailer checksum mismatch")
+	}
+	return nil
+}
+
+// encodeTrailer serializes the block index of files including its checksum.
+// Block checksums are included when flags has fBlockCRC32.
+func encodeTrailer(files []FileEntry, flags BitFlags, sumType, sumLen uint8) []byte {
+	var trailer bytes.Buffer
+	for _, f := range files {
+		binary.Write(&trailer, binary.LittleEndian, uint32(len(f.Blocks)))
+		for _, b := range f.Blocks {
+			binary.Write(&trailer, binary.LittleEndian, b.Offset)
+			binary.Write(&trailer, binary.LittleEndian, b.Size)
+			if flags.IsSet(fBlockCRC32) {
+				binary.Write(&trailer, binary.LittleEndian, b.Sum)
+			}
+		}
+	}
+	trailer.Write(sumBytes(sumType, sumLen, trailer.Bytes()))
+	return trailer.Bytes()
+}
+
+// encodeFooter serializes the fixed-size footer of a streamed archive.
+func encodeFooter(trailerOffset, arcSize uint64) []byte {
+	footer := make([]byte, footerLen)
+	copy(footer, footerMagic)
+	binary.LittleEndian.PutUint64(footer[4:], trailerOffset)
+	binary.LittleEndian.PutUint64(footer[12:], arcSize)
+	binary.LittleEndian.PutUint32(footer[20:], crc32.ChecksumIEEE(footer[:20]))
+	return footer
+}
+
+// parseFooter validates a streamed archive footer and returns the trailer
+// offset and archive size it records.
+func parseFooter(footer []byte) (uint64, uint64, error) {
+	if len(footer) != footerLen || string(footer[:4]) != footerMagic {
+		return 0, 0, fmt.Errorf("footer not found")
+	}
+	if crc32.ChecksumIEEE(footer[:20]) != binary.LittleEndian.Uint32(footer[20:]) {
+		return 0, 0, fmt.Errorf("footer checksum mismatch")
+	}
+	return binary.LittleEndian.Uint64(footer[4:]), binary.LittleEndian.Uint64(footer[12:]), nil
+}
+
+// readFooter fills in the trailer offset and archive size of a streamed
+// archive from the footer at the end of r.
+func readFooter(r io.ReaderAt, size int64, h *ArchiveHeader) error {
+	if size < footerLen {
+		return fmt.Errorf("footer not found")
+	}
+	footer := make([]byte, footerLen)
+	if _, err := r.ReadAt(footer, size-footerLen); err != nil {
+		return fmt.Errorf("read footer: %w", err)
+	}
+	trailerOffset, arcSize, err := parseFooter(footer)
+	if err != nil {
+		return err
+	}
+	h.TrailerOffset = trailerOffset
+	h.ArcSize = arcSize
+	return nil
+}
+
+// redundantIndex locates the copies of header and trailer that archives
+// with fRedundant keep after the trailer.
+type redundantIndex struct {
+	hdrOff, hdrLen uint64
+	trOff, trLen   uint64
+}
+
+// redundantCopies returns the header and trailer copies written at offset,
+// followed by the fixed-size footer pointing at them.
+func redundantCopies(header, trailer []byte, offset uint64) []byte {
+	out := make([]byte, 0, len(header)+len(trailer)+redundantLen)
+	out = append(out, header...)
+	out = append(out, trailer...)
+	footer := make([]byte, redundantLen)
+	copy(footer, redundantMagic)
+	binary.LittleEndian.PutUint64(footer[4:], offset)
+	binary.LittleEndian.PutUint64(footer[12:], uint64(len(header)))
+	binary.LittleEndian.PutUint64(footer[20:], offset+uint64(len(header)))
+	binary.LittleEndian.PutUint64(footer[28:], uint64(len(trailer)))
+	binary.LittleEndian.PutUint32(footer[36:], crc32.ChecksumIEEE(footer[:36]))
+	return append(out, footer...)
+}
+
+// findRedundant reads the footer locating the header and trailer copies.
+// It precedes the streamed archive footer when there is one, which is
+// detected from the data as the header may be the damaged part.
+func findRedundant(r io.ReaderAt, size int64) (redundantIndex, error) {
+	var idx redundantIndex
+	end := size
+	if size >= footerLen {
+		footer := make([]byte, footerLen)
+		if _, err := r.ReadAt(footer, size-footerLen); err == nil {
+			if _, _, err := parseFooter(footer); err == nil {
+				end -= footerLen
+			}
+		}
+	}
+	if end < redundantLen {
+		return idx, fmt.Errorf("archive holds no header and trailer copies")
+	}
+	footer := make([]byte, redundantLen)
+	if _, err := r.ReadAt(footer, end-redundantLen); err != nil {
+		return idx, fmt.Errorf("read copy footer: %w", err)
+	}
+	if string(footer[:4]) != redundantMagic {
+		return idx, fmt.Errorf("archive holds no header and trailer copies")
+	}
+	if crc32.ChecksumIEEE(footer[:36]) != binary.LittleEndian.Uint32(footer[36:]) {
+		return idx, fmt.Errorf("copy footer checksum mismatch")
+	}
+	idx.hdrOff = binary.LittleEndian.Uint64(footer[4:])
+	idx.hdrLen = binary.LittleEndian.Uint64(footer[12:])
+	idx.trOff = binary.LittleEndian.Uint64(footer[20:])
+	idx.trLen = binary.LittleEndian.Uint64(footer[28:])
+	if idx.hdrOff+idx.hdrLen != idx.trOff || idx.trOff+idx.trLen != uint64(end-redundantLen) {
+		return idx, fmt.Errorf("copy footer offsets don't fit the archive")
+	}
+	return idx, nil
+}
+
+// loadHeader reads the header of arc. When it can't be parsed or fails
+// its checksum and the archive keeps a copy, the copy is used instead.
+// The primary header is returned unverified when there is no good copy.
+// Streamed archives get their trailer offset and size from the footer.
+func loadHeader(arc *BinReader) (*ArchiveHeader, error) {
+	hdr, err := readHeader(arc)
+	if err != nil || !hdr.Verify() {
+		cp, off, cerr := readHeaderCopy(arc)
+		switch {
+		case cerr == nil:
+			doLog(false, "Header damaged, using the copy at offset %v", off)
+			hdr, err = cp, nil
+		case off > 0:
+			doLog(false, "Header damaged and its copy is unusable: %v", cerr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Flags.IsSet(fStreamed) {
+		if err := readFooter(arc, arc.Size(), hdr); err != nil {
+			return nil, err
+		}
+	}
+	return hdr, nil
+}
+
+// loadTrailer reads the block index of arc into hdr, falling back to the
+// copy when the trailer is damaged.
+func loadTrailer(arc *BinReader, hdr *ArchiveHeader) error {
+	_, err := arc.Seek(int64(hdr.TrailerOffset), io.SeekStart)
+	if err == nil {
+		err = readTrailer(arc, hdr)
+	}
+	if err == nil {
+		return nil
+	}
+	off, cerr := readTrailerCopy(arc, hdr)
+	if cerr != nil {
+		if off == 0 {
+			return err
+		}
+		return fmt.Errorf("%w, copy at offset %v: %v", err, off, cerr)
+	}
+	doLog(false, "Trailer damaged (%v), using the copy at offset %v", err, off)
+	return nil
+}
+
+// readHeaderCopy reads and verifies the header copy of arc. The returned
+// offset of the copy is 0 when the archive keeps none.
+func readHeaderCopy(arc *BinReader) (*ArchiveHeader, uint64, error) {
+	idx, err := findRedundant(arc, arc.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr, err := readHeader(bufio.NewReader(io.NewSectionReader(arc, int64(idx.hdrOff), int64(idx.hdrLen))))
+	if err == nil && !hdr.Verify() {
+		err = fmt.Errorf("header copy checksum mismatch")
+	}
+	return hdr, idx.hdrOff, err
+}
+
+// readTrailerCopy reads the trailer copy of arc into hdr and returns its
+// offset, which is 0 when the archive keeps none.
+func readTrailerCopy(arc *BinReader, hdr *ArchiveHeader) (uint64, error) {
+	idx, err := findRedundant(arc, arc.Size())
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(arc, int64(idx.trOff), int64(idx.trLen)), readBuffer)
+	return idx.trOff, readTrailer(r, hdr)
+}
+
+// sumBytes hashes data with the given checksum type, padded or truncated
+// to sumLen bytes.
+func sumBytes(sumType, sumLen uint8, data []byte) []byte {
+	h := newHasher(sumType)
+	h.Write(data)
+	return padSum(h.Sum(nil), sumLen)
+}
+
+// padSum zero pads or truncates sum to sumLen bytes.
+func padSum(sum []byte, sumLen uint8) []byte {
+	if len(sum) < int(sumLen) {
+		pad := make([]byte, int(sumLen)-len(sum))
+		sum = append(sum, pad...)
+	}
+	return sum[:sumLen]
+}
+
+// readArchive opens the goxa archive at path, decoding it when
+// encode is set, and reads and verifies its header and trailer. The
+// returned function closes the archive and removes any decoded copy;
+// calls after the first do nothing.
+func readArchive(path string) (*BinReader, *ArchiveHeader, func(), error) {
+	path, cleanup, err := useRecovery(path, false)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("recovery volumes: %w", err)
+	}
+	src, err := openEncoded(path)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	arc := newBinReader(src)
+	// done may be called again by a deferred call after an early close
+	done := sync.OnceFunc(func() {
+		arc.Close()
+		cleanup()
+	})
+	hdr, err := loadHeader(arc)
+	if err == nil && uint64(arc.Size()) != hdr.ArcSize {
+		err = fmt.Errorf("archive size mismatch")
+	}
+	if err == nil && !hdr.Verify() {
+		err = fmt.Errorf("header checksum mismatch")
+	}
+	if err == nil {
+		err = loadTrailer(arc, hdr)
+	}
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	return arc, hdr, done, nil
+}
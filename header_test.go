@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedundantCopies(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	setupTestTree(t, root)
+
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compType = compZstd
+	configureChecksum("blake3")
+	features = fChecksums | fRedundant
+	archivePath = filepath.Join(tempDir, "plain.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	plain, _ := os.ReadFile(archivePath)
+	features = fChecksums | fRedundant
+	streamed := createToPipe(t, root)
+
+	_, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	done()
+	headerLen := len(hdr.Encode())
+	trailerOffset := int(hdr.TrailerOffset)
+
+	cases := []struct {
+		name    string
+		data    []byte
+		damage  func(data []byte)
+		wantErr bool
+	}{
+		{"header", plain, func(data []byte) {
+			// A byte of the first stored path
+			i := bytes.Index(data[:headerLen], []byte("root"))
+			data[i] ^= 0x01
+		}, false},
+		{"trailer", plain, func(data []byte) { data[trailerOffset+4] ^= 0xff }, false},
+		{"header and copy", plain, func(data []byte) {
+			data[headerLen-1] ^= 0xff
+			data[trailerOffset+len(data[trailerOffset:])/2] ^= 0xff
+		}, true},
+		{"streamed header", streamed, func(data []byte) { data[headerLen-1] ^= 0xff }, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.Clone(tc.data)
+			tc.damage(data)
+			archivePath = filepath.Join(tempDir, strings.ReplaceAll(tc.name, " ", "-")+".goxa")
+			os.WriteFile(archivePath, data, 0o644)
+
+			_, hdr, done, err := readArchive(archivePath)
+			if tc.wantErr {
+				if err == nil {
+					done()
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read archive: %v", err)
+			}
+			done()
+			if len(hdr.Files) != 3 || hdr.Flags.IsNotSet(fRedundant) {
+				t.Fatalf("unexpected header: %+v", hdr)
+			}
+
+			dest := filepath.Join(tempDir, "out-"+filepath.Base(archivePath))
+			features = 0
+			extract([]string{dest}, false, false)
+			checkFile(t, filepath.Join(dest, "root", "dir1", "file1.txt"), []byte("file1"), 0, false)
+			checkFile(t, filepath.Join(dest, "root", "rootfile.txt"), []byte("root"), 0, false)
+		})
+	}
+}
+
+func TestTrailerBlockCRC32(t *testing.T) {
+	files := []FileEntry{{Blocks: []Block{{Offset: 100, Size: 10, Sum: 0xdeadbeef}, {Offset: 110, Size: 20, Sum: 1}}}}
+	for _, tc := range []struct {
+		flags BitFlags
+		entry int
+	}{
+		// The flag of older versions leaves the layout alone
+		{fChecksums | fBlockChecksums, 16},
+		{fChecksums | fBlockCRC32, 20},
+	} {
+		trailer := encodeTrailer(files, tc.flags, sumBlake3, 32)
+		if want := 4 + 2*tc.entry + 32; len(trailer) != want {
+			t.Fatalf("flags %v: trailer of %v bytes, want %v", tc.flags, len(trailer), want)
+		}
+		h := &ArchiveHeader{Flags: tc.flags, SumType: sumBlake3, SumLen: 32, Files: make([]FileEntry, 1)}
+		if err := readTrailer(bytes.NewReader(trailer), h); err != nil {
+			t.Fatalf("flags %v: read trailer: %v", tc.flags, err)
+		}
+		if tc.flags.IsSet(fBlockCRC32) && h.Files[0].Blocks[0].Sum != 0xdeadbeef {
+			t.Fatalf("block checksum not read back")
+		}
+	}
+}
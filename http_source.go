@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// httpChunkSize is the granularity of Range requests. Reads are rounded
+	// out to whole chunks so small sequential reads don't each cost a round
+	// trip.
+	httpChunkSize = 256 * 1024
+	// httpCacheChunks limits how many chunks are kept in memory.
+	httpCacheChunks = 64
+	// httpTimeout bounds each request, so a stalled server fails the read
+	// instead of hanging it.
+	httpTimeout = 2 * time.Minute
+)
+
+// isURL reports whether name is an http or https URL.
+func isURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// urlBaseName returns the last path element of a URL, ignoring any query
+// string, so remote archives get the same default destination and format
+// detection as local ones.
+func urlBaseName(name string) string {
+	u, err := url.Parse(name)
+	if err != nil || u.Path == "" {
+		return name
+	}
+	return path.Base(u.Path)
+}
+
+// httpSource reads a remote archive using HTTP Range requests.
+type httpSource struct {
+	url    string
+	client *http.Client
+	size   int64
+
+	lock   sync.Mutex
+	chunks map[int64][]byte
+	order  []int64
+}
+
+func newHTTPSource(rawURL string) (*httpSource, error) {
+	hs := &httpSource{
+		url:    rawURL,
+		client: &http.Client{Timeout: httpTimeout},
+		chunks: make(map[int64][]byte),
+	}
+
+	// A one byte range request tells us the total size and whether the
+	// server honours ranges at all.
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%s: server does not support range requests (status %v)", rawURL, resp.Status)
+	}
+	cr := resp.Header.Get("Content-Range")
+	if _, _, hs.size, err = parseContentRange(cr); err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	return hs, nil
+}
+
+// parseContentRange splits a "bytes START-END/TOTAL" Content-Range header.
+func parseContentRange(cr string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(cr, "bytes ")
+	rng, size, ok2 := strings.Cut(spec, "/")
+	first, last, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("unknown archive size in Content-Range %q", cr)
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err == nil {
+		end, err = strconv.ParseInt(last, 10, 64)
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	return start, end, total, nil
+}
+
+func (hs *httpSource) Size() int64 {
+	return hs.size
+}
+
+func (hs *httpSource) Close() error {
+	hs.lock.Lock()
+	hs.chunks = make(map[int64][]byte)
+	hs.order = nil
+	hs.lock.Unlock()
+	return nil
+}
+
+// ReadAt implements io.ReaderAt, fetching any missing chunks with a single
+// Range request.
+func (hs *httpSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= hs.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > hs.size {
+		end = hs.size
+	}
+	first := off / httpChunkSize
+	last := (end - 1) / httpChunkSize
+
+	// Take references to cached chunks up front so a concurrent eviction
+	// can't pull them out from under us.
+	hs.lock.Lock()
+	have := make(map[int64][]byte, last-first+1)
+	missFirst, missLast := int64(-1), int64(-1)
+	for c := first; c <= last; c++ {
+		if chunk, ok := hs.chunks[c]; ok {
+			have[c] = chunk
+			continue
+		}
+		if missFirst < 0 {
+			missFirst = c
+		}
+		missLast = c
+	}
+	hs.lock.Unlock()
+
+	if missFirst >= 0 {
+		fetched, err := hs.fetch(missFirst, missLast)
+		if err != nil {
+			return 0, err
+		}
+		hs.lock.Lock()
+		for c, chunk := range fetched {
+			have[c] = chunk
+			hs.store(c, chunk)
+		}
+		hs.lock.Unlock()
+	}
+
+	n := 0
+	for c := first; c <= last; c++ {
+		start := off + int64(n) - c*httpChunkSize
+		n += copy(p[n:end-off], have[c][start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch downloads chunks first through last inclusive.
+func (hs *httpSource) fetch(first, last int64) (map[int64][]byte, error) {
+	start := first * httpChunkSize
+	end := (last+1)*httpChunkSize - 1
+	if end >= hs.size {
+		end = hs.size - 1
+	}
+	req, err := http.NewRequest(http.MethodGet, hs.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range request failed: %v", resp.Status)
+	}
+	// A server or proxy answering with other bytes would poison the cache
+	gotStart, gotEnd, gotSize, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, fmt.Errorf("range request: %w", err)
+	}
+	if gotStart != start || gotEnd != end || gotSize != hs.size {
+		return nil, fmt.Errorf("range request for bytes %d-%d/%d answered with %d-%d/%d", start, end, hs.size, gotStart, gotEnd, gotSize)
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("range request: %w", err)
+	}
+
+	out := make(map[int64][]byte, last-first+1)
+	for c := first; c <= last; c++ {
+		cs := (c - first) * httpChunkSize
+		ce := cs + httpChunkSize
+		if ce > int64(len(data)) {
+			ce = int64(len(data))
+		}
+		out[c] = data[cs:ce]
+	}
+	return out, nil
+}
+
+// store caches a chunk, evicting the oldest once the cache is full.
+// The caller must hold hs.lock.
+func (hs *httpSource) store(c int64, chunk []byte) {
+	if _, ok := hs.chunks[c]; ok {
+		return
+	}
+	if len(hs.order) >= httpCacheChunks {
+		delete(hs.chunks, hs.order[0])
+		hs.order = hs.order[1:]
+	}
+	hs.chunks[c] = chunk
+	hs.order = append(hs.order, c)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (cw countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+func TestHTTPRangeExtract(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	small := []byte("remote hello")
+	if err := os.WriteFile(filepath.Join(root, "a_small.txt"), small, 0o644); err != nil {
+		t.Fatalf("write small: %v", err)
+	}
+	big := make([]byte, 8<<20)
+	rand.Read(big)
+	if err := os.WriteFile(filepath.Join(root, "z_big.bin"), big, 0o644); err != nil {
+		t.Fatalf("write big: %v", err)
+	}
+
+	local := filepath.Join(tempDir, "test.goxa")
+	archivePath = local
+	features = fChecksums
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+
+	var served atomic.Int64
+	var noRange atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			noRange.Add(1)
+		}
+		http.ServeContent(countingResponseWriter{w, &served}, r, "test.goxa", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(tempDir, "out")
+	os.MkdirAll(dest, 0o755)
+	archivePath = srv.URL + "/test.goxa"
+	features = 0
+	extractList = []string{filepath.Join(filepath.Base(root), "a_small.txt")}
+	defer func() { extractList = nil }()
+	extract([]string{dest}, false, false)
+
+	checkFile(t, filepath.Join(dest, filepath.Base(root), "a_small.txt"), small, 0o644, false)
+	if _, err := os.Stat(filepath.Join(dest, filepath.Base(root), "z_big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("unselected file should not exist")
+	}
+	if noRange.Load() != 0 {
+		t.Fatalf("%d requests without a Range header", noRange.Load())
+	}
+	if served.Load() >= int64(len(data))/2 {
+		t.Fatalf("downloaded %d of %d bytes", served.Load(), len(data))
+	}
+}
+
+func TestHTTPSourceNoRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("GOXA"))
+	}))
+	defer srv.Close()
+
+	if _, err := newHTTPSource(srv.URL + "/test.goxa"); err == nil {
+		t.Fatalf("expected error for server without range support")
+	}
+}
+
+func TestHTTPSourceWrongRange(t *testing.T) {
+	data := make([]byte, 3*httpChunkSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always answer with the first bytes, whatever was asked for
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		n := end - start + 1
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", n-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:n])
+	}))
+	defer srv.Close()
+
+	hs, err := newHTTPSource(srv.URL + "/test.goxa")
+	if err != nil {
+		t.Fatalf("newHTTPSource: %v", err)
+	}
+	if _, err := hs.ReadAt(make([]byte, 10), httpChunkSize); err == nil {
+		t.Fatalf("expected error for mismatched Content-Range")
+	}
+	if _, err := hs.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatalf("matching range: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// linkGuard remembers the symlinks created by the running extraction so
+// that link targets can be kept inside the destination and later entries
+// are never written through one of them.
+type linkGuard struct {
+	root  string
+	mu    sync.Mutex
+	links map[string]struct{}
+}
+
+// extractGuard is the guard of the running extraction, nil when link
+// checks are disabled with -safelinks=false.
+var extractGuard *linkGuard
+
+// startLinkGuard sets up extractGuard for an extraction into destination.
+func startLinkGuard(destination string) {
+	if !safeLinks {
+		extractGuard = nil
+		return
+	}
+	root := filepath.Clean(destination)
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	extractGuard = &linkGuard{root: root, links: make(map[string]struct{})}
+}
+
+func (g *linkGuard) abs(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return filepath.Clean(p)
+}
+
+// inside reports whether p is the destination or below it.
+func (g *linkGuard) inside(p string) bool {
+	return p == g.root || strings.HasPrefix(p, g.root+string(os.PathSeparator)) || g.root == string(os.PathSeparator)
+}
+
+// checkPath refuses p when it or one of its parent directories is a
+// symlink created by this extraction.
+func (g *linkGuard) checkPath(p string) error {
+	if g == nil {
+		return nil
+	}
+	p = g.abs(p)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for cur := p; g.inside(cur); cur = filepath.Dir(cur) {
+		if _, ok := g.links[cur]; ok {
+			return fmt.Errorf("%v: refusing to write through symlink %v", p, cur)
+		}
+		if cur == g.root {
+			break
+		}
+	}
+	return nil
+}
+
+// checkSymlink validates a symlink at p pointing at target. The target
+// must stay inside the destination, checked component by component so it
+// can't leave through a symlink created earlier, unless absolute paths
+// are allowed.
+func (g *linkGuard) checkSymlink(p, target string, absPaths bool) error {
+	if g == nil {
+		return nil
+	}
+	if err := g.checkPath(p); err != nil {
+		return err
+	}
+	if absPaths {
+		return nil
+	}
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("%v: symlink target %v is absolute", p, target)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cur := filepath.Dir(g.abs(p))
+	parts := strings.Split(filepath.ToSlash(target), "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+		default:
+			cur = filepath.Join(cur, part)
+		}
+		if !g.inside(cur) {
+			return fmt.Errorf("%v: symlink target %v is outside the destination", p, target)
+		}
+		if _, ok := g.links[cur]; ok && i < len(parts)-1 {
+			return fmt.Errorf("%v: symlink target %v passes through symlink %v", p, target, cur)
+		}
+	}
+	return nil
+}
+
+// checkHardlink validates a hardlink at p to the already extracted source.
+func (g *linkGuard) checkHardlink(p, source string) error {
+	if g == nil {
+		return nil
+	}
+	if err := g.checkPath(p); err != nil {
+		return err
+	}
+	if !g.inside(g.abs(source)) {
+		return fmt.Errorf("%v: hardlink target %v is outside the destination", p, source)
+	}
+	return g.checkPath(source)
+}
+
+// add records a symlink created at p.
+func (g *linkGuard) add(p string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.links[g.abs(p)] = struct{}{}
+	g.mu.Unlock()
+}
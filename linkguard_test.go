@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkGuard(t *testing.T) {
+	dest := t.TempDir()
+	safeLinks = true
+	startLinkGuard(dest)
+	defer func() { extractGuard = nil }()
+	g := extractGuard
+
+	if err := g.checkSymlink(filepath.Join(dest, "a"), "sub", false); err != nil {
+		t.Fatalf("inside symlink refused: %v", err)
+	}
+	g.add(filepath.Join(dest, "a"))
+	if err := g.checkSymlink(filepath.Join(dest, "dot"), ".", false); err != nil {
+		t.Fatalf("dot symlink refused: %v", err)
+	}
+	g.add(filepath.Join(dest, "dot"))
+
+	bad := []struct {
+		name, target string
+	}{
+		{"abs", "/etc"},
+		{"up", "../outside"},
+		{"deep/up", "../../outside"},
+		{"through", "dot/.."},
+		{"a/x", "y"},
+	}
+	for _, tc := range bad {
+		if err := g.checkSymlink(filepath.Join(dest, tc.name), tc.target, false); err == nil {
+			t.Fatalf("symlink %v -> %v allowed", tc.name, tc.target)
+		}
+	}
+	if err := g.checkSymlink(filepath.Join(dest, "abs"), "/etc", true); err != nil {
+		t.Fatalf("absolute paths should allow %v", err)
+	}
+	if err := g.checkSymlink(filepath.Join(dest, "link"), "dot", false); err != nil {
+		t.Fatalf("link to created symlink refused: %v", err)
+	}
+
+	if err := g.checkPath(filepath.Join(dest, "a", "file")); err == nil {
+		t.Fatalf("write through symlink allowed")
+	}
+	if err := g.checkPath(filepath.Join(dest, "a")); err == nil {
+		t.Fatalf("overwriting symlink allowed")
+	}
+	if err := g.checkPath(filepath.Join(dest, "b", "file")); err != nil {
+		t.Fatalf("plain path refused: %v", err)
+	}
+	if err := g.checkHardlink(filepath.Join(dest, "h"), filepath.Join(dest, "..", "x")); err == nil {
+		t.Fatalf("hardlink outside destination allowed")
+	}
+	if err := g.checkHardlink(filepath.Join(dest, "h"), filepath.Join(dest, "a", "x")); err == nil {
+		t.Fatalf("hardlink through symlink allowed")
+	}
+
+	safeLinks = false
+	startLinkGuard(dest)
+	safeLinks = true
+	if extractGuard.checkPath(filepath.Join(dest, "a", "file")) != nil {
+		t.Fatalf("checks should be off with -safelinks=false")
+	}
+}
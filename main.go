@@ -10,6 +10,8 @@ import (
 
 	"path/filepath"
 	"strings"
+
+	"github.com/dustin/go-humanize"
 )
 
 const makeProfile = false
@@ -32,7 +34,7 @@ func main() {
 	}
 
 	cmdLetter, opts := parseCommand(os.Args[1])
-	if !strings.ContainsRune("cljx", rune(cmdLetter)) {
+	if !strings.ContainsRune("cdljx", rune(cmdLetter)) && !isWordMode(cmdLetter) {
 		showUsage()
 		fmt.Printf("\nError: Unknown mode: %s\n", os.Args[1])
 		return
@@ -42,7 +44,7 @@ func main() {
 	flagSet.Parse(os.Args[2:])
 	blockSize = uint32(flagBlockSize)
 
-	quietMode = toStdOut || cmdLetter == 'j'
+	quietMode = toStdOut || cmdLetter == 'j' || jsonOutput
 	if quietMode {
 		progress = false
 	}
@@ -52,19 +54,35 @@ func main() {
 		fmt.Println("goxa v" + appVersion)
 		return
 	}
+	configureVolumes(cmdLetter, mflags.volSize)
 
+	flagSet.Visit(func(f *flag.Flag) {
+		flagsGiven[f.Name] = true
+		if f.Name == "comp" {
+			mflags.compSet = true
+		}
+	})
+	configureCompression(mflags.compSet)
 	mflags.format = detectArchiveFormat(cmdLetter, mflags.format)
 	buildExtractList(mflags.sel)
 
 	applyModeOptions(opts)
 
-	configureCompression(mflags.format)
 	configureSpeed(mflags.speedOpt)
 	configureChecksum(mflags.sumOpt)
 
 	ensureArchiveExtension(cmdLetter, mflags.format)
 
+	if mflags.progressJSON != "" {
+		e, err := openEvents(mflags.progressJSON)
+		if err != nil {
+			log.Fatalf("progress-json: %v", err)
+		}
+		events = e
+		events.begin(modeName(cmdLetter), archivePath)
+	}
 	runMode(cmdLetter, flagSet.Args(), mflags.format)
+	events.finish(0)
 }
 
 func showUsage() {
@@ -78,6 +96,14 @@ func showUsage() {
 	fmt.Println("  l   list archive contents")
 	fmt.Println("  j   output JSON listing")
 	fmt.Println("  x   extract files")
+	fmt.Println("  d   compare the archive with a directory (default .) or another archive")
+	fmt.Println("  convert OUT  convert the archive to OUT (goxa, tar or zip by extension)")
+	fmt.Println("  recompress [OUT]  re-encode a goxa archive with -comp/-speed/-block, in place without OUT")
+	fmt.Println("  merge ARCS...     merge goxa archives into the -arc archive")
+	fmt.Println("  recover [DEST]    salvage a damaged goxa archive into DEST with a lost+found report")
+	fmt.Println("  fec-verify        report the health of every shard of a .goxaf archive")
+	fmt.Println("  fec-repair [OUT]  rebuild damaged shards and parity of a .goxaf archive, in place without OUT")
+	fmt.Println("  bitfix            correct single flipped bits or bytes in blocks using block checksums (b)")
 
 	fmt.Println()
 	fmt.Println("Flags (append after the mode letter):")
@@ -86,39 +112,53 @@ func showUsage() {
 	fmt.Println("  b  per-block checksums          n  disable compression")
 	fmt.Println("  i  include hidden files         o  allow special files")
 	fmt.Println("  u  use flags from archive       v  verbose output")
+	fmt.Println("  r  keep a copy of header and trailer")
 	fmt.Println("  f  force overwrite / ignore read errors")
 
 	fmt.Println()
 	fmt.Println("Options:")
-	fmt.Println("  -arc FILE       archive file name")
+	fmt.Println("  -arc FILE       archive file name, http(s) URL or - (stdin) for l, j and x")
 	fmt.Println("  -stdout         write archive to stdout")
 	fmt.Println("  -files LIST     comma separated files to extract")
+	fmt.Println("  -json           print the d, recover, bitfix or fec-verify/fec-repair report as JSON")
+	fmt.Println("  -conflict P     merge: duplicate paths keep the first or last copy, or error (default)")
 	fmt.Println("  -progress=false disable progress display")
+	fmt.Println("  -progress-json=FD|FILE write NDJSON progress events to a file descriptor or file")
 	fmt.Println("  -interactive=false disable prompts for archive flags")
 	fmt.Println("  -comp ALG       compression algorithm (gzip, zstd, lz4, s2, snappy, brotli, xz, none)")
 	fmt.Println("  -speed LEVEL    compression speed (fastest, default, better, best)")
 	fmt.Println("  -sum ALG        checksum algorithm (crc32, crc16, xxhash, sha256, blake3)")
 	fmt.Println("  -block N        compression block size in bytes")
 	fmt.Println("  -threads N      number of threads to use")
-	fmt.Println("  -format FORMAT  archive format (goxa or tar)")
+	fmt.Println("  -format FORMAT  archive format (goxa, tar or zip)")
 	fmt.Println("  -retries N      retries when file changes during read (0 = never give up)")
 	fmt.Println("  -retrydelay N   delay between retries in seconds")
 	fmt.Println("  -failonchange   treat changed files as fatal errors")
 	fmt.Println("  -bombcheck=false disable zip bomb detection")
 	fmt.Println("  -spacecheck=false disable free space check")
+	fmt.Println("  -safelinks=false allow links leaving the destination")
 	fmt.Println("  -noflush        skip final disk flush")
+	fmt.Println("  -volsize SIZE   split the archive into numbered volumes (e.g. 700MB)")
 	fmt.Println("  -version        print program version")
 	fmt.Println("  -pgo            run built-in PGO training (10k files ~2GB, s-curve around 150KB)")
 	fmt.Println("  -fec-data N     number of FEC data shards (default 10)")
 	fmt.Println("  -fec-parity N   number of FEC parity shards (default 3)")
 	fmt.Println("  -fec-level L    FEC redundancy preset (low, medium, high)")
+	fmt.Println("  -fec-stripe KiB stream FEC in interleaved stripes of this size (0 = whole file)")
+	fmt.Println("  -fec-interleave N stripes interleaved per FEC group (default 16)")
+	fmt.Println("  -recovery N     also write N recovery volumes (ARCHIVE.rec01...) of 1/fec-data the size each")
 
 	fmt.Println()
 	fmt.Println("Extensions:")
 	fmt.Println("  .b32/.b64       output Base32/Base64 encoded archive")
+	fmt.Println("  .asc            ASCII armored text with per-line CRC32")
 	fmt.Println("  .goxaf          FEC encoded archive")
 	fmt.Println("  .tar, .tar.gz   tar archive (gzipped if .gz)")
 	fmt.Println("  .tar.xz         tar archive compressed with xz")
+	fmt.Println("  .tar.zst/.lz4   tar archive compressed with zstd or lz4")
+	fmt.Println("  .tar.br/.sz     tar archive compressed with brotli or s2/snappy")
+	fmt.Println("  .tar.bz2        bzip2 tar archive (extract and list only)")
+	fmt.Println("  .zip            zip archive")
 
 	fmt.Println()
 	fmt.Println("Examples:")
@@ -129,6 +169,14 @@ func showUsage() {
 	fmt.Println("  goxa c -arc=backup.tar.gz dir/                # create tar.gz")
 	fmt.Println("  goxa c -arc=backup.goxa.b64 dir/              # Base64 encoded archive")
 	fmt.Println("  goxa c -arc=backup.goxaf dir/                 # FEC encoded archive")
+	fmt.Println("  goxa x -arc=https://host/backup.goxa -files=dir/file.txt  # pull one file from a remote archive")
+	fmt.Println("  ssh host cat backup.goxa | goxa x -arc=- out/ # extract from a pipe")
+	fmt.Println("  goxa c -arc=backup.goxa -volsize=4GB dir/     # write backup.goxa.001, .002, ...")
+	fmt.Println("  goxa d -arc=backup.goxa /restore              # compare with a restored tree")
+	fmt.Println("  goxa d -arc=v1.goxa v2.goxa -json             # what changed between releases")
+	fmt.Println("  goxa convert -arc=backup.goxa backup.tar.zst  # convert without extracting")
+	fmt.Println("  goxa recompress -arc=old.goxa -comp=zstd -speed=best  # recompress in place")
+	fmt.Println("  goxa merge -arc=all.goxa part-*.goxa          # roll up partial archives")
 }
 
 type flagSettings struct {
@@ -139,7 +187,11 @@ type flagSettings struct {
 	fecData   int
 	fecParity int
 	fecLevel  string
+	volSize   string
 	showVer   bool
+	// progressJSON is the -progress-json target
+	progressJSON string
+	compSet      bool
 }
 
 func startProfile() func() {
@@ -190,6 +242,11 @@ func parseCommand(cmd string) (byte, string) {
 	if cmd == "" {
 		return 0, ""
 	}
+	for word, letter := range wordModes {
+		if strings.HasPrefix(cmd, word) {
+			return letter, cmd[len(word):]
+		}
+	}
 	letter := cmd[0]
 	opts := ""
 	if len(cmd) > 1 {
@@ -198,33 +255,66 @@ func parseCommand(cmd string) (byte, string) {
 	return letter, opts
 }
 
+func isWordMode(cmdLetter byte) bool {
+	for _, letter := range wordModes {
+		if letter == cmdLetter {
+			return true
+		}
+	}
+	return false
+}
+
 func initFlags() (*flag.FlagSet, *flagSettings) {
 	fs := flag.NewFlagSet("goxa", flag.ExitOnError)
 	f := &flagSettings{}
 	fs.StringVar(&archivePath, "arc", defaultArchiveName, "archive file name (extension not required)")
 	fs.BoolVar(&toStdOut, "stdout", false, "output archive data to stdout")
+	fs.BoolVar(&jsonOutput, "json", false, "print the d, recover, bitfix or fec-verify/fec-repair report as JSON")
+	fs.StringVar(&mergeConflict, "conflict", "error", "merge: keep the first or last of duplicate paths, or error")
 	fs.BoolVar(&progress, "progress", true, "show progress bar")
+	fs.StringVar(&f.progressJSON, "progress-json", "", "write NDJSON progress events to this file descriptor number or file")
 	fs.BoolVar(&interactiveMode, "interactive", true, "prompt when archive uses extra flags")
 	fs.StringVar(&compression, "comp", "zstd", "compression: gzip|zstd|lz4|s2|snappy|brotli|xz|none")
 	fs.StringVar(&f.speedOpt, "speed", "fastest", "compression speed: fastest|default|better|best")
 	fs.StringVar(&f.sumOpt, "sum", "blake3", "checksum: crc32|crc16|xxhash|sha256|blake3")
 	fs.UintVar(&flagBlockSize, "block", defaultBlockSize, "compression block size in bytes")
 	fs.IntVar(&threads, "threads", runtime.NumCPU(), "number of threads to use")
-	fs.StringVar(&f.format, "format", "goxa", "archive format: tar|goxa")
+	fs.StringVar(&f.format, "format", "goxa", "archive format: tar|goxa|zip")
 	fs.StringVar(&f.sel, "files", "", "comma-separated list of files and directories to extract")
 	fs.IntVar(&f.fecData, "fec-data", fecDataShards, "FEC data shards")
 	fs.IntVar(&f.fecParity, "fec-parity", fecParityShards, "FEC parity shards")
 	fs.StringVar(&f.fecLevel, "fec-level", "", "FEC redundancy preset: low|medium|high")
+	fs.IntVar(&fecStripe, "fec-stripe", 0, "FEC stripe size in KiB, 0 encodes the whole file at once")
+	fs.IntVar(&fecInterleave, "fec-interleave", 16, "FEC stripes interleaved per group")
+	fs.IntVar(&recoveryVolumes, "recovery", 0, "number of recovery volumes to write next to the archive")
 	fs.IntVar(&fileRetries, "retries", 3, "retries when file changes during read (0=never give up)")
 	fs.IntVar(&fileRetryDelay, "retrydelay", 5, "delay between retries in seconds")
 	fs.BoolVar(&failOnChange, "failonchange", false, "treat file change after retries as fatal")
 	fs.BoolVar(&bombCheck, "bombcheck", true, "detect extremely compressed files")
 	fs.BoolVar(&spaceCheck, "spacecheck", true, "verify free disk space before operations")
+	fs.BoolVar(&safeLinks, "safelinks", true, "keep link targets inside the destination and never write through extracted symlinks")
 	fs.BoolVar(&noFlush, "noflush", false, "skip final disk flush")
+	fs.StringVar(&f.volSize, "volsize", "", "split the archive into volumes of this size, e.g. 700MB")
 	fs.BoolVar(&f.showVer, "version", false, "print version and exit")
 	return fs, f
 }
 
+func configureVolumes(cmdLetter byte, volSize string) {
+	if volSize != "" {
+		size, err := humanize.ParseBytes(volSize)
+		if err != nil {
+			log.Fatalf("invalid volsize: %s", volSize)
+		}
+		volumeSize = size
+	}
+	// Accept the name of the first volume as well as the archive name
+	if cmdLetter != 'c' {
+		if base := volumeBase(archivePath); base != archivePath && hasVolumes(base) {
+			archivePath = base
+		}
+	}
+}
+
 func configureFEC(f *flagSettings) {
 	switch f.fecLevel {
 	case "low":
@@ -239,6 +329,18 @@ func configureFEC(f *flagSettings) {
 	default:
 		log.Fatalf("invalid fec-level: %s", f.fecLevel)
 	}
+	if fecStripe < 0 || fecStripe > 1<<20 {
+		log.Fatalf("invalid fec-stripe: %d", fecStripe)
+	}
+	if fecInterleave < 1 || fecInterleave > 1<<16-1 {
+		log.Fatalf("invalid fec-interleave: %d", fecInterleave)
+	}
+	if fecStripe > 0 && fecStripedConfig().groupLen(fecInterleave) > fecMaxGroup {
+		log.Fatalf("fec-stripe %d KiB with fec-interleave %d exceeds the %d MiB group limit", fecStripe, fecInterleave, fecMaxGroup>>20)
+	}
+	if recoveryVolumes < 0 || fecDataShards+recoveryVolumes > 256 {
+		log.Fatalf("invalid recovery: %d", recoveryVolumes)
+	}
 }
 
 func detectArchiveFormat(cmdLetter byte, format string) string {
@@ -254,7 +356,8 @@ func detectArchiveFormat(cmdLetter byte, format string) string {
 		}
 	}
 
-	if cmdLetter != 'c' {
+	// The FEC modes check the encoded file itself, so don't decode it here
+	if cmdLetter != 'c' && cmdLetter != cmdFECVerify && cmdLetter != cmdFECRepair && archivePath != "-" {
 		if fFmt, fNoComp, ok := detectFormatFromHeader(archivePath); ok {
 			format = fFmt
 			if fFmt == "tar" {
@@ -296,13 +399,15 @@ func applyModeOptions(opts string) {
 			features.Clear(fChecksums)
 		case 'b':
 			features.Set(fChecksums)
-			features.Set(fBlockChecksums)
+			features.Set(fBlockCRC32)
 		case 'n':
 			features.Set(fNoCompress)
 		case 'i':
 			features.Set(fIncludeInvis)
 		case 'o':
 			features.Set(fSpecialFiles)
+		case 'r':
+			features.Set(fRedundant)
 		case 'u':
 			useArchiveFlags = true
 		case 'v':
@@ -315,7 +420,10 @@ func applyModeOptions(opts string) {
 	}
 }
 
-func configureCompression(format string) {
+// configureCompression selects the compression named by -comp. When it was
+// given explicitly it also selects the tar compression; a compressed tar
+// extension or the archive's own magic bytes take precedence.
+func configureCompression(explicit bool) {
 	switch strings.ToLower(compression) {
 	case "gzip":
 		compType = compGzip
@@ -330,17 +438,17 @@ func configureCompression(format string) {
 	case "brotli":
 		compType = compBrotli
 	case "xz":
-		if strings.ToLower(format) == "tar" {
-			tarUseXz = true
-		} else {
-			compType = compXZ
-		}
+		compType = compXZ
 	case "none":
 		features.Set(fNoCompress)
 		compType = compGzip
+		return
 	default:
 		log.Fatalf("Unknown compression: %s", compression)
 	}
+	if explicit {
+		tarComp = compType
+	}
 }
 
 func configureSpeed(speed string) {
@@ -386,14 +494,12 @@ func ensureArchiveExtension(cmdLetter byte, format string) {
 	}
 	if strings.ToLower(format) == "tar" {
 		if features.IsNotSet(fNoCompress) {
-			if tarUseXz {
-				archivePath += ".tar.xz"
-			} else {
-				archivePath += ".tar.gz"
-			}
+			archivePath += tarExt(tarComp)
 		} else {
 			archivePath += ".tar"
 		}
+	} else if strings.ToLower(format) == "zip" {
+		archivePath += ".zip"
 	} else {
 		archivePath += ".goxa"
 	}
@@ -402,21 +508,59 @@ func ensureArchiveExtension(cmdLetter byte, format string) {
 func runMode(cmdLetter byte, args []string, format string) {
 	switch cmdLetter {
 	case 'c':
+		if isURL(archivePath) {
+			log.Fatal("Archives can not be created at a URL.")
+		}
+		if volumeSize > 0 && (toStdOut || encode != "" || strings.ToLower(format) != "goxa") {
+			log.Fatal("-volsize only supports plain goxa archives written to files.")
+		}
+		if recoveryVolumes > 0 && (toStdOut || volumeSize > 0 || strings.ToLower(format) != "goxa") {
+			log.Fatal("-recovery only supports goxa archives written to a single file.")
+		}
 		if strings.ToLower(format) == "tar" {
 			if err := createTar(args); err != nil {
 				log.Fatalf("tar create failed: %v", err)
 			}
 			return
 		}
+		if strings.ToLower(format) == "zip" {
+			if err := createZip(args); err != nil {
+				log.Fatalf("zip create failed: %v", err)
+			}
+			return
+		}
 		create(args)
+		if recoveryVolumes > 0 {
+			if err := writeRecovery(archivePath, recoveryVolumes); err != nil {
+				log.Fatalf("recovery volumes: %v", err)
+			}
+		}
 	case 'l':
 		if strings.ToLower(format) == "tar" {
-			log.Fatalf("list not supported for tar format")
+			if err := listTar(false); err != nil {
+				log.Fatalf("tar list failed: %v", err)
+			}
+			return
+		}
+		if strings.ToLower(format) == "zip" {
+			if err := listZip(false); err != nil {
+				log.Fatalf("zip list failed: %v", err)
+			}
+			return
 		}
 		extract(args, true, false)
 	case 'j':
 		if strings.ToLower(format) == "tar" {
-			log.Fatalf("list not supported for tar format")
+			if err := listTar(true); err != nil {
+				log.Fatalf("tar list failed: %v", err)
+			}
+			return
+		}
+		if strings.ToLower(format) == "zip" {
+			if err := listZip(true); err != nil {
+				log.Fatalf("zip list failed: %v", err)
+			}
+			return
 		}
 		extract(args, true, true)
 	case 'x':
@@ -438,7 +582,129 @@ func runMode(cmdLetter byte, args []string, format string) {
 			}
 			return
 		}
+		if strings.ToLower(format) == "zip" {
+			if err := extractZip(extractDestination(args)); err != nil {
+				log.Fatalf("zip extract failed: %v", err)
+			}
+			return
+		}
 		extract(args, false, false)
+	case 'd':
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to compare.")
+		}
+		dir := ""
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		var report *DiffReport
+		var err error
+		if isRegularFile(dir) {
+			report, err = diffArchives(dir, format)
+		} else {
+			report, err = diffArchive(dir, format)
+		}
+		if err != nil {
+			log.Fatalf("compare failed: %v", err)
+		}
+		printDiff(report, jsonOutput)
+		if len(report.Entries) > 0 {
+			exitWith(1)
+		}
+	case cmdConvert:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to convert.")
+		}
+		if len(args) != 1 {
+			log.Fatal("Convert needs exactly one output archive name.")
+		}
+		if err := convert(args[0], format); err != nil {
+			log.Fatalf("convert failed: %v", err)
+		}
+	case cmdMerge:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify the merged archive with -arc.")
+		}
+		if err := merge(args); err != nil {
+			log.Fatalf("merge failed: %v", err)
+		}
+	case cmdRecover:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to recover.")
+		}
+		if len(args) > 1 {
+			log.Fatal("Recover takes at most one destination directory.")
+		}
+		dest := ""
+		if len(args) == 1 {
+			dest = args[0]
+		}
+		report, err := recoverArchive(dest)
+		if err != nil {
+			log.Fatalf("recover failed: %v", err)
+		}
+		printRecover(report, jsonOutput)
+		if report.Damaged+report.Lost+report.Fragments > 0 {
+			exitWith(1)
+		}
+	case cmdBitfix:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to fix.")
+		}
+		report, err := bitfix()
+		if report != nil {
+			printBitfix(report, jsonOutput)
+		}
+		if err != nil {
+			log.Fatalf("bitfix failed: %v", err)
+		}
+		if report.Fixed < report.Damaged {
+			exitWith(1)
+		}
+	case cmdFECVerify:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to verify.")
+		}
+		report, err := fecVerify(archivePath)
+		if err != nil {
+			log.Fatalf("fec-verify failed: %v", err)
+		}
+		printFECReport(report, jsonOutput)
+		if report.Damaged+report.Records > 0 {
+			exitWith(1)
+		}
+	case cmdFECRepair:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to repair.")
+		}
+		if len(args) > 1 {
+			log.Fatal("Repair takes at most one output file name.")
+		}
+		out := ""
+		if len(args) == 1 {
+			out = args[0]
+		}
+		report, err := fecRepair(out)
+		if report != nil {
+			printFECReport(report, jsonOutput)
+		}
+		if err != nil {
+			log.Fatalf("fec-repair failed: %v", err)
+		}
+	case cmdRecompress:
+		if archivePath == defaultArchiveName {
+			log.Fatal("You must specify an archive to recompress.")
+		}
+		if len(args) > 1 {
+			log.Fatal("Recompress takes at most one output archive name.")
+		}
+		out := ""
+		if len(args) == 1 {
+			out = args[0]
+		}
+		if err := recompress(out); err != nil {
+			log.Fatalf("recompress failed: %v", err)
+		}
 	default:
 		showUsage()
 		doLog(false, "Unknown mode: %c", cmdLetter)
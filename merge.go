@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// mergeInput is one of the archives being merged.
+type mergeInput struct {
+	path string
+	arc  *BinReader
+	hdr  *ArchiveHeader
+	done func()
+	// verbatim inputs match the output settings and have their blocks
+	// copied as they are, the others are decoded and encoded again.
+	verbatim bool
+}
+
+// mergeFile is an entry of the merged archive and where it comes from.
+type mergeFile struct {
+	entry FileEntry
+	in    *mergeInput
+}
+
+// merge combines the goxa archives inputs into the new archive at
+// archivePath. Compression, block size and checksum follow the first
+// input unless -comp, -block or -sum are given; inputs with other
+// settings are transcoded, the blocks of all others copied verbatim.
+// Duplicate paths are resolved by mergeConflict.
+func merge(inputs []string) error {
+	switch mergeConflict {
+	case "first", "last", "error":
+	default:
+		return fmt.Errorf("unknown conflict policy %q, use first, last or error", mergeConflict)
+	}
+	if len(inputs) < 1 {
+		return fmt.Errorf("no archives to merge")
+	}
+	if format, _, _, err := convertTarget(archivePath); err != nil || format != "goxa" {
+		return fmt.Errorf("%v: merge writes goxa archives", archivePath)
+	}
+	outAbs, _ := filepath.Abs(archivePath)
+	for _, in := range inputs {
+		if inAbs, _ := filepath.Abs(in); inAbs == outAbs {
+			return fmt.Errorf("%v is both an input and the output", in)
+		}
+	}
+	if !doForce {
+		if found, _ := fileExists(archivePath); found {
+			return fmt.Errorf("archive %v already exists", archivePath)
+		}
+	}
+
+	var ins []*mergeInput
+	defer func() {
+		for _, in := range ins {
+			in.done()
+		}
+	}()
+	oldEncode := encode
+	for _, path := range inputs {
+		// Inputs may be encoded differently from the output name
+		encode = ""
+		detectFormatFromExt(path)
+		arc, hdr, done, err := readArchive(path)
+		encode = oldEncode
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		ins = append(ins, &mergeInput{path: path, arc: arc, hdr: hdr, done: done})
+	}
+
+	if err := mergeSettings(ins); err != nil {
+		return err
+	}
+	dirs, files, err := mergeEntries(ins)
+	if err != nil {
+		return err
+	}
+	doLog(false, "Merging %v archives into %v", len(ins), archivePath)
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var totalBytes int64
+	for _, mf := range files {
+		totalBytes += int64(mf.entry.Size)
+	}
+	p, tickDone, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	err = mergeWrite(f, dirs, files, p)
+	close(tickDone)
+	<-finished
+	if err != nil {
+		return err
+	}
+	if st, err := os.Stat(archivePath); err == nil {
+		doLog(false, "\nWrote %v, %v containing %v files.", archivePath, humanize.Bytes(uint64(st.Size())), len(files))
+	}
+	return nil
+}
+
+// mergeSettings picks the features, compression, block size and checksum
+// of the merged archive and marks the inputs that can be copied verbatim.
+func mergeSettings(ins []*mergeInput) error {
+	first := ins[0].hdr
+	features = first.Flags&^fStreamed | features&(fRedundant|fBlockCRC32)
+	for _, in := range ins[1:] {
+		if in.hdr.Flags.IsSet(fAbsolutePaths) != first.Flags.IsSet(fAbsolutePaths) {
+			return fmt.Errorf("%v: can't merge archives with absolute and relative paths", in.path)
+		}
+		// Metadata is only kept when every archive holds it
+		for _, flag := range []BitFlags{fPermissions, fModDates} {
+			if features.IsSet(flag) && in.hdr.Flags.IsNotSet(flag) {
+				doLog(false, "%v has no %v, dropping them from the merged archive", in.path, strings.ToLower(flagNamesList(flag)[0]))
+				features.Clear(flag)
+			}
+		}
+		features |= in.hdr.Flags & (fIncludeInvis | fSpecialFiles | fBlockCRC32)
+	}
+
+	if flagsGiven["comp"] {
+		features.Clear(fNoCompress)
+		if strings.ToLower(compression) == "none" {
+			features.Set(fNoCompress)
+		}
+	} else {
+		compType = first.CompType
+	}
+	if !flagsGiven["block"] {
+		blockSize = first.BlockSize
+	}
+	if features.IsSet(fNoCompress) {
+		blockSize = 0
+	} else if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	if !flagsGiven["sum"] && first.Flags.IsSet(fChecksums) {
+		checksumType, checksumLength = first.SumType, first.SumLen
+	}
+
+	for _, in := range ins {
+		h := in.hdr
+		in.verbatim = h.Flags.IsSet(fNoCompress) == features.IsSet(fNoCompress) &&
+			(features.IsSet(fNoCompress) || h.CompType == compType) &&
+			h.BlockSize == blockSize &&
+			(features.IsNotSet(fChecksums) || h.Flags.IsSet(fChecksums) && h.SumType == checksumType && h.SumLen == checksumLength)
+		if !in.verbatim {
+			doLog(false, "%v uses other compression or checksum settings, transcoding it", in.path)
+		}
+	}
+	return nil
+}
+
+// mergeEntries combines the entries of ins, resolving duplicate paths by
+// mergeConflict. Files keep the order of their archives.
+func mergeEntries(ins []*mergeInput) ([]FileEntry, []mergeFile, error) {
+	var files []mergeFile
+	index := make(map[string]int)
+	for _, in := range ins {
+		for _, e := range in.hdr.Files {
+			if e.Type == entryFile && e.Offset == 0 && e.Size > 0 {
+				events.fileSkipped(e.Path) // not stored
+				continue
+			}
+			key := filepath.Clean(e.Path)
+			i, dup := index[key]
+			switch {
+			case !dup:
+				index[key] = len(files)
+				files = append(files, mergeFile{entry: e, in: in})
+			case mergeConflict == "error":
+				return nil, nil, fmt.Errorf("%v is in both %v and %v", e.Path, files[i].in.path, in.path)
+			case mergeConflict == "last":
+				doLog(true, "%v: using the copy from %v", e.Path, in.path)
+				events.warn(e.Path, "using the copy from %v", in.path)
+				files[i] = mergeFile{entry: e, in: in}
+			}
+		}
+	}
+
+	// Directories only hold entries of their own when empty
+	used := make(map[string]bool)
+	for key := range index {
+		for p := filepath.Dir(key); p != "." && p != string(os.PathSeparator) && !used[p]; p = filepath.Dir(p) {
+			used[p] = true
+		}
+	}
+	var dirs []FileEntry
+	for _, in := range ins {
+		for _, d := range in.hdr.Dirs {
+			key := filepath.Clean(d.Path)
+			if _, isFile := index[key]; isFile || used[key] {
+				continue
+			}
+			used[key] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs, files, nil
+}
+
+// mergeWrite writes the merged archive to f.
+func mergeWrite(f *os.File, dirs []FileEntry, files []mergeFile, p *progressData) error {
+	entries := make([]FileEntry, len(files))
+	for i, mf := range files {
+		entries[i] = mf.entry
+		entries[i].Offset = 0
+		entries[i].SumOffset = 0
+		entries[i].Blocks = nil
+	}
+	bf := NewBufferedFile(f, writeBuffer, p)
+	header := writeHeader(dirs, entries, 0, 0, features, compType)
+	if _, err := bf.Write(header); err != nil {
+		return err
+	}
+	cOffset := uint64(len(header))
+	var buf []byte
+	if blockSize > 0 {
+		buf = make([]byte, blockSize)
+	}
+	h := newHasher(checksumType)
+	sumResult := ""
+	if features.IsSet(fChecksums) {
+		sumResult = "stored"
+	}
+
+	for i, mf := range files {
+		entry := &entries[i]
+		if entry.Type != entryFile {
+			continue
+		}
+		p.file.Store(entry.Path)
+		events.fileBegin(entry.Path, entry.Size)
+		src := &mf.entry
+		// Archives from before the block index hold one stream per file
+		if !mf.in.verbatim || len(src.Blocks) == 0 && src.Size > 0 {
+			r, err := goxaFileReader(mf.in.arc, mf.in.hdr, src)
+			if err != nil {
+				return err
+			}
+			if cOffset, err = encodeFile(bf, entry, progressReader{r: r, p: p}, h, buf, cOffset); err != nil {
+				return err
+			}
+			events.fileEnd(entry.Path, entry.Size, sumResult)
+			continue
+		}
+
+		entry.Offset = cOffset
+		if features.IsSet(fChecksums) {
+			sum := make([]byte, checksumLength)
+			if src.Offset == 0 {
+				sum = padSum(newHasher(checksumType).Sum(nil), checksumLength)
+			} else if _, err := mf.in.arc.ReadAt(sum, int64(src.SumOffset)); err != nil {
+				return fmt.Errorf("unable to read checksum for %v: %w", src.Path, err)
+			}
+			if _, err := bf.Write(sum); err != nil {
+				return err
+			}
+			cOffset += uint64(len(sum))
+		}
+		for _, b := range src.Blocks {
+			sum := crc32.NewIEEE()
+			n, err := io.Copy(io.MultiWriter(bf, sum), io.NewSectionReader(mf.in.arc, int64(b.Offset), int64(b.Size)))
+			if err != nil {
+				return fmt.Errorf("copy block of %v: %w", src.Path, err)
+			}
+			if uint64(n) != b.Size {
+				return fmt.Errorf("copy block of %v: short read", src.Path)
+			}
+			if mf.in.hdr.Flags.IsSet(fBlockCRC32) && sum.Sum32() != b.Sum {
+				return fmt.Errorf("copy block of %v: CRC32 mismatch", src.Path)
+			}
+			entry.Blocks = append(entry.Blocks, Block{Offset: cOffset, Size: b.Size, Sum: sum.Sum32()})
+			cOffset += b.Size
+		}
+		p.current.Add(int64(src.Size))
+		events.fileEnd(entry.Path, entry.Size, sumResult)
+	}
+	return finishArchive(bf, dirs, entries, len(header), cOffset)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mergeCreate(t *testing.T, dir, name string, files map[string]string, comp uint8, sum string) string {
+	root := filepath.Join(dir, "src-"+name, "root")
+	for rel, data := range files {
+		full := filepath.Join(root, rel)
+		os.MkdirAll(filepath.Dir(full), 0o755)
+		if err := os.WriteFile(full, []byte(data), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compType = comp
+	blockSize = defaultBlockSize
+	configureChecksum(sum)
+	features = fChecksums
+	archivePath = filepath.Join(dir, name+".goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	return archivePath
+}
+
+func TestMerge(t *testing.T) {
+	tempDir := t.TempDir()
+	a := mergeCreate(t, tempDir, "a", map[string]string{"one.txt": "one", "same.txt": "from a", "empty.txt": ""}, compZstd, "blake3")
+	b := mergeCreate(t, tempDir, "b", map[string]string{"two.txt": "two", "same.txt": "from b"}, compZstd, "blake3")
+	c := mergeCreate(t, tempDir, "c", map[string]string{"sub/three.txt": strings.Repeat("three", 1000)}, compGzip, "crc32")
+
+	cases := []struct {
+		policy string
+		same   string
+	}{
+		{"error", ""},
+		{"first", "from a"},
+		{"last", "from b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			flagsGiven = map[string]bool{}
+			mergeConflict = tc.policy
+			compType = compLZ4
+			configureChecksum("sha256")
+			archivePath = filepath.Join(tempDir, "merged-"+tc.policy+".goxa")
+			err := merge([]string{a, b, c})
+			if tc.policy == "error" {
+				if err == nil || !strings.Contains(err.Error(), "same.txt") {
+					t.Fatalf("expected conflict error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+
+			_, hdr, done, err := readArchive(archivePath)
+			if err != nil {
+				t.Fatalf("read merged archive: %v", err)
+			}
+			done()
+			if hdr.CompType != compZstd || hdr.SumType != sumBlake3 || len(hdr.Files) != 5 {
+				t.Fatalf("unexpected header: comp %v sum %v files %v", hdr.CompType, hdr.SumType, len(hdr.Files))
+			}
+
+			dest := filepath.Join(tempDir, "out-"+tc.policy)
+			os.MkdirAll(dest, 0o755)
+			features = 0
+			extract([]string{dest}, false, false)
+			base := filepath.Join(dest, "root")
+			checkFile(t, filepath.Join(base, "one.txt"), []byte("one"), 0, false)
+			checkFile(t, filepath.Join(base, "two.txt"), []byte("two"), 0, false)
+			checkFile(t, filepath.Join(base, "same.txt"), []byte(tc.same), 0, false)
+			checkFile(t, filepath.Join(base, "sub", "three.txt"), []byte(strings.Repeat("three", 1000)), 0, false)
+		})
+	}
+	mergeConflict = "error"
+}
+
+func TestMergeBlockCRC32(t *testing.T) {
+	tempDir := t.TempDir()
+	a := mergeCreate(t, tempDir, "a", map[string]string{"one.txt": strings.Repeat("one", 1000)}, compZstd, "blake3")
+	root := filepath.Join(tempDir, "src-b", "root")
+	os.MkdirAll(root, 0o755)
+	os.WriteFile(filepath.Join(root, "two.txt"), []byte(strings.Repeat("two", 1000)), 0o644)
+	features = fChecksums | fBlockCRC32
+	b := filepath.Join(tempDir, "b.goxa")
+	archivePath = b
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// Blocks copied from either archive get their CRC32
+	flagsGiven = map[string]bool{}
+	features = 0
+	archivePath = filepath.Join(tempDir, "merged.goxa")
+	if err := merge([]string{a, b}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	checkBlockCRC32(t, archivePath)
+}
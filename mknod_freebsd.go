@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// mknod takes a 64-bit device number on FreeBSD.
+func mknod(path string, mode uint32, dev int) error {
+	return unix.Mknod(path, mode, uint64(dev))
+}
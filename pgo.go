@@ -73,7 +73,7 @@ func runPGOTraining() {
 		}
 
 		var buf bytes.Buffer
-		zw := compressor(&buf)
+		zw := compressor(&buf, compType)
 		if _, err := zw.Write(data); err != nil {
 			log.Fatalf("compress: %v", err)
 		}
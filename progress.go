@@ -40,12 +40,15 @@ type progressData struct {
 	speedWindowSize  time.Duration
 	lastPrintStr     string
 	file             atomic.Value
+	// lastEvent is when counters were last sent to events
+	lastEvent time.Time
 }
 
 func progressTicker(p *progressData) (*progressData, chan struct{}, chan struct{}) {
 	done := make(chan struct{})
 	finished := make(chan struct{})
-	if !progress || quietMode {
+	showBar := progress && !quietMode
+	if !showBar && events == nil {
 		close(finished)
 		return p, done, finished
 	}
@@ -59,9 +62,11 @@ func progressTicker(p *progressData) (*progressData, chan struct{}, chan struct{
 			select {
 			case <-ticker.C:
 				printProgress(p)
+				events.counters(p, false)
 			case <-done:
 				printProgress(p)
-				if progress {
+				events.counters(p, true)
+				if showBar {
 					fmt.Print("\n")
 				}
 				return
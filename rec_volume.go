@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// recMagic starts a recovery volume. The index of the parity shard it
+// holds and a FEC header describing the whole set follow.
+const recMagic = "GOXAREC"
+
+// recHeaderPrefix is the length of the magic and the index
+const recHeaderPrefix = len(recMagic) + 1
+
+// Recovery volumes protect an archive file without changing it. The file
+// is seen as dataShards data shards, each a consecutive piece of it with
+// the last one zero padded, and every recovery volume holds one parity
+// shard. Each volume carries the checksums of every stripe of every shard,
+// so any one of them can locate damage in the archive.
+
+// recoveryName returns the name of recovery volume n of the archive at
+// path, counting from 1.
+func recoveryName(path string, n int) string {
+	return fmt.Sprintf("%v.rec%02d", path, n)
+}
+
+// recoveryData reads data shards from the archive, padding the last one
+// with zeros.
+type recoveryData struct {
+	f    io.ReaderAt
+	size int64
+}
+
+func (r recoveryData) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < r.size {
+		var err error
+		n, err = r.f.ReadAt(p[:min(int64(len(p)), r.size-off)], off)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+// writeRecovery writes volumes recovery volumes for the archive at path,
+// using the configured number of data shards.
+func writeRecovery(path string, volumes int) error {
+	doLog(false, "Writing %v recovery volumes", volumes)
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	h := &fecHeader{
+		version:      2,
+		dataShards:   fecDataShards,
+		parityShards: volumes,
+		shardSize:    (info.Size() + int64(fecDataShards) - 1) / int64(fecDataShards),
+		dataSize:     info.Size(),
+		stripeSize:   fecStripeSize,
+	}
+	enc, err := reedsolomon.New(h.dataShards, h.parityShards)
+	if err != nil {
+		return err
+	}
+	// The checksum table has a fixed size, so the parity can be written
+	// before the final headers
+	headerLen := int64(recHeaderPrefix + len(h.encode()))
+
+	outs := make([]*os.File, volumes)
+	defer func() {
+		for _, f := range outs {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for j := range outs {
+		if outs[j], err = os.Create(recoveryName(path, j+1)); err != nil {
+			return err
+		}
+	}
+
+	p, done, finished := progressTicker(&progressData{total: info.Size(), speedWindowSize: time.Second * 5})
+	p.file.Store(path)
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	data := recoveryData{f: in, size: info.Size()}
+	h.sums = make([][]uint32, h.totalShards())
+	for i := range h.sums {
+		h.sums[i] = make([]uint32, h.stripes())
+	}
+	shards := make([][]byte, h.totalShards())
+	for i := range shards {
+		shards[i] = make([]byte, h.stripeSize)
+	}
+	for s := 0; s < h.stripes(); s++ {
+		n := h.stripeLen(s)
+		row := make([][]byte, len(shards))
+		for i := range row {
+			row[i] = shards[i][:n]
+		}
+		for i := 0; i < h.dataShards; i++ {
+			if _, err := data.ReadAt(row[i], int64(i)*h.shardSize+int64(s)*h.stripeSize); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+		for i := range row {
+			h.sums[i][s] = crc32.ChecksumIEEE(row[i])
+		}
+		for j, f := range outs {
+			if _, err := f.WriteAt(row[h.dataShards+j], headerLen+int64(s)*h.stripeSize); err != nil {
+				return err
+			}
+		}
+		p.current.Add(n * int64(h.dataShards))
+	}
+
+	hdr := h.encode()
+	for j, f := range outs {
+		buf := append([]byte(recMagic), uint8(j))
+		if _, err := f.WriteAt(append(buf, hdr...), 0); err != nil {
+			return err
+		}
+		// A set without data still needs its header
+		if err := f.Truncate(headerLen + h.shardSize); err != nil {
+			return err
+		}
+		if !noFlush {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverySet is the recovery volumes found for an archive.
+type recoverySet struct {
+	h *fecHeader
+	// vols holds the volume of each parity shard, nil when missing
+	vols []*os.File
+	// offs holds where the parity starts in each volume
+	offs  []int64
+	found int
+}
+
+func (rs *recoverySet) Close() {
+	for _, f := range rs.vols {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// readRecoveryHeader reads the header of the recovery volume f.
+func readRecoveryHeader(f *os.File) (*fecHeader, int, error) {
+	prefix := make([]byte, recHeaderPrefix)
+	if _, err := f.ReadAt(prefix, 0); err != nil {
+		return nil, 0, err
+	}
+	if string(prefix[:len(recMagic)]) != recMagic {
+		return nil, 0, fmt.Errorf("not a recovery volume")
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	h, err := readFECHeader(io.NewSectionReader(f, int64(recHeaderPrefix), st.Size()-int64(recHeaderPrefix)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.version != 2 || int(prefix[len(recMagic)]) >= h.parityShards {
+		return nil, 0, fmt.Errorf("invalid recovery volume")
+	}
+	h.headerLen += int64(recHeaderPrefix)
+	return h, int(prefix[len(recMagic)]), nil
+}
+
+// sameSet reports whether two recovery volume headers belong together.
+// Checksum tables are only compared when both passed their own check.
+func sameSet(a, b *fecHeader) bool {
+	if a.dataShards != b.dataShards || a.parityShards != b.parityShards ||
+		a.shardSize != b.shardSize || a.dataSize != b.dataSize || a.stripeSize != b.stripeSize {
+		return false
+	}
+	if a.sumsDamaged || b.sumsDamaged {
+		return true
+	}
+	for i := range a.sums {
+		for s := range a.sums[i] {
+			if a.sums[i][s] != b.sums[i][s] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// findRecovery opens the recovery volumes next to the archive at path.
+// Volumes that can't be read or belong to another set are skipped. It
+// returns nil when there are none.
+func findRecovery(path string) *recoverySet {
+	var rs *recoverySet
+	for n := 1; n < 256; n++ {
+		name := recoveryName(path, n)
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		h, idx, err := readRecoveryHeader(f)
+		if err != nil {
+			doLog(false, "Skipping recovery volume %v: %v", name, err)
+			f.Close()
+			continue
+		}
+		if rs == nil {
+			rs = &recoverySet{h: h, vols: make([]*os.File, h.parityShards), offs: make([]int64, h.parityShards)}
+		}
+		if !sameSet(rs.h, h) || rs.vols[idx] != nil {
+			doLog(false, "Skipping recovery volume %v: it belongs to another archive", name)
+			f.Close()
+			continue
+		}
+		if rs.h.sumsDamaged && !h.sumsDamaged {
+			// Prefer a checksum table that passed its own check
+			rs.h = h
+		}
+		rs.vols[idx] = f
+		rs.offs[idx] = h.headerLen
+		rs.found++
+	}
+	return rs
+}
+
+// recoveryShards presents the archive and its recovery volumes as the
+// shards of a FEC file for fecScan. Reads from missing volumes fail.
+type recoveryShards struct {
+	rs   *recoverySet
+	data recoveryData
+}
+
+func (r recoveryShards) ReadAt(p []byte, off int64) (int, error) {
+	h := r.rs.h
+	shard := int(off / h.shardSize)
+	if shard < h.dataShards {
+		return r.data.ReadAt(p, off)
+	}
+	j := shard - h.dataShards
+	if r.rs.vols[j] == nil {
+		return 0, fmt.Errorf("recovery volume %v missing", j+1)
+	}
+	return r.rs.vols[j].ReadAt(p, r.rs.offs[j]+off-int64(shard)*h.shardSize)
+}
+
+// damaged reports whether the archive fails the checksums of the set.
+func (rs *recoverySet) damaged(f io.ReaderAt, size int64) bool {
+	h := rs.h
+	if size != h.dataSize {
+		return true
+	}
+	data := recoveryData{f: f, size: size}
+	buf := make([]byte, h.stripeSize)
+	for i := 0; i < h.dataShards; i++ {
+		for s := 0; s < h.stripes(); s++ {
+			b := buf[:h.stripeLen(s)]
+			data.ReadAt(b, int64(i)*h.shardSize+int64(s)*h.stripeSize)
+			if crc32.ChecksumIEEE(b) != h.sums[i][s] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexIntact reports whether the goxa archive at path of size bytes has a
+// header and trailer passing their own checksums.
+func indexIntact(path string, size int64) bool {
+	src, err := openArchiveSource(path)
+	if err != nil {
+		return false
+	}
+	arc := newBinReader(src)
+	defer arc.Close()
+	hdr, err := readHeader(arc)
+	if err != nil || !hdr.Verify() {
+		return false
+	}
+	if hdr.Flags.IsSet(fStreamed) {
+		if err := readFooter(arc, size, hdr); err != nil {
+			return false
+		}
+	}
+	if hdr.ArcSize != uint64(size) {
+		return false
+	}
+	if _, err := arc.Seek(int64(hdr.TrailerOffset), io.SeekStart); err != nil {
+		return false
+	}
+	return readTrailer(arc, hdr) == nil
+}
+
+// useRecovery checks the archive at path against its recovery volumes and,
+// when it fails, rebuilds it into a temporary file. It returns the path to
+// read and a function removing any rebuilt copy. Without usable recovery
+// volumes the archive is returned as is. Unless scan is set, a goxa
+// archive whose header and trailer pass their checksums is used without
+// reading it all, leaving damage in file data to its file checksums;
+// extract then calls it again with scan set to repair the damaged files.
+func useRecovery(path string, scan bool) (string, func(), error) {
+	none := func() {}
+	if isURL(path) || path == "-" || hasVolumes(path) {
+		return path, none, nil
+	}
+	rs := findRecovery(path)
+	if rs == nil {
+		return path, none, nil
+	}
+	defer rs.Close()
+
+	in, err := os.Open(path)
+	if err != nil {
+		return path, none, err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return path, none, err
+	}
+	if !scan && st.Size() == rs.h.dataSize && indexIntact(path, st.Size()) {
+		doLog(true, "Archive index is intact, not checking it against its %v recovery volumes", rs.found)
+		return path, none, nil
+	}
+	if !rs.damaged(in, st.Size()) {
+		doLog(true, "Archive matches its %v recovery volumes", rs.found)
+		return path, none, nil
+	}
+
+	doLog(false, "Archive fails its checksums, rebuilding it from %v of %v recovery volumes", rs.found, rs.h.parityShards)
+	tmp, err := os.CreateTemp("", "goxa_rec_*")
+	if err != nil {
+		return path, none, err
+	}
+	h := *rs.h
+	h.headerLen = 0
+	p, done, finished := progressTicker(&progressData{total: h.dataSize, speedWindowSize: time.Second * 5})
+	p.file.Store(path)
+	damage, err := fecScan(recoveryShards{rs: rs, data: recoveryData{f: in, size: st.Size()}}, &h, p, func(s int, shards [][]byte) error {
+		for i, shard := range shards[:h.dataShards] {
+			off := int64(i)*h.shardSize + int64(s)*h.stripeSize
+			if off >= h.dataSize {
+				break
+			}
+			if _, err := tmp.WriteAt(shard[:min(int64(len(shard)), h.dataSize-off)], off); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	close(done)
+	<-finished
+	if err == nil {
+		err = tmp.Truncate(h.dataSize)
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		doLog(false, "Recovery volumes can't repair the archive: %v", err)
+		return path, none, nil
+	}
+	doLog(false, "Rebuilt damaged stripes in %v", damage)
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// hasRecovery reports whether recovery volumes for the archive at path
+// may exist, without reading them.
+func hasRecovery(path string) bool {
+	if isURL(path) || path == "-" || hasVolumes(path) {
+		return false
+	}
+	for n := 1; n < 256; n++ {
+		if _, err := os.Stat(recoveryName(path, n)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoveryVolumes(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	os.MkdirAll(root, 0o755)
+	contents := map[string][]byte{
+		"a.txt": make([]byte, 150000),
+		"b.txt": make([]byte, 70000),
+	}
+	rng := rand.New(rand.NewSource(5))
+	rng.Read(contents["a.txt"])
+	rng.Read(contents["b.txt"])
+	for name, data := range contents {
+		os.WriteFile(filepath.Join(root, name), data, 0o644)
+	}
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compType = compZstd
+	features = fChecksums
+	configureChecksum("blake3")
+	archivePath = filepath.Join(tempDir, "test.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	fecDataShards = 4
+	defer func() { fecDataShards = 10 }()
+	if err := writeRecovery(archivePath, 2); err != nil {
+		t.Fatalf("write recovery: %v", err)
+	}
+	clean, _ := os.ReadFile(archivePath)
+
+	// Two damaged pieces with two recovery volumes
+	d := bytes.Clone(clean)
+	shard := (len(d) + 3) / 4
+	for i := 10; i < 5000; i++ {
+		d[i] = 0
+		d[2*shard+i] ^= 0xff
+	}
+	os.WriteFile(archivePath, d, 0o644)
+	first := d
+	path, cleanup, err := useRecovery(archivePath, false)
+	if err != nil {
+		t.Fatalf("use recovery: %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	cleanup()
+	if path == archivePath || !bytes.Equal(got, clean) {
+		t.Fatalf("archive not rebuilt")
+	}
+	if _, hdr, done, err := readArchive(archivePath); err != nil || len(hdr.Files) != 2 {
+		t.Fatalf("read damaged archive: %v", err)
+	} else {
+		done()
+	}
+
+	// Damage only in file data leaves the intact index to be trusted,
+	// unless a scan is asked for
+	d = bytes.Clone(clean)
+	for i := shard + 100; i < shard+200; i++ {
+		d[i] ^= 0xff
+	}
+	os.WriteFile(archivePath, d, 0o644)
+	if path, cleanup, err := useRecovery(archivePath, false); err != nil || path != archivePath {
+		t.Fatalf("expected the archive as is without a scan, got %v, %v", path, err)
+	} else {
+		cleanup()
+	}
+	path, cleanup, err = useRecovery(archivePath, true)
+	if err != nil {
+		t.Fatalf("use recovery: %v", err)
+	}
+	got, _ = os.ReadFile(path)
+	cleanup()
+	if path == archivePath || !bytes.Equal(got, clean) {
+		t.Fatalf("archive not rebuilt by a scan")
+	}
+
+	// Extraction finds it through the file checks and repairs it
+	dest := filepath.Join(tempDir, "out")
+	extract([]string{dest}, false, false)
+	for name, data := range contents {
+		checkFile(t, filepath.Join(dest, filepath.Base(root), name), data, 0o644, false)
+	}
+	if extractRepair != nil {
+		t.Fatalf("repair queue left behind")
+	}
+
+	// With one volume left the first damage can't be repaired
+	os.WriteFile(archivePath, first, 0o644)
+	os.Remove(recoveryName(archivePath, 1))
+	if path, cleanup, err := useRecovery(archivePath, true); err != nil || path != archivePath {
+		t.Fatalf("expected the archive as is, got %v, %v", path, err)
+	} else {
+		cleanup()
+	}
+
+	// An intact archive is used directly, and volumes of another archive
+	// are ignored
+	os.WriteFile(archivePath, clean, 0o644)
+	other := filepath.Join(tempDir, "other.goxa")
+	os.WriteFile(other, contents["b.txt"], 0o644)
+	if err := writeRecovery(other, 2); err != nil {
+		t.Fatalf("write recovery: %v", err)
+	}
+	os.Rename(recoveryName(other, 1), recoveryName(archivePath, 1))
+	rs := findRecovery(archivePath)
+	if rs == nil || rs.found != 1 {
+		t.Fatalf("expected one matching volume")
+	}
+	rs.Close()
+	if path, cleanup, err := useRecovery(archivePath, true); err != nil || path != archivePath {
+		t.Fatalf("intact archive not used directly: %v, %v", path, err)
+	} else {
+		cleanup()
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// recompItem is passed from the archive reader to the writer of
+// recompress. A file's blocks are framed by a start and an end item.
+type recompItem struct {
+	file  int
+	start bool
+	sum   []byte // stored checksum, sent with start
+	block *recompBlock
+	err   error
+}
+
+// recompBlock is one block of new blockSize, encoded by a worker.
+type recompBlock struct {
+	data []byte
+	enc  []byte
+	sum  uint32
+	err  error
+	done chan struct{}
+}
+
+// recompress rewrites the goxa archive at archivePath with the current
+// -comp, -speed and -block settings. Blocks are decoded one file after
+// the other, every file checksum is verified and the new blocks are
+// encoded in parallel. Without out the archive is replaced once the new
+// one is complete.
+func recompress(out string) error {
+	inPlace := out == ""
+	if inPlace {
+		if isURL(archivePath) || archivePath == "-" || encode != "" || hasVolumes(archivePath) {
+			return fmt.Errorf("only plain goxa archive files can be recompressed in place, name an output archive")
+		}
+		out = archivePath
+	} else {
+		if format, _, _, err := convertTarget(out); err != nil || format != "goxa" {
+			return fmt.Errorf("%v: recompress writes goxa archives, use convert for other formats", out)
+		}
+		if !doForce {
+			if found, _ := fileExists(out); found {
+				return fmt.Errorf("archive %v already exists", out)
+			}
+		}
+	}
+
+	arc, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var f *os.File
+	if inPlace {
+		f, err = os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+		if err == nil {
+			if st, serr := os.Stat(out); serr == nil {
+				f.Chmod(st.Mode().Perm())
+			}
+		}
+	} else {
+		f, err = os.Create(out)
+	}
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer func() {
+		f.Close()
+		if inPlace {
+			os.Remove(tmpName)
+		}
+	}()
+
+	from, to := compName(hdr.CompType), compName(compType)
+	if hdr.Flags.IsSet(fNoCompress) {
+		from = "none"
+	}
+	if strings.ToLower(compression) == "none" {
+		to = "none"
+	}
+	doLog(false, "Recompressing %v from %v to %v", archivePath, from, to)
+	var totalBytes int64
+	for _, e := range hdr.Files {
+		if e.Type == entryFile {
+			totalBytes += int64(e.Size)
+		}
+	}
+	p, tickDone, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	err = recompressTo(arc, hdr, f, p)
+	close(tickDone)
+	<-finished
+	if err != nil {
+		return err
+	}
+	if inPlace {
+		done()
+		if err := os.Rename(tmpName, out); err != nil {
+			return err
+		}
+	}
+	if st, err := os.Stat(out); err == nil {
+		doLog(false, "\nWrote %v, %v containing %v files.", out, humanize.Bytes(uint64(st.Size())), len(hdr.Files))
+	}
+	return nil
+}
+
+// recompressTo writes the entries of hdr, read from arc, as a new
+// archive to f. The file checksums are kept, using the original type.
+func recompressTo(arc *BinReader, hdr *ArchiveHeader, f *os.File, p *progressData) error {
+	oldFeatures, oldSumType, oldSumLen := features, checksumType, checksumLength
+	features = hdr.Flags&^(fNoCompress|fStreamed) | features&(fRedundant|fBlockCRC32)
+	if strings.ToLower(compression) == "none" {
+		features |= fNoCompress
+	}
+	checksumType, checksumLength = hdr.SumType, hdr.SumLen
+	defer func() { features, checksumType, checksumLength = oldFeatures, oldSumType, oldSumLen }()
+	if features.IsSet(fNoCompress) {
+		blockSize = 0
+	} else if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	chunk := int(blockSize)
+	if chunk == 0 {
+		chunk = defaultBlockSize
+	}
+
+	files := slices.Clone(hdr.Files)
+	for i := range files {
+		files[i].Offset = 0
+		files[i].SumOffset = 0
+		files[i].Blocks = nil
+	}
+	bf := NewBufferedFile(f, writeBuffer, p)
+	header := writeHeader(hdr.Dirs, files, 0, 0, features, compType)
+	if _, err := bf.Write(header); err != nil {
+		return err
+	}
+	cOffset := uint64(len(header))
+
+	if threads < 1 {
+		threads = 1
+	}
+	queue := make(chan recompItem, threads*2)
+	stop := make(chan struct{})
+	defer close(stop)
+	go recompressRead(arc, hdr, chunk, p, queue, stop)
+
+	for item := range queue {
+		if item.err != nil {
+			return item.err
+		}
+		entry := &files[item.file]
+		switch {
+		case item.start:
+			events.fileBegin(entry.Path, entry.Size)
+			if features.IsSet(fChecksums) {
+				if _, err := bf.Write(item.sum); err != nil {
+					return err
+				}
+				cOffset += uint64(len(item.sum))
+			}
+		case item.block != nil:
+			b := item.block
+			<-b.done
+			if b.err != nil {
+				return fmt.Errorf("%v: %w", entry.Path, b.err)
+			}
+			if _, err := bf.Write(b.enc); err != nil {
+				return err
+			}
+			entry.Blocks = append(entry.Blocks, Block{Offset: cOffset, Size: uint64(len(b.enc)), Sum: b.sum})
+			cOffset += uint64(len(b.enc))
+		case features.IsSet(fChecksums):
+			events.fileEnd(entry.Path, entry.Size, "stored")
+		default:
+			events.fileEnd(entry.Path, entry.Size, "")
+		}
+	}
+
+	return finishArchive(bf, hdr.Dirs, files, len(header), cOffset)
+}
+
+// recompressRead decodes the files of hdr in order, cutting them into
+// blocks of chunk bytes that are encoded by up to threads workers, and
+// queues them for the writer in archive order.
+func recompressRead(arc *BinReader, hdr *ArchiveHeader, chunk int, p *progressData, queue chan<- recompItem, stop <-chan struct{}) {
+	defer close(queue)
+	send := func(item recompItem) bool {
+		select {
+		case queue <- item:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	noComp := features.IsSet(fNoCompress)
+	wg := sizedwaitgroup.New(threads)
+	for i := range hdr.Files {
+		item := &hdr.Files[i]
+		if item.Type != entryFile {
+			continue
+		}
+		if item.Offset == 0 && item.Size > 0 {
+			// Not stored when the archive was made
+			events.fileSkipped(item.Path)
+			continue
+		}
+		p.file.Store(item.Path)
+		r, err := goxaFileReader(arc, hdr, item)
+		if err != nil {
+			send(recompItem{err: err})
+			return
+		}
+		start := recompItem{file: i, start: true}
+		if vr, ok := r.(*verifyReader); ok && vr.h != nil {
+			start.sum = vr.want
+		}
+		if !send(start) {
+			return
+		}
+		src := progressReader{r: r, p: p}
+		for {
+			buf := make([]byte, chunk)
+			n, err := io.ReadFull(src, buf)
+			if n > 0 {
+				b := &recompBlock{data: buf[:n], done: make(chan struct{})}
+				wg.Add()
+				go func() {
+					defer wg.Done()
+					defer close(b.done)
+					if noComp {
+						b.enc = b.data
+					} else {
+						var enc bytes.Buffer
+						zw := compressor(&enc, compType)
+						if _, b.err = zw.Write(b.data); b.err == nil {
+							b.err = zw.Close()
+						}
+						b.enc = enc.Bytes()
+					}
+					b.sum = crc32.ChecksumIEEE(b.enc)
+				}()
+				if !send(recompItem{file: i, block: b}) {
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				send(recompItem{err: err})
+				return
+			}
+		}
+		if !send(recompItem{file: i}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func recompressSetup(t *testing.T, noComp bool) (string, string, []byte) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	os.MkdirAll(root, 0o755)
+	data := make([]byte, 200*1024)
+	rng := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(4))
+	}
+	os.WriteFile(filepath.Join(root, "big.txt"), data, 0o644)
+	os.WriteFile(filepath.Join(root, "empty.txt"), nil, 0o644)
+
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	encode = ""
+	compression = "gzip"
+	compType = compGzip
+	blockSize = 16 * 1024
+	configureChecksum("sha256")
+	features = fChecksums
+	if noComp {
+		features |= fNoCompress
+	}
+	archivePath = filepath.Join(tempDir, "old.goxa")
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	os.RemoveAll(root)
+	return tempDir, root, data
+}
+
+func TestRecompressInPlace(t *testing.T) {
+	tempDir, root, data := recompressSetup(t, false)
+
+	compression = "zstd"
+	compType = compZstd
+	compSpeed = SpeedBestCompression
+	blockSize = 64 * 1024
+	configureChecksum("blake3")
+	threads = 4
+	features = 0
+	if err := recompress(""); err != nil {
+		t.Fatalf("recompress failed: %v", err)
+	}
+	compSpeed = SpeedFastest
+
+	_, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	done()
+	if hdr.CompType != compZstd || hdr.BlockSize != 64*1024 || hdr.SumType != sumSHA256 {
+		t.Fatalf("unexpected header: comp %v block %v sum %v", hdr.CompType, hdr.BlockSize, hdr.SumType)
+	}
+	for _, e := range hdr.Files {
+		if e.Path == "root/big.txt" && len(e.Blocks) != 4 {
+			t.Fatalf("expected 4 blocks, got %v", len(e.Blocks))
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(tempDir, "*.tmp")); len(matches) > 0 {
+		t.Fatalf("temporary file left behind: %v", matches)
+	}
+
+	dest := filepath.Join(tempDir, "out")
+	os.MkdirAll(dest, 0o755)
+	features = 0
+	extract([]string{dest}, false, false)
+	checkFile(t, filepath.Join(dest, filepath.Base(root), "big.txt"), data, 0, false)
+}
+
+func TestRecompressBlockCRC32(t *testing.T) {
+	tempDir, _, _ := recompressSetup(t, false)
+
+	// Turned on by b and kept when recompressing again
+	features = fChecksums | fBlockCRC32
+	out := filepath.Join(tempDir, "crc.goxa")
+	if err := recompress(out); err != nil {
+		t.Fatalf("recompress failed: %v", err)
+	}
+	checkBlockCRC32(t, out)
+	archivePath = out
+	features = 0
+	if err := recompress(""); err != nil {
+		t.Fatalf("recompress failed: %v", err)
+	}
+	checkBlockCRC32(t, out)
+}
+
+func TestRecompressChecksumMismatch(t *testing.T) {
+	tempDir, _, data := recompressSetup(t, true)
+	raw, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	idx := bytes.Index(raw, data[:64])
+	if idx < 0 {
+		t.Fatalf("file data not found in archive")
+	}
+	raw[idx+10] ^= 0xff
+	os.WriteFile(archivePath, raw, 0o644)
+
+	compression = "lz4"
+	compType = compLZ4
+	features = 0
+	out := filepath.Join(tempDir, "new.goxa")
+	err = recompress(out)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
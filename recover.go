@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// recoverSearchLimit caps how many frame starts are tried when looking for
+// the data of a file that isn't where the previous one ended.
+const recoverSearchLimit = 4096
+
+// lostFoundDir holds damaged files, unclaimed data and the report.
+const lostFoundDir = "lost+found"
+
+// recoverer salvages what it can from a damaged goxa archive.
+type recoverer struct {
+	arc *BinReader
+	hdr *ArchiveHeader
+	// verified is set when hdr passed its checksum
+	verified bool
+	dest     string
+	report   *RecoverReport
+	// start and end of the file data between header and trailer
+	dataStart, dataEnd int64
+	// frame starts found in the data, by compression type
+	hits map[uint8][]int64
+	// archive ranges belonging to files that were recovered
+	claimed []Block
+}
+
+// recoverArchive extracts everything that can still be decoded from the
+// archive at archivePath into dest. A damaged header or trailer is
+// tolerated: without the trailer, file data is located by walking the
+// compressed frames in header order and matching sizes and checksums;
+// without a usable header, every decodable frame is saved to lost+found.
+func recoverArchive(dest string) (*RecoverReport, error) {
+	if archivePath == "-" {
+		return nil, fmt.Errorf("recover needs an archive file, not stdin")
+	}
+	path, cleanup, err := useRecovery(archivePath, true)
+	if err != nil {
+		return nil, fmt.Errorf("recovery volumes: %w", err)
+	}
+	defer cleanup()
+	src, err := openEncoded(path)
+	if err != nil {
+		return nil, err
+	}
+	arc := newBinReader(src)
+	defer arc.Close()
+
+	if dest == "" {
+		dest = extractDestination(nil) + ".recovered"
+	}
+	dest = filepath.Clean(dest)
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 && !doForce {
+		return nil, fmt.Errorf("%v already exists and is not empty", dest)
+	}
+	if err := os.MkdirAll(filepath.Join(dest, lostFoundDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	rc := &recoverer{
+		arc:     arc,
+		dest:    dest,
+		report:  &RecoverReport{Archive: archivePath, Destination: dest},
+		dataEnd: arc.Size(),
+	}
+	rc.readIndex()
+	rc.findFrames()
+	if rc.hdr != nil {
+		rc.recoverFiles()
+	}
+	rc.recoverFragments()
+
+	data, err := json.MarshalIndent(rc.report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dest, lostFoundDir, "report.json"), append(data, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+	return rc.report, nil
+}
+
+// readIndex reads as much of the header and trailer as is usable and
+// records their state in the report.
+func (rc *recoverer) readIndex() {
+	hdr, err := readHeader(rc.arc)
+	if err != nil || !hdr.Verify() {
+		if cp, off, cerr := readHeaderCopy(rc.arc); cerr == nil {
+			rc.report.Header = fmt.Sprintf("damaged, used the copy at offset %v", off)
+			hdr, err = cp, nil
+		}
+	}
+	switch {
+	case err != nil:
+		rc.report.Header = "unreadable: " + err.Error()
+		rc.report.Trailer = "not used"
+		return
+	case rc.report.Header != "":
+	case !hdr.Verify():
+		rc.report.Header = "checksum mismatch"
+	default:
+		rc.report.Header = "ok"
+	}
+	rc.hdr = hdr
+	rc.verified = hdr.Verify()
+	rc.dataStart = int64(len(hdr.Encode()))
+
+	err = rc.readTrailer()
+	if err != nil {
+		if off, cerr := readTrailerCopy(rc.arc, hdr); cerr == nil && rc.checkBlocks() == nil {
+			rc.report.Trailer = fmt.Sprintf("damaged, used the copy at offset %v", off)
+			return
+		}
+	}
+	if err != nil {
+		rc.report.Trailer = err.Error()
+		if rc.report.Header != "ok" {
+			// The trailer offset itself may be damaged
+			rc.dataEnd = rc.arc.Size()
+		}
+		for i := range hdr.Files {
+			hdr.Files[i].Blocks = nil
+			hdr.Files[i].Offset = 0
+			hdr.Files[i].SumOffset = 0
+		}
+		return
+	}
+	rc.report.Trailer = "ok"
+}
+
+// readTrailer reads the block index and checks that it fits the archive.
+func (rc *recoverer) readTrailer() error {
+	h := rc.hdr
+	if h.Flags.IsSet(fStreamed) {
+		if err := readFooter(rc.arc, rc.arc.Size(), h); err != nil {
+			return err
+		}
+	}
+	if h.TrailerOffset < uint64(rc.dataStart) || h.TrailerOffset >= uint64(rc.arc.Size()) {
+		return fmt.Errorf("trailer offset %v is outside the archive", h.TrailerOffset)
+	}
+	rc.dataEnd = int64(h.TrailerOffset)
+	if _, err := rc.arc.Seek(int64(h.TrailerOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if err := readTrailer(rc.arc, h); err != nil {
+		return err
+	}
+	return rc.checkBlocks()
+}
+
+// checkBlocks reports blocks of the index that lie outside the file data.
+func (rc *recoverer) checkBlocks() error {
+	for _, e := range rc.hdr.Files {
+		for _, b := range e.Blocks {
+			if b.Offset < uint64(rc.dataStart) || b.Offset+b.Size > uint64(rc.dataEnd) {
+				return fmt.Errorf("block of %v is outside the file data", e.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// findFrames records where compressed frames start in the file data. The
+// header's compression type is searched for when known, otherwise every
+// type whose frames can be walked without the trailer.
+func (rc *recoverer) findFrames() {
+	rc.hits = make(map[uint8][]int64)
+	if rc.hdr != nil && rc.hdr.Flags.IsSet(fNoCompress) {
+		return
+	}
+	const chunk = 1 << 20
+	buf := make([]byte, chunk+16)
+	for off := rc.dataStart; off < rc.dataEnd; off += chunk {
+		n, err := rc.arc.ReadAt(buf[:min(int64(len(buf)), rc.dataEnd-off)], off)
+		if err != nil && err != io.EOF {
+			return
+		}
+		for _, m := range tarMagics {
+			if m.comp == compBzip2 || rc.hdr != nil && m.comp != rc.hdr.CompType &&
+				!(m.comp == compS2 && rc.hdr.CompType == compSnappy) {
+				continue
+			}
+			comp := m.comp
+			if rc.hdr != nil {
+				comp = rc.hdr.CompType
+			}
+			for i := 0; ; {
+				j := bytes.Index(buf[i:n], m.magic)
+				if j < 0 || i+j >= chunk {
+					break
+				}
+				rc.hits[comp] = append(rc.hits[comp], off+int64(i+j))
+				i += j + 1
+			}
+		}
+	}
+	for comp := range rc.hits {
+		slices.Sort(rc.hits[comp])
+	}
+}
+
+// recoverFiles restores the files named in the header.
+func (rc *recoverer) recoverFiles() {
+	h := rc.hdr
+	for _, d := range h.Dirs {
+		if p, err := safeJoin(rc.dest, d.Path); err == nil {
+			os.MkdirAll(p, 0o755)
+		}
+	}
+	useTrailer := rc.report.Trailer == "ok" || strings.HasPrefix(rc.report.Trailer, "damaged")
+	pos := rc.dataStart
+	for i := range h.Files {
+		e := &h.Files[i]
+		if e.Type != entryFile {
+			note := "link to " + e.Linkname
+			if e.Type != entrySymlink && e.Type != entryHardlink {
+				note = "special file"
+			}
+			rc.add(RecoverEntry{Path: e.Path, Status: "skipped", Size: e.Size, Note: note})
+			continue
+		}
+		if useTrailer {
+			sum, err := rc.storedSum(e)
+			if err != nil || len(e.Blocks) == 0 && e.Size > 0 {
+				rc.add(RecoverEntry{Path: e.Path, Status: "lost", Size: e.Size, Note: "data not in the block index"})
+				continue
+			}
+			rc.restore(e, e.Blocks, sum)
+			continue
+		}
+
+		blocks, sum, end, ok := rc.search(e, pos)
+		if !ok {
+			rc.add(RecoverEntry{Path: e.Path, Status: "lost", Size: e.Size, Note: "data not found"})
+			continue
+		}
+		rc.restore(e, blocks, sum)
+		pos = end
+	}
+}
+
+// storedSum returns the checksum stored for e, or nil without checksums.
+func (rc *recoverer) storedSum(e *FileEntry) ([]byte, error) {
+	h := rc.hdr
+	if h.Flags.IsNotSet(fChecksums) {
+		return nil, nil
+	}
+	if e.Offset == 0 {
+		return padSum(newHasher(h.SumType).Sum(nil), h.SumLen), nil
+	}
+	sum := make([]byte, h.SumLen)
+	_, err := rc.arc.ReadAt(sum, int64(e.SumOffset))
+	return sum, err
+}
+
+// search looks for the data of e, first at pos where the previous file
+// ended and then at the following frame starts. It returns the blocks
+// and checksum of e and where its data ends.
+func (rc *recoverer) search(e *FileEntry, pos int64) ([]Block, []byte, int64, bool) {
+	blocks, sum, end, err := rc.locate(e, pos)
+	if err == nil && rc.matches(e, blocks, sum) {
+		return blocks, sum, end, true
+	}
+	if e.Size == 0 {
+		// Nothing to find, the checksum of no data is known
+		sum, _ := rc.storedSum(e)
+		return nil, sum, pos, true
+	}
+	sumBefore := int64(0)
+	if rc.hdr.Flags.IsSet(fChecksums) && rc.hdr.Flags.IsNotSet(fStreamed) {
+		sumBefore = int64(rc.hdr.SumLen)
+	}
+	hits := rc.hits[rc.hdr.CompType]
+	i, _ := slices.BinarySearch(hits, pos+sumBefore+1)
+	for tries := 0; i < len(hits) && tries < recoverSearchLimit; i, tries = i+1, tries+1 {
+		b, s, n, err := rc.locate(e, hits[i]-sumBefore)
+		if err == nil && rc.matches(e, b, s) {
+			return b, s, n, true
+		}
+	}
+	// Blocks of the right sizes where the file should be are most likely
+	// its damaged data
+	return blocks, sum, end, err == nil
+}
+
+// locate walks the blocks e would have if its data started at start,
+// using the block size from the header and the framing of the
+// compression type to find where each block ends.
+func (rc *recoverer) locate(e *FileEntry, start int64) ([]Block, []byte, int64, error) {
+	h := rc.hdr
+	pos := start
+	var sum []byte
+	readSum := func() error {
+		sum = make([]byte, h.SumLen)
+		if _, err := rc.arc.ReadAt(sum, pos); err != nil {
+			return err
+		}
+		pos += int64(h.SumLen)
+		return nil
+	}
+	if h.Flags.IsSet(fChecksums) && h.Flags.IsNotSet(fStreamed) {
+		if err := readSum(); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if pos > rc.dataEnd {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	sr := &streamReader{r: bufio.NewReaderSize(io.NewSectionReader(rc.arc, pos, rc.dataEnd-pos), readBuffer)}
+	var blocks []Block
+	for remaining := e.Size; remaining > 0; {
+		raw := remaining
+		if h.BlockSize > 0 {
+			raw = min(raw, uint64(h.BlockSize))
+		}
+		off := uint64(pos) + sr.pos
+		if h.Flags.IsSet(fNoCompress) {
+			if err := skipN(sr, int64(raw)); err != nil {
+				return nil, nil, 0, err
+			}
+		} else if _, err := readFrame(sr, h.CompType, raw); err != nil {
+			return nil, nil, 0, err
+		}
+		blocks = append(blocks, Block{Offset: off, Size: uint64(pos) + sr.pos - off})
+		remaining -= raw
+	}
+	pos += int64(sr.pos)
+	if h.Flags.IsSet(fChecksums) && h.Flags.IsSet(fStreamed) {
+		if err := readSum(); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	return blocks, sum, pos, nil
+}
+
+// matches reports whether blocks decode to the size and checksum of e.
+func (rc *recoverer) matches(e *FileEntry, blocks []Block, sum []byte) bool {
+	bad, ok := rc.decode(io.Discard, e, blocks, sum)
+	return bad == 0 && ok
+}
+
+// decode writes the decoded blocks of e to w, filling blocks that can't be
+// decoded with zeros. It returns the number of such blocks and whether the
+// result matches the checksum sum, which is true without a checksum.
+func (rc *recoverer) decode(w io.Writer, e *FileEntry, blocks []Block, sum []byte) (int, bool) {
+	h := rc.hdr
+	var hasher hash.Hash
+	if sum != nil {
+		hasher = newHasher(h.SumType)
+		w = io.MultiWriter(w, hasher)
+	}
+	bad := 0
+	remaining := e.Size
+	for i, b := range blocks {
+		raw := remaining
+		if h.BlockSize > 0 && i < len(blocks)-1 {
+			raw = min(raw, uint64(h.BlockSize))
+		}
+		n, err := rc.decodeBlock(w, b, raw)
+		if err != nil {
+			bad++
+			if _, err := io.CopyN(w, zeroReader{}, int64(rc.fillSize(raw))-n); err != nil {
+				return bad, false
+			}
+		}
+		remaining -= raw
+	}
+	if remaining > 0 {
+		return bad + 1, false
+	}
+	return bad, hasher == nil || bytes.Equal(padSum(hasher.Sum(nil), h.SumLen), sum)
+}
+
+// fillSize returns how much of a block of raw bytes that can't be decoded
+// is filled with zeros. Sizes from a header that failed its checksum may be
+// damaged, so the fill is capped at one block then, or defaultBlockSize
+// when files are stored as a single block.
+func (rc *recoverer) fillSize(raw uint64) uint64 {
+	if rc.verified {
+		return raw
+	}
+	limit := uint64(rc.hdr.BlockSize)
+	if limit == 0 {
+		limit = defaultBlockSize
+	}
+	return min(raw, limit)
+}
+
+// decodeBlock writes exactly raw decoded bytes of block b to w. It fails
+// when the block is corrupt or holds a different amount of data.
+func (rc *recoverer) decodeBlock(w io.Writer, b Block, raw uint64) (int64, error) {
+	var r io.Reader = io.NewSectionReader(rc.arc, int64(b.Offset), int64(b.Size))
+	if rc.hdr.Flags.IsNotSet(fNoCompress) {
+		dec, err := decompressor(r, rc.hdr.CompType)
+		if err != nil {
+			return 0, err
+		}
+		defer dec.Close()
+		r = dec
+	}
+	n, err := io.CopyN(w, r, int64(raw))
+	if err != nil {
+		return n, err
+	}
+	if extra, _ := io.CopyN(io.Discard, r, 1); extra > 0 {
+		return n, fmt.Errorf("block holds more data than expected")
+	}
+	return n, nil
+}
+
+// restore writes e to its place below dest when it decodes and matches its
+// checksum, and to lost+found with damaged blocks zeroed otherwise.
+func (rc *recoverer) restore(e *FileEntry, blocks []Block, sum []byte) {
+	events.fileBegin(e.Path, e.Size)
+	entry := RecoverEntry{Path: e.Path, Size: e.Size}
+	if len(blocks) > 0 {
+		entry.Offset = blocks[0].Offset
+	}
+	target, err := safeJoin(rc.dest, e.Path)
+	if err != nil {
+		entry.Status, entry.Note = "lost", err.Error()
+		rc.add(entry)
+		return
+	}
+	rel, _ := filepath.Rel(rc.dest, target)
+	if rel == "." || strings.SplitN(rel, string(os.PathSeparator), 2)[0] == lostFoundDir {
+		// Keep lost+found for what recover puts there
+		target = filepath.Join(rc.dest, lostFoundDir, "renamed", rel)
+		entry.Note = "stored under " + filepath.Join(lostFoundDir, "renamed")
+	}
+	os.MkdirAll(filepath.Dir(target), 0o755)
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".goxa-recover-*")
+	if err != nil {
+		entry.Status, entry.Note = "lost", err.Error()
+		rc.add(entry)
+		return
+	}
+	bad, ok := rc.decode(tmp, e, blocks, sum)
+	if err := tmp.Close(); err != nil {
+		bad, ok = len(blocks), false
+	}
+
+	switch {
+	case bad == 0 && ok && sum != nil:
+		entry.Status = "recovered"
+	case bad == 0 && ok:
+		entry.Status, entry.Note = "unverified", "archive holds no checksums"
+	case bad == len(blocks) && e.Size > 0:
+		os.Remove(tmp.Name())
+		entry.Status, entry.Note = "lost", "no block could be decoded"
+		rc.add(entry)
+		return
+	default:
+		entry.Status = "damaged"
+		entry.Note = "checksum mismatch"
+		if bad > 0 {
+			entry.Note = fmt.Sprintf("%v of %v blocks could not be decoded and are zero filled", bad, len(blocks))
+		}
+		target = filepath.Join(rc.dest, lostFoundDir, "damaged", rel)
+		os.MkdirAll(filepath.Dir(target), 0o755)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		entry.Status, entry.Note = "lost", err.Error()
+		rc.add(entry)
+		return
+	}
+	if rc.hdr.Flags.IsSet(fPermissions) {
+		os.Chmod(target, e.Mode.Perm())
+	}
+	if rc.hdr.Flags.IsSet(fModDates) {
+		os.Chtimes(target, e.ModTime, e.ModTime)
+	}
+	rc.claimed = append(rc.claimed, blocks...)
+	rc.add(entry)
+}
+
+// recoverFragments saves runs of decodable frames that belong to no
+// recovered file to lost+found, named by their archive offset.
+func (rc *recoverer) recoverFragments() {
+	slices.SortFunc(rc.claimed, func(a, b Block) int { return cmp.Compare(a.Offset, b.Offset) })
+	var comps []uint8
+	for comp := range rc.hits {
+		comps = append(comps, comp)
+	}
+	slices.Sort(comps)
+	for _, comp := range comps {
+		next := int64(0)
+		for _, off := range rc.hits[comp] {
+			if off < next || rc.isClaimed(off) {
+				continue
+			}
+			if end, ok := rc.fragment(off, comp); ok {
+				next = end
+			}
+		}
+	}
+}
+
+// isClaimed reports whether off lies within the data of a recovered file.
+func (rc *recoverer) isClaimed(off int64) bool {
+	i, _ := slices.BinarySearchFunc(rc.claimed, uint64(off), func(b Block, o uint64) int {
+		if b.Offset+b.Size <= o {
+			return -1
+		}
+		if b.Offset > o {
+			return 1
+		}
+		return 0
+	})
+	return i < len(rc.claimed) && rc.claimed[i].Offset <= uint64(off) && uint64(off) < rc.claimed[i].Offset+rc.claimed[i].Size
+}
+
+// fragment decodes the frames following each other from off into one
+// lost+found file. It returns where the last decoded frame ends.
+func (rc *recoverer) fragment(off int64, comp uint8) (int64, bool) {
+	var rawSize uint64
+	if comp == compS2 || comp == compSnappy {
+		if rc.hdr == nil || rc.hdr.BlockSize == 0 {
+			return 0, false // chunks can't be grouped into blocks
+		}
+		rawSize = uint64(rc.hdr.BlockSize)
+	}
+	name := filepath.Join(rc.dest, lostFoundDir, fmt.Sprintf("offset-%v.bin", off))
+	out, err := os.Create(name)
+	if err != nil {
+		return 0, false
+	}
+	sr := &streamReader{r: bufio.NewReaderSize(io.NewSectionReader(rc.arc, off, rc.dataEnd-off), readBuffer)}
+	var written uint64
+	end := off
+	truncated := false
+	for !rc.isClaimed(end) {
+		frame, err := readFrame(sr, comp, rawSize)
+		if err != nil {
+			break
+		}
+		dec, err := decompressor(bytes.NewReader(frame), comp)
+		if err != nil {
+			break
+		}
+		// Cap the output like extraction does for suspicious ratios
+		limit := max(uint64(zipBombMinSize), uint64(end-off+int64(len(frame)))*zipBombRatio) - written
+		n, err := io.Copy(out, io.LimitReader(dec, int64(limit)+1))
+		dec.Close()
+		if uint64(n) > limit {
+			out.Truncate(int64(written + limit))
+			written += limit
+			truncated = true
+			break
+		}
+		if err != nil {
+			// Keep the part before the damage but don't continue past it
+			out.Truncate(int64(written))
+			break
+		}
+		written += uint64(n)
+		end = off + int64(sr.pos)
+	}
+	out.Close()
+	if end == off {
+		os.Remove(name)
+		return 0, false
+	}
+	entry := RecoverEntry{Path: filepath.Join(lostFoundDir, filepath.Base(name)), Status: "fragment", Size: written, Offset: uint64(off),
+		Note: fmt.Sprintf("%v compressed bytes of %v data", end-off, compName(comp))}
+	if truncated {
+		entry.Note += ", truncated"
+	}
+	rc.add(entry)
+	return end, true
+}
+
+// add records e in the report and reports it to events.
+func (rc *recoverer) add(e RecoverEntry) {
+	r := rc.report
+	switch e.Status {
+	case "recovered":
+		r.Recovered++
+		events.fileEnd(e.Path, e.Size, "verified")
+	case "unverified":
+		r.Unverified++
+		events.fileEnd(e.Path, e.Size, "")
+	case "damaged":
+		r.Damaged++
+		events.warn(e.Path, "damaged: %v", e.Note)
+		events.fileEnd(e.Path, e.Size, "mismatch")
+	case "lost":
+		r.Lost++
+		events.warn(e.Path, "lost: %v", e.Note)
+		events.fileSkipped(e.Path)
+	case "fragment":
+		r.Fragments++
+		events.fileEnd(e.Path, e.Size, "")
+	default:
+		events.fileSkipped(e.Path)
+	}
+	r.Entries = append(r.Entries, e)
+}
+
+// printRecover prints the recover report as text or JSON.
+func printRecover(r *RecoverReport, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			doLog(false, "encode report: %v", err)
+		}
+		return
+	}
+	doLog(false, "Header: %v", r.Header)
+	doLog(false, "Trailer: %v", r.Trailer)
+	for _, e := range r.Entries {
+		if e.Status == "recovered" && !verboseMode {
+			continue
+		}
+		line := fmt.Sprintf("%-10v %v (%v)", e.Status, e.Path, humanize.Bytes(e.Size))
+		if e.Note != "" {
+			line += ": " + e.Note
+		}
+		doLog(false, "%v", line)
+	}
+	doLog(false, "\nRecovered %v, unverified %v, damaged %v, lost %v, fragments %v into %v",
+		r.Recovered, r.Unverified, r.Damaged, r.Lost, r.Fragments, r.Destination)
+}
+
+// zeroReader reads endless zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
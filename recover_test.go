@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recoverText returns n bytes of compressible but varied text.
+func recoverText(seed int64, n int) []byte {
+	words := []string{"goxa ", "block ", "frame ", "trailer ", "header ", "data\n"}
+	rng := rand.New(rand.NewSource(seed))
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[rng.Intn(len(words))])
+	}
+	return b.Bytes()[:n]
+}
+
+func TestRecover(t *testing.T) {
+	contents := map[string][]byte{
+		"a.txt":     recoverText(1, 10000),
+		"b.txt":     recoverText(2, 300),
+		"empty.txt": {},
+		"c.txt":     recoverText(3, 9000),
+	}
+
+	cases := []struct {
+		name   string
+		damage func(t *testing.T, data []byte, hdr *ArchiveHeader)
+		check  func(t *testing.T, dest string, report *RecoverReport)
+	}{
+		{
+			name: "header and trailer",
+			damage: func(t *testing.T, data []byte, hdr *ArchiveHeader) {
+				data[len(hdr.Encode())-1] ^= 0xff
+				for i := hdr.TrailerOffset; i < uint64(len(data)); i++ {
+					data[i] = 0xaa
+				}
+			},
+			check: func(t *testing.T, dest string, report *RecoverReport) {
+				if report.Header != "checksum mismatch" || report.Trailer == "ok" {
+					t.Fatalf("damage not noticed: %+v", report)
+				}
+				if report.Recovered != 4 || report.Damaged+report.Lost+report.Fragments != 0 {
+					t.Fatalf("unexpected report: %+v", report)
+				}
+				for name, want := range contents {
+					checkFile(t, filepath.Join(dest, "root", name), want, 0, false)
+				}
+			},
+		},
+		{
+			name: "block and trailer",
+			damage: func(t *testing.T, data []byte, hdr *ArchiveHeader) {
+				b := recoverFile(t, hdr, "a.txt").Blocks[1]
+				for i := b.Offset + 8; i < b.Offset+b.Size-8; i++ {
+					data[i] ^= 0x55
+				}
+				for i := hdr.TrailerOffset; i < uint64(len(data)); i++ {
+					data[i] = 0
+				}
+			},
+			check: func(t *testing.T, dest string, report *RecoverReport) {
+				for _, name := range []string{"b.txt", "empty.txt", "c.txt"} {
+					checkFile(t, filepath.Join(dest, "root", name), contents[name], 0, false)
+				}
+				if _, err := os.Stat(filepath.Join(dest, "root", "a.txt")); err == nil {
+					t.Fatalf("damaged file restored in place")
+				}
+				if report.Recovered != 3 || report.Damaged+report.Lost != 1 {
+					t.Fatalf("unexpected report: %+v", report)
+				}
+			},
+		},
+		{
+			name: "block",
+			damage: func(t *testing.T, data []byte, hdr *ArchiveHeader) {
+				b := recoverFile(t, hdr, "a.txt").Blocks[1]
+				for i := b.Offset + 8; i < b.Offset+b.Size-8; i++ {
+					data[i] ^= 0x55
+				}
+			},
+			check: func(t *testing.T, dest string, report *RecoverReport) {
+				if report.Trailer != "ok" || report.Recovered != 3 || report.Damaged != 1 {
+					t.Fatalf("unexpected report: %+v", report)
+				}
+				got, err := os.ReadFile(filepath.Join(dest, lostFoundDir, "damaged", "root", "a.txt"))
+				if err != nil {
+					t.Fatalf("damaged file not saved: %v", err)
+				}
+				want := contents["a.txt"]
+				if len(got) != len(want) || !bytes.Equal(got[:4096], want[:4096]) || !bytes.Equal(got[8192:], want[8192:]) {
+					t.Fatalf("intact blocks of the damaged file not kept")
+				}
+			},
+		},
+		{
+			name: "inflated size",
+			damage: func(t *testing.T, data []byte, hdr *ArchiveHeader) {
+				// Change a size without fixing the header checksum
+				recoverFile(t, hdr, "a.txt").Size = 1 << 40
+				enc := hdr.Encode()
+				copy(data, enc[:len(enc)-int(hdr.SumLen)])
+			},
+			check: func(t *testing.T, dest string, report *RecoverReport) {
+				if report.Header != "checksum mismatch" || report.Damaged != 1 {
+					t.Fatalf("unexpected report: %+v", report)
+				}
+				st, err := os.Stat(filepath.Join(dest, lostFoundDir, "damaged", "root", "a.txt"))
+				if err != nil {
+					t.Fatalf("damaged file not saved: %v", err)
+				}
+				if st.Size() > 3*4096 {
+					t.Fatalf("zero fill of %v bytes trusted an unverified size", st.Size())
+				}
+			},
+		},
+		{
+			name: "no header",
+			damage: func(t *testing.T, data []byte, hdr *ArchiveHeader) {
+				copy(data, "JUNKJUNK")
+			},
+			check: func(t *testing.T, dest string, report *RecoverReport) {
+				if !strings.HasPrefix(report.Header, "unreadable") || report.Fragments != 3 {
+					t.Fatalf("unexpected report: %+v", report)
+				}
+				found := 0
+				for _, e := range report.Entries {
+					data, err := os.ReadFile(filepath.Join(dest, e.Path))
+					if err != nil {
+						t.Fatalf("read fragment: %v", err)
+					}
+					for _, want := range contents {
+						if len(want) > 0 && bytes.Equal(data, want) {
+							found++
+						}
+					}
+				}
+				if found != 3 {
+					t.Fatalf("fragments don't hold the files: %+v", report.Entries)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			os.MkdirAll(root, 0o755)
+			for name, data := range contents {
+				if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			protoVersion = protoVersion2
+			toStdOut = false
+			doForce = false
+			encode = ""
+			compType = compZstd
+			blockSize = 4096
+			configureChecksum("blake3")
+			features = fChecksums
+			archivePath = filepath.Join(tempDir, "test.goxa")
+			if err := create([]string{root}); err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+			blockSize = defaultBlockSize
+
+			_, hdr, done, err := readArchive(archivePath)
+			if err != nil {
+				t.Fatalf("read archive: %v", err)
+			}
+			done()
+			data, _ := os.ReadFile(archivePath)
+			tc.damage(t, data, hdr)
+			os.WriteFile(archivePath, data, 0o644)
+
+			dest := filepath.Join(tempDir, "out")
+			report, err := recoverArchive(dest)
+			if err != nil {
+				t.Fatalf("recover failed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dest, lostFoundDir, "report.json")); err != nil {
+				t.Fatalf("report not written: %v", err)
+			}
+			tc.check(t, dest, report)
+		})
+	}
+}
+
+func recoverFile(t *testing.T, hdr *ArchiveHeader, name string) *FileEntry {
+	for i := range hdr.Files {
+		if filepath.Base(hdr.Files[i].Path) == name {
+			return &hdr.Files[i]
+		}
+	}
+	t.Fatalf("%v not in archive", name)
+	return nil
+}
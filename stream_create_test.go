@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createToPipe runs create with stdout replaced by a pipe, so any attempt
+// to seek the output fails, and returns what was written.
+func createToPipe(t *testing.T, root string) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = oldStdout }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+
+	toStdOut = true
+	err = create([]string{root})
+	toStdOut = false
+	w.Close()
+	data := <-out
+	r.Close()
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	return data
+}
+
+func TestStreamedCreate(t *testing.T) {
+	cases := []struct {
+		name   string
+		encode string
+		flag   BitFlags
+	}{
+		{"plain", "", fChecksums},
+		{"nochecksum", "", 0},
+		{"nocompress", "", fChecksums | fNoCompress},
+		{"b64", "b64", fChecksums},
+		{"armor", "armor", fChecksums},
+		{"redundant", "", fChecksums | fRedundant},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			if err := os.MkdirAll(root, 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			small := []byte("streamed create")
+			big := make([]byte, 200<<10)
+			rand.Read(big)
+			if err := os.WriteFile(filepath.Join(root, "a.txt"), small, 0o644); err != nil {
+				t.Fatalf("write small: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "big.bin"), big, 0o644); err != nil {
+				t.Fatalf("write big: %v", err)
+			}
+
+			archivePath = filepath.Join(tempDir, "test.goxa")
+			features = tc.flag
+			compType = compZstd
+			encode = tc.encode
+			blockSize = 64 << 10
+			protoVersion = protoVersion2
+			doForce = false
+			defer func() {
+				encode = ""
+				blockSize = defaultBlockSize
+				interactiveMode = true
+			}()
+
+			data := createToPipe(t, root)
+			if err := os.WriteFile(archivePath, data, 0o644); err != nil {
+				t.Fatalf("write archive: %v", err)
+			}
+
+			features = tc.flag
+			dest := filepath.Join(tempDir, "out")
+			extract([]string{dest}, false, false)
+			base := filepath.Join(dest, filepath.Base(root))
+			checkFile(t, filepath.Join(base, "a.txt"), small, 0o644, false)
+			checkFile(t, filepath.Join(base, "big.bin"), big, 0o644, false)
+
+			if tc.encode != "" {
+				return
+			}
+			if !bytes.Equal(data[len(data)-footerLen:len(data)-footerLen+4], []byte(footerMagic)) {
+				t.Fatalf("footer missing")
+			}
+			streamDest := filepath.Join(tempDir, "stream")
+			extractStream(bytes.NewReader(data), streamDest, false, false)
+			base = filepath.Join(streamDest, filepath.Base(root))
+			checkFile(t, filepath.Join(base, "a.txt"), small, 0o644, false)
+			checkFile(t, filepath.Join(base, "big.bin"), big, 0o644, false)
+		})
+	}
+}
+
+func TestFooterRoundTrip(t *testing.T) {
+	footer := encodeFooter(1234, 5678)
+	if len(footer) != footerLen {
+		t.Fatalf("footer length %d", len(footer))
+	}
+	off, size, err := parseFooter(footer)
+	if err != nil || off != 1234 || size != 5678 {
+		t.Fatalf("parse footer: %v %v %v", off, size, err)
+	}
+	footer[5] ^= 0xff
+	if _, _, err := parseFooter(footer); err == nil {
+		t.Fatalf("expected checksum error")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// streamReader is a buffered reader that tracks how many bytes have been
+// consumed so archive offsets can be checked without seeking.
+type streamReader struct {
+	r   *bufio.Reader
+	pos uint64
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.pos += uint64(n)
+	return n, err
+}
+
+func (sr *streamReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.pos++
+	}
+	return b, err
+}
+
+// extractStream extracts a goxa archive read front to back from a
+// non-seekable input such as a pipe. File data follows the header in entry
+// order, so blocks are located from the header alone and the trailer is
+// only checked once it arrives at the end.
+func extractStream(in io.Reader, destination string, listOnly bool, jsonList bool) {
+	// The archive arrives on stdin, so there's nobody to answer prompts.
+	interactiveMode = false
+
+	sr := &streamReader{r: bufio.NewReaderSize(in, readBuffer)}
+	doLog(false, "Reading archive from stdin")
+	if !listOnly {
+		doLog(false, "Destination: %v", destination)
+	}
+
+	hdr, err := readHeader(sr)
+	if err != nil {
+		log.Fatalf("extract: %v", err)
+	}
+	useArchiveHeader(hdr)
+
+	if listOnly {
+		listArchive(hdr, jsonList)
+		return
+	}
+	if !hdr.Verify() {
+		log.Fatalf("extract: header checksum mismatch")
+	}
+	if hdr.Flags.IsNotSet(fNoCompress) && hdr.CompType == compBrotli {
+		log.Fatalf("extract: %v archives can not be extracted from a stream, save the archive to a file first", compName(hdr.CompType))
+	}
+
+	var totalBytes int64
+	selectedFiles := 0
+	for _, entry := range hdr.Files {
+		if !isSelected(entry.Path) {
+			continue
+		}
+		selectedFiles++
+		totalBytes += int64(entry.Size)
+	}
+	if spaceCheck {
+		checkFreeSpace(destination, uint64(totalBytes))
+	}
+
+	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	startLinkGuard(destination)
+	openExtractRoot(destination, hdr.Flags)
+	defer closeExtractRoot()
+	makeEmptyDirs(destination, hdr)
+
+	seen := make([][]Block, len(hdr.Files))
+	for i := range hdr.Files {
+		item := &hdr.Files[i]
+		selected := isSelected(item.Path)
+		if item.Type != entryFile {
+			if selected && (item.Type == entrySymlink || item.Type == entryHardlink) {
+				if err := extractLink(destination, hdr.Flags, item); err != nil {
+					doLog(false, "unable to create link %v: %v", item.Path, err)
+				}
+			}
+			continue
+		}
+		seen[i] = streamFile(sr, destination, hdr, item, selected, p)
+	}
+
+	if hdr.TrailerOffset != 0 && sr.pos != hdr.TrailerOffset {
+		log.Fatalf("extract: trailer expected at offset %v, found at %v", hdr.TrailerOffset, sr.pos)
+	}
+	trailerOffset := sr.pos
+	if err := readTrailer(sr, hdr); err != nil {
+		log.Fatalf("extract: %v", err)
+	}
+	if hdr.Flags.IsSet(fRedundant) {
+		// The copies are only of use to readers that can seek
+		copyLen := uint64(len(hdr.Encode())) + sr.pos - trailerOffset + redundantLen
+		if err := skipN(sr, int64(copyLen)); err != nil {
+			log.Fatalf("extract: skip header and trailer copies: %v", err)
+		}
+	}
+	if hdr.Flags.IsSet(fStreamed) {
+		footer := make([]byte, footerLen)
+		if _, err := io.ReadFull(sr, footer); err != nil {
+			log.Fatalf("extract: read footer: %v", err)
+		}
+		if hdr.TrailerOffset, hdr.ArcSize, err = parseFooter(footer); err != nil {
+			log.Fatalf("extract: %v", err)
+		}
+		if hdr.TrailerOffset != trailerOffset {
+			log.Fatalf("extract: footer trailer offset mismatch")
+		}
+	}
+	for i, item := range hdr.Files {
+		if item.Type != entryFile {
+			continue
+		}
+		if !blocksEqual(seen[i], item.Blocks) {
+			log.Fatalf("extract: block index mismatch for %v", item.Path)
+		}
+	}
+	io.Copy(io.Discard, sr)
+	if hdr.ArcSize != 0 && sr.pos != hdr.ArcSize {
+		log.Fatalf("extract: archive size mismatch")
+	}
+
+	if hdr.Flags.IsSet(fChecksums) && int(checksumCount.Load()) == selectedFiles-int(skippedFiles.Load()) {
+		doLog(false, "All checksums verified.")
+	}
+}
+
+// streamFile reads the data of one file entry from sr, writing it out when
+// selected, and returns the blocks it occupied.
+func streamFile(sr *streamReader, destination string, hdr *ArchiveHeader, item *FileEntry, selected bool, p *progressData) []Block {
+	lfeat := hdr.Flags
+
+	expectedChecksum := make([]byte, hdr.SumLen)
+	readChecksum := func() {
+		if _, err := io.ReadFull(sr, expectedChecksum); err != nil {
+			log.Fatalf("unable to read checksum for %v: %v", item.Path, err)
+		}
+	}
+	if lfeat.IsSet(fChecksums) && lfeat.IsNotSet(fStreamed) {
+		readChecksum()
+	}
+
+	var out io.Writer
+	var bf *BufferedFile
+	var finalPath string
+	if selected {
+		if item.Changed {
+			doLog(false, "warning: %v changed during archiving", item.Path)
+			events.warn(item.Path, "changed during archiving")
+		}
+		newFile, fp, err := openExtractFile(destination, lfeat, item)
+		if err != nil {
+			if !doForce {
+				log.Fatalf("extract: %v", err)
+			}
+			doLog(false, "unable to create %v: %v", item.Path, err)
+			events.warn(item.Path, "unable to create: %v", err)
+			events.fileSkipped(item.Path)
+			skippedFiles.Add(1)
+		} else if newFile != nil {
+			p.file.Store(item.Path)
+			events.fileBegin(item.Path, item.Size)
+			bf = NewBufferedFile(newFile, writeBuffer, p)
+			bf.doCount = true
+			out = bf
+			finalPath = fp
+		}
+	}
+	hasher := newHasher(hdr.SumType)
+	if out != nil && lfeat.IsSet(fChecksums) {
+		out = io.MultiWriter(out, hasher)
+	}
+
+	nBlocks := uint64(1)
+	if hdr.BlockSize > 0 {
+		nBlocks = (item.Size + uint64(hdr.BlockSize) - 1) / uint64(hdr.BlockSize)
+	}
+	var blocks []Block
+	var rawSeen, compSeen uint64
+	bombChecked := false
+	remaining := item.Size
+	for b := uint64(0); b < nBlocks; b++ {
+		raw := remaining
+		if hdr.BlockSize > 0 && raw > uint64(hdr.BlockSize) {
+			raw = uint64(hdr.BlockSize)
+		}
+		off := sr.pos
+
+		if lfeat.IsSet(fNoCompress) {
+			dst := out
+			if dst == nil {
+				dst = io.Discard
+			} else {
+				dst = progressWriter{w: dst, p: p}
+			}
+			if _, err := io.CopyN(dst, sr, int64(raw)); err != nil {
+				log.Fatalf("copy block: %v :: %v", item.Path, err)
+			}
+		} else {
+			frame, err := readFrame(sr, hdr.CompType, raw)
+			if err != nil {
+				log.Fatalf("extract: reading block of %v: %v", item.Path, err)
+			}
+			rawSeen += raw
+			compSeen += uint64(len(frame))
+			if out != nil && bombCheck && !bombChecked && item.Size >= zipBombMinSize && compSeen > 0 {
+				if ratio := float64(rawSeen) / float64(compSeen); ratio > zipBombRatio {
+					bombChecked = true
+					confirmOrAbort(fmt.Sprintf("potential zip bomb: %s expands from %v to %v (x%.0f)", item.Path, humanize.Bytes(compSeen), humanize.Bytes(rawSeen), ratio))
+				}
+			}
+			if out != nil {
+				dec, err := decompressor(bytes.NewReader(frame), hdr.CompType)
+				if err != nil {
+					log.Fatalf("decompress setup: %v", err)
+				}
+				n, err := io.Copy(out, progressReader{r: dec, p: p})
+				if err != nil {
+					log.Fatalf("copy block: %v", err)
+				}
+				dec.Close()
+				if uint64(n) != raw {
+					log.Fatalf("extract: block of %v holds %v bytes, expected %v", item.Path, n, raw)
+				}
+			}
+		}
+		blocks = append(blocks, Block{Offset: off, Size: sr.pos - off})
+		remaining -= raw
+	}
+	if lfeat.IsSet(fChecksums) && lfeat.IsSet(fStreamed) {
+		readChecksum()
+	}
+
+	if bf != nil {
+		if err := bf.Close(); err != nil {
+			log.Fatalf("extract: close failed: %v", err)
+		}
+		finishExtractFile(finalPath, lfeat, item, padSum(hasher.Sum(nil), hdr.SumLen), expectedChecksum)
+	}
+	return blocks
+}
+
+// blocksEqual reports whether two block lists are identical.
+func blocksEqual(a, b []Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Offset != b[i].Offset || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
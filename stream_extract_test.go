@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamExtract(t *testing.T) {
+	cases := []struct {
+		name  string
+		ctype uint8
+		flag  BitFlags
+	}{
+		{"gzip", compGzip, 0},
+		{"zstd", compZstd, 0},
+		{"lz4", compLZ4, 0},
+		{"s2", compS2, 0},
+		{"snappy", compSnappy, 0},
+		{"xz", compXZ, 0},
+		{"none", compGzip, fNoCompress},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			small := []byte("stream test")
+			big := make([]byte, 300<<10)
+			rand.Read(big[:100<<10])
+			if err := os.WriteFile(filepath.Join(root, "a.txt"), small, 0o644); err != nil {
+				t.Fatalf("write small: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "sub", "big.bin"), big, 0o644); err != nil {
+				t.Fatalf("write big: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "empty"), nil, 0o644); err != nil {
+				t.Fatalf("write empty: %v", err)
+			}
+
+			archivePath = filepath.Join(tempDir, "test.goxa")
+			features = tc.flag | fChecksums
+			compType = tc.ctype
+			blockSize = 64 << 10
+			protoVersion = protoVersion2
+			toStdOut = false
+			doForce = false
+			defer func() { blockSize = defaultBlockSize }()
+
+			if err := create([]string{root}); err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+
+			in, err := os.Open(archivePath)
+			if err != nil {
+				t.Fatalf("open archive: %v", err)
+			}
+			defer in.Close()
+
+			dest := filepath.Join(tempDir, "out")
+			extractStream(in, dest, false, false)
+
+			base := filepath.Join(dest, filepath.Base(root))
+			checkFile(t, filepath.Join(base, "a.txt"), small, 0o644, false)
+			checkFile(t, filepath.Join(base, "sub", "big.bin"), big, 0o644, false)
+		})
+	}
+}
+
+func TestReadFrameBrotliUnsupported(t *testing.T) {
+	r := bytes.NewReader([]byte{0x0b, 0x00, 0x80})
+	if _, err := readFrame(r, compBrotli, 1); err != errFrameUnsupported {
+		t.Fatalf("expected errFrameUnsupported, got %v", err)
+	}
+}
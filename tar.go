@@ -2,53 +2,97 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+)
 
-	gzip "github.com/klauspost/pgzip"
+// compBzip2 marks bzip2 compressed tar archives. It is only used for
+// tarComp and can be read but not written.
+const compBzip2 uint8 = 0xff
 
-	"github.com/ulikunitz/xz"
-)
+// paxXattr prefixes the PAX records holding extended attributes.
+const paxXattr = "SCHILY.xattr."
+
+// tarExts maps tar archive extensions to the compression they imply.
+var tarExts = []struct {
+	ext  string
+	comp uint8
+}{
+	{".tar.gz", compGzip},
+	{".tar.xz", compXZ},
+	{".tar.zst", compZstd},
+	{".tar.lz4", compLZ4},
+	{".tar.br", compBrotli},
+	{".tar.sz", compS2},
+	{".tar.bz2", compBzip2},
+}
+
+// tarExt returns the extension used for tar archives compressed with comp.
+func tarExt(comp uint8) string {
+	if comp == compSnappy {
+		comp = compS2
+	}
+	for _, te := range tarExts {
+		if te.comp == comp {
+			return te.ext
+		}
+	}
+	return ".tar.gz"
+}
+
+// tarCompExt returns the tar extension name ends with, if any.
+func tarCompExt(name string) (string, uint8, bool) {
+	lower := strings.ToLower(name)
+	for _, te := range tarExts {
+		if strings.HasSuffix(lower, te.ext) {
+			return te.ext, te.comp, true
+		}
+	}
+	return "", 0, false
+}
+
+// tarDecompressor returns a reader decompressing r with comp.
+func tarDecompressor(r io.Reader, comp uint8) (io.ReadCloser, error) {
+	switch comp {
+	case compBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case compSnappy:
+		// The s2 reader also accepts snappy streams
+		return decompressor(r, compS2)
+	default:
+		return decompressor(r, comp)
+	}
+}
 
 // createTar creates a tar archive from the provided paths.
-// When fNoCompress is not set, the archive is gzip compressed unless
-// tarUseXz is true, in which case xz compression is used.
+// When fNoCompress is not set, the archive is compressed with tarComp.
 func createTar(paths []string) error {
+	if features.IsNotSet(fNoCompress) && tarComp == compBzip2 {
+		return fmt.Errorf("bzip2 tar archives can only be read")
+	}
 	f, err := os.Create(archivePath)
 	if err != nil {
 		return err
 	}
-	var w io.WriteCloser = f
+	defer f.Close()
+	var w io.Writer = f
 	if features.IsNotSet(fNoCompress) {
-		if tarUseXz {
-			xzw, err := xz.NewWriter(f)
-			if err != nil {
-				f.Close()
-				return err
-			}
-			w = xzw
-			defer f.Close()
-			defer xzw.Close()
-		} else {
-			gw := gzip.NewWriter(f)
-			if threads < 1 {
-				threads = 1
-			}
-			_ = gw.SetConcurrency(1<<20, threads)
-			w = gw
-			defer f.Close()
-			defer gw.Close()
-		}
-	} else {
-		defer f.Close()
+		zw := compressor(f, tarComp)
+		defer zw.Close()
+		w = zw
 	}
 
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
+	// First stored name of every multiply linked file, by device and inode
+	links := make(map[[2]uint64]string)
 	for _, root := range paths {
 		root = filepath.Clean(root)
 		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
@@ -66,30 +110,58 @@ func createTar(paths []string) error {
 			if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 && !info.IsDir() && features.IsNotSet(fSpecialFiles) {
 				return nil
 			}
+			if info.Mode()&os.ModeSocket != 0 {
+				doLog(true, "tar: skipping socket %v", p)
+				events.fileSkipped(p)
+				return nil
+			}
 
 			header, err := tar.FileInfoHeader(info, "")
 			if err != nil {
 				return err
 			}
+			// PAX keeps long names, nanosecond times and xattrs
+			header.Format = tar.FormatPAX
 			header.Name = storedPath(root, p)
 			if info.Mode()&os.ModeSymlink != 0 {
 				if link, lerr := os.Readlink(p); lerr == nil {
 					header.Linkname = link
 				}
 			}
+			if info.Mode().IsRegular() && features.IsSet(fSpecialFiles) {
+				if id, multi := fileID(info); multi {
+					if first, ok := links[id]; ok {
+						header.Typeflag = tar.TypeLink
+						header.Linkname = first
+						header.Size = 0
+					} else {
+						links[id] = header.Name
+					}
+				}
+			}
 			if info.IsDir() && header.Name != "." {
 				header.Name += "/"
 			}
 			if features.IsNotSet(fPermissions) {
 				header.Mode = 0
+			} else {
+				for name, val := range readXattrs(p) {
+					if header.PAXRecords == nil {
+						header.PAXRecords = make(map[string]string)
+					}
+					header.PAXRecords[paxXattr+name] = val
+				}
 			}
 			if features.IsNotSet(fModDates) {
 				header.ModTime = time.Time{}
+				header.AccessTime = time.Time{}
+				header.ChangeTime = time.Time{}
 			}
 			if err := tw.WriteHeader(header); err != nil {
 				return err
 			}
-			if info.Mode().IsRegular() {
+			if header.Typeflag == tar.TypeReg {
+				events.fileBegin(header.Name, uint64(header.Size))
 				file, err := os.Open(p)
 				if err != nil {
 					return err
@@ -99,6 +171,7 @@ func createTar(paths []string) error {
 					return err
 				}
 				file.Close()
+				events.fileEnd(header.Name, uint64(header.Size), "")
 			}
 			return nil
 		})
@@ -109,38 +182,158 @@ func createTar(paths []string) error {
 	return nil
 }
 
-// extractTar extracts a tar archive into destination. When fNoCompress is not set,
-// gzip compression is assumed unless tarUseXz is true, in which case xz is used.
-func extractTar(destination string) error {
-	r, err := os.Open(archivePath)
+// openTarStream opens the tar archive at archivePath, or stdin for "-",
+// and returns the decompressed stream, the archive size (0 for stdin) and
+// a function releasing it. When fNoCompress is not set, the stream is
+// decompressed with tarComp.
+func openTarStream() (io.Reader, int64, func(), error) {
+	return openTarFile(archivePath, tarComp, features.IsSet(fNoCompress))
+}
+
+// openTarFile is openTarStream for the tar archive at path compressed
+// with comp, or not at all when noComp is set.
+func openTarFile(path string, comp uint8, noComp bool) (io.Reader, int64, func(), error) {
+	var r io.Closer
+	var src io.Reader
+	var size int64
+	if path == "-" {
+		r = io.NopCloser(nil)
+		src = bufio.NewReaderSize(os.Stdin, readBuffer)
+	} else {
+		as, err := openArchiveSource(path)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		r = as
+		size = as.Size()
+		src = bufio.NewReaderSize(io.NewSectionReader(as, 0, as.Size()), readBuffer)
+	}
+	if !noComp {
+		dec, err := tarDecompressor(src, comp)
+		if err != nil {
+			r.Close()
+			return nil, 0, nil, err
+		}
+		return dec, size, func() {
+			dec.Close()
+			r.Close()
+		}, nil
+	}
+	return src, size, func() { r.Close() }, nil
+}
+
+// tarCompName names the compression openTarStream assumes.
+func tarCompName() string {
+	switch {
+	case features.IsSet(fNoCompress):
+		return "none"
+	case tarComp == compBzip2:
+		return "bzip2"
+	default:
+		return compName(tarComp)
+	}
+}
+
+// paxChanged marks entries that changed while a goxa archive was written.
+const paxChanged = "GOXA.changed"
+
+// tarEntry converts a tar header to a FileEntry and returns the feature
+// flags its contents imply. Directories are reported with isDir.
+func tarEntry(hdr *tar.Header) (entry FileEntry, isDir bool, flags BitFlags) {
+	entry = FileEntry{
+		Path:     strings.TrimSuffix(filepath.FromSlash(hdr.Name), string(os.PathSeparator)),
+		Size:     uint64(hdr.Size),
+		Mode:     hdr.FileInfo().Mode(),
+		ModTime:  hdr.ModTime,
+		Linkname: hdr.Linkname,
+		Changed:  hdr.PAXRecords[paxChanged] == "1",
+	}
+	if hdr.Mode != 0 {
+		flags |= fPermissions
+	}
+	if !hdr.ModTime.IsZero() && hdr.ModTime.Unix() != 0 {
+		flags |= fModDates
+	}
+	if strings.HasPrefix(filepath.Base(entry.Path), ".") {
+		flags |= fIncludeInvis
+	}
+	if filepath.IsAbs(entry.Path) {
+		flags |= fAbsolutePaths
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return entry, true, flags
+	case tar.TypeReg, tar.TypeRegA:
+		entry.Type = entryFile
+	case tar.TypeSymlink:
+		entry.Type = entrySymlink
+		flags |= fSpecialFiles
+	case tar.TypeLink:
+		entry.Type = entryHardlink
+		flags |= fSpecialFiles
+	default:
+		entry.Type = entryOther
+		flags |= fSpecialFiles
+	}
+	if entry.Type != entryFile {
+		entry.Size = 0
+	}
+	return entry, false, flags
+}
+
+// listTar lists a tar archive using the same output as goxa archives.
+// Flags are derived from what the tar headers contain.
+func listTar(jsonList bool) error {
+	src, size, closeSrc, err := openTarStream()
 	if err != nil {
 		return err
 	}
-	var src io.Reader = r
-	if features.IsNotSet(fNoCompress) {
-		if tarUseXz {
-			xr, err := xz.NewReader(r)
-			if err != nil {
-				r.Close()
-				return err
-			}
-			src = xr
+	defer closeSrc()
+
+	var dirs, files []FileEntry
+	var flags BitFlags
+	if features.IsSet(fNoCompress) {
+		flags |= fNoCompress
+	}
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry, isDir, eflags := tarEntry(hdr)
+		flags |= eflags
+		if isDir {
+			dirs = append(dirs, entry)
 		} else {
-			if threads < 1 {
-				threads = 1
-			}
-			gr, err := gzip.NewReaderN(r, 0, threads)
-			if err != nil {
-				r.Close()
-				return err
-			}
-			src = gr
-			defer gr.Close()
+			files = append(files, entry)
 		}
 	}
-	defer r.Close()
+
+	printListing(ArchiveListingOut{
+		Flags:       flagNamesList(flags),
+		Compression: tarCompName(),
+		Checksum:    "none",
+		ArchiveSize: uint64(size),
+	}, dirs, files, jsonList)
+	return nil
+}
+
+// extractTar extracts a tar archive into destination, see openTarStream.
+func extractTar(destination string) error {
+	src, _, closeSrc, err := openTarStream()
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
 
 	tr := tar.NewReader(src)
+	startLinkGuard(destination)
+	openExtractRoot(destination, features)
+	defer closeExtractRoot()
 
 	for {
 		hdr, err := tr.Next()
@@ -159,44 +352,84 @@ func extractTar(destination string) error {
 				return err
 			}
 		}
+		var source string
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			err = extractGuard.checkSymlink(target, hdr.Linkname, features.IsSet(fAbsolutePaths))
+		case tar.TypeLink:
+			if source, err = linkSource(destination, features, hdr.Linkname); err == nil {
+				err = extractGuard.checkHardlink(target, source)
+			}
+		default:
+			err = extractGuard.checkPath(target)
+		}
+		if err != nil {
+			if !doForce {
+				return err
+			}
+			doLog(false, "skipping unsafe entry: %v", err)
+			events.warn(hdr.Name, "skipping unsafe entry: %v", err)
+			events.fileSkipped(hdr.Name)
+			continue
+		}
 		switch hdr.Typeflag {
 		case tar.TypeDir:
 			perm := os.FileMode(0755)
 			if features.IsSet(fPermissions) {
 				perm = os.FileMode(hdr.Mode)
 			}
-			if err := os.MkdirAll(target, perm); err != nil {
+			if err := extractRoot.MkdirAll(target, perm); err != nil {
 				return err
 			}
-			if features.IsSet(fModDates) {
-				os.Chtimes(target, hdr.ModTime, hdr.ModTime)
-			}
 		case tar.TypeSymlink:
 			if features.IsNotSet(fSpecialFiles) {
 				continue
 			}
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			if err := extractRoot.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
-			if err := os.Symlink(hdr.Linkname, target); err != nil {
+			if err := extractRoot.Symlink(hdr.Linkname, target); err != nil {
 				return err
 			}
+			extractGuard.add(target)
+			continue
 		case tar.TypeLink:
 			if features.IsNotSet(fSpecialFiles) {
 				continue
 			}
-			if err := os.Link(hdr.Linkname, target); err != nil {
+			if err := extractRoot.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
-		default:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			if err := extractRoot.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if features.IsNotSet(fSpecialFiles) {
+				continue
+			}
+			if err := extractRoot.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := makeSpecial(target, hdr); err != nil {
+				if !doForce {
+					return err
+				}
+				doLog(false, "unable to create %v: %v", target, err)
+				events.warn(hdr.Name, "unable to create: %v", err)
+				events.fileSkipped(hdr.Name)
+				continue
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractRoot.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
 			perm := os.FileMode(0644)
 			if features.IsSet(fPermissions) {
 				perm = os.FileMode(hdr.Mode)
 			}
-			w, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+			events.fileBegin(hdr.Name, uint64(hdr.Size))
+			w, err := extractRoot.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
 			if err != nil {
 				return err
 			}
@@ -205,10 +438,35 @@ func extractTar(destination string) error {
 				return err
 			}
 			w.Close()
-			if features.IsSet(fModDates) {
-				os.Chtimes(target, hdr.ModTime, hdr.ModTime)
-			}
+			events.fileEnd(hdr.Name, uint64(hdr.Size), "")
+		default:
+			doLog(true, "tar: skipping %v of unsupported type %q", hdr.Name, hdr.Typeflag)
+			events.fileSkipped(hdr.Name)
+			continue
 		}
+		setTarMeta(target, hdr)
 	}
 	return nil
 }
+
+// setTarMeta restores the owner, extended attributes and times recorded
+// in hdr on target according to the feature flags.
+func setTarMeta(target string, hdr *tar.Header) {
+	if features.IsSet(fPermissions) {
+		setOwner(target, hdr)
+		attrs := make(map[string]string)
+		for k, v := range hdr.PAXRecords {
+			if name, ok := strings.CutPrefix(k, paxXattr); ok {
+				attrs[name] = v
+			}
+		}
+		writeXattrs(target, attrs)
+	}
+	if features.IsSet(fModDates) {
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		extractRoot.Chtimes(target, atime, hdr.ModTime)
+	}
+}
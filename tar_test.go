@@ -1,13 +1,23 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"encoding/json"
+	"io"
 	"io/fs"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type tarFileSpec struct {
@@ -65,9 +75,9 @@ func TestTarBasic(t *testing.T) {
 
 			archivePath = filepath.Join(tempDir, "test.tar")
 			features = fIncludeInvis
-			tarUseXz = false
+			tarComp = compGzip
 			if tc.name == "xz" {
-				tarUseXz = true
+				tarComp = compXZ
 				archivePath += ".xz"
 			}
 			if tc.noComp {
@@ -121,3 +131,333 @@ func TestTarModTime(t *testing.T) {
 		t.Fatalf("mod time mismatch")
 	}
 }
+
+func TestTarJSONList(t *testing.T) {
+	for _, ext := range []string{".tar", ".tar.gz", ".tar.xz"} {
+		t.Run(ext, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			setupTarTree(t, root)
+			archive := filepath.Join(tempDir, "test"+ext)
+
+			resetGlobals()
+			os.Args = []string{"goxa", "cpi", "-arc=" + archive, "-progress=false", root}
+			main()
+
+			sel := filepath.Join(filepath.Base(root), "dir1")
+			resetGlobals()
+			defer resetGlobals()
+			os.Args = []string{"goxa", "j", "-arc=" + archive, "-files=" + sel}
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("pipe: %v", err)
+			}
+			std := os.Stdout
+			os.Stdout = w
+			main()
+			w.Close()
+			os.Stdout = std
+			var buf bytes.Buffer
+			io.Copy(&buf, r)
+
+			var listing ArchiveListingOut
+			if err := json.Unmarshal(buf.Bytes(), &listing); err != nil {
+				t.Fatalf("json decode: %v: %s", err, buf.String())
+			}
+			if len(listing.Files) != 2 {
+				t.Fatalf("expected 2 files, got %d", len(listing.Files))
+			}
+			for _, f := range listing.Files {
+				if !strings.HasPrefix(f.Path, sel) || f.Type != "file" {
+					t.Fatalf("unexpected entry %+v", f)
+				}
+			}
+			if !slices.Contains(listing.Flags, flagNames[2]) {
+				t.Fatalf("expected permissions flag, got %v", listing.Flags)
+			}
+		})
+	}
+}
+
+func TestTarCompressions(t *testing.T) {
+	cases := []struct {
+		comp string
+		ext  string
+		want uint8
+	}{
+		{"gzip", ".tar.gz", compGzip},
+		{"xz", ".tar.xz", compXZ},
+		{"zstd", ".tar.zst", compZstd},
+		{"lz4", ".tar.lz4", compLZ4},
+		{"brotli", ".tar.br", compBrotli},
+		{"s2", ".tar.sz", compS2},
+		{"snappy", ".tar.sz", compS2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.comp, func(t *testing.T) {
+			tempDir := t.TempDir()
+			root := filepath.Join(tempDir, "root")
+			specs := setupTarTree(t, root)
+
+			resetGlobals()
+			defer resetGlobals()
+			os.Args = []string{"goxa", "ci", "-format=tar", "-comp=" + tc.comp, "-arc=" + filepath.Join(tempDir, "test"), "-progress=false", root}
+			main()
+			archive := filepath.Join(tempDir, "test"+tc.ext)
+			if _, err := os.Stat(archive); err != nil {
+				t.Fatalf("expected %v: %v", archive, err)
+			}
+
+			resetGlobals()
+			archivePath = archive
+			tarComp = compGzip
+			if format, noComp := detectFormatFromExt(archive); format != "tar" || noComp || tarComp != tc.want {
+				t.Fatalf("extension detection: %v %v %v", format, noComp, tarComp)
+			}
+			if tc.want != compBrotli {
+				tarComp = compGzip
+				if format, noComp, ok := detectFormatFromHeader(archive); !ok || format != "tar" || noComp || tarComp != tc.want {
+					t.Fatalf("header detection: %v %v %v %v", format, noComp, ok, tarComp)
+				}
+			}
+			if got := tarCompName(); got != compName(tc.want) {
+				t.Fatalf("compression name %v", got)
+			}
+			features = fIncludeInvis
+			dest := filepath.Join(tempDir, "out")
+			if err := extractTar(dest); err != nil {
+				t.Fatalf("extractTar: %v", err)
+			}
+			base := filepath.Join(dest, filepath.Base(root))
+			for _, sp := range specs {
+				tarCheckFile(t, filepath.Join(base, sp.rel), sp.data)
+			}
+		})
+	}
+}
+
+func TestTarBzip2Read(t *testing.T) {
+	bz, err := exec.LookPath("bzip2")
+	if err != nil {
+		t.Skip("bzip2 not installed")
+	}
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	specs := setupTarTree(t, root)
+
+	defer resetGlobals()
+	archivePath = filepath.Join(tempDir, "test.tar")
+	features = fIncludeInvis | fNoCompress
+	if err := createTar([]string{root}); err != nil {
+		t.Fatalf("createTar: %v", err)
+	}
+	if out, err := exec.Command(bz, archivePath).CombinedOutput(); err != nil {
+		t.Fatalf("bzip2: %v: %s", err, out)
+	}
+	archivePath += ".bz2"
+
+	tarComp = compGzip
+	if format, noComp, ok := detectFormatFromHeader(archivePath); !ok || format != "tar" || noComp || tarComp != compBzip2 {
+		t.Fatalf("header detection: %v %v %v %v", format, noComp, ok, tarComp)
+	}
+	features = fIncludeInvis
+	dest := filepath.Join(tempDir, "out")
+	if err := extractTar(dest); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	base := filepath.Join(dest, filepath.Base(root))
+	for _, sp := range specs {
+		tarCheckFile(t, filepath.Join(base, sp.rel), sp.data)
+	}
+
+	archivePath = filepath.Join(tempDir, "new.tar.bz2")
+	if err := createTar([]string{root}); err == nil {
+		t.Fatalf("expected bzip2 create to fail")
+	}
+}
+
+func TestTarFidelity(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	long := filepath.Join(root, strings.Repeat("d", 80), strings.Repeat("f", 90)+".txt")
+	if err := os.MkdirAll(filepath.Dir(long), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	data := []byte("long path")
+	if err := os.WriteFile(long, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	if err := os.Chtimes(long, modTime, modTime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	first := filepath.Join(root, "first.txt")
+	if err := os.WriteFile(first, []byte("linked"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Link(first, filepath.Join(root, "second.txt")); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "pipe"), 0o600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	xattrs := runtime.GOOS == "linux" && unix.Setxattr(first, "user.goxa", []byte("value"), 0) == nil
+
+	defer resetGlobals()
+	archivePath = filepath.Join(tempDir, "test.tar")
+	features = fPermissions | fModDates | fSpecialFiles | fNoCompress
+	if err := createTar([]string{root}); err != nil {
+		t.Fatalf("createTar: %v", err)
+	}
+	dest := filepath.Join(tempDir, "out")
+	if err := extractTar(dest); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	base := filepath.Join(dest, filepath.Base(root))
+	rel, _ := filepath.Rel(root, long)
+	tarCheckFile(t, filepath.Join(base, rel), data)
+	info, err := os.Stat(filepath.Join(base, rel))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Fatalf("mod time %v, want %v", info.ModTime(), modTime)
+	}
+
+	a, err := os.Stat(filepath.Join(base, "first.txt"))
+	if err != nil {
+		t.Fatalf("stat first: %v", err)
+	}
+	b, err := os.Stat(filepath.Join(base, "second.txt"))
+	if err != nil {
+		t.Fatalf("stat second: %v", err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatalf("hardlink not restored")
+	}
+	tarCheckFile(t, filepath.Join(base, "second.txt"), []byte("linked"))
+
+	fi, err := os.Lstat(filepath.Join(base, "pipe"))
+	if err != nil {
+		t.Fatalf("stat pipe: %v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected fifo, got %v", fi.Mode())
+	}
+
+	if xattrs {
+		buf := make([]byte, 16)
+		n, err := unix.Getxattr(filepath.Join(base, "first.txt"), "user.goxa", buf)
+		if err != nil || string(buf[:n]) != "value" {
+			t.Fatalf("xattr not restored: %v %q", err, buf[:n])
+		}
+	}
+}
+
+func TestTarLinkEscapes(t *testing.T) {
+	tempDir := t.TempDir()
+	outside := filepath.Join(tempDir, "outside")
+	if err := os.MkdirAll(outside, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		entries []*tar.Header
+	}{
+		{"symlink-then-file", []*tar.Header{
+			{Name: "esc", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			{Name: "esc/pwned", Typeflag: tar.TypeReg, Mode: 0o644},
+		}},
+		{"write-through-inside-symlink", []*tar.Header{
+			{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+			{Name: "a/pwned", Typeflag: tar.TypeReg, Mode: 0o644},
+		}},
+		{"chained-symlink", []*tar.Header{
+			{Name: "dot", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "dot/../outside"},
+		}},
+		{"hardlink", []*tar.Header{
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "../outside/pwned"},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer resetGlobals()
+			archivePath = filepath.Join(tempDir, tc.name+".tar")
+			f, err := os.Create(archivePath)
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			tw := tar.NewWriter(f)
+			for _, h := range tc.entries {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("write header: %v", err)
+				}
+			}
+			tw.Close()
+			f.Close()
+
+			features = fSpecialFiles | fNoCompress
+			dest := filepath.Join(tempDir, "dest-"+tc.name)
+			if err := extractTar(dest); err == nil {
+				t.Fatalf("expected extraction to be refused")
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "pwned")); err == nil {
+				t.Fatalf("file written outside destination")
+			}
+			if _, err := os.Lstat(filepath.Join(dest, "sub", "pwned")); err == nil {
+				t.Fatalf("file written through symlink")
+			}
+		})
+	}
+}
+
+func TestTarOwnerByName(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring owners needs root")
+	}
+	root, err := user.LookupId("0")
+	if err != nil {
+		t.Skip("no user with ID 0")
+	}
+	defer resetGlobals()
+	tempDir := t.TempDir()
+	archivePath = filepath.Join(tempDir, "owner.tar")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	hdrs := []*tar.Header{
+		// The name wins over an ID that differs on this system
+		{Name: "named", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 12345, Gid: 12345, Uname: root.Username},
+		// Unknown names fall back to the ID
+		{Name: "numeric", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 12345, Gid: 12346, Uname: "goxa-no-such-user", Gname: "goxa-no-such-group"},
+	}
+	for _, h := range hdrs {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+	}
+	tw.Close()
+	f.Close()
+
+	features = fPermissions | fNoCompress
+	dest := filepath.Join(tempDir, "out")
+	if err := extractTar(dest); err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	for name, want := range map[string][2]uint32{"named": {0, 12345}, "numeric": {12345, 12346}} {
+		st, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatalf("stat %v: %v", name, err)
+		}
+		sys := st.Sys().(*syscall.Stat_t)
+		if sys.Uid != want[0] || sys.Gid != want[1] {
+			t.Fatalf("%v owned by %v:%v, want %v:%v", name, sys.Uid, sys.Gid, want[0], want[1])
+		}
+	}
+}
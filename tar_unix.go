@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID returns the device and inode of info and whether it has more
+// than one link, so hardlinked files can be archived once.
+func fileID(info os.FileInfo) (devIno [2]uint64, multi bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return devIno, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, st.Nlink > 1
+}
+
+// makeSpecial creates the fifo or device node described by hdr.
+func makeSpecial(target string, hdr *tar.Header) error {
+	perm := uint32(0o644)
+	if features.IsSet(fPermissions) {
+		perm = uint32(hdr.Mode) & 0o7777
+	}
+	dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		return extractRoot.Mknod(target, perm|unix.S_IFIFO, 0)
+	case tar.TypeChar:
+		return extractRoot.Mknod(target, perm|unix.S_IFCHR, dev)
+	default:
+		return extractRoot.Mknod(target, perm|unix.S_IFBLK, dev)
+	}
+}
+
+// setOwner restores the owner recorded in hdr. Only root may do so. The
+// user and group names are looked up on this system first, so the owner is
+// kept when IDs differ between machines, and the numeric IDs are used when
+// a name is missing or unknown.
+func setOwner(target string, hdr *tar.Header) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	uid, gid := hdr.Uid, hdr.Gid
+	if hdr.Uname != "" {
+		if u, err := user.Lookup(hdr.Uname); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+	if hdr.Gname != "" {
+		if g, err := user.LookupGroup(hdr.Gname); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+	if err := extractRoot.Lchown(target, uid, gid); err != nil {
+		doLog(true, "unable to set owner of %v: %v", target, err)
+	}
+}
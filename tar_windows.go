@@ -0,0 +1,21 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+)
+
+func fileID(info os.FileInfo) (devIno [2]uint64, multi bool) {
+	return devIno, false
+}
+
+func makeSpecial(target string, hdr *tar.Header) error {
+	return fmt.Errorf("special files are not supported on windows: %v", hdr.Name)
+}
+
+func setOwner(target string, hdr *tar.Header) {}
+
+func mknod(path string, mode uint32, dev int) error {
+	return fmt.Errorf("special files are not supported on windows: %v", path)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base32"
 	"encoding/base64"
@@ -8,16 +9,13 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
 	"time"
-
-	"compress/gzip"
-
-	"github.com/ulikunitz/xz"
 )
 
 func fileExists(filePath string) (bool, error) {
@@ -31,7 +29,7 @@ func fileExists(filePath string) (bool, error) {
 	return false, err
 }
 
-// detectEncodingFromExt checks for .b32 or .b64 suffixes.
+// detectEncodingFromExt checks for .b32, .b64 or .asc suffixes.
 // It returns the filename without the encoding extension and the encoding type.
 func detectEncodingFromExt(name string) (string, string) {
 	lower := strings.ToLower(name)
@@ -41,24 +39,26 @@ func detectEncodingFromExt(name string) (string, string) {
 	if strings.HasSuffix(lower, ".b64") {
 		return name[:len(name)-4], "b64"
 	}
+	if strings.HasSuffix(lower, ".asc") {
+		return name[:len(name)-4], "armor"
+	}
 	return name, ""
 }
 
 // detectFormatFromExt inspects the archive filename to infer the format.
 // It returns "tar" or "goxa" and whether the tar archive is uncompressed.
 func detectFormatFromExt(name string) (string, bool) {
+	if isURL(name) {
+		name = urlBaseName(name)
+	}
 	var enc string
 	name, enc = detectEncodingFromExt(name)
 	if enc != "" {
 		encode = enc
 	}
 	lower := strings.ToLower(name)
-	tarUseXz = false
-	if strings.HasSuffix(lower, ".tar.gz") {
-		return "tar", false
-	}
-	if strings.HasSuffix(lower, ".tar.xz") {
-		tarUseXz = true
+	if _, comp, ok := tarCompExt(name); ok {
+		tarComp = comp
 		return "tar", false
 	}
 	if strings.HasSuffix(lower, ".tar") {
@@ -71,24 +71,28 @@ func detectFormatFromExt(name string) (string, bool) {
 	if strings.HasSuffix(lower, ".goxa") {
 		return "goxa", false
 	}
+	if strings.HasSuffix(lower, ".zip") {
+		return "zip", false
+	}
 	return "", false
 }
 
 // stripArchiveExt removes a known archive extension from name.
 func stripArchiveExt(name string) string {
 	name, _ = detectEncodingFromExt(name)
+	if ext, _, ok := tarCompExt(name); ok {
+		return name[:len(name)-len(ext)]
+	}
 	lower := strings.ToLower(name)
 	switch {
-	case strings.HasSuffix(lower, ".tar.gz"):
-		return name[:len(name)-len(".tar.gz")]
-	case strings.HasSuffix(lower, ".tar.xz"):
-		return name[:len(name)-len(".tar.xz")]
 	case strings.HasSuffix(lower, ".tar"):
 		return name[:len(name)-len(".tar")]
 	case strings.HasSuffix(lower, ".goxaf"):
 		return name[:len(name)-len(".goxaf")]
 	case strings.HasSuffix(lower, ".goxa"):
 		return name[:len(name)-len(".goxa")]
+	case strings.HasSuffix(lower, ".zip"):
+		return name[:len(name)-len(".zip")]
 	default:
 		return name
 	}
@@ -96,11 +100,14 @@ func stripArchiveExt(name string) string {
 
 func hasKnownArchiveExt(name string) bool {
 	name, _ = detectEncodingFromExt(name)
+	if _, _, ok := tarCompExt(name); ok {
+		return true
+	}
 	lower := strings.ToLower(name)
-	return strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tar.xz") || strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".goxa") || strings.HasSuffix(lower, ".goxaf")
+	return strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".goxa") || strings.HasSuffix(lower, ".goxaf") || strings.HasSuffix(lower, ".zip")
 }
 
-// decodeIfNeeded decodes a Base32, Base64 or FEC encoded archive to a temporary file
+// decodeIfNeeded decodes a Base32, Base64, armored or FEC encoded archive to a temporary file
 // and returns the new filename and a cleanup function.
 func decodeIfNeeded(name string) (string, func(), error) {
 	if encode == "" {
@@ -110,35 +117,33 @@ func decodeIfNeeded(name string) (string, func(), error) {
 		doLog(false, "Base32 decoding archive")
 	} else if encode == "b64" {
 		doLog(false, "Base64 decoding archive")
+	} else if encode == "armor" {
+		doLog(false, "Decoding ASCII armored archive")
 	}
-	f, err := os.Open(name)
-	if err != nil {
-		return "", nil, err
+	if encode == "fec" {
+		return decodeWithFEC(name)
 	}
-	defer f.Close()
-
-	info, err := f.Stat()
+	src, err := openArchiveSource(name)
 	if err != nil {
 		return "", nil, err
 	}
+	defer src.Close()
 
 	tmp, err := os.CreateTemp("", "goxa_dec_*")
 	if err != nil {
 		return "", nil, err
 	}
 
-	p, done, finished := progressTicker(&progressData{total: info.Size(), speedWindowSize: time.Second * 5})
+	p, done, finished := progressTicker(&progressData{total: src.Size(), speedWindowSize: time.Second * 5})
 	p.file.Store(name)
 
-	var r io.Reader = progressReader{r: f, p: p}
+	var r io.Reader = progressReader{r: io.NewSectionReader(src, 0, src.Size()), p: p}
 	if encode == "b32" {
 		r = base32.NewDecoder(base32.StdEncoding, r)
 	} else if encode == "b64" {
 		r = base64.NewDecoder(base64.StdEncoding, r)
-	} else if encode == "fec" {
-		f.Close()
-		os.Remove(tmp.Name())
-		return decodeWithFEC(name)
+	} else if encode == "armor" {
+		r = newArmorReader(r)
 	}
 	if _, err := io.Copy(tmp, r); err != nil {
 		tmp.Close()
@@ -153,6 +158,63 @@ func decodeIfNeeded(name string) (string, func(), error) {
 	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
 }
 
+// decodedSource is a decoded copy of an archive, removed when closed.
+type decodedSource struct {
+	archiveSource
+	cleanup func()
+}
+
+func (d *decodedSource) Close() error {
+	err := d.archiveSource.Close()
+	d.cleanup()
+	return err
+}
+
+// openEncoded opens the archive at path, decoding it when encode is set.
+// Base32 and Base64 are decoded as they are read; other encodings, and
+// Base32 or Base64 text wrapped into lines, are decoded to a temporary
+// file first.
+func openEncoded(path string) (archiveSource, error) {
+	src, err := openArchiveSource(path)
+	if err != nil || encode == "" {
+		return src, err
+	}
+	if b, ok := openBaseSource(src, encode); ok {
+		return b, nil
+	}
+	src.Close()
+	var name string
+	var cleanup func()
+	if encode == "fec" {
+		name, cleanup, err = decodeWithFEC(path)
+	} else {
+		name, cleanup, err = decodeIfNeeded(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src, err = openArchiveSource(name); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &decodedSource{archiveSource: src, cleanup: cleanup}, nil
+}
+
+// tarMagics lists the leading bytes of the compressed streams a tar
+// archive is sniffed for. Brotli has no magic and is only known by name.
+var tarMagics = []struct {
+	magic []byte
+	comp  uint8
+}{
+	{[]byte{0x1f, 0x8b}, compGzip},
+	{[]byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, compXZ},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, compZstd},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, compLZ4},
+	{[]byte("\xff\x06\x00\x00S2sTwO"), compS2},
+	{[]byte("\xff\x06\x00\x00sNaPpY"), compS2},
+	{[]byte("BZh"), compBzip2},
+}
+
 // detectTarHeader reports whether buf appears to be a tar archive by checking
 // for the ustar magic at the expected offset.
 func detectTarHeader(buf []byte) bool {
@@ -165,23 +227,14 @@ func detectTarHeader(buf []byte) bool {
 // detectFormatFromHeader attempts to identify the archive format based on the
 // file's magic bytes. The returned bool indicates success.
 func detectFormatFromHeader(name string) (string, bool, bool) {
-	path := name
-	cleanup := func() {}
-	if encode != "" {
-		var err error
-		path, cleanup, err = decodeIfNeeded(name)
-		if err != nil {
-			return "", false, false
-		}
-		defer cleanup()
-	}
-	f, err := os.Open(path)
+	src, err := openEncoded(name)
 	if err != nil {
 		return "", false, false
 	}
-	defer f.Close()
+	defer src.Close()
+	f := io.NewSectionReader(src, 0, src.Size())
 
-	hdr := make([]byte, 6)
+	hdr := make([]byte, 10)
 	n, _ := io.ReadFull(f, hdr)
 	hdr = hdr[:n]
 
@@ -189,32 +242,29 @@ func detectFormatFromHeader(name string) (string, bool, bool) {
 		return "goxa", false, true
 	}
 
-	if n >= 2 && hdr[0] == 0x1f && hdr[1] == 0x8b { // gzip
-		if _, err := f.Seek(0, io.SeekStart); err == nil {
-			gr, err := gzip.NewReader(f)
-			if err == nil {
-				buf := make([]byte, 512)
-				m, _ := io.ReadFull(gr, buf)
-				gr.Close()
-				if detectTarHeader(buf[:m]) {
-					return "tar", false, true
-				}
-			}
-		}
+	if n >= 4 && (string(hdr[:4]) == "PK\x03\x04" || string(hdr[:4]) == "PK\x05\x06") {
+		return "zip", false, true
 	}
 
-	if n >= 6 && bytes.Equal(hdr, []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}) { // xz
-		if _, err := f.Seek(0, io.SeekStart); err == nil {
-			xr, err := xz.NewReader(f)
-			if err == nil {
-				buf := make([]byte, 512)
-				m, _ := io.ReadFull(xr, buf)
-				if detectTarHeader(buf[:m]) {
-					tarUseXz = true
-					return "tar", false, true
-				}
-			}
+	for _, tm := range tarMagics {
+		if !bytes.HasPrefix(hdr, tm.magic) {
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+		dec, err := tarDecompressor(f, tm.comp)
+		if err != nil {
+			break
+		}
+		buf := make([]byte, 512)
+		m, _ := io.ReadFull(dec, buf)
+		dec.Close()
+		if detectTarHeader(buf[:m]) {
+			tarComp = tm.comp
+			return "tar", false, true
 		}
+		break
 	}
 
 	if _, err := f.Seek(0, io.SeekStart); err == nil {
@@ -228,6 +278,21 @@ func detectFormatFromHeader(name string) (string, bool, bool) {
 	return "", false, false
 }
 
+// confirmOrAbort asks the user whether to continue after msg, exiting
+// unless they agree. Without interactive mode it always exits.
+func confirmOrAbort(msg string) {
+	if !interactiveMode {
+		log.Fatalf("%s", msg)
+	}
+	fmt.Printf("%s. Continue? [y/N]: ", msg)
+	reader := bufio.NewReader(os.Stdin)
+	resp, _ := reader.ReadString('\n')
+	resp = strings.TrimSpace(strings.ToLower(resp))
+	if resp != "y" && resp != "yes" {
+		log.Fatalf("aborted: %s", msg)
+	}
+}
+
 func doLog(verbose bool, format string, args ...interface{}) {
 	if quietMode || toStdOut || (!verboseMode && verbose) {
 		return
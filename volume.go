@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	volumeMagic     = "GXVL"
+	volumeHeaderLen = 40
+	minVolumeSize   = 64 * 1024
+)
+
+// volumeHeader starts every volume of a split archive. The archive itself
+// is cut into DataSize byte pieces. A block that doesn't fit in what is
+// left of a volume starts the next one, the rest of the volume is zero
+// padding, so only blocks larger than DataSize span volumes.
+type volumeHeader struct {
+	SetID    uint64 // random, identical for all volumes of one archive
+	Index    uint32 // 1-based volume number
+	Count    uint32 // number of volumes
+	DataSize uint64 // archive bytes held by every volume but the last
+	Total    uint64 // archive size across all volumes
+}
+
+func (vh volumeHeader) encode() []byte {
+	b := make([]byte, volumeHeaderLen)
+	copy(b, volumeMagic)
+	binary.LittleEndian.PutUint64(b[4:], vh.SetID)
+	binary.LittleEndian.PutUint32(b[12:], vh.Index)
+	binary.LittleEndian.PutUint32(b[16:], vh.Count)
+	binary.LittleEndian.PutUint64(b[20:], vh.DataSize)
+	binary.LittleEndian.PutUint64(b[28:], vh.Total)
+	binary.LittleEndian.PutUint32(b[36:], crc32.ChecksumIEEE(b[:36]))
+	return b
+}
+
+func parseVolumeHeader(b []byte) (volumeHeader, error) {
+	var vh volumeHeader
+	if len(b) != volumeHeaderLen || string(b[:4]) != volumeMagic {
+		return vh, fmt.Errorf("not an archive volume")
+	}
+	if crc32.ChecksumIEEE(b[:36]) != binary.LittleEndian.Uint32(b[36:]) {
+		return vh, fmt.Errorf("volume header checksum mismatch")
+	}
+	vh.SetID = binary.LittleEndian.Uint64(b[4:])
+	vh.Index = binary.LittleEndian.Uint32(b[12:])
+	vh.Count = binary.LittleEndian.Uint32(b[16:])
+	vh.DataSize = binary.LittleEndian.Uint64(b[20:])
+	vh.Total = binary.LittleEndian.Uint64(b[28:])
+	if vh.Index == 0 || vh.Index > vh.Count || vh.DataSize == 0 {
+		return vh, fmt.Errorf("invalid volume header")
+	}
+	return vh, nil
+}
+
+// volumeName returns the file name of volume n (1-based) of base.
+func volumeName(base string, n uint32) string {
+	return fmt.Sprintf("%s.%03d", base, n)
+}
+
+// volumeBase strips the volume number suffix such as .001 from name when
+// name is a volume of a split archive.
+func volumeBase(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name
+	}
+	n, err := strconv.ParseUint(name[i+1:], 10, 32)
+	if err != nil || n == 0 || volumeName(name[:i], uint32(n)) != name {
+		return name
+	}
+	// Only a real volume header makes it part of a set, so names such as
+	// backup.2024 stay as they are
+	f, err := os.Open(name)
+	if err != nil {
+		return name
+	}
+	defer f.Close()
+	b := make([]byte, volumeHeaderLen)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return name
+	}
+	if vh, err := parseVolumeHeader(b); err != nil || vh.Index != uint32(n) {
+		return name
+	}
+	return name[:i]
+}
+
+// hasVolumes reports whether base names a split archive on disk.
+func hasVolumes(base string) bool {
+	if isURL(base) {
+		return false
+	}
+	if _, err := os.Stat(base); err == nil {
+		return false
+	}
+	_, err := os.Stat(volumeName(base, 1))
+	return err == nil
+}
+
+// volumeWriter writes an archive across numbered volume files of at most
+// volSize bytes each. Volume headers are completed on Close once the
+// number of volumes is known.
+type volumeWriter struct {
+	base  string
+	hdr   volumeHeader
+	names []string
+	cur   *os.File
+	left  uint64
+}
+
+func newVolumeWriter(base string, volSize uint64) (*volumeWriter, error) {
+	if volSize < minVolumeSize {
+		return nil, fmt.Errorf("volume size must be at least %v bytes", minVolumeSize)
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return &volumeWriter{
+		base: base,
+		hdr: volumeHeader{
+			SetID:    binary.LittleEndian.Uint64(id[:]),
+			DataSize: volSize - volumeHeaderLen,
+		},
+	}, nil
+}
+
+func (vw *volumeWriter) next() error {
+	if vw.cur != nil {
+		if err := vw.finish(); err != nil {
+			return err
+		}
+	}
+	name := volumeName(vw.base, uint32(len(vw.names)+1))
+	if !doForce {
+		if found, _ := fileExists(name); found {
+			return fmt.Errorf("volume %v already exists", name)
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	// Placeholder, rewritten on Close
+	if _, err := f.Write(make([]byte, volumeHeaderLen)); err != nil {
+		f.Close()
+		return err
+	}
+	vw.names = append(vw.names, name)
+	vw.cur = f
+	vw.left = vw.hdr.DataSize
+	return nil
+}
+
+func (vw *volumeWriter) finish() error {
+	if !noFlush {
+		if err := vw.cur.Sync(); err != nil {
+			vw.cur.Close()
+			return err
+		}
+	}
+	err := vw.cur.Close()
+	vw.cur = nil
+	return err
+}
+
+func (vw *volumeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if vw.cur == nil || vw.left == 0 {
+			if err := vw.next(); err != nil {
+				return written, err
+			}
+		}
+		n := uint64(len(p))
+		if n > vw.left {
+			n = vw.left
+		}
+		w, err := vw.cur.Write(p[:n])
+		written += w
+		vw.left -= uint64(w)
+		vw.hdr.Total += uint64(w)
+		if err != nil {
+			return written, err
+		}
+		p = p[w:]
+	}
+	return written, nil
+}
+
+// alignBlock pads the current volume with zeros when a block of n bytes
+// won't fit in it but would fit in an empty one, and returns the padding
+// written.
+func (vw *volumeWriter) alignBlock(n uint64) (uint64, error) {
+	if vw.cur == nil || n <= vw.left || n > vw.hdr.DataSize {
+		return 0, nil
+	}
+	pad := vw.left
+	if _, err := vw.Write(make([]byte, pad)); err != nil {
+		return 0, err
+	}
+	return pad, nil
+}
+
+// Close finishes the last volume and fills in every volume header.
+func (vw *volumeWriter) Close() error {
+	if vw.cur != nil {
+		if err := vw.finish(); err != nil {
+			return err
+		}
+	}
+	vw.hdr.Count = uint32(len(vw.names))
+	for i, name := range vw.names {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		vh := vw.hdr
+		vh.Index = uint32(i + 1)
+		if _, err := f.WriteAt(vh.encode(), 0); err != nil {
+			f.Close()
+			return err
+		}
+		if !noFlush {
+			f.Sync()
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeSource reads a split archive as one archiveSource, opening each
+// volume the first time a read touches it.
+type volumeSource struct {
+	base  string
+	hdr   volumeHeader
+	mu    sync.Mutex
+	files map[uint32]*os.File
+}
+
+func openVolumeSource(base string) (*volumeSource, error) {
+	vs := &volumeSource{base: base, files: make(map[uint32]*os.File)}
+	f, err := os.Open(volumeName(base, 1))
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, volumeHeaderLen)
+	if _, err := io.ReadFull(f, b); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", volumeName(base, 1), err)
+	}
+	vh, err := parseVolumeHeader(b)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", volumeName(base, 1), err)
+	}
+	if vh.Index != 1 {
+		f.Close()
+		return nil, fmt.Errorf("%v is volume %v, expected 1", volumeName(base, 1), vh.Index)
+	}
+	vs.hdr = vh
+	vs.files[1] = f
+	return vs, nil
+}
+
+func (vs *volumeSource) Size() int64 {
+	return int64(vs.hdr.Total)
+}
+
+// volume returns the open file for volume n, asking for it to be supplied
+// when missing in interactive mode.
+func (vs *volumeSource) volume(n uint32) (*os.File, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if f, ok := vs.files[n]; ok {
+		return f, nil
+	}
+	name := volumeName(vs.base, n)
+	for {
+		f, err := vs.openVolume(name, n)
+		if err == nil {
+			vs.files[n] = f
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || !interactiveMode {
+			return nil, fmt.Errorf("volume %v of %v: %w", n, vs.hdr.Count, err)
+		}
+		fmt.Printf("\nVolume %v of %v (%v) is missing. Insert it and press Enter, or type q to abort: ", n, vs.hdr.Count, name)
+		resp, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(resp)) == "q" {
+			return nil, fmt.Errorf("volume %v of %v: %w", n, vs.hdr.Count, err)
+		}
+	}
+}
+
+func (vs *volumeSource) openVolume(name string, n uint32) (*os.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, volumeHeaderLen)
+	if _, err := io.ReadFull(f, b); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	vh, err := parseVolumeHeader(b)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	if vh.SetID != vs.hdr.SetID {
+		f.Close()
+		return nil, fmt.Errorf("%v belongs to a different archive", name)
+	}
+	if vh.Index != n {
+		f.Close()
+		return nil, fmt.Errorf("%v is volume %v, expected %v", name, vh.Index, n)
+	}
+	return f, nil
+}
+
+func (vs *volumeSource) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for len(p) > 0 {
+		if off >= int64(vs.hdr.Total) {
+			return read, io.EOF
+		}
+		idx := uint64(off) / vs.hdr.DataSize
+		within := uint64(off) - idx*vs.hdr.DataSize
+		f, err := vs.volume(uint32(idx + 1))
+		if err != nil {
+			return read, err
+		}
+		n := uint64(len(p))
+		n = min(n, vs.hdr.DataSize-within, vs.hdr.Total-uint64(off))
+		m, err := f.ReadAt(p[:n], int64(within)+volumeHeaderLen)
+		read += m
+		off += int64(m)
+		p = p[m:]
+		if err != nil && !(err == io.EOF && uint64(m) == n) {
+			if err == io.EOF {
+				err = fmt.Errorf("volume %v is truncated", idx+1)
+			}
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (vs *volumeSource) Close() error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for _, f := range vs.files {
+		f.Close()
+	}
+	return nil
+}
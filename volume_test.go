@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVolumeArchive(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	small := []byte("split archive")
+	big := make([]byte, 300<<10)
+	rand.Read(big)
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), small, 0o644); err != nil {
+		t.Fatalf("write small: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "big.bin"), big, 0o644); err != nil {
+		t.Fatalf("write big: %v", err)
+	}
+
+	archivePath = filepath.Join(tempDir, "test.goxa")
+	features = fChecksums
+	compType = compZstd
+	protoVersion = protoVersion2
+	toStdOut = false
+	doForce = false
+	volumeSize = minVolumeSize
+	blockSize = 32 << 10
+	defer func() {
+		volumeSize = 0
+		blockSize = defaultBlockSize
+		interactiveMode = true
+	}()
+	if err := create([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	volumeSize = 0
+
+	for n := uint32(1); n <= 4; n++ {
+		st, err := os.Stat(volumeName(archivePath, n))
+		if err != nil {
+			t.Fatalf("volume %d: %v", n, err)
+		}
+		if st.Size() > minVolumeSize {
+			t.Fatalf("volume %d is %d bytes", n, st.Size())
+		}
+	}
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Fatalf("unsplit archive should not exist")
+	}
+	if volumeBase(volumeName(archivePath, 1)) != archivePath {
+		t.Fatalf("volumeBase failed")
+	}
+	// Numbered names that aren't volumes are left alone
+	for _, name := range []string{archivePath + ".2024", archivePath + ".01", volumeName(filepath.Join(tempDir, "plain"), 1)} {
+		if err := os.WriteFile(name, []byte("not a volume"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if volumeBase(name) != name {
+			t.Fatalf("volumeBase rewrote %v", name)
+		}
+		os.Remove(name)
+	}
+
+	dest := filepath.Join(tempDir, "out")
+	extract([]string{dest}, false, false)
+	base := filepath.Join(dest, filepath.Base(root))
+	checkFile(t, filepath.Join(base, "a.txt"), small, 0o644, false)
+	checkFile(t, filepath.Join(base, "big.bin"), big, 0o644, false)
+
+	// Blocks never continue into the next volume
+	_, hdr, done, err := readArchive(archivePath)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	done()
+	dataSize := uint64(minVolumeSize - volumeHeaderLen)
+	for _, f := range hdr.Files {
+		for _, b := range f.Blocks {
+			if b.Offset/dataSize != (b.Offset+b.Size-1)/dataSize {
+				t.Fatalf("%v: block at %d of %d bytes spans volumes", f.Path, b.Offset, b.Size)
+			}
+		}
+	}
+
+	// A missing volume is reported by number
+	if err := os.Rename(volumeName(archivePath, 2), filepath.Join(tempDir, "moved")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	interactiveMode = false
+	vs, err := openVolumeSource(archivePath)
+	if err != nil {
+		t.Fatalf("open volumes: %v", err)
+	}
+	defer vs.Close()
+	buf := make([]byte, 1024)
+	if _, err := vs.ReadAt(buf, minVolumeSize); err == nil || !strings.Contains(err.Error(), "volume 2 of") {
+		t.Fatalf("expected missing volume error, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of path without following
+// symlinks. Attributes that can't be read are skipped.
+func readXattrs(path string) map[string]string {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		val := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(path, name, val)
+		if err != nil {
+			continue
+		}
+		attrs[name] = string(val[:vsize])
+	}
+	return attrs
+}
+
+// writeXattrs sets the extended attributes on path through extractRoot,
+// logging failures such as unsupported file systems or privileged
+// namespaces.
+func writeXattrs(path string, attrs map[string]string) {
+	for name, val := range attrs {
+		if err := extractRoot.Lsetxattr(path, name, []byte(val)); err != nil {
+			doLog(true, "unable to set xattr %v on %v: %v", name, path, err)
+		}
+	}
+}
+
+func lsetxattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func readXattrs(path string) map[string]string {
+	return nil
+}
+
+func writeXattrs(path string, attrs map[string]string) {}
+
+func lsetxattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
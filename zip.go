@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/flate"
+)
+
+// zipLevel maps the -speed setting to a deflate level.
+func zipLevel() int {
+	switch compSpeed {
+	case SpeedDefault:
+		return flate.DefaultCompression
+	case SpeedBetterCompression:
+		return 7
+	case SpeedBestCompression:
+		return flate.BestCompression
+	default:
+		return flate.BestSpeed
+	}
+}
+
+// zipHeader builds the zip header for entry honouring the feature flags.
+func zipHeader(entry FileEntry, isDir bool) *zip.FileHeader {
+	hdr := &zip.FileHeader{Name: filepath.ToSlash(entry.Path), Method: zip.Deflate}
+	if features.IsSet(fNoCompress) || isDir {
+		hdr.Method = zip.Store
+	}
+	if isDir {
+		hdr.Name += "/"
+	}
+	if features.IsSet(fModDates) {
+		hdr.Modified = entry.ModTime
+	}
+	switch {
+	case entry.Type == entrySymlink:
+		hdr.SetMode(os.ModeSymlink | 0o777)
+	case features.IsSet(fPermissions):
+		hdr.SetMode(entry.Mode)
+	case isDir:
+		hdr.SetMode(os.ModeDir | 0o755)
+	default:
+		hdr.SetMode(0o644)
+	}
+	return hdr
+}
+
+// createZip creates a zip archive from the provided paths using the same
+// file selection as goxa archives.
+func createZip(paths []string) error {
+	var out io.Writer
+	var file *os.File
+	if toStdOut {
+		out = os.Stdout
+	} else {
+		if !doForce {
+			if found, _ := fileExists(archivePath); found {
+				return fmt.Errorf("archive %v already exists", archivePath)
+			}
+		}
+		f, err := os.Create(archivePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file = f
+		out = f
+	}
+	doLog(false, "Creating archive: %v, inputs: %v", archivePath, paths)
+
+	emptyDirs, files, err := walkPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	var totalBytes int64
+	for _, f := range files {
+		totalBytes += int64(f.Size)
+	}
+	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	bw := bufio.NewWriterSize(out, writeBuffer)
+	zw := zip.NewWriter(bw)
+	level := zipLevel()
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+
+	for _, dir := range emptyDirs {
+		if _, err := zw.CreateHeader(zipHeader(dir, true)); err != nil {
+			return err
+		}
+	}
+	count := 0
+	for _, entry := range files {
+		switch entry.Type {
+		case entryFile:
+		case entrySymlink:
+			w, err := zw.CreateHeader(zipHeader(entry, false))
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, entry.Linkname); err != nil {
+				return err
+			}
+			count++
+			continue
+		default:
+			doLog(true, "zip: skipping special file %v", entry.Path)
+			events.fileSkipped(entry.Path)
+			continue
+		}
+
+		p.file.Store(entry.Path)
+		events.fileBegin(entry.Path, entry.Size)
+		src, err := os.Open(entry.SrcPath)
+		if err != nil {
+			if doForce {
+				doLog(false, "\nUnable to open file: %v (continuing)", entry.Path)
+				events.warn(entry.Path, "unable to open file: %v", err)
+				events.fileSkipped(entry.Path)
+				continue
+			}
+			return err
+		}
+		w, err := zw.CreateHeader(zipHeader(entry, false))
+		if err != nil {
+			src.Close()
+			return err
+		}
+		if _, err := io.Copy(w, progressReader{r: src, p: p}); err != nil {
+			src.Close()
+			return err
+		}
+		src.Close()
+		events.fileEnd(entry.Path, entry.Size, "stored")
+		count++
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if file != nil && !noFlush {
+		file.Sync()
+	}
+	if file != nil {
+		if st, err := file.Stat(); err == nil {
+			doLog(false, "\nWrote %v, %v containing %v files.", archivePath, humanize.Bytes(uint64(st.Size())), count)
+		}
+	}
+	return nil
+}
+
+// zipEntries converts the entries of a zip archive to FileEntry lists.
+func zipEntries(zr *zip.Reader) (dirs, files []FileEntry, flags BitFlags) {
+	flags = fChecksums
+	for _, f := range zr.File {
+		mode := f.Mode()
+		entry := FileEntry{
+			Path:    strings.TrimSuffix(filepath.FromSlash(f.Name), string(os.PathSeparator)),
+			Size:    f.UncompressedSize64,
+			ModTime: f.Modified,
+			Mode:    mode,
+		}
+		if !f.Modified.IsZero() {
+			flags |= fModDates
+		}
+		if f.CreatorVersion>>8 == 3 { // unix
+			flags |= fPermissions
+		}
+		if f.Method == zip.Store && f.UncompressedSize64 > 0 {
+			flags |= fNoCompress
+		}
+		switch {
+		case mode.IsDir():
+			dirs = append(dirs, entry)
+			continue
+		case mode&os.ModeSymlink != 0:
+			entry.Type = entrySymlink
+			flags |= fSpecialFiles
+		case mode.IsRegular():
+			entry.Type = entryFile
+		default:
+			entry.Type = entryOther
+			flags |= fSpecialFiles
+		}
+		files = append(files, entry)
+	}
+	return dirs, files, flags
+}
+
+// listZip lists a zip archive using the same output as goxa archives.
+func listZip(jsonList bool) error {
+	src, err := openArchiveSource(archivePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	zr, err := zip.NewReader(src, src.Size())
+	if err != nil {
+		return err
+	}
+	dirs, files, flags := zipEntries(zr)
+	comp := "deflate"
+	if flags.IsSet(fNoCompress) {
+		comp = "store"
+	}
+	printListing(ArchiveListingOut{
+		Flags:          flagNamesList(flags),
+		Compression:    comp,
+		Checksum:       "crc32",
+		ChecksumLength: 4,
+		ArchiveSize:    uint64(src.Size()),
+	}, dirs, files, jsonList)
+	return nil
+}
+
+// extractZip extracts the selected entries of a zip archive into
+// destination with the same path safety and checks as goxa archives.
+func extractZip(destination string) error {
+	src, err := openArchiveSource(archivePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	zr, err := zip.NewReader(src, src.Size())
+	if err != nil {
+		return err
+	}
+	doLog(false, "Opening archive: %v", archivePath)
+	doLog(false, "Destination: %v", destination)
+	if err := os.MkdirAll(destination, 0o755); err != nil {
+		return err
+	}
+	startLinkGuard(destination)
+	openExtractRoot(destination, features)
+	defer closeExtractRoot()
+
+	var totalBytes int64
+	for _, f := range zr.File {
+		if isSelected(filepath.FromSlash(f.Name)) {
+			totalBytes += int64(f.UncompressedSize64)
+		}
+	}
+	if spaceCheck {
+		checkFreeSpace(destination, uint64(totalBytes))
+	}
+
+	p, done, finished := progressTicker(&progressData{total: totalBytes, speedWindowSize: time.Second * 5})
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	for _, f := range zr.File {
+		name := strings.TrimSuffix(filepath.FromSlash(f.Name), string(os.PathSeparator))
+		if name == "" || !isSelected(name) {
+			continue
+		}
+		var target string
+		if features.IsSet(fAbsolutePaths) {
+			target = filepath.Clean(name)
+		} else {
+			target, err = safeJoin(destination, name)
+			if err != nil {
+				return err
+			}
+		}
+
+		mode := f.Mode()
+		if mode&os.ModeSymlink == 0 {
+			if err := extractGuard.checkPath(target); err != nil {
+				if !doForce {
+					return err
+				}
+				doLog(false, "skipping unsafe entry: %v", err)
+				events.warn(name, "skipping unsafe entry: %v", err)
+				events.fileSkipped(name)
+				continue
+			}
+		}
+		switch {
+		case mode.IsDir():
+			perm := os.FileMode(0o755)
+			if features.IsSet(fPermissions) {
+				perm = mode.Perm()
+			}
+			if err := extractRoot.MkdirAll(target, perm); err != nil {
+				return err
+			}
+			if features.IsSet(fPermissions) {
+				extractRoot.Chmod(target, perm)
+			}
+			if features.IsSet(fModDates) && !f.Modified.IsZero() {
+				extractRoot.Chtimes(target, f.Modified, f.Modified)
+			}
+		case mode&os.ModeSymlink != 0:
+			if features.IsNotSet(fSpecialFiles) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(io.LimitReader(rc, 4096))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := extractGuard.checkSymlink(target, string(link), features.IsSet(fAbsolutePaths)); err != nil {
+				if !doForce {
+					return err
+				}
+				doLog(false, "skipping unsafe entry: %v", err)
+				events.warn(name, "skipping unsafe entry: %v", err)
+				events.fileSkipped(name)
+				continue
+			}
+			if err := extractRoot.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := extractRoot.Symlink(string(link), target); err != nil {
+				return err
+			}
+			extractGuard.add(target)
+		case !mode.IsRegular():
+			continue
+		default:
+			events.fileBegin(name, f.UncompressedSize64)
+			if err := extractZipFile(f, target, p); err != nil {
+				if errors.Is(err, zip.ErrChecksum) {
+					events.fileEnd(name, f.UncompressedSize64, "mismatch")
+				} else {
+					events.fileSkipped(name)
+				}
+				if !doForce {
+					return err
+				}
+				doLog(false, "unable to extract %v: %v", name, err)
+				events.warn(name, "unable to extract: %v", err)
+				continue
+			}
+			events.fileEnd(name, f.UncompressedSize64, "verified")
+		}
+	}
+	return nil
+}
+
+// extractZipFile writes one regular zip entry to target. The stored CRC32
+// is verified by archive/zip when the entry has been read completely.
+func extractZipFile(f *zip.File, target string, p *progressData) error {
+	if bombCheck && f.UncompressedSize64 >= zipBombMinSize && f.CompressedSize64 > 0 {
+		ratio := float64(f.UncompressedSize64) / float64(f.CompressedSize64)
+		if ratio > zipBombRatio {
+			confirmOrAbort(fmt.Sprintf("potential zip bomb: %s expands from %v to %v (x%.0f)", f.Name, humanize.Bytes(f.CompressedSize64), humanize.Bytes(f.UncompressedSize64), ratio))
+		}
+	}
+	if err := extractRoot.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	perm := os.FileMode(0o644)
+	if features.IsSet(fPermissions) {
+		perm = f.Mode().Perm()
+	}
+	if !doForce {
+		if found, _ := fileExists(target); found {
+			return fmt.Errorf("file %v already exists", target)
+		}
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w, err := extractRoot.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	p.file.Store(f.Name)
+	// Never trust the size in the header beyond what it claims
+	n, err := io.Copy(w, progressReader{r: io.LimitReader(rc, int64(f.UncompressedSize64)+1), p: p})
+	if err == nil && uint64(n) != f.UncompressedSize64 {
+		err = fmt.Errorf("%v: size mismatch, header says %v bytes, got %v", f.Name, f.UncompressedSize64, n)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if features.IsSet(fPermissions) {
+		extractRoot.Chmod(target, perm)
+	}
+	if features.IsSet(fModDates) && !f.Modified.IsZero() {
+		extractRoot.Chtimes(target, f.Modified, f.Modified)
+	}
+	return nil
+}
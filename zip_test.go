@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZipRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "root")
+	files := setupTestTree(t, root)
+	if err := os.MkdirAll(filepath.Join(root, "emptydir"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	resetGlobals()
+	archivePath = filepath.Join(tempDir, "test.zip")
+	features = fPermissions | fModDates | fIncludeInvis
+	if err := createZip([]string{root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if format, _ := detectFormatFromExt(archivePath); format != "zip" {
+		t.Fatalf("expected zip format from extension, got %q", format)
+	}
+	if format, _, ok := detectFormatFromHeader(archivePath); !ok || format != "zip" {
+		t.Fatalf("expected zip format from header, got %q", format)
+	}
+
+	dest := filepath.Join(tempDir, "out")
+	if err := extractZip(dest); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	base := filepath.Join(dest, filepath.Base(root))
+	for _, f := range files {
+		checkFile(t, filepath.Join(base, f.rel), f.data, f.perm, true)
+	}
+	if st, err := os.Stat(filepath.Join(base, "emptydir")); err != nil || !st.IsDir() {
+		t.Fatalf("empty dir not restored: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	std := os.Stdout
+	os.Stdout = w
+	extractList = []string{filepath.Join(filepath.Base(root), "dir1")}
+	err = listZip(true)
+	extractList = nil
+	w.Close()
+	os.Stdout = std
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	var listing ArchiveListingOut
+	if err := json.Unmarshal(buf.Bytes(), &listing); err != nil {
+		t.Fatalf("json decode: %v", err)
+	}
+	if len(listing.Files) != 2 {
+		t.Fatalf("expected 2 selected files, got %d", len(listing.Files))
+	}
+	if listing.Compression != "deflate" {
+		t.Fatalf("unexpected compression %q", listing.Compression)
+	}
+}
+
+func TestZipRejectsTraversal(t *testing.T) {
+	tempDir := t.TempDir()
+	archive := filepath.Join(tempDir, "evil.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("../evil.txt")
+	if err != nil {
+		t.Fatalf("zip create: %v", err)
+	}
+	w.Write([]byte("evil"))
+	zw.Close()
+	f.Close()
+
+	resetGlobals()
+	archivePath = archive
+	err = extractZip(filepath.Join(tempDir, "out"))
+	if err == nil || !strings.Contains(err.Error(), "illegal path") {
+		t.Fatalf("expected illegal path error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "evil.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file escaped destination")
+	}
+}